@@ -3,9 +3,14 @@ package i18n
 import (
 	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/fs"
 	"log"
+	"maps"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 
@@ -75,10 +80,19 @@ func (i *I18n) T(key string, args ...any) string {
 
 // Translate translates a key with optional arguments
 func (i *I18n) Translate(key string, args ...any) string {
+	return i.TranslateLang("", key, args...)
+}
+
+// TranslateLang translates a key into lang, e.g. for a client that asked for another language
+// Unloaded or empty languages fall back to the current language, then to English
+func (i *I18n) TranslateLang(lang, key string, args ...any) string {
 	i.mu.RLock()
 	defer i.mu.RUnlock()
 
-	translations, ok := i.translations[i.lang]
+	translations, ok := i.translations[lang]
+	if !ok {
+		translations, ok = i.translations[i.lang]
+	}
 	if !ok {
 		// Fall back to English if current language not loaded
 		translations = i.translations["en"]
@@ -138,10 +152,19 @@ func (i *I18n) Translate(key string, args ...any) string {
 // GetTranslations returns full translations map for current language (as JSON)
 // This is used to send translations to frontend
 func (i *I18n) GetTranslations() (map[string]any, error) {
+	return i.GetTranslationsLang("")
+}
+
+// GetTranslationsLang returns the full translations map for lang, e.g. for a page in the visitor's language
+// Unloaded or empty languages fall back to the current language, then to English
+func (i *I18n) GetTranslationsLang(lang string) (map[string]any, error) {
 	i.mu.RLock()
 	defer i.mu.RUnlock()
 
-	translations, ok := i.translations[i.lang]
+	translations, ok := i.translations[lang]
+	if !ok {
+		translations, ok = i.translations[i.lang]
+	}
 	if !ok {
 		translations = i.translations["en"]
 		if translations == nil {
@@ -244,23 +267,91 @@ func (i *I18n) LoadAllLanguages() error {
 	return nil
 }
 
-// GetAvailableLanguages returns list of available language codes
+// GetAvailableLanguages returns the loaded language codes, sorted
 func (i *I18n) GetAvailableLanguages() []string {
 	i.mu.RLock()
 	defer i.mu.RUnlock()
 
-	langs := make([]string, 0, len(i.translations))
-	for lang := range i.translations {
-		langs = append(langs, lang)
-	}
-	return langs
+	return slices.Sorted(maps.Keys(i.translations))
 }
 
 // ToJSON converts translations to JSON format for frontend use
 func (i *I18n) ToJSON() ([]byte, error) {
-	translations, err := i.GetTranslations()
+	return i.ToJSONLang("")
+}
+
+// ToJSONLang converts the translations for lang to JSON (see GetTranslationsLang)
+func (i *I18n) ToJSONLang(lang string) ([]byte, error) {
+	translations, err := i.GetTranslationsLang(lang)
 	if err != nil {
 		return nil, err
 	}
 	return json.Marshal(translations)
 }
+
+// MatchLanguage picks the loaded language that best fits an Accept-Language header
+// Tags are tried by descending quality; "pt" or "pt-PT" match "pt-BR" when only that variant is loaded
+// Returns "" when nothing matches
+func (i *I18n) MatchLanguage(acceptLanguage string) string {
+	type tag struct {
+		lang string
+		q    float64
+	}
+	var tags []tag
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		lang, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if lang == "" || lang == "*" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		if q > 0 {
+			tags = append(tags, tag{lang, q})
+		}
+	}
+	sort.SliceStable(tags, func(a, b int) bool { return tags[a].q > tags[b].q })
+
+	loadedLangs := i.GetAvailableLanguages()
+
+	for _, t := range tags {
+		for _, loaded := range loadedLangs {
+			if strings.EqualFold(loaded, t.lang) {
+				return loaded
+			}
+		}
+		base, _, _ := strings.Cut(t.lang, "-")
+		for _, loaded := range loadedLangs {
+			loadedBase, _, _ := strings.Cut(loaded, "-")
+			if strings.EqualFold(loadedBase, base) {
+				return loaded
+			}
+		}
+	}
+	return ""
+}
+
+// ErrUnknownLanguage is returned by UseLanguage in strict mode for a language without translations
+var ErrUnknownLanguage = errors.New("unknown language")
+
+// DefaultLanguage is used when the configured language has no translations
+const DefaultLanguage = "en"
+
+// UseLanguage loads every translation and makes lang the server language
+// An unknown lang is an error in strict mode; otherwise it logs a warning and falls back to DefaultLanguage
+func (i *I18n) UseLanguage(lang string, strict bool) error {
+	if err := i.LoadAllLanguages(); err != nil {
+		return err
+	}
+	if !slices.Contains(i.GetAvailableLanguages(), lang) {
+		if strict {
+			return fmt.Errorf("%w %q, available: %s", ErrUnknownLanguage, lang, strings.Join(i.GetAvailableLanguages(), ", "))
+		}
+		log.Printf("Warning: unknown language %q, falling back to %s (available: %s)", lang, DefaultLanguage, strings.Join(i.GetAvailableLanguages(), ", "))
+		lang = DefaultLanguage
+	}
+	return i.SetLanguage(lang)
+}
@@ -0,0 +1,32 @@
+package i18n
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestUseLanguage(t *testing.T) {
+	i := &I18n{translations: make(map[string]*Translations)}
+	if err := i.UseLanguage("pt-BR", true); err != nil {
+		t.Fatalf("Expected pt-BR to be accepted, got %v", err)
+	}
+	if lang := i.GetLanguage(); lang != "pt-BR" {
+		t.Errorf("Expected pt-BR, got %q", lang)
+	}
+
+	// Strict mode refuses a language without translations and keeps the current one
+	if err := i.UseLanguage("xx", true); !errors.Is(err, ErrUnknownLanguage) {
+		t.Errorf("Expected ErrUnknownLanguage in strict mode, got %v", err)
+	}
+	if lang := i.GetLanguage(); lang != "pt-BR" {
+		t.Errorf("Expected a rejected language to leave pt-BR in place, got %q", lang)
+	}
+
+	// Otherwise it falls back to English
+	if err := i.UseLanguage("xx", false); err != nil {
+		t.Fatalf("Expected fallback without an error, got %v", err)
+	}
+	if lang := i.GetLanguage(); lang != DefaultLanguage {
+		t.Errorf("Expected fallback to %s, got %q", DefaultLanguage, lang)
+	}
+}
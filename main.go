@@ -8,6 +8,7 @@ import (
 	"context"
 	"embed"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -15,6 +16,7 @@ import (
 	"time"
 
 	"tvclipboard/i18n"
+	"tvclipboard/pkg/companion"
 	"tvclipboard/pkg/config"
 	"tvclipboard/pkg/hub"
 	"tvclipboard/pkg/qrcode"
@@ -29,23 +31,88 @@ func main() {
 	// Load configuration
 	cfg := config.Load()
 
+	if cfg.Command == "connect" {
+		os.Exit(companion.Main(cfg.CommandArgs))
+	}
+
+	if cfg.GenKey {
+		if err := config.PrintGeneratedKey(os.Stdout); err != nil {
+			log.Fatal("Failed to generate private key:", err)
+		}
+		return
+	}
+
+	privateKeys, err := cfg.ResolvePrivateKeys()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	allowedNets, err := cfg.ParseAllowedCIDRs()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// Initialize i18n
 	i18nInstance := i18n.GetInstance()
-	if err := i18nInstance.SetLanguage(cfg.Language); err != nil {
-		log.Printf("Failed to set language %s, falling back to en: %v", cfg.Language, err)
+	if err := i18nInstance.UseLanguage(cfg.Language, cfg.StrictLanguage); err != nil {
+		log.Fatal("Failed to set language: ", err)
 	}
-	if err := i18nInstance.LoadAllLanguages(); err != nil {
-		log.Printf("Warning: failed to load translation files: %v", err)
+
+	// Security events go to an optional JSON-lines file
+	var auditLog hub.AuditLogger = hub.NopAuditLogger{}
+	if cfg.AuditLog != "" {
+		auditFile, err := os.OpenFile(cfg.AuditLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			log.Fatal("Failed to open audit log:", err)
+		}
+		defer auditFile.Close()
+		auditLog = hub.NewJSONAuditLogger(auditFile)
 	}
 
 	// Initialize components
 	h := hub.NewHub(cfg.MaxMessageSize, cfg.RateLimitPerSec)
+	h.SetGlobalRateLimit(cfg.GlobalRateLimit)
+	h.SetTypeRateLimits(cfg.TypeRateLimits)
+	h.SetHistorySize(cfg.HistorySize)
+	h.SetMessageSizeLimits(cfg.MaxMessageSizeHost, cfg.MaxMessageSizeClient)
+	h.SetMessageWarnRatio(cfg.MessageWarnRatio)
+	h.SetTitle(cfg.SessionTitle)
+	h.SetFeatures(cfg.Features)
+	h.SetMaxTextRunes(cfg.MaxTextRunes)
+	h.SetLogContent(cfg.LogContent)
+	h.SetMaxSessionLifetime(cfg.MaxSessionLifetime, cfg.MaxSessionLifetimeExemptHost)
+	h.SetJoinApproval(cfg.JoinApproval, cfg.JoinApprovalTimeout)
+	h.SetChunking(cfg.MaxChunkedSize, cfg.ChunkTimeout)
+	h.SetMaxMessagesPerConnection(cfg.MaxMessagesPerConnection)
+	h.SetMissedPongTolerance(cfg.MissedPongTolerance)
+	h.SetFirstMessageTimeout(cfg.FirstMessageTimeout)
+	h.SetReconnectGrace(cfg.ReconnectGrace)
+	h.SetMaxClientsPerIP(cfg.MaxClientsPerIP)
+	h.SetPauseQueueSize(cfg.PauseQueueSize)
+	h.SetAuditLogger(auditLog)
+	h.SetTranslator(i18nInstance)
+	if err := h.SetPersistLast(cfg.PersistLast); err != nil {
+		log.Fatal(err)
+	}
 	go h.Run()
 
 	tokenManager := token.NewTokenManager(
 		int(cfg.SessionTimeout.Minutes()),
 	)
-	defer tokenManager.StartCleanup(1 * time.Minute)()
+	tokenManager.SetTimeout(cfg.SessionTimeout)
+	tokenManager.SetPrivateKeys(privateKeys...)
+	tokenManager.SetMaxTokens(cfg.MaxActiveTokens)
+	tokenManager.SetMaxTTL(cfg.MaxTokenTTL)
+	if err := tokenManager.SelfCheck(); err != nil {
+		log.Fatal(err)
+	}
+	defer tokenManager.StartCleanup(cfg.TokenCleanupInterval)()
+
+	// Listen before building QR URLs so they carry the real port, even with --port 0
+	listener, err := cfg.Listen()
+	if err != nil {
+		log.Fatal("Server error:", err)
+	}
 
 	// Determine host:port for QR code
 	// If GetQRHost already includes a port (from PublicURL), use it as-is
@@ -62,27 +129,80 @@ func main() {
 		cfg.SessionTimeout,
 	)
 
+	// Host pages can show one QR code per address (?target=lan or ?target=public)
+	lan := qrcode.Target{Name: "lan", Scheme: "http", Host: cfg.LocalIP + ":" + cfg.Port}
+	if cfg.PublicURL == "" {
+		qrGen.SetTargets(lan)
+	} else {
+		qrGen.SetTargets(qrcode.Target{Name: "public", Scheme: cfg.GetQRScheme(), Host: qrHost}, lan)
+	}
+
 	srv := server.NewServer(h, tokenManager, qrGen, staticFiles, cfg.AllowedOrigins, i18nInstance)
-	srv.RegisterRoutes()
+	srv.SetHandlerTimeout(cfg.HandlerTimeout)
+	srv.SetAllowedHosts(cfg.AllowedHosts)
+	srv.SetDefaultTheme(cfg.DefaultTheme)
+	srv.SetTrustLocal(!cfg.UnixSocketStrict)
+	srv.SetMaxTokenLength(cfg.MaxTokenLength)
+	srv.SetAllowedCIDRs(allowedNets)
+	srv.SetAutoClientRedirect(cfg.AutoClientRedirect)
+	srv.SetAuditLogger(auditLog)
+	srv.SetStrictOrigins(cfg.StrictOrigins)
+	srv.SetFeatures(cfg.Features)
+	srv.SetWSPath(cfg.WSPath)
+	srv.SetHostSecret(cfg.HostSecret)
+	srv.SetAdminToken(cfg.AdminToken)
+	srv.SetNoCacheBust(cfg.NoCacheBust)
+	mux := http.NewServeMux()
+	srv.RegisterRoutes(mux)
+	defer srv.StartRoomCleanup(1 * time.Minute)()
 
 	// Log startup information
 	cfg.LogStartup()
 
 	// Start server with graceful shutdown
 	httpServer := &http.Server{
-		Addr:              ":" + cfg.Port,
-		ReadHeaderTimeout: 5 * time.Second,
+		Handler:           mux,
+		ReadHeaderTimeout: cfg.HandshakeTimeout,
 		ReadTimeout:       30 * time.Second,
 		WriteTimeout:      30 * time.Second,
 		IdleTimeout:       60 * time.Second,
 	}
 
+	// The listener already accepts connections, so --open can fire right away
 	go func() {
 		log.Printf("Server listening on :%s", cfg.Port)
-		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		if err := httpServer.Serve(listener); err != nil && err != http.ErrServerClosed {
 			log.Fatal("Server error:", err)
 		}
 	}()
+	cfg.OpenBrowser(config.SystemOpener)
+
+	// Optional Unix socket listener for local companion apps
+	var unixServer *http.Server
+	if cfg.UnixSocket != "" {
+		// Remove a stale socket left by an unclean exit
+		if err := os.Remove(cfg.UnixSocket); err != nil && !os.IsNotExist(err) {
+			log.Fatal("Failed to remove stale Unix socket:", err)
+		}
+		unixListener, err := net.Listen("unix", cfg.UnixSocket)
+		if err != nil {
+			log.Fatal("Failed to listen on Unix socket:", err)
+		}
+		if err := os.Chmod(cfg.UnixSocket, 0600); err != nil {
+			log.Printf("Failed to restrict Unix socket permissions: %v", err)
+		}
+
+		unixServer = &http.Server{
+			Handler:           srv.LocalHandler(mux),
+			ReadHeaderTimeout: cfg.HandshakeTimeout,
+		}
+		go func() {
+			log.Printf("Server listening on unix:%s", cfg.UnixSocket)
+			if err := unixServer.Serve(unixListener); err != nil && err != http.ErrServerClosed {
+				log.Printf("Unix socket server error: %v", err)
+			}
+		}()
+	}
 
 	// Wait for interrupt signal
 	sigChan := make(chan os.Signal, 1)
@@ -91,8 +211,8 @@ func main() {
 
 	// Graceful shutdown
 	log.Println("Shutting down server...")
-	h.Stop()
 	srv.Shutdown()
+	h.Stop()
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
@@ -100,6 +220,12 @@ func main() {
 	if err := httpServer.Shutdown(ctx); err != nil {
 		log.Printf("Server shutdown error: %v", err)
 	}
+	if unixServer != nil {
+		if err := unixServer.Shutdown(ctx); err != nil {
+			log.Printf("Unix socket server shutdown error: %v", err)
+		}
+		os.Remove(cfg.UnixSocket)
+	}
 
 	log.Println("Server stopped")
 }
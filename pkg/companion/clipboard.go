@@ -0,0 +1,65 @@
+package companion
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// Clipboard abstracts access to the local clipboard
+type Clipboard interface {
+	Read() (string, error)
+	Write(text string) error
+}
+
+// SystemClipboard accesses the OS clipboard through the platform's clipboard tools
+// (pbcopy/pbpaste on macOS, wl-clipboard or xclip on Linux, PowerShell/clip on Windows)
+type SystemClipboard struct{}
+
+// Read returns the current clipboard text
+func (SystemClipboard) Read() (string, error) {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("pbpaste")
+	case "windows":
+		cmd = exec.Command("powershell", "-NoProfile", "-Command", "Get-Clipboard")
+	default:
+		if os.Getenv("WAYLAND_DISPLAY") != "" {
+			cmd = exec.Command("wl-paste", "--no-newline")
+		} else {
+			cmd = exec.Command("xclip", "-selection", "clipboard", "-o")
+		}
+	}
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to read clipboard with %s: %w", cmd.Path, err)
+	}
+	return string(out), nil
+}
+
+// Write replaces the clipboard contents with text
+func (SystemClipboard) Write(text string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("pbcopy")
+	case "windows":
+		cmd = exec.Command("clip")
+	default:
+		if os.Getenv("WAYLAND_DISPLAY") != "" {
+			cmd = exec.Command("wl-copy")
+		} else {
+			cmd = exec.Command("xclip", "-selection", "clipboard")
+		}
+	}
+
+	cmd.Stdin = strings.NewReader(text)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to write clipboard with %s: %w", cmd.Path, err)
+	}
+	return nil
+}
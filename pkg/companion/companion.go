@@ -0,0 +1,300 @@
+// Package companion implements the "tvclipboard connect" command-line client
+package companion
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"tvclipboard/pkg/hub"
+)
+
+// Shared key parameters, matching getKey() in static/js/common.js
+const (
+	sharedKey        = "tvclipboard-default-key"
+	sharedSalt       = "tvclipboard-salt"
+	sharedIterations = 100000
+)
+
+// defaultWSPath is dialed when the server doesn't report its WebSocket path (see server.DefaultWSPath)
+const defaultWSPath = "/ws"
+
+// infoTimeout bounds the /api/info request that looks up the WebSocket path
+const infoTimeout = 5 * time.Second
+
+// Options configures a companion session
+type Options struct {
+	SessionURL string            // URL from the host's QR code (contains token and mode=client)
+	WSPath     string            // WebSocket path on the server; "" asks /api/info, falling back to /ws
+	Text       string            // Sent instead of the clipboard contents when set
+	Receive    bool              // Keep the connection open and print incoming messages
+	Out        io.Writer         // Destination for status output and received messages
+	Dialer     *websocket.Dialer // Defaults to websocket.DefaultDialer
+}
+
+// WebSocketURL converts a session URL into the WebSocket URL and Origin to dial
+// wsPath is the server's WebSocket path ("" uses /ws)
+func WebSocketURL(sessionURL, wsPath string) (wsURL string, origin string, err error) {
+	parsed, err := url.Parse(sessionURL)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid session URL: %w", err)
+	}
+
+	var scheme string
+	switch parsed.Scheme {
+	case "http":
+		scheme = "ws"
+	case "https":
+		scheme = "wss"
+	default:
+		return "", "", fmt.Errorf("invalid session URL: scheme must be http or https")
+	}
+	if parsed.Host == "" {
+		return "", "", fmt.Errorf("invalid session URL: missing host")
+	}
+
+	token := parsed.Query().Get("token")
+	if token == "" {
+		return "", "", fmt.Errorf("invalid session URL: missing token (scan the host's QR code)")
+	}
+
+	query := url.Values{"token": {token}}
+	if room := parsed.Query().Get("room"); room != "" {
+		query.Set("room", room)
+	}
+
+	if wsPath == "" {
+		wsPath = defaultWSPath
+	}
+	if !strings.HasPrefix(wsPath, "/") {
+		wsPath = "/" + wsPath
+	}
+
+	ws := url.URL{Scheme: scheme, Host: parsed.Host, Path: wsPath, RawQuery: query.Encode()}
+	return ws.String(), parsed.Scheme + "://" + parsed.Host, nil
+}
+
+// discoverWSPath asks the server's /api/info for its WebSocket path (moved with --ws-path)
+// It returns "" when the server doesn't say, e.g. an older version, so the default is dialed
+func discoverWSPath(ctx context.Context, origin string) string {
+	ctx, cancel := context.WithTimeout(ctx, infoTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, origin+"/api/info", nil)
+	if err != nil {
+		return ""
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return ""
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return ""
+	}
+
+	var info struct {
+		WSPath string `json:"wsPath"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&info); err != nil {
+		return ""
+	}
+	return info.WSPath
+}
+
+// Run connects to a session, sends the clipboard (or opts.Text) and optionally prints incoming messages
+func Run(ctx context.Context, opts Options, clip Clipboard) error {
+	if opts.Out == nil {
+		opts.Out = io.Discard
+	}
+	if opts.Dialer == nil {
+		opts.Dialer = websocket.DefaultDialer
+	}
+
+	_, origin, err := WebSocketURL(opts.SessionURL, "")
+	if err != nil {
+		return err
+	}
+	wsPath := opts.WSPath
+	if wsPath == "" {
+		wsPath = discoverWSPath(ctx, origin)
+	}
+	wsURL, _, err := WebSocketURL(opts.SessionURL, wsPath)
+	if err != nil {
+		return err
+	}
+
+	text := opts.Text
+	if text == "" && clip != nil {
+		if text, err = clip.Read(); err != nil {
+			return err
+		}
+	}
+	if text == "" && !opts.Receive {
+		return fmt.Errorf("nothing to send: clipboard is empty")
+	}
+
+	conn, resp, err := opts.Dialer.DialContext(ctx, wsURL, http.Header{"Origin": {origin}})
+	if err != nil {
+		if resp != nil {
+			return fmt.Errorf("connection rejected: %s", resp.Status)
+		}
+		return fmt.Errorf("failed to connect: %w", err)
+	}
+	defer conn.Close()
+
+	// Close the connection when the context ends so blocking reads return
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	var roleMsg hub.Message
+	if err := conn.ReadJSON(&roleMsg); err != nil {
+		return fmt.Errorf("failed to read role assignment: %w", err)
+	}
+	if roleMsg.Type != "role" || roleMsg.Role != "client" {
+		return fmt.Errorf("unexpected role assignment: %s", roleMsg.Role)
+	}
+
+	// Greet the server so it doesn't drop us as a silent connection
+	if err := conn.WriteJSON(hub.Message{Type: "hello"}); err != nil {
+		return fmt.Errorf("failed to greet server: %w", err)
+	}
+
+	if text != "" {
+		content, err := encryptContent(text)
+		if err != nil {
+			return err
+		}
+		if err := conn.WriteJSON(hub.Message{Type: "text", Content: content}); err != nil {
+			return fmt.Errorf("failed to send message: %w", err)
+		}
+		fmt.Fprintf(opts.Out, "Sent %d bytes\n", len(text))
+	}
+
+	if !opts.Receive {
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+		return nil
+	}
+
+	return receive(ctx, conn, opts.Out)
+}
+
+// receive prints incoming text messages until the connection closes or ctx ends
+func receive(ctx context.Context, conn *websocket.Conn, out io.Writer) error {
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if ctx.Err() != nil || websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				return nil
+			}
+			return fmt.Errorf("connection lost: %w", err)
+		}
+
+		var msg hub.Message
+		if err := json.Unmarshal(data, &msg); err != nil {
+			continue
+		}
+		switch msg.Type {
+		case "text":
+			fmt.Fprintln(out, decryptContent(msg.Content))
+		case "error":
+			fmt.Fprintf(out, "Server error: %s\n", msg.Content)
+		}
+	}
+}
+
+// sharedAEAD derives the AES-GCM cipher shared with the browser clients
+func sharedAEAD() (cipher.AEAD, error) {
+	key, err := pbkdf2.Key(sha256.New, sharedKey, []byte(sharedSalt), sharedIterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptContent encrypts text the same way encryptMessage() does in the browser
+func encryptContent(text string) (string, error) {
+	aead, err := sharedAEAD()
+	if err != nil {
+		return "", fmt.Errorf("failed to set up encryption: %w", err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(text), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decryptContent reverses encryptContent, returning content unchanged if it isn't encrypted
+func decryptContent(content string) string {
+	raw, err := base64.StdEncoding.DecodeString(content)
+	if err != nil {
+		return content
+	}
+	aead, err := sharedAEAD()
+	if err != nil || len(raw) < aead.NonceSize() {
+		return content
+	}
+	plain, err := aead.Open(nil, raw[:aead.NonceSize()], raw[aead.NonceSize():], nil)
+	if err != nil {
+		return content
+	}
+	return string(plain)
+}
+
+// Main runs the connect command with its arguments and returns the exit code
+func Main(args []string) int {
+	fs := flag.NewFlagSet("connect", flag.ContinueOnError)
+	text := fs.String("text", "", "Send this text instead of the clipboard contents")
+	receive := fs.Bool("receive", false, "Stay connected and print incoming messages")
+	wsPath := fs.String("ws-path", "", "WebSocket path on the server (default: asked from the server, else /ws)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: tvclipboard connect [options] <session-url>\n\nOptions:\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	opts := Options{
+		SessionURL: fs.Arg(0),
+		WSPath:     *wsPath,
+		Text:       *text,
+		Receive:    *receive,
+		Out:        os.Stdout,
+	}
+	if err := Run(ctx, opts, SystemClipboard{}); err != nil && !errors.Is(err, context.Canceled) {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,277 @@
+package companion
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"tvclipboard/pkg/hub"
+)
+
+// fakeClipboard is an in-memory Clipboard for tests
+type fakeClipboard struct {
+	text    string
+	err     error
+	written []string
+}
+
+func (f *fakeClipboard) Read() (string, error) {
+	return f.text, f.err
+}
+
+func (f *fakeClipboard) Write(text string) error {
+	f.written = append(f.written, text)
+	return nil
+}
+
+// safeBuffer is a bytes.Buffer safe for concurrent use
+type safeBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *safeBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *safeBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// startTestHub starts a hub behind a WebSocket handler and registers a receiver client
+func startTestHub(t *testing.T) (*httptest.Server, *hub.Client) {
+	t.Helper()
+	h := hub.NewHub(1024*1024, 10)
+	go h.Run()
+	t.Cleanup(h.Stop)
+
+	receiver := hub.NewClient(nil, h, false)
+	h.Register <- receiver
+	<-receiver.Send // role assignment (host)
+
+	upgrader := websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("token") == "" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		client := hub.NewClient(conn, h, false)
+		h.Register <- client
+		go client.WritePump()
+		go client.ReadPump()
+	}))
+	t.Cleanup(server.Close)
+
+	return server, receiver
+}
+
+// TestWebSocketURL tests conversion of QR session URLs to WebSocket URLs
+func TestWebSocketURL(t *testing.T) {
+	tests := []struct {
+		name       string
+		sessionURL string
+		wsPath     string
+		wantWS     string
+		wantOrigin string
+		wantErr    bool
+	}{
+		{
+			name:       "local http",
+			sessionURL: "http://192.168.1.5:3333?token=ABC12345&mode=client",
+			wantWS:     "ws://192.168.1.5:3333/ws?token=ABC12345",
+			wantOrigin: "http://192.168.1.5:3333",
+		},
+		{
+			name:       "https with room",
+			sessionURL: "https://tv.example.com/?token=ABC12345&mode=client&room=den",
+			wantWS:     "wss://tv.example.com/ws?room=den&token=ABC12345",
+			wantOrigin: "https://tv.example.com",
+		},
+		{
+			name:       "custom ws path",
+			sessionURL: "http://localhost:3333?token=ABC12345",
+			wsPath:     "clip/socket",
+			wantWS:     "ws://localhost:3333/clip/socket?token=ABC12345",
+			wantOrigin: "http://localhost:3333",
+		},
+		{name: "missing token", sessionURL: "http://localhost:3333?mode=client", wantErr: true},
+		{name: "bad scheme", sessionURL: "ftp://localhost?token=abc", wantErr: true},
+		{name: "no host", sessionURL: "token=abc", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ws, origin, err := WebSocketURL(tt.sessionURL, tt.wsPath)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Expected error for %s", tt.sessionURL)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if ws != tt.wantWS || origin != tt.wantOrigin {
+				t.Errorf("WebSocketURL() = %s, %s; want %s, %s", ws, origin, tt.wantWS, tt.wantOrigin)
+			}
+		})
+	}
+}
+
+// TestRunSendsClipboard tests that the clipboard contents reach other clients
+func TestRunSendsClipboard(t *testing.T) {
+	server, receiver := startTestHub(t)
+
+	var out bytes.Buffer
+	opts := Options{SessionURL: server.URL + "?token=ABC12345&mode=client", Out: &out}
+	if err := Run(context.Background(), opts, &fakeClipboard{text: "from the desktop"}); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	select {
+	case raw := <-receiver.Send:
+		var msg hub.Message
+		json.Unmarshal(raw, &msg)
+		if msg.Type != "text" || decryptContent(msg.Content) != "from the desktop" {
+			t.Errorf("Unexpected message: %+v", msg)
+		}
+		if msg.Content == "from the desktop" {
+			t.Error("Content should be encrypted like browser clients")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Receiver did not get the clipboard message")
+	}
+
+	if !strings.Contains(out.String(), "Sent 16 bytes") {
+		t.Errorf("Expected send confirmation, got: %s", out.String())
+	}
+}
+
+// TestRunCustomWSPath tests that the companion finds a WebSocket endpoint moved with --ws-path through /api/info
+func TestRunCustomWSPath(t *testing.T) {
+	h := hub.NewHub(1024*1024, 10)
+	go h.Run()
+	defer h.Stop()
+	receiver := hub.NewClient(nil, h, false)
+	h.Register <- receiver
+	<-receiver.Send // role assignment (host)
+
+	upgrader := websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/info", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"wsPath":"/clip/socket"}`))
+	})
+	mux.HandleFunc("/clip/socket", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		client := hub.NewClient(conn, h, false)
+		h.Register <- client
+		go client.WritePump()
+		go client.ReadPump()
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	opts := Options{SessionURL: server.URL + "?token=ABC12345", Text: "moved socket"}
+	if err := Run(context.Background(), opts, nil); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	select {
+	case raw := <-receiver.Send:
+		var msg hub.Message
+		json.Unmarshal(raw, &msg)
+		if decryptContent(msg.Content) != "moved socket" {
+			t.Errorf("Unexpected message: %+v", msg)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Receiver did not get the message sent over the custom path")
+	}
+}
+
+// TestRunReceive tests that incoming messages are printed until the context ends
+func TestRunReceive(t *testing.T) {
+	server, receiver := startTestHub(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var out safeBuffer
+	done := make(chan error, 1)
+	go func() {
+		opts := Options{SessionURL: server.URL + "?token=ABC12345", Text: "hello", Receive: true, Out: &out}
+		done <- Run(ctx, opts, nil)
+	}()
+
+	// Wait for the companion's message, then reply as the receiver
+	var msg hub.Message
+	select {
+	case raw := <-receiver.Send:
+		json.Unmarshal(raw, &msg)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Receiver did not get the companion message")
+	}
+	tv, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws?token=ABC12345", nil)
+	if err != nil {
+		t.Fatalf("Failed to connect second client: %v", err)
+	}
+	defer tv.Close()
+	reply, _ := encryptContent("reply from tv")
+	tv.WriteJSON(hub.Message{Type: "text", Content: reply})
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !strings.Contains(out.String(), "reply from tv") {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected decrypted reply in output, got: %s", out.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Run should end cleanly on cancel, got: %v", err)
+	}
+}
+
+// TestRunEmptyClipboard tests that an empty clipboard is reported instead of sent
+func TestRunEmptyClipboard(t *testing.T) {
+	opts := Options{SessionURL: "http://localhost:1?token=ABC12345"}
+	if err := Run(context.Background(), opts, &fakeClipboard{}); err == nil {
+		t.Error("Expected error for empty clipboard")
+	}
+
+	clipErr := errors.New("no clipboard tool")
+	if err := Run(context.Background(), opts, &fakeClipboard{err: clipErr}); !errors.Is(err, clipErr) {
+		t.Errorf("Expected clipboard error, got: %v", err)
+	}
+}
+
+// TestEncryptDecryptContent tests round-tripping through the shared browser key
+func TestEncryptDecryptContent(t *testing.T) {
+	encrypted, err := encryptContent("secret")
+	if err != nil {
+		t.Fatalf("encryptContent failed: %v", err)
+	}
+	if got := decryptContent(encrypted); got != "secret" {
+		t.Errorf("decryptContent() = %q, want secret", got)
+	}
+	if got := decryptContent("plain text"); got != "plain text" {
+		t.Errorf("Unencrypted content should pass through, got %q", got)
+	}
+}
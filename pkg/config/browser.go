@@ -0,0 +1,61 @@
+package config
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+)
+
+// SystemOpener opens url in the default browser with the platform's opener
+// (open on macOS, cmd /c start on Windows, xdg-open elsewhere)
+func SystemOpener(url string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", url)
+	case "windows":
+		// The empty argument is start's window title, so a quoted URL isn't taken for it
+		cmd = exec.Command("cmd", "/c", "start", "", url)
+	default:
+		cmd = exec.Command("xdg-open", url)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start %s: %w", cmd.Path, err)
+	}
+	// Reap the opener in the background; it usually exits right after handing off
+	go cmd.Wait()
+	return nil
+}
+
+// hasDisplay reports whether a graphical session is likely available
+// Only Linux and the BSDs can tell: macOS and Windows always have one
+func hasDisplay() bool {
+	switch runtime.GOOS {
+	case "darwin", "windows":
+		return true
+	default:
+		return os.Getenv("DISPLAY") != "" || os.Getenv("WAYLAND_DISPLAY") != ""
+	}
+}
+
+// HostURL returns the local URL of the host page
+func (c *Config) HostURL() string {
+	return "http://localhost:" + c.Port
+}
+
+// OpenBrowser opens the host page with opener when Open is set
+// It does nothing on headless machines, so --open is safe to leave on in server deployments
+func (c *Config) OpenBrowser(opener func(url string) error) {
+	if !c.Open {
+		return
+	}
+	if !hasDisplay() {
+		log.Printf("No display detected, not opening a browser")
+		return
+	}
+	if err := opener(c.HostURL()); err != nil {
+		log.Printf("Failed to open browser: %v", err)
+	}
+}
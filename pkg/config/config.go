@@ -1,8 +1,10 @@
 package config
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/url"
@@ -11,22 +13,92 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"tvclipboard/pkg/features"
+	"tvclipboard/pkg/token"
 )
 
 // cliFlags holds parsed CLI flag values
 type cliFlags struct {
 	portFlag           string
 	baseURLFlag        string
-	expiresFlag        int
+	expiresFlag        string
 	keyFlag            string
 	helpFlag           bool
 	maxMessageSizeFlag int
+	hostSizeFlag       int
+	clientSizeFlag     int
+	titleFlag          string
+	maxTokenLenFlag    int
+	presenceFlag       bool
+	unknownTypesFlag   bool
+	fixedHostFlag      bool
+	textRunesFlag      int
+	allowCIDRFlag      stringList
+	e2eOnlyFlag        bool
+	logContentFlag     bool
+	keyFileFlag        string
+	openFlag           bool
+	clientRedirectFlag bool
+	auditLogFlag       string
+	strictOriginsFlag  bool
+	lifetimeFlag       time.Duration
+	lifetimeHostFlag   bool
+	debugWSFlag        bool
+	wsPathFlag         string
+	hostSecretFlag     string
+	joinApprovalFlag   bool
+	joinTimeoutFlag    time.Duration
+	quotaFlag          int
+	noHostFlag         bool
+	pauseQueueFlag     int
+	warnRatioFlag      float64
+	pongToleranceFlag  int
+	clientsPerIPFlag   int
+	adminTokenFlag     string
+	originsFlag        string
+	originsModeFlag    string
+	persistLastFlag    string
+	noCacheBustFlag    bool
+	keysFlag           stringList
+	handshakeFlag      time.Duration
+	firstMessageFlag   time.Duration
+	typeRateFlag       stringList
+	chunkedSizeFlag    int
+	chunkTimeoutFlag   time.Duration
+	strictLangFlag     bool
+	inlineQRFlag       bool
+	maxTokenTTLFlag    time.Duration
+	reconnectFlag      time.Duration
 	rateLimitFlag      int
 	langFlag           string
+	genKeyFlag         bool
+	requireKeyFlag     bool
+	globalRateFlag     int
+	handlerTimeoutFlag time.Duration
+	allowedHostsFlag   string
+	themeFlag          string
+	maxTokensFlag      int
+	cleanupFlag        time.Duration
+	historySizeFlag    int
+	unixSocketFlag     string
+	unixStrictFlag     bool
 }
 
 var cfg = cliFlags{}
 
+// stringList is a flag.Value collecting a repeatable flag; each value may also be comma-separated
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, splitList(value)...)
+	return nil
+}
+
 // Config holds the application configuration
 type Config struct {
 	Port            string
@@ -39,19 +111,210 @@ type Config struct {
 	RateLimitPerSec int
 	AllowedOrigins  []string
 	Language        string
+	GenKey          bool
+	Command         string   // Subcommand given as the first positional argument (e.g. "connect")
+	CommandArgs     []string // Arguments following the subcommand
+	RequireKey      bool
+	GlobalRateLimit int
+	HandlerTimeout  time.Duration
+	AllowedHosts    []string
+	DefaultTheme    string
+	MaxActiveTokens int
+	// TokenCleanupInterval is how often expired tokens are purged
+	TokenCleanupInterval time.Duration
+	HistorySize          int
+	UnixSocket           string // Optional Unix socket path served alongside TCP
+	UnixSocketStrict     bool   // Apply origin, host and token checks to Unix socket connections
+	MaxMessageSizeHost   int64  // Host message size limit in bytes (default: MaxMessageSize)
+	MaxMessageSizeClient int64  // Client message size limit in bytes (default: MaxMessageSize)
+	SessionTitle         string // Initial session label shown to clients
+	MaxTokenLength       int    // Longest token accepted on WebSocket/SSE handshakes
+	Presence             bool   // Broadcast join/leave presence updates
+	AllowUnknownTypes    bool   // Forward message types the server does not recognize
+	FixedHost            bool   // Never promote a client to host when the host disconnects
+	MaxTextRunes         int    // Longest text message in characters (0 disables)
+
+	// AllowCIDRs lists the client networks allowed to connect (empty allows all)
+	AllowCIDRs []string
+
+	// E2EOnly rejects plaintext messages, relaying only end-to-end encrypted content
+	E2EOnly bool
+
+	// LogContent includes truncated message content in logs
+	LogContent bool
+
+	// PrivateKeyFile is read for the private key (hex or raw bytes) when PrivateKeyHex is empty
+	PrivateKeyFile string
+
+	// PrivateKeys are extra hex keys accepted when decrypting tokens, for rolling keys across a fleet
+	PrivateKeys []string
+
+	// Open launches the default browser on the host page once the server is listening
+	Open bool
+
+	// AutoClientRedirect sends "/" to the client page when the room already has a host
+	AutoClientRedirect bool
+
+	// AuditLog is a file that security events are appended to as JSON lines
+	AuditLog string
+
+	// StrictOrigins denies cross-origin WebSocket upgrades when AllowedOrigins is empty
+	StrictOrigins bool
+
+	// MaxSessionLifetime closes clients connected for longer, regardless of activity (0 disables)
+	MaxSessionLifetime time.Duration
+
+	// MaxSessionLifetimeExemptHost keeps the host connected past MaxSessionLifetime
+	MaxSessionLifetimeExemptHost bool
+
+	// EnableDebugWS serves /ws?mode=debug, an echo-only connection for testing proxies
+	EnableDebugWS bool
+
+	// WSPath is where the WebSocket endpoint is served, for proxies that route /ws elsewhere
+	WSPath string
+
+	// HostSecret lets a connection with ?host_secret=<value> always take the host role
+	HostSecret string
+
+	// JoinApproval holds new clients until the host approves them
+	JoinApproval bool
+
+	// JoinApprovalTimeout is how long a join request waits before it is denied
+	JoinApprovalTimeout time.Duration
+
+	// MaxMessagesPerConnection closes a WebSocket client after this many messages (0 = unlimited)
+	MaxMessagesPerConnection int
+
+	// NoHost makes every connection an equal client that needs a token
+	NoHost bool
+
+	// PauseQueueSize is how many messages are held while the host is paused
+	PauseQueueSize int
+
+	// MessageWarnRatio warns senders above this share of the message size limit (0 disables)
+	MessageWarnRatio float64
+
+	// MissedPongTolerance is how many consecutive pongs a client may miss before it is closed (0 disables)
+	MissedPongTolerance int
+
+	// MaxClientsPerIP caps the clients one IP address may have connected to a room (0 = unlimited)
+	MaxClientsPerIP int
+
+	// AdminToken enables /api/maintenance and /api/announce for requests with "Authorization: Bearer <value>" ("" disables it)
+	AdminToken string
+
+	// PersistLast is the file the last text message is saved to and restored from ("" disables it)
+	PersistLast string
+
+	// NoCacheBust leaves static asset URLs in pages without the ?v=<version> query
+	NoCacheBust bool
+
+	// HandshakeTimeout bounds how long a connection may take to send its request headers
+	HandshakeTimeout time.Duration
+
+	// FirstMessageTimeout closes WebSocket clients that stay silent this long after connecting (0 = disabled)
+	FirstMessageTimeout time.Duration
+
+	// TypeRateLimits gives message types their own messages per second per client; other types use RateLimitPerSec
+	TypeRateLimits map[string]int
+
+	// MaxChunkedSize is the largest message reassembled from "chunk" parts in bytes (0 disables chunking)
+	MaxChunkedSize int64
+
+	// ChunkTimeout drops chunked transfers that aren't completed in time
+	ChunkTimeout time.Duration
+
+	// StrictLanguage makes an unknown Language a startup error instead of a warning
+	StrictLanguage bool
+
+	// InlineQR embeds the QR codes in the host page instead of loading them from /qrcode.png
+	InlineQR bool
+
+	// MaxTokenTTL is the longest lifetime a QR code may ask for with ?ttl= (0 means the session timeout)
+	MaxTokenTTL time.Duration
+
+	// ReconnectGrace is how long a dropped client may rejoin with the reconnect token from its welcome (0 = disabled)
+	ReconnectGrace time.Duration
+
+	// Features gathers the optional behaviors above that the hub, server and frontend switch on
+	Features features.Set
 }
 
+// DefaultHandshakeTimeout is the default HandshakeTimeout
+const DefaultHandshakeTimeout = 5 * time.Second
+
+// DefaultReconnectGrace is the default ReconnectGrace
+const DefaultReconnectGrace = 2 * time.Minute
+
 // Load loads configuration from environment variables and CLI flags
 func Load() *Config {
 	// Parse CLI flags
-	flag.StringVar(&cfg.portFlag, "port", "", "Server port (default: 3333, env: PORT)")
+	flag.StringVar(&cfg.portFlag, "port", "", "Server port, 0 picks a free one (default: 3333, env: PORT)")
 	flag.StringVar(&cfg.baseURLFlag, "base-url", "", "Public base URL for QR codes (e.g., https://example.com, env: TVCLIPBOARD_PUBLIC_URL)")
-	flag.IntVar(&cfg.expiresFlag, "expires", 0, "Session timeout in minutes (default: 10, env: TVCLIPBOARD_SESSION_TIMEOUT)")
+	flag.StringVar(&cfg.expiresFlag, "expires", "", "Session timeout in minutes or as a duration like 90s or 1h30m (default: 10, env: TVCLIPBOARD_SESSION_TIMEOUT)")
 	flag.StringVar(&cfg.keyFlag, "key", "", "Private key hex string (env: TVCLIPBOARD_PRIVATE_KEY)")
+	flag.StringVar(&cfg.keyFileFlag, "key-file", "", "File containing the private key as hex or 32 raw bytes (env: TVCLIPBOARD_PRIVATE_KEY_FILE)")
+	cfg.keysFlag = nil
+	flag.Var(&cfg.keysFlag, "keys", "Private key hex string also accepted when decrypting tokens, repeatable; the first encrypts if --key is unset (env: TVCLIPBOARD_PRIVATE_KEYS)")
 	flag.BoolVar(&cfg.helpFlag, "help", false, "Show this help message")
 	flag.IntVar(&cfg.maxMessageSizeFlag, "max-message-size", 0, "Maximum message size in KB (default: 1024, env: TVCLIPBOARD_MAX_MESSAGE_SIZE)")
+	flag.IntVar(&cfg.hostSizeFlag, "max-message-size-host", 0, "Maximum message size in KB for the host (default: max-message-size, env: TVCLIPBOARD_MAX_MESSAGE_SIZE_HOST)")
+	flag.IntVar(&cfg.clientSizeFlag, "max-message-size-client", 0, "Maximum message size in KB for clients (default: max-message-size, env: TVCLIPBOARD_MAX_MESSAGE_SIZE_CLIENT)")
 	flag.IntVar(&cfg.rateLimitFlag, "rate-limit", 0, "Messages per second per client (default: 10, env: TVCLIPBOARD_RATE_LIMIT)")
-	flag.StringVar(&cfg.langFlag, "lang", "", "Language code (default: en, env: TVCLIPBOARD_LANGUAGE)")
+	flag.IntVar(&cfg.globalRateFlag, "global-rate-limit", 0, "Messages per second across all clients, 0 disables (env: TVCLIPBOARD_GLOBAL_RATE_LIMIT)")
+	flag.DurationVar(&cfg.handlerTimeoutFlag, "handler-timeout", 0, "Timeout for page, QR and i18n handlers (default: 5s, env: TVCLIPBOARD_HANDLER_TIMEOUT)")
+	flag.StringVar(&cfg.originsFlag, "allowed-origins", "", "Comma-separated WebSocket origins to allow instead of the ones derived from the public URL or local IP (env: TVCLIPBOARD_ALLOWED_ORIGINS)")
+	flag.StringVar(&cfg.originsModeFlag, "origins-mode", "", "How --allowed-origins combines with the derived origins: replace or append (default: replace, env: TVCLIPBOARD_ORIGINS_MODE)")
+	flag.StringVar(&cfg.allowedHostsFlag, "allowed-hosts", "", "Comma-separated Host headers accepted for WebSocket upgrades (env: TVCLIPBOARD_ALLOWED_HOSTS)")
+	flag.StringVar(&cfg.themeFlag, "default-theme", "", "Theme hint for pages: light, dark or auto (default: auto, env: TVCLIPBOARD_DEFAULT_THEME)")
+	flag.DurationVar(&cfg.maxTokenTTLFlag, "max-token-ttl", 0, "Longest lifetime /qrcode.png?ttl= may give a token (default: the session timeout, env: TVCLIPBOARD_MAX_TOKEN_TTL)")
+	flag.DurationVar(&cfg.reconnectFlag, "reconnect-grace", -1, "How long a dropped client may rejoin as itself with its reconnect token, 0 disables (default: 2m, env: TVCLIPBOARD_RECONNECT_GRACE)")
+	flag.IntVar(&cfg.maxTokensFlag, "max-active-tokens", 0, "Maximum active session tokens, oldest are evicted (default: 10000, env: TVCLIPBOARD_MAX_ACTIVE_TOKENS)")
+	flag.DurationVar(&cfg.cleanupFlag, "token-cleanup-interval", 0, "How often expired tokens are purged (default: min(timeout/2, 1m), env: TVCLIPBOARD_TOKEN_CLEANUP_INTERVAL)")
+	flag.IntVar(&cfg.historySizeFlag, "history-size", -1, "Recent messages kept for /api/history, 0 disables (default: 20, env: TVCLIPBOARD_HISTORY_SIZE)")
+	flag.StringVar(&cfg.unixSocketFlag, "unix-socket", "", "Also listen on this Unix socket path for local clients (env: TVCLIPBOARD_UNIX_SOCKET)")
+	flag.BoolVar(&cfg.unixStrictFlag, "unix-socket-strict", false, "Apply origin and token checks to Unix socket connections (env: TVCLIPBOARD_UNIX_SOCKET_STRICT)")
+	flag.IntVar(&cfg.maxTokenLenFlag, "max-token-length", 0, "Longest token accepted on the WebSocket handshake (default: 256, env: TVCLIPBOARD_MAX_TOKEN_LENGTH)")
+	flag.BoolVar(&cfg.presenceFlag, "presence", false, "Broadcast join/leave presence updates to connected clients (env: TVCLIPBOARD_PRESENCE)")
+	flag.BoolVar(&cfg.unknownTypesFlag, "allow-unknown-types", false, "Forward unrecognized message types instead of rejecting them (env: TVCLIPBOARD_ALLOW_UNKNOWN_TYPES)")
+	flag.BoolVar(&cfg.fixedHostFlag, "fixed-host", false, "Keep the host slot for the returning host instead of promoting a client (env: TVCLIPBOARD_FIXED_HOST)")
+	cfg.allowCIDRFlag = nil
+	flag.Var(&cfg.allowCIDRFlag, "allow-cidr", "Client network allowed to connect, repeatable (e.g. 192.168.1.0/24, env: TVCLIPBOARD_ALLOW_CIDR)")
+	flag.BoolVar(&cfg.e2eOnlyFlag, "e2e-only", false, "Reject plaintext text/image messages, relaying only end-to-end encrypted ones (env: TVCLIPBOARD_E2E_ONLY)")
+	flag.BoolVar(&cfg.logContentFlag, "log-content", false, "Include truncated message content in logs (env: TVCLIPBOARD_LOG_CONTENT)")
+	flag.BoolVar(&cfg.openFlag, "open", false, "Open the host page in the default browser on startup (env: TVCLIPBOARD_OPEN)")
+	flag.BoolVar(&cfg.clientRedirectFlag, "auto-client-redirect", false, "Redirect / to the client page when a host is already connected (env: TVCLIPBOARD_AUTO_CLIENT_REDIRECT)")
+	flag.StringVar(&cfg.auditLogFlag, "audit-log", "", "Append security events (rejected tokens, origins, rate limiting) to this file as JSON lines (env: TVCLIPBOARD_AUDIT_LOG)")
+	flag.BoolVar(&cfg.strictOriginsFlag, "strict-origins", false, "Deny cross-origin WebSocket upgrades unless the origin is explicitly allowed (env: TVCLIPBOARD_STRICT_ORIGINS)")
+	flag.DurationVar(&cfg.lifetimeFlag, "max-session-lifetime", 0, "Close clients connected longer than this, e.g. 4h, even if active (default: 0, disabled, env: TVCLIPBOARD_MAX_SESSION_LIFETIME)")
+	flag.BoolVar(&cfg.lifetimeHostFlag, "max-session-lifetime-exempt-host", false, "Keep the host connected past the max session lifetime (env: TVCLIPBOARD_MAX_SESSION_LIFETIME_EXEMPT_HOST)")
+	flag.BoolVar(&cfg.debugWSFlag, "enable-debug-ws", false, "Serve /ws?mode=debug, which echoes messages back to test WebSockets through proxies (env: TVCLIPBOARD_ENABLE_DEBUG_WS)")
+	flag.StringVar(&cfg.wsPathFlag, "ws-path", "", "Path of the WebSocket endpoint (default: /ws, env: TVCLIPBOARD_WS_PATH)")
+	flag.StringVar(&cfg.hostSecretFlag, "host-secret", "", "Secret that makes a connection with ?host_secret=<value> the host, replacing the current one (env: TVCLIPBOARD_HOST_SECRET)")
+	flag.BoolVar(&cfg.joinApprovalFlag, "join-approval", false, "Hold each new client until the host approves it (env: TVCLIPBOARD_JOIN_APPROVAL)")
+	flag.DurationVar(&cfg.joinTimeoutFlag, "join-approval-timeout", 0, "Deny join requests the host hasn't answered after this long (default: 30s, env: TVCLIPBOARD_JOIN_APPROVAL_TIMEOUT)")
+	flag.IntVar(&cfg.quotaFlag, "max-messages-per-connection", 0, "Disconnect a client after this many messages, 0 for no limit (env: TVCLIPBOARD_MAX_MESSAGES_PER_CONNECTION)")
+	flag.BoolVar(&cfg.noHostFlag, "no-host", false, "Relay between equal clients: every connection needs a token and none becomes host (env: TVCLIPBOARD_NO_HOST)")
+	flag.IntVar(&cfg.pauseQueueFlag, "pause-queue-size", 0, "Messages held while the host is paused, oldest dropped beyond it (default: 50, env: TVCLIPBOARD_PAUSE_QUEUE_SIZE)")
+	flag.Float64Var(&cfg.warnRatioFlag, "message-warn-ratio", -1, "Warn senders whose message exceeds this share of the size limit, 0 disables (default: 0.8, env: TVCLIPBOARD_MESSAGE_WARN_RATIO)")
+	flag.IntVar(&cfg.pongToleranceFlag, "missed-pong-tolerance", 0, "Consecutive missed pongs tolerated before closing a client, for spotty networks (env: TVCLIPBOARD_MISSED_PONG_TOLERANCE)")
+	flag.IntVar(&cfg.clientsPerIPFlag, "max-clients-per-ip", 0, "Most clients one IP address may have connected to a room, 0 for no limit (env: TVCLIPBOARD_MAX_CLIENTS_PER_IP)")
+	flag.StringVar(&cfg.adminTokenFlag, "admin-token", "", "Bearer token that enables POST /api/maintenance, /api/announce, /api/tokens, /api/clients and /metrics (env: TVCLIPBOARD_ADMIN_TOKEN)")
+	flag.StringVar(&cfg.persistLastFlag, "persist-last", "", "Save the last text message to this file and show it again after a restart (env: TVCLIPBOARD_PERSIST_LAST)")
+	flag.BoolVar(&cfg.noCacheBustFlag, "no-cache-bust", false, "Don't add ?v=<version> to static asset URLs, for CDNs that strip query strings (env: TVCLIPBOARD_NO_CACHE_BUST)")
+	flag.DurationVar(&cfg.handshakeFlag, "handshake-timeout", 0, "Longest a connection may take to send its request headers, including WebSocket upgrades (default: 5s, env: TVCLIPBOARD_HANDSHAKE_TIMEOUT)")
+	flag.DurationVar(&cfg.firstMessageFlag, "first-message-timeout", 0, "Close WebSocket clients that send nothing for this long after connecting, 0 disables (env: TVCLIPBOARD_FIRST_MESSAGE_TIMEOUT)")
+	flag.BoolVar(&cfg.strictLangFlag, "strict-lang", false, "Refuse to start with a language that has no translations instead of falling back to en (env: TVCLIPBOARD_STRICT_LANG)")
+	flag.BoolVar(&cfg.inlineQRFlag, "inline-qr", false, "Embed the QR codes in the host page as data: URIs instead of loading /qrcode.png (env: TVCLIPBOARD_INLINE_QR)")
+	flag.IntVar(&cfg.chunkedSizeFlag, "max-chunked-size", 0, "Accept messages sent in \"chunk\" parts up to this size in KB, 0 disables (env: TVCLIPBOARD_MAX_CHUNKED_SIZE)")
+	flag.DurationVar(&cfg.chunkTimeoutFlag, "chunk-timeout", 0, "Drop chunked transfers not completed within this long (default: 30s, env: TVCLIPBOARD_CHUNK_TIMEOUT)")
+	cfg.typeRateFlag = nil
+	flag.Var(&cfg.typeRateFlag, "type-rate-limit", "Messages per second per client for one message type, as type=limit, repeatable (e.g. typing=20,text=2, env: TVCLIPBOARD_TYPE_RATE_LIMITS)")
+	flag.IntVar(&cfg.textRunesFlag, "max-text-runes", 0, "Longest text message in characters, 0 for no limit (env: TVCLIPBOARD_MAX_TEXT_RUNES)")
+	flag.StringVar(&cfg.titleFlag, "session-title", "", "Initial session title shown to clients, e.g. \"Living Room TV\" (env: TVCLIPBOARD_SESSION_TITLE)")
+	flag.StringVar(&cfg.langFlag, "lang", "", "Language code (default: en, env: TVCLIPBOARD_LANGUAGE or TVCLIPBOARD_LANG)")
+	flag.BoolVar(&cfg.requireKeyFlag, "require-key", false, "Fail startup unless a valid private key is configured (env: TVCLIPBOARD_REQUIRE_KEY)")
+	flag.BoolVar(&cfg.genKeyFlag, "genkey", false, "Print a new private key and exit (also: tvclipboard genkey)")
 	flag.Parse()
 
 	if cfg.helpFlag {
@@ -68,13 +331,11 @@ func Load() *Config {
 		port = "3333"
 	}
 
-	timeoutMinutes := cfg.expiresFlag
-	if timeoutMinutes == 0 {
-		timeoutStr := os.Getenv("TVCLIPBOARD_SESSION_TIMEOUT")
-		var err error
-		timeoutMinutes, err = strconv.Atoi(timeoutStr)
-		if err != nil || timeoutMinutes <= 0 {
-			timeoutMinutes = 10
+	sessionTimeout, ok := parseSessionTimeout(cfg.expiresFlag)
+	if !ok {
+		sessionTimeout, ok = parseSessionTimeout(os.Getenv("TVCLIPBOARD_SESSION_TIMEOUT"))
+		if !ok {
+			sessionTimeout = 10 * time.Minute
 		}
 	}
 
@@ -83,6 +344,16 @@ func Load() *Config {
 		privateKeyHex = os.Getenv("TVCLIPBOARD_PRIVATE_KEY")
 	}
 
+	privateKeyFile := cfg.keyFileFlag
+	if privateKeyFile == "" {
+		privateKeyFile = os.Getenv("TVCLIPBOARD_PRIVATE_KEY_FILE")
+	}
+
+	privateKeys := []string(cfg.keysFlag)
+	if len(privateKeys) == 0 {
+		privateKeys = splitList(os.Getenv("TVCLIPBOARD_PRIVATE_KEYS"))
+	}
+
 	publicURL := cfg.baseURLFlag
 	if publicURL == "" {
 		publicURL = os.Getenv("TVCLIPBOARD_PUBLIC_URL")
@@ -98,6 +369,9 @@ func Load() *Config {
 		}
 	}
 
+	hostMessageSize := sizeKB(cfg.hostSizeFlag, "TVCLIPBOARD_MAX_MESSAGE_SIZE_HOST", maxMessageSize)
+	clientMessageSize := sizeKB(cfg.clientSizeFlag, "TVCLIPBOARD_MAX_MESSAGE_SIZE_CLIENT", maxMessageSize)
+
 	rateLimit := cfg.rateLimitFlag
 	if rateLimit == 0 {
 		rateStr := os.Getenv("TVCLIPBOARD_RATE_LIMIT")
@@ -108,13 +382,353 @@ func Load() *Config {
 		}
 	}
 
+	globalRateLimit := cfg.globalRateFlag
+	if globalRateLimit == 0 {
+		globalRateLimit, _ = strconv.Atoi(os.Getenv("TVCLIPBOARD_GLOBAL_RATE_LIMIT"))
+	}
+	if globalRateLimit < 0 {
+		globalRateLimit = 0
+	}
+
+	handlerTimeout := cfg.handlerTimeoutFlag
+	if handlerTimeout <= 0 {
+		var err error
+		handlerTimeout, err = time.ParseDuration(os.Getenv("TVCLIPBOARD_HANDLER_TIMEOUT"))
+		if err != nil || handlerTimeout <= 0 {
+			handlerTimeout = 5 * time.Second
+		}
+	}
+
+	allowedHostsStr := cfg.allowedHostsFlag
+	if allowedHostsStr == "" {
+		allowedHostsStr = os.Getenv("TVCLIPBOARD_ALLOWED_HOSTS")
+	}
+
+	originsStr := cfg.originsFlag
+	if originsStr == "" {
+		originsStr = os.Getenv("TVCLIPBOARD_ALLOWED_ORIGINS")
+	}
+	originsMode := cfg.originsModeFlag
+	if originsMode == "" {
+		originsMode = os.Getenv("TVCLIPBOARD_ORIGINS_MODE")
+	}
+	switch originsMode {
+	case OriginsReplace, OriginsAppend:
+	default:
+		if originsMode != "" {
+			log.Printf("Unknown origins mode %q, using %s", originsMode, OriginsReplace)
+		}
+		originsMode = OriginsReplace
+	}
+
+	theme := cfg.themeFlag
+	if theme == "" {
+		theme = os.Getenv("TVCLIPBOARD_DEFAULT_THEME")
+	}
+	switch theme {
+	case "light", "dark", "auto":
+	default:
+		if theme != "" {
+			log.Printf("Unknown theme %q, using auto", theme)
+		}
+		theme = "auto"
+	}
+
+	maxActiveTokens := cfg.maxTokensFlag
+	if maxActiveTokens <= 0 {
+		var err error
+		maxActiveTokens, err = strconv.Atoi(os.Getenv("TVCLIPBOARD_MAX_ACTIVE_TOKENS"))
+		if err != nil || maxActiveTokens <= 0 {
+			maxActiveTokens = token.MaxTokens
+		}
+	}
+
+	cleanupInterval := cfg.cleanupFlag
+	if cleanupInterval <= 0 {
+		var err error
+		cleanupInterval, err = time.ParseDuration(os.Getenv("TVCLIPBOARD_TOKEN_CLEANUP_INTERVAL"))
+		if err != nil || cleanupInterval <= 0 {
+			cleanupInterval = min(sessionTimeout/2, time.Minute)
+		}
+	}
+
+	maxSessionLifetime := cfg.lifetimeFlag
+	if maxSessionLifetime <= 0 {
+		var err error
+		maxSessionLifetime, err = time.ParseDuration(os.Getenv("TVCLIPBOARD_MAX_SESSION_LIFETIME"))
+		if err != nil || maxSessionLifetime < 0 {
+			maxSessionLifetime = 0
+		}
+	}
+
+	lifetimeExemptHost := cfg.lifetimeHostFlag
+	if !lifetimeExemptHost {
+		lifetimeExemptHost, _ = strconv.ParseBool(os.Getenv("TVCLIPBOARD_MAX_SESSION_LIFETIME_EXEMPT_HOST"))
+	}
+
+	historySize := cfg.historySizeFlag
+	if historySize < 0 {
+		var err error
+		historySize, err = strconv.Atoi(os.Getenv("TVCLIPBOARD_HISTORY_SIZE"))
+		if err != nil || historySize < 0 {
+			historySize = 20
+		}
+	}
+
+	unixSocket := cfg.unixSocketFlag
+	if unixSocket == "" {
+		unixSocket = os.Getenv("TVCLIPBOARD_UNIX_SOCKET")
+	}
+	unixStrict := cfg.unixStrictFlag
+	if !unixStrict {
+		unixStrict, _ = strconv.ParseBool(os.Getenv("TVCLIPBOARD_UNIX_SOCKET_STRICT"))
+	}
+
+	sessionTitle := cfg.titleFlag
+	if sessionTitle == "" {
+		sessionTitle = os.Getenv("TVCLIPBOARD_SESSION_TITLE")
+	}
+
+	maxTokenLength := cfg.maxTokenLenFlag
+	if maxTokenLength <= 0 {
+		var err error
+		maxTokenLength, err = strconv.Atoi(os.Getenv("TVCLIPBOARD_MAX_TOKEN_LENGTH"))
+		if err != nil || maxTokenLength <= 0 {
+			maxTokenLength = 256
+		}
+	}
+
+	presence := cfg.presenceFlag
+	if !presence {
+		presence, _ = strconv.ParseBool(os.Getenv("TVCLIPBOARD_PRESENCE"))
+	}
+
+	allowUnknownTypes := cfg.unknownTypesFlag
+	if !allowUnknownTypes {
+		allowUnknownTypes, _ = strconv.ParseBool(os.Getenv("TVCLIPBOARD_ALLOW_UNKNOWN_TYPES"))
+	}
+
+	fixedHost := cfg.fixedHostFlag
+	if !fixedHost {
+		fixedHost, _ = strconv.ParseBool(os.Getenv("TVCLIPBOARD_FIXED_HOST"))
+	}
+
+	maxTextRunes := cfg.textRunesFlag
+	if maxTextRunes <= 0 {
+		maxTextRunes, _ = strconv.Atoi(os.Getenv("TVCLIPBOARD_MAX_TEXT_RUNES"))
+		if maxTextRunes < 0 {
+			maxTextRunes = 0
+		}
+	}
+
+	allowCIDRs := []string(cfg.allowCIDRFlag)
+	if len(allowCIDRs) == 0 {
+		allowCIDRs = splitList(os.Getenv("TVCLIPBOARD_ALLOW_CIDR"))
+	}
+
+	e2eOnly := cfg.e2eOnlyFlag
+	if !e2eOnly {
+		e2eOnly, _ = strconv.ParseBool(os.Getenv("TVCLIPBOARD_E2E_ONLY"))
+	}
+
+	logContent := cfg.logContentFlag
+	if !logContent {
+		logContent, _ = strconv.ParseBool(os.Getenv("TVCLIPBOARD_LOG_CONTENT"))
+	}
+
+	openBrowser := cfg.openFlag
+	if !openBrowser {
+		openBrowser, _ = strconv.ParseBool(os.Getenv("TVCLIPBOARD_OPEN"))
+	}
+
+	autoClientRedirect := cfg.clientRedirectFlag
+	if !autoClientRedirect {
+		autoClientRedirect, _ = strconv.ParseBool(os.Getenv("TVCLIPBOARD_AUTO_CLIENT_REDIRECT"))
+	}
+
+	auditLog := cfg.auditLogFlag
+	if auditLog == "" {
+		auditLog = os.Getenv("TVCLIPBOARD_AUDIT_LOG")
+	}
+
+	strictOrigins := cfg.strictOriginsFlag
+	if !strictOrigins {
+		strictOrigins, _ = strconv.ParseBool(os.Getenv("TVCLIPBOARD_STRICT_ORIGINS"))
+	}
+
+	debugWS := cfg.debugWSFlag
+	if !debugWS {
+		debugWS, _ = strconv.ParseBool(os.Getenv("TVCLIPBOARD_ENABLE_DEBUG_WS"))
+	}
+
+	wsPath := cfg.wsPathFlag
+	if wsPath == "" {
+		wsPath = os.Getenv("TVCLIPBOARD_WS_PATH")
+	}
+	if wsPath == "" {
+		wsPath = "/ws"
+	}
+
+	hostSecret := cfg.hostSecretFlag
+	if hostSecret == "" {
+		hostSecret = os.Getenv("TVCLIPBOARD_HOST_SECRET")
+	}
+
+	joinApproval := cfg.joinApprovalFlag
+	if !joinApproval {
+		joinApproval, _ = strconv.ParseBool(os.Getenv("TVCLIPBOARD_JOIN_APPROVAL"))
+	}
+
+	joinTimeout := cfg.joinTimeoutFlag
+	if joinTimeout <= 0 {
+		var err error
+		joinTimeout, err = time.ParseDuration(os.Getenv("TVCLIPBOARD_JOIN_APPROVAL_TIMEOUT"))
+		if err != nil || joinTimeout <= 0 {
+			joinTimeout = 30 * time.Second
+		}
+	}
+
+	maxMessagesPerConn := cfg.quotaFlag
+	if maxMessagesPerConn <= 0 {
+		var err error
+		maxMessagesPerConn, err = strconv.Atoi(os.Getenv("TVCLIPBOARD_MAX_MESSAGES_PER_CONNECTION"))
+		if err != nil || maxMessagesPerConn < 0 {
+			maxMessagesPerConn = 0
+		}
+	}
+
+	noHost := cfg.noHostFlag
+	if !noHost {
+		noHost, _ = strconv.ParseBool(os.Getenv("TVCLIPBOARD_NO_HOST"))
+	}
+
+	pauseQueueSize := cfg.pauseQueueFlag
+	if pauseQueueSize <= 0 {
+		var err error
+		pauseQueueSize, err = strconv.Atoi(os.Getenv("TVCLIPBOARD_PAUSE_QUEUE_SIZE"))
+		if err != nil || pauseQueueSize <= 0 {
+			pauseQueueSize = 50
+		}
+	}
+
+	warnRatio := cfg.warnRatioFlag
+	if warnRatio < 0 {
+		var err error
+		warnRatio, err = strconv.ParseFloat(os.Getenv("TVCLIPBOARD_MESSAGE_WARN_RATIO"), 64)
+		if err != nil || warnRatio < 0 {
+			warnRatio = 0.8
+		}
+	}
+
+	pongTolerance := cfg.pongToleranceFlag
+	if pongTolerance <= 0 {
+		var err error
+		pongTolerance, err = strconv.Atoi(os.Getenv("TVCLIPBOARD_MISSED_PONG_TOLERANCE"))
+		if err != nil || pongTolerance < 0 {
+			pongTolerance = 0
+		}
+	}
+
+	maxClientsPerIP := cfg.clientsPerIPFlag
+	if maxClientsPerIP <= 0 {
+		var err error
+		maxClientsPerIP, err = strconv.Atoi(os.Getenv("TVCLIPBOARD_MAX_CLIENTS_PER_IP"))
+		if err != nil || maxClientsPerIP < 0 {
+			maxClientsPerIP = 0
+		}
+	}
+
+	adminToken := cfg.adminTokenFlag
+	if adminToken == "" {
+		adminToken = os.Getenv("TVCLIPBOARD_ADMIN_TOKEN")
+	}
+
+	persistLast := cfg.persistLastFlag
+	if persistLast == "" {
+		persistLast = os.Getenv("TVCLIPBOARD_PERSIST_LAST")
+	}
+
+	noCacheBust := cfg.noCacheBustFlag
+	if !noCacheBust {
+		noCacheBust, _ = strconv.ParseBool(os.Getenv("TVCLIPBOARD_NO_CACHE_BUST"))
+	}
+
+	handshakeTimeout := cfg.handshakeFlag
+	if handshakeTimeout <= 0 {
+		var err error
+		handshakeTimeout, err = time.ParseDuration(os.Getenv("TVCLIPBOARD_HANDSHAKE_TIMEOUT"))
+		if err != nil || handshakeTimeout <= 0 {
+			handshakeTimeout = DefaultHandshakeTimeout
+		}
+	}
+
+	firstMessageTimeout := cfg.firstMessageFlag
+	if firstMessageTimeout <= 0 {
+		var err error
+		firstMessageTimeout, err = time.ParseDuration(os.Getenv("TVCLIPBOARD_FIRST_MESSAGE_TIMEOUT"))
+		if err != nil || firstMessageTimeout < 0 {
+			firstMessageTimeout = 0
+		}
+	}
+
+	typeRateEntries := []string(cfg.typeRateFlag)
+	if len(typeRateEntries) == 0 {
+		typeRateEntries = splitList(os.Getenv("TVCLIPBOARD_TYPE_RATE_LIMITS"))
+	}
+	typeRateLimits := parseTypeRateLimits(typeRateEntries)
+
+	maxChunkedSize := sizeKB(cfg.chunkedSizeFlag, "TVCLIPBOARD_MAX_CHUNKED_SIZE", 0)
+
+	chunkTimeout := cfg.chunkTimeoutFlag
+	if chunkTimeout <= 0 {
+		var err error
+		chunkTimeout, err = time.ParseDuration(os.Getenv("TVCLIPBOARD_CHUNK_TIMEOUT"))
+		if err != nil || chunkTimeout <= 0 {
+			chunkTimeout = 30 * time.Second
+		}
+	}
+
+	strictLang := cfg.strictLangFlag
+	if !strictLang {
+		strictLang, _ = strconv.ParseBool(os.Getenv("TVCLIPBOARD_STRICT_LANG"))
+	}
+
+	inlineQR := cfg.inlineQRFlag
+	if !inlineQR {
+		inlineQR, _ = strconv.ParseBool(os.Getenv("TVCLIPBOARD_INLINE_QR"))
+	}
+
+	// 0 leaves the token manager's default, the session timeout
+	maxTokenTTL := cfg.maxTokenTTLFlag
+	if maxTokenTTL <= 0 {
+		maxTokenTTL, _ = time.ParseDuration(os.Getenv("TVCLIPBOARD_MAX_TOKEN_TTL"))
+		maxTokenTTL = max(maxTokenTTL, 0)
+	}
+
+	reconnectGrace := cfg.reconnectFlag
+	if reconnectGrace < 0 {
+		var err error
+		reconnectGrace, err = time.ParseDuration(os.Getenv("TVCLIPBOARD_RECONNECT_GRACE"))
+		if err != nil || reconnectGrace < 0 {
+			reconnectGrace = DefaultReconnectGrace
+		}
+	}
+
+	requireKey := cfg.requireKeyFlag
+	if !requireKey {
+		requireKey, _ = strconv.ParseBool(os.Getenv("TVCLIPBOARD_REQUIRE_KEY"))
+	}
+
 	localIP := getLocalIP()
-	allowedOrigins := parseAllowedOrigins(publicURL, localIP)
+	allowedOrigins := mergeAllowedOrigins(parseAllowedOrigins(publicURL, localIP), splitList(originsStr), originsMode)
 
 	// Set language (default to en if not specified)
 	lang := cfg.langFlag
 	if lang == "" {
 		lang = os.Getenv("TVCLIPBOARD_LANGUAGE")
+		if lang == "" {
+			lang = os.Getenv("TVCLIPBOARD_LANG")
+		}
 		if lang == "" {
 			lang = "en"
 		}
@@ -123,7 +737,7 @@ func Load() *Config {
 	config := &Config{
 		Port:            port,
 		PublicURL:       publicURL,
-		SessionTimeout:  time.Duration(timeoutMinutes) * time.Minute,
+		SessionTimeout:  sessionTimeout,
 		PrivateKeyHex:   privateKeyHex,
 		LocalIP:         localIP,
 		showHelp:        cfg.helpFlag,
@@ -131,27 +745,341 @@ func Load() *Config {
 		RateLimitPerSec: rateLimit,
 		AllowedOrigins:  allowedOrigins,
 		Language:        lang,
+		GenKey:          cfg.genKeyFlag || flag.Arg(0) == "genkey",
+		Command:         flag.Arg(0),
+		RequireKey:      requireKey,
+		GlobalRateLimit: globalRateLimit,
+		HandlerTimeout:  handlerTimeout,
+		AllowedHosts:    splitList(allowedHostsStr),
+		DefaultTheme:    theme,
+		MaxActiveTokens: maxActiveTokens,
+
+		TokenCleanupInterval: cleanupInterval,
+		HistorySize:          historySize,
+		UnixSocket:           unixSocket,
+		UnixSocketStrict:     unixStrict,
+		MaxMessageSizeHost:   int64(hostMessageSize) * 1024,
+		MaxMessageSizeClient: int64(clientMessageSize) * 1024,
+		SessionTitle:         sessionTitle,
+		MaxTokenLength:       maxTokenLength,
+		Presence:             presence,
+		AllowUnknownTypes:    allowUnknownTypes,
+		FixedHost:            fixedHost,
+		MaxTextRunes:         maxTextRunes,
+		AllowCIDRs:           allowCIDRs,
+		E2EOnly:              e2eOnly,
+		LogContent:           logContent,
+		PrivateKeyFile:       privateKeyFile,
+		PrivateKeys:          privateKeys,
+		Open:                 openBrowser,
+		AutoClientRedirect:   autoClientRedirect,
+		AuditLog:             auditLog,
+		StrictOrigins:        strictOrigins,
+
+		MaxSessionLifetime:           maxSessionLifetime,
+		MaxSessionLifetimeExemptHost: lifetimeExemptHost,
+		EnableDebugWS:                debugWS,
+		WSPath:                       wsPath,
+		HostSecret:                   hostSecret,
+		JoinApproval:                 joinApproval,
+		JoinApprovalTimeout:          joinTimeout,
+		MaxMessagesPerConnection:     maxMessagesPerConn,
+		NoHost:                       noHost,
+		PauseQueueSize:               pauseQueueSize,
+		MessageWarnRatio:             warnRatio,
+		MissedPongTolerance:          pongTolerance,
+		MaxClientsPerIP:              maxClientsPerIP,
+		AdminToken:                   adminToken,
+		PersistLast:                  persistLast,
+		NoCacheBust:                  noCacheBust,
+		HandshakeTimeout:             handshakeTimeout,
+		FirstMessageTimeout:          firstMessageTimeout,
+		TypeRateLimits:               typeRateLimits,
+		MaxChunkedSize:               int64(maxChunkedSize) * 1024,
+		ChunkTimeout:                 chunkTimeout,
+		StrictLanguage:               strictLang,
+		InlineQR:                     inlineQR,
+		MaxTokenTTL:                  maxTokenTTL,
+		ReconnectGrace:               reconnectGrace,
+	}
+
+	if flag.NArg() > 1 {
+		config.CommandArgs = flag.Args()[1:]
+	}
+
+	config.Features = features.Set{
+		History:      config.HistorySize > 0,
+		Presence:     config.Presence,
+		E2EOnly:      config.E2EOnly,
+		FixedHost:    config.FixedHost,
+		NoHost:       config.NoHost,
+		JoinApproval: config.JoinApproval,
+		UnknownTypes: config.AllowUnknownTypes,
+		Chunking:     config.MaxChunkedSize > 0,
+		DebugWS:      config.EnableDebugWS,
+		InlineQR:     config.InlineQR,
 	}
 
 	return config
 }
 
+// sizeKB returns a size in KB from the CLI flag, then the env var, then the fallback
+func sizeKB(flagValue int, envVar string, fallback int) int {
+	if flagValue > 0 {
+		return flagValue
+	}
+	if size, err := strconv.Atoi(os.Getenv(envVar)); err == nil && size > 0 {
+		return size
+	}
+	return fallback
+}
+
 // printUsage displays help information
 func printUsage() {
 	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
 	fmt.Fprintf(os.Stderr, "\nOptions:\n")
 	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "\nCommands:\n")
+	fmt.Fprintf(os.Stderr, "  genkey                      Print a new private key and exit\n")
+	fmt.Fprintf(os.Stderr, "  connect <session-url>       Send the local clipboard to a session (see: connect --help)\n")
 	fmt.Fprintf(os.Stderr, "\nEnvironment Variables:\n")
-	fmt.Fprintf(os.Stderr, "  PORT                        Server port (default: 3333)\n")
+	fmt.Fprintf(os.Stderr, "  PORT                        Server port, 0 picks a free one (default: 3333)\n")
 	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_PUBLIC_URL      Public base URL for QR codes (default: auto-detected local IP)\n")
-	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_SESSION_TIMEOUT  Session timeout in minutes (default: 10)\n")
+	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_SESSION_TIMEOUT  Session timeout in minutes or as a duration like 1h30m (default: 10)\n")
 	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_PRIVATE_KEY      Private key hex string (auto-generated if not set)\n")
+	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_PRIVATE_KEY_FILE File containing the private key, hex or 32 raw bytes\n")
+	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_PRIVATE_KEYS     Comma-separated hex keys also accepted when decrypting tokens\n")
+	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_REQUIRE_KEY      Fail startup without a valid private key (default: false)\n")
 	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_MAX_MESSAGE_SIZE  Maximum message size in KB (default: 1)\n")
+	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_MAX_MESSAGE_SIZE_HOST Maximum message size in KB for the host (default: max message size)\n")
+	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_MAX_MESSAGE_SIZE_CLIENT Maximum message size in KB for clients (default: max message size)\n")
 	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_RATE_LIMIT       Messages per second per client (default: 4)\n")
-	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_LANGUAGE          Language code (default: en)\n")
+	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_TYPE_RATE_LIMITS Per-type messages per second per client, e.g. typing=20,text=2 (default: none)\n")
+	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_GLOBAL_RATE_LIMIT Messages per second across all clients (default: 0, disabled)\n")
+	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_HANDLER_TIMEOUT  Timeout for page, QR and i18n handlers (default: 5s)\n")
+	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_ALLOWED_ORIGINS  Comma-separated WebSocket origins, replacing the derived ones (default: derived)\n")
+	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_ORIGINS_MODE     replace or append explicit origins to the derived ones (default: replace)\n")
+	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_ALLOWED_HOSTS    Comma-separated Host headers accepted for WebSocket upgrades (default: any)\n")
+	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_DEFAULT_THEME    Theme hint for pages: light, dark or auto (default: auto)\n")
+	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_MAX_ACTIVE_TOKENS Maximum active session tokens (default: 10000)\n")
+	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_MAX_TOKEN_TTL    Longest lifetime /qrcode.png?ttl= may give a token (default: session timeout)\n")
+	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_RECONNECT_GRACE  How long a dropped client may rejoin with its reconnect token, 0 disables (default: 2m)\n")
+	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_TOKEN_CLEANUP_INTERVAL How often expired tokens are purged (default: min(timeout/2, 1m))\n")
+	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_HISTORY_SIZE     Recent messages kept for /api/history, 0 disables (default: 20)\n")
+	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_UNIX_SOCKET      Also listen on this Unix socket path for local clients\n")
+	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_UNIX_SOCKET_STRICT Apply origin and token checks to Unix socket connections (default: false)\n")
+	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_MAX_TOKEN_LENGTH Longest token accepted on the WebSocket handshake (default: 256)\n")
+	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_PRESENCE         Broadcast join/leave presence updates (default: false)\n")
+	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_ALLOW_UNKNOWN_TYPES Forward unrecognized message types (default: false)\n")
+	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_FIXED_HOST       Never promote a client when the host disconnects (default: false)\n")
+	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_MAX_TEXT_RUNES   Longest text message in characters (default: 0, no limit)\n")
+	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_ALLOW_CIDR       Comma-separated client networks allowed to connect (default: all)\n")
+	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_E2E_ONLY         Reject plaintext messages, relay only end-to-end encrypted ones (default: false)\n")
+	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_OPEN             Open the host page in the default browser on startup (default: false)\n")
+	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_AUTO_CLIENT_REDIRECT Redirect / to the client page when a host is connected (default: false)\n")
+	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_AUDIT_LOG        File to append security events to as JSON lines (default: none)\n")
+	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_MAX_SESSION_LIFETIME Close clients connected longer than this duration (default: 0, disabled)\n")
+	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_MAX_SESSION_LIFETIME_EXEMPT_HOST Keep the host past the max session lifetime (default: false)\n")
+	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_HOST_SECRET      Connections with ?host_secret=<value> always become host\n")
+	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_JOIN_APPROVAL    Hold new clients until the host approves them (default: false)\n")
+	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_JOIN_APPROVAL_TIMEOUT Deny unanswered join requests after this duration (default: 30s)\n")
+	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_MAX_MESSAGES_PER_CONNECTION Disconnect a client after this many messages (default: 0, no limit)\n")
+	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_NO_HOST          Every connection needs a token and none becomes host (default: false)\n")
+	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_PAUSE_QUEUE_SIZE Messages held while the host is paused (default: 50)\n")
+	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_MESSAGE_WARN_RATIO Warn senders above this share of the size limit (default: 0.8)\n")
+	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_MISSED_PONG_TOLERANCE Consecutive missed pongs tolerated before closing (default: 0, disabled)\n")
+	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_MAX_CLIENTS_PER_IP Most clients one IP may have connected to a room (default: 0, no limit)\n")
+	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_ADMIN_TOKEN      Bearer token that enables POST /api/maintenance, /api/announce, /api/tokens, /api/clients and /metrics\n")
+	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_PERSIST_LAST     File the last text message is saved to and restored from after a restart\n")
+	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_NO_CACHE_BUST    Don't add ?v=<version> to static asset URLs (default: false)\n")
+	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_HANDSHAKE_TIMEOUT Longest a connection may take to send its request headers (default: 5s)\n")
+	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_FIRST_MESSAGE_TIMEOUT Close WebSocket clients silent this long after connecting (default: disabled)\n")
+	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_MAX_CHUNKED_SIZE Largest message sent in chunks in KB (default: 0, disabled)\n")
+	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_CHUNK_TIMEOUT    Drop chunked transfers not completed within this long (default: 30s)\n")
+	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_INLINE_QR        Embed the QR codes in the host page instead of loading /qrcode.png (default: false)\n")
+	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_WS_PATH          Path of the WebSocket endpoint (default: /ws)\n")
+	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_ENABLE_DEBUG_WS  Serve /ws?mode=debug echo connections for proxy testing (default: false)\n")
+	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_STRICT_ORIGINS   Deny cross-origin WebSocket upgrades without an explicit allowlist (default: false)\n")
+	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_LOG_CONTENT      Include truncated message content in logs (default: false)\n")
+	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_SESSION_TITLE    Initial session title shown to clients\n")
+	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_LANGUAGE          Language code, TVCLIPBOARD_LANG also works (default: en)\n")
+	fmt.Fprintf(os.Stderr, "  TVCLIPBOARD_STRICT_LANG       Refuse to start with a language that has no translations (default: false)\n")
 	fmt.Fprintf(os.Stderr, "\nCLI flags override environment variables.\n")
 }
 
+// PrintGeneratedKey writes a freshly generated private key to w
+// The output is suitable for TVCLIPBOARD_PRIVATE_KEY or --key
+func PrintGeneratedKey(w io.Writer) error {
+	key, err := token.GeneratePrivateKey()
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, key)
+	return err
+}
+
+// ResolvePrivateKey returns the configured private key, or a random one if none is usable
+// When RequireKey is set, a missing or invalid key is an error instead
+// Precedence: PrivateKeyHex, then PrivateKeyFile, then a generated key
+func (c *Config) ResolvePrivateKey() ([]byte, error) {
+	if c.PrivateKeyHex == "" && c.PrivateKeyFile != "" {
+		return readKeyFile(c.PrivateKeyFile)
+	}
+	if c.PrivateKeyHex == "" {
+		if c.RequireKey {
+			return nil, fmt.Errorf("private key required: set TVCLIPBOARD_PRIVATE_KEY, --key or --key-file (generate one with: tvclipboard genkey)")
+		}
+		log.Printf("WARNING: no private key configured, using a random key. Tokens will not survive restarts and cannot be shared between instances. Generate one with: tvclipboard genkey")
+		return generateKey()
+	}
+
+	key, err := token.ParsePrivateKey(c.PrivateKeyHex)
+	if err != nil {
+		if c.RequireKey {
+			return nil, fmt.Errorf("private key required: %w", err)
+		}
+		log.Printf("WARNING: %v, using a random key instead. Tokens will not survive restarts", err)
+		return generateKey()
+	}
+	return key, nil
+}
+
+// ResolvePrivateKeys returns the token keys, the one that encrypts first
+// That is the key from ResolvePrivateKey followed by PrivateKeys, or just PrivateKeys when
+// neither PrivateKeyHex nor PrivateKeyFile is set. An invalid entry in PrivateKeys is always an error
+func (c *Config) ResolvePrivateKeys() ([][]byte, error) {
+	var extra [][]byte
+	for i, keyHex := range c.PrivateKeys {
+		key, err := token.ParsePrivateKey(keyHex)
+		if err != nil {
+			return nil, fmt.Errorf("--keys entry %d: %w", i+1, err)
+		}
+		extra = append(extra, key)
+	}
+	if c.PrivateKeyHex == "" && c.PrivateKeyFile == "" && len(extra) > 0 {
+		return extra, nil
+	}
+
+	primary, err := c.ResolvePrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	keys := [][]byte{primary}
+	for _, key := range extra {
+		if !slices.ContainsFunc(keys, func(k []byte) bool { return bytes.Equal(k, key) }) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// ParseAllowedCIDRs parses AllowCIDRs, returning nil when every client is allowed
+// Bare IPs are accepted as single-host networks, and loopback is always included so the local host can connect
+func (c *Config) ParseAllowedCIDRs() ([]*net.IPNet, error) {
+	if len(c.AllowCIDRs) == 0 {
+		return nil, nil
+	}
+	var nets []*net.IPNet
+	for _, entry := range append([]string{"127.0.0.0/8", "::1/128"}, c.AllowCIDRs...) {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid --allow-cidr entry %q", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --allow-cidr entry %q: %w", entry, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// readKeyFile reads a private key stored as hex or as raw bytes
+// A configured but unreadable or invalid file is always an error
+func readKeyFile(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("private key file: %w", err)
+	}
+	if info.Mode().Perm()&0o004 != 0 {
+		log.Printf("WARNING: private key file %s is world-readable, restrict it with: chmod 600 %s", path, path)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("private key file: %w", err)
+	}
+	if len(data) == token.PrivateKeySize {
+		return data, nil
+	}
+	key, err := token.ParsePrivateKey(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("private key file %s: %w", path, err)
+	}
+	return key, nil
+}
+
+// generateKey returns a new random private key as raw bytes
+func generateKey() ([]byte, error) {
+	keyHex, err := token.GeneratePrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	return token.ParsePrivateKey(keyHex)
+}
+
+// parseSessionTimeout parses a bare number of minutes or a Go duration string (e.g. 90s, 1h30m)
+// It reports false for empty, invalid or non-positive values
+func parseSessionTimeout(s string) (time.Duration, bool) {
+	s = strings.TrimSpace(s)
+	if minutes, err := strconv.Atoi(s); err == nil {
+		return time.Duration(minutes) * time.Minute, minutes > 0
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, false
+	}
+	return d, true
+}
+
+// parseTypeRateLimits parses type=limit entries, skipping malformed ones with a warning
+func parseTypeRateLimits(entries []string) map[string]int {
+	if len(entries) == 0 {
+		return nil
+	}
+	limits := make(map[string]int, len(entries))
+	for _, entry := range entries {
+		msgType, value, ok := strings.Cut(entry, "=")
+		msgType = strings.TrimSpace(msgType)
+		perSec, err := strconv.Atoi(strings.TrimSpace(value))
+		if !ok || msgType == "" || err != nil || perSec <= 0 {
+			log.Printf("Ignoring invalid type rate limit %q, expected type=limit with a positive limit", entry)
+			continue
+		}
+		limits[msgType] = perSec
+	}
+	return limits
+}
+
+// splitList splits a comma-separated list, dropping empty entries
+func splitList(s string) []string {
+	var items []string
+	for item := range strings.SplitSeq(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 // getLocalIP returns the local IP address
 func getLocalIP() string {
 	addrs, err := net.InterfaceAddrs()
@@ -199,6 +1127,30 @@ func (c *Config) GetQRScheme() string {
 	return "http"
 }
 
+// How explicitly configured origins combine with the derived ones
+const (
+	OriginsReplace = "replace" // Only the explicit origins are allowed
+	OriginsAppend  = "append"  // The explicit origins are allowed alongside the derived ones
+)
+
+// mergeAllowedOrigins combines the derived origins with explicit ones according to mode
+// Without explicit origins the derived ones are used unchanged
+func mergeAllowedOrigins(derived, explicit []string, mode string) []string {
+	if len(explicit) == 0 {
+		return derived
+	}
+	if mode != OriginsAppend {
+		return explicit
+	}
+	origins := slices.Clone(derived)
+	for _, origin := range explicit {
+		if !slices.Contains(origins, origin) {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
+
 // parseAllowedOrigins determines allowed CORS origins from config
 func parseAllowedOrigins(publicURL string, localIP string) []string {
 	origins := []string{"http://localhost:*", "http://127.0.0.1:*", "http://[::1]:*", "http://0.0.0.0:*"}
@@ -225,10 +1177,23 @@ func parseAllowedOrigins(publicURL string, localIP string) []string {
 	return origins
 }
 
+// Listen opens the TCP listener on Port and records the port actually bound
+// With --port 0 the OS picks a free port, so call this before building QR URLs or logging startup
+func (c *Config) Listen() (net.Listener, error) {
+	listener, err := net.Listen("tcp", ":"+c.Port)
+	if err != nil {
+		return nil, err
+	}
+	if addr, ok := listener.Addr().(*net.TCPAddr); ok {
+		c.Port = strconv.Itoa(addr.Port)
+	}
+	return listener, nil
+}
+
 // LogStartup logs the server startup information
 func (c *Config) LogStartup() {
 	log.Printf("Server starting on port %s\n", c.Port)
-	log.Printf("Session timeout: %v minutes\n", int(c.SessionTimeout.Minutes()))
+	log.Printf("Session timeout: %v\n", c.SessionTimeout)
 	log.Printf("Local access: http://localhost:%s\n", c.Port)
 
 	if c.PublicURL != "" {
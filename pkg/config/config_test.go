@@ -1,10 +1,20 @@
 package config
 
 import (
+	"bytes"
+	"encoding/hex"
 	"flag"
+	"log"
+	"net"
 	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
 	"testing"
 	"time"
+
+	"tvclipboard/pkg/features"
 )
 
 func TestLoadDefaults(t *testing.T) {
@@ -260,3 +270,950 @@ func TestGetQRHostPublicURLPort80(t *testing.T) {
 		t.Errorf("Expected GetQRHost to return example.com:80, got %s", cfg.GetQRHost())
 	}
 }
+
+func TestGenKeyFlag(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+
+	oldArgs := os.Args
+	os.Args = []string{"tvclipboard", "--genkey"}
+	defer func() { os.Args = oldArgs }()
+
+	cfg := Load()
+
+	if !cfg.GenKey {
+		t.Fatal("Expected GenKey to be set by --genkey")
+	}
+
+	var buf bytes.Buffer
+	if err := PrintGeneratedKey(&buf); err != nil {
+		t.Fatalf("PrintGeneratedKey failed: %v", err)
+	}
+
+	key := strings.TrimSpace(buf.String())
+	if len(key) != 64 {
+		t.Errorf("Expected 64-char hex key, got %d chars: %s", len(key), key)
+	}
+	if _, err := hex.DecodeString(key); err != nil {
+		t.Errorf("Expected valid hex key, got %s: %v", key, err)
+	}
+}
+
+func TestGenKeySubcommand(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+
+	oldArgs := os.Args
+	os.Args = []string{"tvclipboard", "genkey"}
+	defer func() { os.Args = oldArgs }()
+
+	cfg := Load()
+
+	if !cfg.GenKey {
+		t.Error("Expected GenKey to be set by genkey subcommand")
+	}
+}
+
+func TestResolvePrivateKeyValid(t *testing.T) {
+	keyHex := strings.Repeat("ab", 32)
+	cfg := &Config{PrivateKeyHex: keyHex, RequireKey: true}
+
+	key, err := cfg.ResolvePrivateKey()
+	if err != nil {
+		t.Fatalf("Expected valid key to resolve, got: %v", err)
+	}
+	if hex.EncodeToString(key) != keyHex {
+		t.Errorf("Expected resolved key to match configured key")
+	}
+}
+
+func TestResolvePrivateKeyRequired(t *testing.T) {
+	tests := []struct {
+		name   string
+		keyHex string
+	}{
+		{"missing key", ""},
+		{"invalid hex", "not-a-hex-key"},
+		{"wrong size", "deadbeef"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{PrivateKeyHex: tt.keyHex, RequireKey: true}
+			if _, err := cfg.ResolvePrivateKey(); err == nil {
+				t.Error("Expected error when key is required but not valid")
+			}
+		})
+	}
+}
+
+func TestResolvePrivateKeyWarnings(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	tests := []struct {
+		name     string
+		keyHex   string
+		wantWarn string
+	}{
+		{"missing key", "", "no private key configured"},
+		{"invalid key", "deadbeef", "invalid private key size"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf.Reset()
+			cfg := &Config{PrivateKeyHex: tt.keyHex}
+
+			key, err := cfg.ResolvePrivateKey()
+			if err != nil {
+				t.Fatalf("Expected random key fallback, got error: %v", err)
+			}
+			if len(key) != 32 {
+				t.Errorf("Expected 32-byte fallback key, got %d bytes", len(key))
+			}
+			if !strings.Contains(buf.String(), "WARNING") || !strings.Contains(buf.String(), tt.wantWarn) {
+				t.Errorf("Expected warning containing %q, got: %s", tt.wantWarn, buf.String())
+			}
+		})
+	}
+}
+
+func TestResolvePrivateKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	keyHex := strings.Repeat("cd", 32)
+
+	hexFile := filepath.Join(dir, "key.hex")
+	if err := os.WriteFile(hexFile, []byte(keyHex+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	key, err := (&Config{PrivateKeyFile: hexFile}).ResolvePrivateKey()
+	if err != nil {
+		t.Fatalf("Expected hex key file to resolve, got: %v", err)
+	}
+	if hex.EncodeToString(key) != keyHex {
+		t.Errorf("Expected key from hex file")
+	}
+
+	raw := bytes.Repeat([]byte{0x01}, 32)
+	rawFile := filepath.Join(dir, "key.bin")
+	if err := os.WriteFile(rawFile, raw, 0600); err != nil {
+		t.Fatal(err)
+	}
+	key, err = (&Config{PrivateKeyFile: rawFile}).ResolvePrivateKey()
+	if err != nil {
+		t.Fatalf("Expected raw key file to resolve, got: %v", err)
+	}
+	if !bytes.Equal(key, raw) {
+		t.Errorf("Expected key from raw file")
+	}
+
+	// An explicit key string wins over the file
+	key, err = (&Config{PrivateKeyHex: strings.Repeat("ef", 32), PrivateKeyFile: hexFile}).ResolvePrivateKey()
+	if err != nil || hex.EncodeToString(key) != strings.Repeat("ef", 32) {
+		t.Errorf("Expected key string to take precedence over key file, got %x, %v", key, err)
+	}
+
+	if _, err := (&Config{PrivateKeyFile: filepath.Join(dir, "missing")}).ResolvePrivateKey(); err == nil {
+		t.Error("Expected error for missing key file")
+	}
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	if err := os.Chmod(hexFile, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&Config{PrivateKeyFile: hexFile}).ResolvePrivateKey(); err != nil {
+		t.Fatalf("Expected world-readable key file to resolve, got: %v", err)
+	}
+	if !strings.Contains(buf.String(), "world-readable") {
+		t.Errorf("Expected world-readable warning, got: %s", buf.String())
+	}
+}
+
+func TestRequireKeyFlag(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+
+	oldArgs := os.Args
+	os.Args = []string{"tvclipboard", "--require-key"}
+	defer func() { os.Args = oldArgs }()
+
+	cfg := Load()
+
+	if !cfg.RequireKey {
+		t.Error("Expected RequireKey to be set by --require-key")
+	}
+}
+
+func TestHandlerTimeout(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	os.Unsetenv("TVCLIPBOARD_HANDLER_TIMEOUT")
+
+	if cfg := Load(); cfg.HandlerTimeout != 5*time.Second {
+		t.Errorf("Expected default handler timeout 5s, got %v", cfg.HandlerTimeout)
+	}
+
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	oldArgs := os.Args
+	os.Args = []string{"tvclipboard", "--handler-timeout", "2s"}
+	defer func() { os.Args = oldArgs }()
+
+	if cfg := Load(); cfg.HandlerTimeout != 2*time.Second {
+		t.Errorf("Expected handler timeout 2s from CLI, got %v", cfg.HandlerTimeout)
+	}
+}
+
+func TestAllowedHosts(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	os.Setenv("TVCLIPBOARD_ALLOWED_HOSTS", "tv.local, example.com:3333,,")
+	defer os.Unsetenv("TVCLIPBOARD_ALLOWED_HOSTS")
+
+	cfg := Load()
+
+	if len(cfg.AllowedHosts) != 2 || cfg.AllowedHosts[0] != "tv.local" || cfg.AllowedHosts[1] != "example.com:3333" {
+		t.Errorf("Expected [tv.local example.com:3333], got %v", cfg.AllowedHosts)
+	}
+}
+
+func TestTokenCleanupInterval(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want time.Duration
+	}{
+		{"default capped at 1m", []string{"tvclipboard"}, time.Minute},
+		{"default half of short timeout", []string{"tvclipboard", "--expires", "1"}, 30 * time.Second},
+		{"explicit interval", []string{"tvclipboard", "--token-cleanup-interval", "5s"}, 5 * time.Second},
+		{"non-positive falls back", []string{"tvclipboard", "--token-cleanup-interval", "-5s"}, time.Minute},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+			os.Unsetenv("TVCLIPBOARD_SESSION_TIMEOUT")
+			oldArgs := os.Args
+			os.Args = tt.args
+			defer func() { os.Args = oldArgs }()
+
+			if cfg := Load(); cfg.TokenCleanupInterval != tt.want {
+				t.Errorf("Expected cleanup interval %v, got %v", tt.want, cfg.TokenCleanupInterval)
+			}
+		})
+	}
+}
+
+func TestCommandArgs(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+
+	oldArgs := os.Args
+	os.Args = []string{"tvclipboard", "connect", "--receive", "http://tv.local:3333?token=abc"}
+	defer func() { os.Args = oldArgs }()
+
+	cfg := Load()
+
+	if cfg.Command != "connect" {
+		t.Errorf("Expected command connect, got %q", cfg.Command)
+	}
+	if len(cfg.CommandArgs) != 2 || cfg.CommandArgs[0] != "--receive" {
+		t.Errorf("Expected subcommand args to be preserved, got %v", cfg.CommandArgs)
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	os.Setenv("TVCLIPBOARD_UNIX_SOCKET", "/tmp/env.sock")
+	defer os.Unsetenv("TVCLIPBOARD_UNIX_SOCKET")
+
+	oldArgs := os.Args
+	os.Args = []string{"tvclipboard", "--unix-socket", "/run/tvclipboard.sock", "--unix-socket-strict"}
+	defer func() { os.Args = oldArgs }()
+
+	cfg := Load()
+
+	if cfg.UnixSocket != "/run/tvclipboard.sock" {
+		t.Errorf("Expected CLI socket path to override env, got %q", cfg.UnixSocket)
+	}
+	if !cfg.UnixSocketStrict {
+		t.Error("Expected strict Unix socket mode to be enabled")
+	}
+}
+
+func TestMessageSizePerRole(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	os.Setenv("TVCLIPBOARD_MAX_MESSAGE_SIZE_CLIENT", "4")
+	defer os.Unsetenv("TVCLIPBOARD_MAX_MESSAGE_SIZE_CLIENT")
+
+	oldArgs := os.Args
+	os.Args = []string{"tvclipboard", "--max-message-size", "2", "--max-message-size-host", "64"}
+	defer func() { os.Args = oldArgs }()
+
+	cfg := Load()
+
+	if cfg.MaxMessageSizeHost != 64*1024 {
+		t.Errorf("Expected host limit 64KB from CLI, got %d", cfg.MaxMessageSizeHost)
+	}
+	if cfg.MaxMessageSizeClient != 4*1024 {
+		t.Errorf("Expected client limit 4KB from env, got %d", cfg.MaxMessageSizeClient)
+	}
+
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	os.Unsetenv("TVCLIPBOARD_MAX_MESSAGE_SIZE_CLIENT")
+	os.Args = []string{"tvclipboard", "--max-message-size", "2"}
+
+	cfg = Load()
+
+	if cfg.MaxMessageSizeHost != 2*1024 || cfg.MaxMessageSizeClient != 2*1024 {
+		t.Errorf("Expected both limits to default to 2KB, got host=%d client=%d", cfg.MaxMessageSizeHost, cfg.MaxMessageSizeClient)
+	}
+}
+
+func TestSessionTitle(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	os.Setenv("TVCLIPBOARD_SESSION_TITLE", "Bedroom TV")
+	defer os.Unsetenv("TVCLIPBOARD_SESSION_TITLE")
+
+	if cfg := Load(); cfg.SessionTitle != "Bedroom TV" {
+		t.Errorf("Expected session title from env, got %q", cfg.SessionTitle)
+	}
+
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	oldArgs := os.Args
+	os.Args = []string{"tvclipboard", "--session-title", "Living Room TV"}
+	defer func() { os.Args = oldArgs }()
+
+	if cfg := Load(); cfg.SessionTitle != "Living Room TV" {
+		t.Errorf("Expected CLI session title to override env, got %q", cfg.SessionTitle)
+	}
+}
+
+func TestMaxTokenLength(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	oldArgs := os.Args
+	os.Args = []string{"tvclipboard", "--max-token-length", "64"}
+	defer func() { os.Args = oldArgs }()
+
+	if cfg := Load(); cfg.MaxTokenLength != 64 {
+		t.Errorf("Expected max token length 64, got %d", cfg.MaxTokenLength)
+	}
+
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	os.Args = []string{"tvclipboard"}
+	if cfg := Load(); cfg.MaxTokenLength != 256 {
+		t.Errorf("Expected default max token length 256, got %d", cfg.MaxTokenLength)
+	}
+}
+
+func TestPresence(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	os.Setenv("TVCLIPBOARD_PRESENCE", "true")
+	defer os.Unsetenv("TVCLIPBOARD_PRESENCE")
+
+	if cfg := Load(); !cfg.Presence {
+		t.Error("Expected presence to be enabled from env")
+	}
+}
+
+func TestAllowUnknownTypes(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	oldArgs := os.Args
+	os.Args = []string{"tvclipboard", "--allow-unknown-types"}
+	defer func() { os.Args = oldArgs }()
+
+	if cfg := Load(); !cfg.AllowUnknownTypes {
+		t.Error("Expected unknown types to be allowed from CLI")
+	}
+}
+
+func TestFixedHost(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	os.Setenv("TVCLIPBOARD_FIXED_HOST", "1")
+	defer os.Unsetenv("TVCLIPBOARD_FIXED_HOST")
+
+	if cfg := Load(); !cfg.FixedHost {
+		t.Error("Expected fixed host mode from env")
+	}
+}
+
+func TestMaxTextRunes(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	oldArgs := os.Args
+	os.Args = []string{"tvclipboard", "--max-text-runes", "500"}
+	defer func() { os.Args = oldArgs }()
+
+	if cfg := Load(); cfg.MaxTextRunes != 500 {
+		t.Errorf("Expected max text runes 500, got %d", cfg.MaxTextRunes)
+	}
+
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	os.Args = []string{"tvclipboard"}
+	if cfg := Load(); cfg.MaxTextRunes != 0 {
+		t.Errorf("Expected text rune limit disabled by default, got %d", cfg.MaxTextRunes)
+	}
+}
+
+func TestAllowCIDR(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	oldArgs := os.Args
+	os.Args = []string{"tvclipboard", "--allow-cidr", "192.168.1.0/24", "--allow-cidr", "10.0.0.5"}
+	defer func() { os.Args = oldArgs }()
+
+	cfg := Load()
+	if len(cfg.AllowCIDRs) != 2 {
+		t.Fatalf("Expected 2 CIDRs from repeated flag, got %v", cfg.AllowCIDRs)
+	}
+	nets, err := cfg.ParseAllowedCIDRs()
+	if err != nil {
+		t.Fatalf("Expected valid CIDRs, got %v", err)
+	}
+	for _, ip := range []string{"192.168.1.7", "10.0.0.5", "127.0.0.1", "::1"} {
+		if !containsIP(nets, ip) {
+			t.Errorf("Expected %s to be allowed", ip)
+		}
+	}
+	if containsIP(nets, "10.0.0.6") {
+		t.Error("Expected 10.0.0.6 to be denied")
+	}
+
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	os.Args = []string{"tvclipboard"}
+	cfg = Load()
+	if nets, err := cfg.ParseAllowedCIDRs(); err != nil || nets != nil {
+		t.Errorf("Expected no CIDR restriction by default, got %v, %v", nets, err)
+	}
+
+	cfg.AllowCIDRs = []string{"192.168.1.0/33"}
+	if _, err := cfg.ParseAllowedCIDRs(); err == nil {
+		t.Error("Expected error for malformed CIDR")
+	}
+	cfg.AllowCIDRs = []string{"not-an-ip"}
+	if _, err := cfg.ParseAllowedCIDRs(); err == nil {
+		t.Error("Expected error for malformed IP")
+	}
+}
+
+func TestE2EOnly(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	os.Setenv("TVCLIPBOARD_E2E_ONLY", "true")
+	defer os.Unsetenv("TVCLIPBOARD_E2E_ONLY")
+
+	if cfg := Load(); !cfg.E2EOnly {
+		t.Error("Expected e2e-only mode from env")
+	}
+}
+
+func TestLogContent(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	oldArgs := os.Args
+	os.Args = []string{"tvclipboard"}
+	defer func() { os.Args = oldArgs }()
+
+	if cfg := Load(); cfg.LogContent {
+		t.Error("Expected content logging to be off by default")
+	}
+
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	os.Args = []string{"tvclipboard", "--log-content"}
+	if cfg := Load(); !cfg.LogContent {
+		t.Error("Expected content logging from CLI")
+	}
+}
+
+func TestSessionTimeoutDuration(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"10", 10 * time.Minute},
+		{"30s", 30 * time.Second},
+		{"1h", time.Hour},
+		{"1h30m", 90 * time.Minute},
+		{"soon", 10 * time.Minute},
+		{"-5m", 10 * time.Minute},
+		{"0", 10 * time.Minute},
+	}
+
+	oldArgs := os.Args
+	defer func() { os.Args = oldArgs }()
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+			os.Args = []string{"tvclipboard", "--expires", tt.value}
+			if cfg := Load(); cfg.SessionTimeout != tt.want {
+				t.Errorf("--expires %s: expected %v, got %v", tt.value, tt.want, cfg.SessionTimeout)
+			}
+		})
+	}
+
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	os.Args = []string{"tvclipboard"}
+	os.Setenv("TVCLIPBOARD_SESSION_TIMEOUT", "45s")
+	defer os.Unsetenv("TVCLIPBOARD_SESSION_TIMEOUT")
+	if cfg := Load(); cfg.SessionTimeout != 45*time.Second {
+		t.Errorf("Expected 45s from env, got %v", cfg.SessionTimeout)
+	}
+}
+
+func TestOpenBrowser(t *testing.T) {
+	t.Setenv("DISPLAY", ":0")
+
+	var opened []string
+	opener := func(url string) error {
+		opened = append(opened, url)
+		return nil
+	}
+
+	(&Config{Port: "4444"}).OpenBrowser(opener)
+	if len(opened) != 0 {
+		t.Fatalf("Expected no browser without --open, got %v", opened)
+	}
+
+	(&Config{Port: "4444", Open: true}).OpenBrowser(opener)
+	if len(opened) != 1 || opened[0] != "http://localhost:4444" {
+		t.Errorf("Expected opener called with host URL, got %v", opened)
+	}
+
+	if runtime.GOOS == "linux" {
+		t.Setenv("DISPLAY", "")
+		t.Setenv("WAYLAND_DISPLAY", "")
+		opened = nil
+		(&Config{Port: "4444", Open: true}).OpenBrowser(opener)
+		if len(opened) != 0 {
+			t.Errorf("Expected no browser on a headless machine, got %v", opened)
+		}
+	}
+}
+
+func TestAutoClientRedirect(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	os.Setenv("TVCLIPBOARD_AUTO_CLIENT_REDIRECT", "true")
+	defer os.Unsetenv("TVCLIPBOARD_AUTO_CLIENT_REDIRECT")
+
+	if cfg := Load(); !cfg.AutoClientRedirect {
+		t.Error("Expected auto client redirect from env")
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	oldArgs := os.Args
+	os.Args = []string{"tvclipboard", "--audit-log", "/var/log/tvclipboard-audit.jsonl"}
+	defer func() { os.Args = oldArgs }()
+
+	if cfg := Load(); cfg.AuditLog != "/var/log/tvclipboard-audit.jsonl" {
+		t.Errorf("Expected audit log path from CLI, got %q", cfg.AuditLog)
+	}
+}
+
+func containsIP(nets []*net.IPNet, s string) bool {
+	ip := net.ParseIP(s)
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestStrictOrigins(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	oldArgs := os.Args
+	os.Args = []string{"tvclipboard", "--strict-origins"}
+	defer func() { os.Args = oldArgs }()
+
+	if cfg := Load(); !cfg.StrictOrigins {
+		t.Error("Expected strict origins from CLI")
+	}
+}
+
+func TestMaxSessionLifetime(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	oldArgs := os.Args
+	os.Args = []string{"tvclipboard", "--max-session-lifetime", "4h"}
+	defer func() { os.Args = oldArgs }()
+	os.Setenv("TVCLIPBOARD_MAX_SESSION_LIFETIME_EXEMPT_HOST", "true")
+	defer os.Unsetenv("TVCLIPBOARD_MAX_SESSION_LIFETIME_EXEMPT_HOST")
+
+	cfg := Load()
+	if cfg.MaxSessionLifetime != 4*time.Hour {
+		t.Errorf("Expected 4h max session lifetime from CLI, got %v", cfg.MaxSessionLifetime)
+	}
+	if !cfg.MaxSessionLifetimeExemptHost {
+		t.Error("Expected host exemption from env")
+	}
+}
+
+func TestListenEphemeralPort(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	oldArgs := os.Args
+	os.Args = []string{"tvclipboard", "--port", "0"}
+	defer func() { os.Args = oldArgs }()
+
+	cfg := Load()
+	listener, err := cfg.Listen()
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer listener.Close()
+
+	if cfg.Port == "0" || cfg.Port == "" {
+		t.Fatalf("Expected the bound port to be recorded, got %q", cfg.Port)
+	}
+	if !strings.HasSuffix(cfg.HostURL(), ":"+cfg.Port) {
+		t.Errorf("Expected host URL on port %s, got %s", cfg.Port, cfg.HostURL())
+	}
+
+	conn, err := net.Dial("tcp", "127.0.0.1:"+cfg.Port)
+	if err != nil {
+		t.Fatalf("Expected reported port %s to accept connections: %v", cfg.Port, err)
+	}
+	conn.Close()
+}
+
+func TestEnableDebugWS(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	os.Setenv("TVCLIPBOARD_ENABLE_DEBUG_WS", "1")
+	defer os.Unsetenv("TVCLIPBOARD_ENABLE_DEBUG_WS")
+
+	if cfg := Load(); !cfg.EnableDebugWS {
+		t.Error("Expected debug WebSocket mode from env")
+	}
+}
+
+func TestWSPath(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	if cfg := Load(); cfg.WSPath != "/ws" {
+		t.Errorf("Expected default WebSocket path /ws, got %q", cfg.WSPath)
+	}
+
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	oldArgs := os.Args
+	os.Args = []string{"tvclipboard", "--ws-path", "/clipboard/ws"}
+	defer func() { os.Args = oldArgs }()
+	if cfg := Load(); cfg.WSPath != "/clipboard/ws" {
+		t.Errorf("Expected WebSocket path from CLI, got %q", cfg.WSPath)
+	}
+}
+
+func TestHostSecret(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	os.Setenv("TVCLIPBOARD_HOST_SECRET", "living-room")
+	defer os.Unsetenv("TVCLIPBOARD_HOST_SECRET")
+
+	if cfg := Load(); cfg.HostSecret != "living-room" {
+		t.Errorf("Expected host secret from env, got %q", cfg.HostSecret)
+	}
+}
+
+func TestJoinApproval(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	os.Setenv("TVCLIPBOARD_JOIN_APPROVAL", "true")
+	defer os.Unsetenv("TVCLIPBOARD_JOIN_APPROVAL")
+
+	cfg := Load()
+	if !cfg.JoinApproval {
+		t.Error("Expected join approval from env")
+	}
+	if cfg.JoinApprovalTimeout != 30*time.Second {
+		t.Errorf("Expected default join approval timeout, got %s", cfg.JoinApprovalTimeout)
+	}
+
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	oldArgs := os.Args
+	defer func() { os.Args = oldArgs }()
+	os.Args = []string{"cmd", "--join-approval-timeout", "10s"}
+
+	if cfg := Load(); cfg.JoinApprovalTimeout != 10*time.Second {
+		t.Errorf("Expected join approval timeout from flag, got %s", cfg.JoinApprovalTimeout)
+	}
+}
+
+func TestMaxMessagesPerConnection(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	os.Setenv("TVCLIPBOARD_MAX_MESSAGES_PER_CONNECTION", "500")
+	defer os.Unsetenv("TVCLIPBOARD_MAX_MESSAGES_PER_CONNECTION")
+
+	if cfg := Load(); cfg.MaxMessagesPerConnection != 500 {
+		t.Errorf("Expected quota from env, got %d", cfg.MaxMessagesPerConnection)
+	}
+}
+
+func TestNoHost(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	oldArgs := os.Args
+	defer func() { os.Args = oldArgs }()
+	os.Args = []string{"cmd", "--no-host"}
+
+	if cfg := Load(); !cfg.NoHost {
+		t.Error("Expected no-host mode from flag")
+	}
+}
+
+func TestPauseQueueSize(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	if cfg := Load(); cfg.PauseQueueSize != 50 {
+		t.Errorf("Expected default pause queue size 50, got %d", cfg.PauseQueueSize)
+	}
+
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	os.Setenv("TVCLIPBOARD_PAUSE_QUEUE_SIZE", "5")
+	defer os.Unsetenv("TVCLIPBOARD_PAUSE_QUEUE_SIZE")
+	if cfg := Load(); cfg.PauseQueueSize != 5 {
+		t.Errorf("Expected pause queue size from env, got %d", cfg.PauseQueueSize)
+	}
+}
+
+func TestMessageWarnRatio(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	if cfg := Load(); cfg.MessageWarnRatio != 0.8 {
+		t.Errorf("Expected default warn ratio 0.8, got %v", cfg.MessageWarnRatio)
+	}
+
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	oldArgs := os.Args
+	defer func() { os.Args = oldArgs }()
+	os.Args = []string{"cmd", "--message-warn-ratio", "0"}
+	if cfg := Load(); cfg.MessageWarnRatio != 0 {
+		t.Errorf("Expected --message-warn-ratio 0 to disable warnings, got %v", cfg.MessageWarnRatio)
+	}
+}
+
+func TestMissedPongTolerance(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	os.Setenv("TVCLIPBOARD_MISSED_PONG_TOLERANCE", "3")
+	defer os.Unsetenv("TVCLIPBOARD_MISSED_PONG_TOLERANCE")
+
+	if cfg := Load(); cfg.MissedPongTolerance != 3 {
+		t.Errorf("Expected missed pong tolerance from env, got %d", cfg.MissedPongTolerance)
+	}
+}
+
+func TestMaxClientsPerIP(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	oldArgs := os.Args
+	defer func() { os.Args = oldArgs }()
+	os.Args = []string{"cmd", "--max-clients-per-ip", "3"}
+
+	if cfg := Load(); cfg.MaxClientsPerIP != 3 {
+		t.Errorf("Expected max clients per IP from flag, got %d", cfg.MaxClientsPerIP)
+	}
+}
+
+func TestAdminToken(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	os.Setenv("TVCLIPBOARD_ADMIN_TOKEN", "ops-token")
+	defer os.Unsetenv("TVCLIPBOARD_ADMIN_TOKEN")
+
+	if cfg := Load(); cfg.AdminToken != "ops-token" {
+		t.Errorf("Expected admin token from env, got %q", cfg.AdminToken)
+	}
+}
+
+func TestAllowedOriginsReplace(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	oldArgs := os.Args
+	defer func() { os.Args = oldArgs }()
+	os.Args = []string{"cmd", "--allowed-origins", "https://tv.example.com:*, https://proxy.example.com"}
+
+	cfg := Load()
+	want := []string{"https://tv.example.com:*", "https://proxy.example.com"}
+	if !slices.Equal(cfg.AllowedOrigins, want) {
+		t.Errorf("Expected only the explicit origins %v, got %v", want, cfg.AllowedOrigins)
+	}
+}
+
+func TestAllowedOriginsAppend(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	os.Setenv("TVCLIPBOARD_ALLOWED_ORIGINS", "https://tv.example.com:*,http://localhost:*")
+	os.Setenv("TVCLIPBOARD_ORIGINS_MODE", "append")
+	defer os.Unsetenv("TVCLIPBOARD_ALLOWED_ORIGINS")
+	defer os.Unsetenv("TVCLIPBOARD_ORIGINS_MODE")
+
+	cfg := Load()
+	derived := parseAllowedOrigins(cfg.PublicURL, cfg.LocalIP)
+	want := append(slices.Clone(derived), "https://tv.example.com:*")
+	if !slices.Equal(cfg.AllowedOrigins, want) {
+		t.Errorf("Expected derived plus explicit origins %v, got %v", want, cfg.AllowedOrigins)
+	}
+}
+
+func TestPersistLast(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	oldArgs := os.Args
+	defer func() { os.Args = oldArgs }()
+	os.Args = []string{"cmd", "--persist-last", "/var/lib/tvclipboard/last.json"}
+
+	if cfg := Load(); cfg.PersistLast != "/var/lib/tvclipboard/last.json" {
+		t.Errorf("Expected persist path from flag, got %q", cfg.PersistLast)
+	}
+}
+
+func TestNoCacheBust(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	os.Setenv("TVCLIPBOARD_NO_CACHE_BUST", "true")
+	defer os.Unsetenv("TVCLIPBOARD_NO_CACHE_BUST")
+
+	if cfg := Load(); !cfg.NoCacheBust {
+		t.Error("Expected cache busting disabled from env")
+	}
+}
+
+func TestPrivateKeysFlag(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	oldArgs := os.Args
+	defer func() { os.Args = oldArgs }()
+	first, second := strings.Repeat("ab", 32), strings.Repeat("cd", 32)
+	os.Args = []string{"cmd", "--keys", first, "--keys", second}
+
+	cfg := Load()
+	if !slices.Equal(cfg.PrivateKeys, []string{first, second}) {
+		t.Fatalf("Expected both keys from repeated --keys, got %v", cfg.PrivateKeys)
+	}
+
+	// Without --key the first listed key encrypts
+	keys, err := cfg.ResolvePrivateKeys()
+	if err != nil {
+		t.Fatalf("Expected keys to resolve, got: %v", err)
+	}
+	if len(keys) != 2 || hex.EncodeToString(keys[0]) != first || hex.EncodeToString(keys[1]) != second {
+		t.Errorf("Expected [%s %s], got %x", first, second, keys)
+	}
+}
+
+func TestResolvePrivateKeys(t *testing.T) {
+	primary, extra := strings.Repeat("ab", 32), strings.Repeat("cd", 32)
+
+	// --key encrypts, --keys are accepted too, duplicates are dropped
+	cfg := &Config{PrivateKeyHex: primary, PrivateKeys: []string{extra, primary}}
+	keys, err := cfg.ResolvePrivateKeys()
+	if err != nil {
+		t.Fatalf("Expected keys to resolve, got: %v", err)
+	}
+	if len(keys) != 2 || hex.EncodeToString(keys[0]) != primary || hex.EncodeToString(keys[1]) != extra {
+		t.Errorf("Expected [%s %s], got %x", primary, extra, keys)
+	}
+
+	cfg = &Config{PrivateKeyHex: primary, PrivateKeys: []string{"not-hex"}}
+	if _, err := cfg.ResolvePrivateKeys(); err == nil {
+		t.Error("Expected an invalid --keys entry to be an error")
+	}
+}
+
+func TestConnectionTimeouts(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	cfg := Load()
+	if cfg.HandshakeTimeout != DefaultHandshakeTimeout || cfg.FirstMessageTimeout != 0 {
+		t.Errorf("Expected defaults %v and 0, got %v and %v", DefaultHandshakeTimeout, cfg.HandshakeTimeout, cfg.FirstMessageTimeout)
+	}
+
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	oldArgs := os.Args
+	defer func() { os.Args = oldArgs }()
+	os.Args = []string{"cmd", "--handshake-timeout", "2s"}
+	os.Setenv("TVCLIPBOARD_FIRST_MESSAGE_TIMEOUT", "10s")
+	defer os.Unsetenv("TVCLIPBOARD_FIRST_MESSAGE_TIMEOUT")
+
+	cfg = Load()
+	if cfg.HandshakeTimeout != 2*time.Second {
+		t.Errorf("Expected handshake timeout 2s from flag, got %v", cfg.HandshakeTimeout)
+	}
+	if cfg.FirstMessageTimeout != 10*time.Second {
+		t.Errorf("Expected first message timeout 10s from env, got %v", cfg.FirstMessageTimeout)
+	}
+}
+
+func TestTypeRateLimits(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	if cfg := Load(); cfg.TypeRateLimits != nil {
+		t.Errorf("Expected no type rate limits by default, got %v", cfg.TypeRateLimits)
+	}
+
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	oldArgs := os.Args
+	defer func() { os.Args = oldArgs }()
+	os.Args = []string{"cmd", "--type-rate-limit", "typing=20,text=2", "--type-rate-limit", "ping=oops"}
+
+	cfg := Load()
+	if len(cfg.TypeRateLimits) != 2 || cfg.TypeRateLimits["typing"] != 20 || cfg.TypeRateLimits["text"] != 2 {
+		t.Errorf("Expected typing=20 and text=2 with the invalid entry skipped, got %v", cfg.TypeRateLimits)
+	}
+
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	os.Args = []string{"cmd"}
+	os.Setenv("TVCLIPBOARD_TYPE_RATE_LIMITS", "typing=15")
+	defer os.Unsetenv("TVCLIPBOARD_TYPE_RATE_LIMITS")
+	if cfg := Load(); cfg.TypeRateLimits["typing"] != 15 {
+		t.Errorf("Expected typing=15 from env, got %v", cfg.TypeRateLimits)
+	}
+}
+
+func TestLanguageConfig(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	os.Setenv("TVCLIPBOARD_LANG", "pt-BR")
+	defer os.Unsetenv("TVCLIPBOARD_LANG")
+	os.Setenv("TVCLIPBOARD_STRICT_LANG", "true")
+	defer os.Unsetenv("TVCLIPBOARD_STRICT_LANG")
+
+	cfg := Load()
+	if cfg.Language != "pt-BR" || !cfg.StrictLanguage {
+		t.Errorf("Expected strict pt-BR from env, got %q (strict: %v)", cfg.Language, cfg.StrictLanguage)
+	}
+
+	// TVCLIPBOARD_LANGUAGE takes precedence over the shorter alias
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	os.Setenv("TVCLIPBOARD_LANGUAGE", "en")
+	defer os.Unsetenv("TVCLIPBOARD_LANGUAGE")
+	if cfg := Load(); cfg.Language != "en" {
+		t.Errorf("Expected en from TVCLIPBOARD_LANGUAGE, got %q", cfg.Language)
+	}
+}
+
+func TestFeatures(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	oldArgs := os.Args
+	defer func() { os.Args = oldArgs }()
+	os.Args = []string{"cmd", "--presence", "--e2e-only", "--history-size", "0", "--max-chunked-size", "64", "--inline-qr"}
+	os.Setenv("TVCLIPBOARD_JOIN_APPROVAL", "true")
+	defer os.Unsetenv("TVCLIPBOARD_JOIN_APPROVAL")
+
+	cfg := Load()
+	want := features.Set{Presence: true, E2EOnly: true, JoinApproval: true, Chunking: true, InlineQR: true}
+	if cfg.Features != want {
+		t.Errorf("Expected features %+v, got %+v", want, cfg.Features)
+	}
+
+	// Defaults keep history on and everything else off
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	os.Args = []string{"cmd"}
+	os.Unsetenv("TVCLIPBOARD_JOIN_APPROVAL")
+	if cfg := Load(); cfg.Features != (features.Set{History: true}) {
+		t.Errorf("Expected only history by default, got %+v", cfg.Features)
+	}
+}
+
+func TestMaxTokenTTL(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	if cfg := Load(); cfg.MaxTokenTTL != 0 {
+		t.Errorf("Expected no max token TTL by default, got %v", cfg.MaxTokenTTL)
+	}
+
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	os.Setenv("TVCLIPBOARD_MAX_TOKEN_TTL", "24h")
+	defer os.Unsetenv("TVCLIPBOARD_MAX_TOKEN_TTL")
+	if cfg := Load(); cfg.MaxTokenTTL != 24*time.Hour {
+		t.Errorf("Expected a 24h max token TTL from env, got %v", cfg.MaxTokenTTL)
+	}
+}
+
+func TestReconnectGrace(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	if cfg := Load(); cfg.ReconnectGrace != DefaultReconnectGrace {
+		t.Errorf("Expected the default reconnect grace, got %v", cfg.ReconnectGrace)
+	}
+
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	os.Setenv("TVCLIPBOARD_RECONNECT_GRACE", "0")
+	defer os.Unsetenv("TVCLIPBOARD_RECONNECT_GRACE")
+	if cfg := Load(); cfg.ReconnectGrace != 0 {
+		t.Errorf("Expected reconnect tokens disabled from env, got %v", cfg.ReconnectGrace)
+	}
+}
@@ -0,0 +1,18 @@
+// Package features holds the on/off behaviors shared by the config, hub and server packages
+// It has no dependencies so the hub and server don't need to import the config package
+package features
+
+// Set is the on/off behaviors handed to the hub and server together and reported by /api/info
+// Each mirrors the config.Config setting of the same meaning
+type Set struct {
+	History      bool `json:"history"`      // HistorySize > 0
+	Presence     bool `json:"presence"`     // Presence
+	E2EOnly      bool `json:"e2eOnly"`      // E2EOnly
+	FixedHost    bool `json:"fixedHost"`    // FixedHost
+	NoHost       bool `json:"noHost"`       // NoHost
+	JoinApproval bool `json:"joinApproval"` // JoinApproval
+	UnknownTypes bool `json:"unknownTypes"` // AllowUnknownTypes
+	Chunking     bool `json:"chunking"`     // MaxChunkedSize > 0
+	DebugWS      bool `json:"debugWs"`      // EnableDebugWS
+	InlineQR     bool `json:"inlineQr"`     // InlineQR
+}
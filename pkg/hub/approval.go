@@ -0,0 +1,128 @@
+package hub
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// DefaultJoinApprovalTimeout is how long a join request waits for the host before it is denied
+const DefaultJoinApprovalTimeout = 30 * time.Second
+
+// pendingJoin is a client waiting for the host to approve it
+type pendingJoin struct {
+	client *Client
+	timer  *time.Timer // Denies the join when the host doesn't answer in time
+}
+
+// SetJoinApproval makes new clients wait for the host's "approve" before joining (timeout <= 0 uses the default)
+// The host gets a "join_request" with the client's ID and answers "approve" or "deny" with that ID;
+// unanswered requests are denied after timeout. Must be called before Run
+func (h *Hub) SetJoinApproval(enabled bool, timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = DefaultJoinApprovalTimeout
+	}
+	h.joinApproval = enabled
+	h.joinTimeout = timeout
+}
+
+// needsApproval reports whether a registering client must wait for the host
+// The first client (the host itself) and host secret holders never wait
+// Caller must hold h.mu
+func (h *Hub) needsApproval(client *Client) bool {
+	return h.joinApproval && h.hostID != "" && !client.ClaimHost && !client.Reconnected
+}
+
+// holdForApproval parks client until the host approves or denies it, or the request times out
+// Caller must hold h.mu
+func (h *Hub) holdForApproval(client *Client) {
+	h.pending[client.ID] = &pendingJoin{
+		client: client,
+		timer: time.AfterFunc(h.joinTimeout, func() {
+			if h.resolveJoin(client.ID, false) {
+				log.Printf("Join request from %s timed out", client.ID)
+			}
+		}),
+	}
+	log.Printf("Client %s is waiting for host approval (mobile: %v)", client.ID, client.Mobile)
+
+	h.sendControl(client, Message{Type: "join_pending"})
+	if host, ok := h.clients[h.hostID]; ok {
+		h.sendControl(host, Message{Type: "join_request", Content: client.ID})
+	}
+}
+
+// resolveJoin admits or denies a pending client, reporting whether id was pending
+func (h *Hub) resolveJoin(id string, approve bool) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	p, ok := h.pending[id]
+	if !ok {
+		return false
+	}
+	delete(h.pending, id)
+	p.timer.Stop()
+
+	if approve {
+		log.Printf("Host approved client %s", id)
+		h.admit(p.client)
+		return true
+	}
+	log.Printf("Client %s was denied", id)
+	h.sendControl(p.client, Message{Type: "join_denied"})
+	p.client.closeSend()
+	return true
+}
+
+// dropPending forgets a pending client that disconnected before the host answered
+// Caller must hold h.mu
+func (h *Hub) dropPending(client *Client) bool {
+	p, ok := h.pending[client.ID]
+	if !ok {
+		return false
+	}
+	delete(h.pending, client.ID)
+	p.timer.Stop()
+	client.closeSend()
+	log.Printf("Client %s left while waiting for approval", client.ID)
+	return true
+}
+
+// isPending reports whether the client is still waiting for approval
+func (h *Hub) isPending(id string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	_, ok := h.pending[id]
+	return ok
+}
+
+// sendControl queues a hub message for one client without blocking
+func (h *Hub) sendControl(c *Client, msg Message) {
+	msgBytes, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("Failed to marshal %s message: %v", msg.Type, err)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	select {
+	case c.Send <- msgBytes:
+	default:
+		log.Printf("Client %s send channel full, dropping %s", c.ID, msg.Type)
+		c.dropped.Add(1)
+	}
+}
+
+// closeSend closes the client's Send channel once, which makes WritePump close the connection
+func (c *Client) closeSend() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		close(c.Send)
+		c.closed = true
+	}
+}
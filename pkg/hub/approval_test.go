@@ -0,0 +1,109 @@
+package hub
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// joinPending connects a client to a hub with join approval and returns it with its join request ID
+func joinPending(t *testing.T, h *Hub, hostConn *MemoryConn) (*Client, *MemoryConn) {
+	t.Helper()
+	client, conn := NewMemoryClient(h, true)
+	h.Register <- client
+	go client.WritePump()
+	go client.ReadPump()
+
+	if msg := nextMessage(t, conn); msg.Type != "join_pending" {
+		t.Fatalf("Expected join_pending, got %+v", msg)
+	}
+	if msg := nextMessage(t, hostConn); msg.Type != "join_request" || msg.Content != client.ID {
+		t.Fatalf("Expected join_request for %s, got %+v", client.ID, msg)
+	}
+	return client, conn
+}
+
+func TestJoinApprovalApprove(t *testing.T) {
+	h := NewHub(1024*1024, 1000)
+	h.SetJoinApproval(true, time.Minute)
+	go h.Run()
+	defer h.Stop()
+
+	host, hostConn := registerMemoryClient(t, h)
+	client, conn := joinPending(t, h, hostConn)
+
+	// Pending clients can't send or receive broadcasts
+	if err := client.Submit([]byte(`{"type":"text","content":"early"}`)); !errors.Is(err, ErrPendingApproval) {
+		t.Errorf("Expected ErrPendingApproval, got %v", err)
+	}
+	if h.ClientCount() != 1 {
+		t.Errorf("Expected pending client not to be counted, got %d clients", h.ClientCount())
+	}
+
+	hostConn.Deliver([]byte(`{"type":"approve","content":"` + client.ID + `"}`))
+	if msg := nextMessage(t, conn); msg.Type != "role" || msg.Role != "client" {
+		t.Fatalf("Expected client role after approval, got %+v", msg)
+	}
+	if msg := nextMessage(t, conn); msg.Type != "welcome" {
+		t.Fatalf("Expected welcome after approval, got %+v", msg)
+	}
+
+	if err := host.Submit([]byte(`{"type":"text","content":"hello"}`)); err != nil {
+		t.Fatalf("Submit failed: %v", err)
+	}
+	if msg := nextMessage(t, conn); msg.Type != "text" || msg.Content != "hello" {
+		t.Errorf("Expected broadcast after approval, got %+v", msg)
+	}
+}
+
+func TestJoinApprovalDeny(t *testing.T) {
+	h := NewHub(1024*1024, 1000)
+	h.SetJoinApproval(true, time.Minute)
+	go h.Run()
+	defer h.Stop()
+
+	_, hostConn := registerMemoryClient(t, h)
+	client, conn := joinPending(t, h, hostConn)
+
+	// Only the host decides
+	if err := client.Submit([]byte(`{"type":"approve","content":"` + client.ID + `"}`)); err == nil {
+		t.Error("Expected a pending client to be unable to approve itself")
+	}
+
+	hostConn.Deliver([]byte(`{"type":"deny","content":"` + client.ID + `"}`))
+	if msg := nextMessage(t, conn); msg.Type != "join_denied" {
+		t.Fatalf("Expected join_denied, got %+v", msg)
+	}
+	select {
+	case <-conn.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected denied client connection to close")
+	}
+	if h.ClientCount() != 1 {
+		t.Errorf("Expected only the host to remain, got %d clients", h.ClientCount())
+	}
+}
+
+func TestJoinApprovalTimeout(t *testing.T) {
+	h := NewHub(1024*1024, 1000)
+	h.SetJoinApproval(true, 50*time.Millisecond)
+	go h.Run()
+	defer h.Stop()
+
+	_, hostConn := registerMemoryClient(t, h)
+	client, conn := joinPending(t, h, hostConn)
+
+	if msg := nextMessage(t, conn); msg.Type != "join_denied" {
+		t.Fatalf("Expected join_denied after timeout, got %+v", msg)
+	}
+	select {
+	case <-conn.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected timed out client connection to close")
+	}
+
+	// A late answer is ignored
+	if h.resolveJoin(client.ID, true) {
+		t.Error("Expected late approval to find no pending join")
+	}
+}
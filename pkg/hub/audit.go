@@ -0,0 +1,77 @@
+package hub
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// Security event types reported to an AuditLogger
+const (
+	AuditIPRejected     = "ip_rejected"
+	AuditHostRejected   = "host_rejected"
+	AuditOriginRejected = "origin_rejected"
+	AuditTokenMissing   = "token_missing"
+	AuditTokenInvalid   = "token_invalid"
+	AuditTokenExpired   = "token_expired"
+	AuditRateLimited    = "rate_limited"
+	AuditKicked         = "kicked"
+)
+
+// AuditEvent describes a rejected connection or message
+type AuditEvent struct {
+	Time       time.Time `json:"time"`
+	Type       string    `json:"type"`
+	ClientID   string    `json:"clientId,omitempty"`
+	RemoteAddr string    `json:"remoteAddr,omitempty"`
+	Room       string    `json:"room,omitempty"`
+	Detail     string    `json:"detail,omitempty"`
+}
+
+// AuditLogger receives security events, e.g. to forward them to an external sink
+// Event is called from request and hub goroutines, so implementations must be safe for concurrent use
+type AuditLogger interface {
+	Event(e AuditEvent)
+}
+
+// NopAuditLogger discards every event
+type NopAuditLogger struct{}
+
+// Event implements AuditLogger
+func (NopAuditLogger) Event(AuditEvent) {}
+
+// JSONAuditLogger writes each event as one line of JSON
+type JSONAuditLogger struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewJSONAuditLogger creates a JSON-lines audit logger writing to w (typically an append-only file)
+func NewJSONAuditLogger(w io.Writer) *JSONAuditLogger {
+	return &JSONAuditLogger{enc: json.NewEncoder(w)}
+}
+
+// Event implements AuditLogger
+func (l *JSONAuditLogger) Event(e AuditEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.enc.Encode(e); err != nil {
+		log.Printf("Failed to write audit event: %v", err)
+	}
+}
+
+// SetAuditLogger sets where the hub reports rate limiting and kicked clients (nil disables)
+// Must be called before Run
+func (h *Hub) SetAuditLogger(l AuditLogger) {
+	if l == nil {
+		l = NopAuditLogger{}
+	}
+	h.auditLog = l
+}
+
+// audit reports a security event for a client of this hub
+func (h *Hub) audit(eventType, clientID, detail string) {
+	h.auditLog.Event(AuditEvent{Time: time.Now(), Type: eventType, ClientID: clientID, Detail: detail})
+}
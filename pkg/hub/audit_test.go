@@ -0,0 +1,101 @@
+package hub
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingAuditLogger collects audit events for assertions
+type recordingAuditLogger struct {
+	mu     sync.Mutex
+	events []AuditEvent
+}
+
+func (r *recordingAuditLogger) Event(e AuditEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, e)
+}
+
+func (r *recordingAuditLogger) types() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var types []string
+	for _, e := range r.events {
+		types = append(types, e.Type)
+	}
+	return types
+}
+
+func TestAuditRateLimited(t *testing.T) {
+	audit := &recordingAuditLogger{}
+	h := NewHub(1024*1024, 1)
+	h.SetAuditLogger(audit)
+	go h.Run()
+	defer h.Stop()
+
+	sender := NewClient(nil, h, false)
+	sender.Submit([]byte(`{"type":"text","content":"one"}`))
+	if err := sender.Submit([]byte(`{"type":"text","content":"two"}`)); err != ErrRateLimited {
+		t.Fatalf("Expected ErrRateLimited, got %v", err)
+	}
+
+	types := audit.types()
+	if len(types) != 1 || types[0] != AuditRateLimited {
+		t.Fatalf("Expected one rate_limited event, got %v", types)
+	}
+	if audit.events[0].ClientID != sender.ID {
+		t.Errorf("Expected event for %s, got %+v", sender.ID, audit.events[0])
+	}
+}
+
+func TestAuditKicked(t *testing.T) {
+	audit := &recordingAuditLogger{}
+	h := NewHub(1024*1024, 1000)
+	h.SetAuditLogger(audit)
+	go h.Run()
+	defer h.Stop()
+
+	slow := NewClient(nil, h, false)
+	slow.Send = make(chan []byte, 1)
+	h.Register <- slow // role assignment fills the queue
+
+	sender := NewClient(nil, h, false)
+	if err := sender.Submit([]byte(`{"type":"text","content":"overflow"}`)); err != nil {
+		t.Fatalf("Submit failed: %v", err)
+	}
+
+	deadline := time.After(2 * time.Second)
+	for len(audit.types()) == 0 {
+		select {
+		case <-deadline:
+			t.Fatal("Expected a kicked event")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	if e := audit.events[0]; e.Type != AuditKicked || e.ClientID != slow.ID {
+		t.Errorf("Expected kicked event for %s, got %+v", slow.ID, e)
+	}
+}
+
+func TestJSONAuditLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewJSONAuditLogger(&buf)
+	l.Event(AuditEvent{Type: AuditTokenExpired, RemoteAddr: "10.0.0.1:5000"})
+	l.Event(AuditEvent{Type: AuditKicked, ClientID: "abc"})
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 JSON lines, got %d: %s", len(lines), buf.String())
+	}
+	var e AuditEvent
+	if err := json.Unmarshal(lines[0], &e); err != nil {
+		t.Fatalf("Failed to parse audit line: %v", err)
+	}
+	if e.Type != AuditTokenExpired || e.RemoteAddr != "10.0.0.1:5000" {
+		t.Errorf("Unexpected audit event: %+v", e)
+	}
+}
@@ -0,0 +1,153 @@
+package hub
+
+import (
+	"encoding/base64"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+)
+
+// DefaultChunkTimeout is how long an incomplete chunked transfer is kept before it is dropped
+const DefaultChunkTimeout = 30 * time.Second
+
+// maxChunkTransfers caps the chunked transfers one client may have in progress
+const maxChunkTransfers = 4
+
+// ErrTransferTooLarge is returned when a chunked transfer grows past the hub's limit
+var ErrTransferTooLarge = errors.New("chunked transfer too large")
+
+// chunkKey identifies a chunked transfer by its sender and the sender's transfer ID
+type chunkKey struct {
+	clientID string
+	id       string
+}
+
+// chunkTransfer is a message arriving in "chunk" parts from one client
+type chunkTransfer struct {
+	parts    [][]byte
+	received int
+	size     int64
+	timer    *time.Timer // Drops the transfer when the rest doesn't arrive in time
+}
+
+// SetChunking accepts "chunk" messages reassembled into messages of up to maxSize bytes (0 disables)
+// A chunk carries a base64 slice of the complete message JSON in Content and "id", "seq" (from 0) and "total"
+// in Meta; once every part arrives the message is handled as if sent whole. Transfers not completed within
+// timeout are dropped (timeout <= 0 uses the default). Must be called before Run
+func (h *Hub) SetChunking(maxSize int64, timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = DefaultChunkTimeout
+	}
+	h.maxChunkedSize = max(maxSize, 0)
+	h.chunkTimeout = timeout
+}
+
+// addChunk stores one part of a chunked transfer, returning the complete message once every part arrived
+// It returns nil while parts are still missing
+func (h *Hub) addChunk(clientID string, msg Message) ([]byte, error) {
+	if h.maxChunkedSize == 0 {
+		return nil, ErrUnknownType
+	}
+	id := msg.Meta["id"]
+	seq, seqErr := strconv.Atoi(msg.Meta["seq"])
+	total, totalErr := strconv.Atoi(msg.Meta["total"])
+	switch {
+	case id == "":
+		return nil, &SchemaError{Type: msg.Type, Reason: "meta id is required"}
+	case totalErr != nil || total < 1:
+		return nil, &SchemaError{Type: msg.Type, Reason: "meta total must be a positive number"}
+	case seqErr != nil || seq < 0 || seq >= total:
+		return nil, &SchemaError{Type: msg.Type, Reason: "meta seq must be between 0 and total-1"}
+	}
+	part, err := base64.StdEncoding.DecodeString(msg.Content)
+	if err != nil {
+		return nil, &SchemaError{Type: msg.Type, Reason: "content must be base64"}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := chunkKey{clientID: clientID, id: id}
+	t, ok := h.chunks[key]
+	if !ok {
+		if h.chunkTransfers(clientID) >= maxChunkTransfers {
+			return nil, &SchemaError{Type: msg.Type, Reason: "too many transfers in progress"}
+		}
+		// Each part is at least a byte, so a total above the size limit can never fit
+		if int64(total) > h.maxChunkedSize {
+			return nil, ErrTransferTooLarge
+		}
+		t = &chunkTransfer{
+			parts: make([][]byte, total),
+			timer: time.AfterFunc(h.chunkTimeout, func() {
+				if h.dropChunk(key) {
+					log.Printf("Chunked transfer %q from %s timed out", id, clientID)
+				}
+			}),
+		}
+		h.chunks[key] = t
+	}
+	if total != len(t.parts) {
+		return nil, &SchemaError{Type: msg.Type, Reason: "meta total changed mid-transfer"}
+	}
+	if t.parts[seq] != nil {
+		return nil, &SchemaError{Type: msg.Type, Reason: "duplicate seq"}
+	}
+	t.size += int64(len(part))
+	if t.size > h.maxChunkedSize {
+		t.timer.Stop()
+		delete(h.chunks, key)
+		log.Printf("Chunked transfer %q from %s exceeded %d bytes, dropping it", id, clientID, h.maxChunkedSize)
+		return nil, ErrTransferTooLarge
+	}
+	t.parts[seq] = part
+	t.received++
+	if t.received < total {
+		return nil, nil
+	}
+
+	t.timer.Stop()
+	delete(h.chunks, key)
+	assembled := make([]byte, 0, t.size)
+	for _, p := range t.parts {
+		assembled = append(assembled, p...)
+	}
+	return assembled, nil
+}
+
+// dropChunk forgets an incomplete transfer, reporting whether it was still pending
+func (h *Hub) dropChunk(key chunkKey) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	t, ok := h.chunks[key]
+	if !ok {
+		return false
+	}
+	t.timer.Stop()
+	delete(h.chunks, key)
+	return true
+}
+
+// chunkTransfers counts the transfers clientID has in progress
+// Caller must hold h.mu
+func (h *Hub) chunkTransfers(clientID string) int {
+	n := 0
+	for key := range h.chunks {
+		if key.clientID == clientID {
+			n++
+		}
+	}
+	return n
+}
+
+// dropClientChunks forgets the incomplete transfers of a client that left
+// Caller must hold h.mu
+func (h *Hub) dropClientChunks(clientID string) {
+	for key, t := range h.chunks {
+		if key.clientID == clientID {
+			t.timer.Stop()
+			delete(h.chunks, key)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package hub
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// chunkMessages splits msg into total "chunk" messages for transfer id
+func chunkMessages(t *testing.T, msg Message, id string, total int) [][]byte {
+	t.Helper()
+	whole, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatalf("Failed to marshal message: %v", err)
+	}
+	size := (len(whole) + total - 1) / total
+	var chunks [][]byte
+	for seq := 0; seq < total; seq++ {
+		part := whole[min(seq*size, len(whole)):min((seq+1)*size, len(whole))]
+		chunk, _ := json.Marshal(Message{
+			Type:    "chunk",
+			Content: base64.StdEncoding.EncodeToString(part),
+			Meta:    map[string]string{"id": id, "seq": strconv.Itoa(seq), "total": strconv.Itoa(total)},
+		})
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+func TestChunkReassembly(t *testing.T) {
+	h := NewHub(512, 1000)
+	h.SetChunking(16*1024, time.Minute)
+	go h.Run()
+	defer h.Stop()
+
+	_, conn := registerMemoryClient(t, h)
+	sender := NewClient(nil, h, false)
+
+	document := strings.Repeat("A long document. ", 200)
+	if err := sender.Submit([]byte(`{"type":"text","content":"` + document + `"}`)); !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("Expected the whole document to be too large for one message, got %v", err)
+	}
+
+	// Parts may arrive in any order; nothing is relayed until the last one
+	chunks := chunkMessages(t, Message{Type: "text", Content: document}, "doc-1", 16)
+	for i := len(chunks) - 1; i >= 0; i-- {
+		if err := sender.Submit(chunks[i]); err != nil {
+			t.Fatalf("Chunk %d rejected: %v", i, err)
+		}
+	}
+
+	msg := nextMessage(t, conn)
+	if msg.Type != "text" || msg.Content != document || msg.From != sender.ID {
+		t.Fatalf("Expected the reassembled document from %s, got type %q from %q (%d bytes)", sender.ID, msg.Type, msg.From, len(msg.Content))
+	}
+	select {
+	case out := <-conn.Outbound():
+		t.Errorf("Expected only the reassembled message, got %s", out)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// A repeated part is rejected rather than overwriting the first
+	chunks = chunkMessages(t, Message{Type: "text", Content: document}, "doc-2", 16)
+	sender.Submit(chunks[0])
+	if err := sender.Submit(chunks[0]); !errors.Is(err, ErrInvalidMessage) {
+		t.Errorf("Expected a duplicate chunk to be invalid, got %v", err)
+	}
+}
+
+func TestChunkLimits(t *testing.T) {
+	disabled := NewHub(512, 1000)
+	chunks := chunkMessages(t, Message{Type: "text", Content: "hello"}, "small", 1)
+	if err := NewClient(nil, disabled, false).Submit(chunks[0]); !errors.Is(err, ErrUnknownType) {
+		t.Errorf("Expected chunks to be rejected while chunking is disabled, got %v", err)
+	}
+
+	h := NewHub(512, 1000)
+	h.SetChunking(1024, time.Minute)
+	go h.Run()
+	defer h.Stop()
+	sender := NewClient(nil, h, false)
+
+	chunks = chunkMessages(t, Message{Type: "text", Content: strings.Repeat("x", 2000)}, "big", 8)
+	var err error
+	for _, chunk := range chunks {
+		if err = sender.Submit(chunk); err != nil {
+			break
+		}
+	}
+	if !errors.Is(err, ErrTransferTooLarge) {
+		t.Errorf("Expected the transfer to exceed the size limit, got %v", err)
+	}
+
+	nested := chunkMessages(t, Message{Type: "chunk", Content: "eA==", Meta: map[string]string{"id": "x", "seq": "0", "total": "1"}}, "nested", 1)
+	if err := sender.Submit(nested[0]); !errors.Is(err, ErrInvalidMessage) {
+		t.Errorf("Expected a nested chunk to be invalid, got %v", err)
+	}
+}
+
+func TestChunkTimeout(t *testing.T) {
+	h := NewHub(512, 1000)
+	h.SetChunking(16*1024, 50*time.Millisecond)
+	go h.Run()
+	defer h.Stop()
+
+	_, conn := registerMemoryClient(t, h)
+	sender := NewClient(nil, h, false)
+
+	chunks := chunkMessages(t, Message{Type: "text", Content: strings.Repeat("late ", 100)}, "slow", 2)
+	if err := sender.Submit(chunks[0]); err != nil {
+		t.Fatalf("First chunk rejected: %v", err)
+	}
+
+	deadline := time.After(2 * time.Second)
+	for {
+		h.mu.RLock()
+		n := len(h.chunks)
+		h.mu.RUnlock()
+		if n == 0 {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatal("Expected the incomplete transfer to be evicted")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	// The last part now starts a new transfer instead of completing the evicted one
+	if err := sender.Submit(chunks[1]); err != nil {
+		t.Fatalf("Late chunk rejected: %v", err)
+	}
+	select {
+	case out := <-conn.Outbound():
+		t.Errorf("Expected nothing relayed for an evicted transfer, got %s", out)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
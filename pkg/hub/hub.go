@@ -1,20 +1,48 @@
 package hub
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math/rand/v2"
+	"net/url"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"tvclipboard/pkg/features"
+)
+
+// WSConn is the subset of *websocket.Conn used by a Client
+// It lets tests and in-process transports replace the network (see MemoryConn)
+type WSConn interface {
+	ReadMessage() (messageType int, p []byte, err error)
+	WriteMessage(messageType int, data []byte) error
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+	SetReadLimit(limit int64)
+	SetReadDeadline(t time.Time) error
+	SetPongHandler(h func(appData string) error)
+	Close() error
+}
+
+// Both the real and the in-memory connection satisfy WSConn
+var (
+	_ WSConn = (*websocket.Conn)(nil)
+	_ WSConn = (*MemoryConn)(nil)
 )
 
 // Client represents a WebSocket client connection
 type Client struct {
 	ID           string
-	Conn         *websocket.Conn
+	Conn         WSConn
 	Send         chan []byte
 	Hub          *Hub
 	Mobile       bool
@@ -22,11 +50,60 @@ type Client struct {
 	messageCount int
 	mu           sync.Mutex
 	closed       bool // Track if Send channel has been closed
+	byeReason    string
+	jitter       func() float64 // Random source in [0, 1) for the ping interval
+	connectedAt  time.Time
+	messagesSent int // Messages accepted from this client over the whole connection
+	messagesRead int // Messages read from the connection, only touched by ReadPump
+
+	// When ReadPump last told the client a message was malformed, only touched by ReadPump
+	lastMalformedReply time.Time
+
+	// Ping bookkeeping for the missed pong tolerance, shared by ReadPump and WritePump
+	awaitingPong atomic.Bool
+	missedPongs  atomic.Int32
+
+	// Messages not queued for this client because its Send buffer was full
+	dropped atomic.Int64
+
+	// Per-client rate limit rejections in the current warning window, guarded by mu
+	throttled      int
+	throttledSince time.Time
+
+	// Rate limit windows for types with their own limit (see SetTypeRateLimits), guarded by mu
+	// Every other type counts against lastMessage and messageCount
+	typeWindows map[string]*rateWindow
+
+	// Round-trip times reported with "rtt" messages, guarded by mu (see recordRTT)
+	lastRTT    time.Duration
+	avgRTT     time.Duration
+	rttSamples int
+
+	// Token from the client's welcome message that lets it rejoin after a drop, guarded by the hub's mu
+	reconnectToken string
+
+	// Checked but unspent reconnect token this client resumes with, consumed on Register (set by Resume)
+	resumeToken string
+
+	// IP is the client's address, counted against the hub's per-IP limit ("" is never limited)
+	IP string
+
+	// Lang is the client's language for error messages, e.g. "pt-BR" ("" uses the server language)
+	Lang string
+
+	// ClaimHost makes the client host on registration, demoting the current host (set before Register)
+	// The server sets it for connections presenting the host secret
+	ClaimHost bool
+
+	// Reconnected marks a client rejoining with a reconnect token under its old ID (set by Resume)
+	// It was already let in once, so join approval doesn't hold it again
+	Reconnected bool
 }
 
 // Hub manages all connected clients
 type Hub struct {
 	clients         map[string]*Client
+	order           []*Client // The same clients in registration order, so delivery and promotion are fair and repeatable
 	hostID          string
 	broadcast       chan BroadcastMessage
 	Register        chan *Client
@@ -35,12 +112,254 @@ type Hub struct {
 	mu              sync.RWMutex
 	maxMessageSize  int64
 	rateLimitPerSec int
+
+	// Messages per second per client for specific types, overriding rateLimitPerSec (set before Run)
+	typeRateLimits map[string]int
+
+	// Per-role message size limits, both default to maxMessageSize
+	hostMaxMessageSize   int64
+	clientMaxMessageSize int64
+
+	// Share of the size limit above which senders get a warning, 0 disables (set before Run)
+	sizeWarnRatio float64
+
+	// Global token bucket across all clients (0 disables), only touched by Run
+	globalRateLimit  int
+	globalTokens     float64
+	globalLastRefill time.Time
+
+	// Ring buffer of recent broadcasts (oldest first), guarded by mu
+	history     []HistoryEntry
+	historySize int
+
+	// Session label set by the host, guarded by mu
+	title string
+
+	// Broadcast join/leave presence updates (set before Run)
+	presence bool
+
+	// Forward message types outside knownTypes (set before Run)
+	allowUnknownTypes bool
+
+	// Never promote a client when the host leaves (set before Run)
+	fixedHost bool
+
+	// Never assign a host; every connection is an equal client (set before Run)
+	noHost bool
+
+	// Longest text message in runes, 0 disables (set before Run)
+	maxTextRunes int
+
+	// Reject plaintext "text" and "image" messages, relaying only "e2e" (set before Run)
+	e2eOnly bool
+
+	// Include (truncated) message content in logs (set before Run)
+	logContent bool
+
+	// Receives security events (set before Run)
+	auditLog AuditLogger
+
+	// Localizes error messages, nil for English (set before Run)
+	translator Translator
+
+	// Base WritePump ping interval, jittered per client
+	pingInterval time.Duration
+
+	// Most clients one IP may have connected, 0 disables (set before Run)
+	maxClientsPerIP int
+
+	// Consecutive unanswered pings tolerated before closing, 0 keeps the plain read deadline (set before Run)
+	missedPongTolerance int
+
+	// Close clients that send nothing this long after connecting, 0 disables (set before Run)
+	firstMessageTimeout time.Duration
+
+	// Longest a client may stay connected, 0 disables; the host can be exempt (set before Run)
+	maxSessionLifetime  time.Duration
+	lifetimeExemptsHost bool
+
+	// Most messages one connection may send before it is closed, 0 disables (set before Run)
+	maxMessagesPerConn int
+
+	// Unregistered clients submitting over HTTP, keyed by caller, guarded by mu
+	// Reusing them across requests keeps their rate limit windows
+	senders map[string]*Client
+
+	// Hold new clients until the host approves them (set before Run)
+	joinApproval bool
+	joinTimeout  time.Duration
+	// Clients waiting for approval, guarded by mu
+	pending map[string]*pendingJoin
+
+	// Largest message reassembled from "chunk" parts, 0 disables chunking (set before Run)
+	maxChunkedSize int64
+	chunkTimeout   time.Duration
+	// Chunked transfers in progress, guarded by mu
+	chunks map[chunkKey]*chunkTransfer
+
+	// Told about lifecycle events, none by default (set before Run)
+	observers []HubObserver
+
+	// Rewrites or drops client messages before broadcast, nil relays them unchanged (set before Run)
+	transformer MessageTransformer
+
+	// Reconnect tokens of dropped clients, keyed by token, guarded by mu (see reconnect.go)
+	reconnects     map[string]reconnectGrant
+	reconnectGrace time.Duration
+
+	// Content held while the host is paused (oldest first), guarded by mu
+	paused         bool
+	pauseQueue     []BroadcastMessage
+	pauseQueueSize int
+
+	// File the last "text" broadcast is saved to, "" disables (set before Run)
+	persistPath string
+	// Message loaded from persistPath for the first client, guarded by mu
+	restored []byte
+	// Latest message waiting for the background writer, and closed once it has flushed after Stop
+	persistQueue chan []byte
+	persistDone  chan struct{}
+
+	// Counters reported by Stats, guarded by mu
+	started           time.Time
+	messagesBroadcast int64
+	messagesDropped   int64
+	bytesBroadcast    int64
+	rateLimited       int64
+	clientDrops       int64 // Dropped counts of clients that already left; connected ones are summed by Stats
+	slowClients       int64
+}
+
+// HubStats is a snapshot of a hub's clients and message counters
+type HubStats struct {
+	ClientCount       int
+	HostID            string
+	MessagesBroadcast int64 // Messages accepted for broadcast
+	MessagesDropped   int64 // Messages dropped by the global rate limit or a full hub or client queue
+	BytesBroadcast    int64
+	RateLimited       int64 // Messages rejected by the per-client rate limit
+	ClientDrops       int64 // Messages not queued for a client because its send buffer was full
+	SlowClients       int64 // Clients disconnected because their send buffer was full
+	Uptime            time.Duration
+}
+
+// DefaultPingInterval is how often WritePump pings the peer, before jitter
+const DefaultPingInterval = 30 * time.Second
+
+// pingJitter is the largest fraction by which a client's ping interval is shifted
+// Spreading the intervals keeps many clients from pinging in lockstep
+const pingJitter = 0.1
+
+// LogContentLength is how many characters of content are logged when content logging is on
+const LogContentLength = 64
+
+// MaxByeReasonLength caps the departure reason a client can send with "bye"
+const MaxByeReasonLength = 128
+
+// Presence is broadcast to the other clients when someone joins or leaves
+type Presence struct {
+	Type     string `json:"type"`  // always "presence"
+	Event    string `json:"event"` // "join" or "leave"
+	ClientID string `json:"clientId"`
+	Reason   string `json:"reason,omitempty"`
+	Clients  int    `json:"clients"`
+}
+
+// MaxTitleLength caps the session title in characters
+const MaxTitleLength = 64
+
+// Welcome is sent to clients when they join a session with a host
+type Welcome struct {
+	Type       string `json:"type"` // always "welcome"
+	Title      string `json:"title,omitempty"`
+	ServerTime int64  `json:"serverTime"` // Unix milliseconds, lets clients correct for clock skew
+
+	// ReconnectToken lets the client rejoin as itself shortly after a drop, see SetReconnectGrace
+	ReconnectToken string `json:"reconnect_token,omitempty"`
+}
+
+// Errors returned by Client.Submit
+var (
+	ErrMessageTooLarge = errors.New("message too large")
+	ErrRateLimited     = errors.New("rate limit exceeded")
+	ErrHubStopped      = errors.New("hub stopped")
+	ErrNotHost         = errors.New("only the host can do that")
+	ErrUnknownType     = errors.New("unknown message type")
+	ErrInvalidContent  = errors.New("invalid message content")
+	ErrTextTooLong     = errors.New("text too long")
+	ErrPlaintext       = errors.New("plaintext messages are not allowed")
+	ErrBroadcastFull   = errors.New("broadcast queue full")
+	ErrInvalidURL      = errors.New("only http and https links are allowed")
+	ErrInvalidAudience = errors.New("unknown audience")
+	ErrPendingApproval = errors.New("waiting for host approval")
+	ErrMetaTooLarge    = errors.New("message metadata too large")
+	ErrMalformed       = errors.New("malformed message")
+)
+
+// malformedReplyInterval is the least time between two "malformed message" errors sent to one client,
+// so a client that answers errors with more garbage can't start a feedback loop
+const malformedReplyInterval = time.Second
+
+// knownTypes are the message types clients may send; others are rejected unless allowUnknownTypes is set
+var knownTypes = map[string]bool{
+	"text":    true,
+	"image":   true,
+	"clear":   true,
+	"hello":   true,
+	"ping":    true,
+	"typing":  true,
+	"title":   true,
+	"bye":     true,
+	"e2e":     true,
+	"approve": true,
+	"deny":    true,
+	"pause":   true,
+	"resume":  true,
+	"chunk":   true,
+	"rtt":     true,
+}
+
+// DefaultHistorySize is the number of recent broadcasts kept by a hub
+const DefaultHistorySize = 20
+
+// HistoryEntry is a broadcast message recorded in the hub's history
+type HistoryEntry struct {
+	Type      string    `json:"type"`
+	Content   string    `json:"content"`
+	From      string    `json:"from"`
+	Timestamp time.Time `json:"timestamp"`
 }
 
 // BroadcastMessage represents a message to broadcast to clients
 type BroadcastMessage struct {
-	Message []byte
-	From    string // Don't send back to this client
+	Message  []byte
+	From     string // Don't send back to this client
+	Echo     bool   // Deliver to From as well
+	Audience string // "mobile" or "desktop" limits recipients; empty or "all" reaches everyone
+	Type     string // Message type, to hold content while the host is paused
+
+	// Told the outcome once the message is handled (nil when nobody waits, see BroadcastWait)
+	result chan<- deliveryResult
+}
+
+// Delivery is the outcome of a broadcast: how many clients it was queued for, and how many were
+// skipped and disconnected because their queue was full. A message held while the host is paused counts as neither
+type Delivery struct {
+	Delivered int `json:"delivered"`
+	Dropped   int `json:"dropped"`
+}
+
+// deliveryResult is what the hub reports to a BroadcastWait caller
+type deliveryResult struct {
+	Delivery
+	err error
+}
+
+// report tells a waiting sender how its message was handled; it never blocks
+func (m BroadcastMessage) report(d Delivery, err error) {
+	if m.result != nil {
+		m.result <- deliveryResult{Delivery: d, err: err}
+	}
 }
 
 // Message represents a WebSocket message
@@ -49,6 +368,36 @@ type Message struct {
 	Content string `json:"content"`
 	From    string `json:"from"`
 	Role    string `json:"role,omitempty"`
+	Echo    bool   `json:"echo,omitempty"`   // Also deliver the message back to its sender
+	Format  string `json:"format,omitempty"` // How to render Content; "url" content must be an http(s) link
+	// Audience targets "all" (default), "mobile" or "desktop" clients
+	Audience string `json:"audience,omitempty"`
+	// Meta is small client metadata (e.g. device type, app version) relayed untouched, capped at MaxMetaSize
+	Meta map[string]string `json:"meta,omitempty"`
+}
+
+// MaxMetaSize caps a message's metadata, counted as the bytes of every key and value
+const MaxMetaSize = 1024
+
+// metaSize returns the bytes of every key and value in meta
+func metaSize(meta map[string]string) int {
+	n := 0
+	for k, v := range meta {
+		n += len(k) + len(v)
+	}
+	return n
+}
+
+// audienceIncludes reports whether a client with the given Mobile flag is in audience
+func audienceIncludes(audience string, mobile bool) bool {
+	switch audience {
+	case "mobile":
+		return mobile
+	case "desktop":
+		return !mobile
+	default:
+		return true
+	}
 }
 
 // NewHub creates a new Hub
@@ -62,6 +411,470 @@ func NewHub(maxMessageSize int64, rateLimitPerSec int) *Hub {
 		mu:              sync.RWMutex{},
 		maxMessageSize:  maxMessageSize,
 		rateLimitPerSec: rateLimitPerSec,
+		historySize:     DefaultHistorySize,
+		started:         time.Now(),
+		pingInterval:    DefaultPingInterval,
+		auditLog:        NopAuditLogger{},
+		senders:         make(map[string]*Client),
+		joinTimeout:     DefaultJoinApprovalTimeout,
+		pending:         make(map[string]*pendingJoin),
+		chunkTimeout:    DefaultChunkTimeout,
+		chunks:          make(map[chunkKey]*chunkTransfer),
+		pauseQueueSize:  DefaultPauseQueueSize,
+		sizeWarnRatio:   DefaultSizeWarnRatio,
+		reconnects:      make(map[string]reconnectGrant),
+		reconnectGrace:  DefaultReconnectGrace,
+
+		hostMaxMessageSize:   maxMessageSize,
+		clientMaxMessageSize: maxMessageSize,
+	}
+}
+
+// newRoomHub creates a new Hub with the same settings as h
+func (h *Hub) newRoomHub() *Hub {
+	room := NewHub(h.maxMessageSize, h.rateLimitPerSec)
+	room.SetGlobalRateLimit(h.globalRateLimit)
+	room.SetTypeRateLimits(h.typeRateLimits)
+	room.SetHistorySize(h.historySize)
+	room.SetMessageSizeLimits(h.hostMaxMessageSize, h.clientMaxMessageSize)
+	room.SetMessageWarnRatio(h.sizeWarnRatio)
+	room.presence = h.presence
+	room.allowUnknownTypes = h.allowUnknownTypes
+	room.fixedHost = h.fixedHost
+	room.noHost = h.noHost
+	room.SetMaxTextRunes(h.maxTextRunes)
+	room.e2eOnly = h.e2eOnly
+	room.SetLogContent(h.logContent)
+	room.SetAuditLogger(h.auditLog)
+	room.SetTranslator(h.translator)
+	room.SetMaxSessionLifetime(h.maxSessionLifetime, h.lifetimeExemptsHost)
+	room.SetJoinApproval(h.joinApproval, h.joinTimeout)
+	room.SetChunking(h.maxChunkedSize, h.chunkTimeout)
+	room.observers = h.observers
+	room.SetMessageTransformer(h.transformer)
+	room.SetReconnectGrace(h.reconnectGrace)
+	room.SetMaxMessagesPerConnection(h.maxMessagesPerConn)
+	room.SetPauseQueueSize(h.pauseQueueSize)
+	room.pingInterval = h.pingInterval
+	room.SetMissedPongTolerance(h.missedPongTolerance)
+	room.SetFirstMessageTimeout(h.firstMessageTimeout)
+	room.SetMaxClientsPerIP(h.maxClientsPerIP)
+	return room
+}
+
+// SetMessageSizeLimits sets separate message size limits for the host and for clients
+// Non-positive values fall back to the hub's max message size
+// Must be called before Run
+func (h *Hub) SetMessageSizeLimits(host, client int64) {
+	if host <= 0 {
+		host = h.maxMessageSize
+	}
+	if client <= 0 {
+		client = h.maxMessageSize
+	}
+	h.hostMaxMessageSize = host
+	h.clientMaxMessageSize = client
+}
+
+// MaxMessageSize returns the larger of the host and client message size limits
+func (h *Hub) MaxMessageSize() int64 {
+	return max(h.hostMaxMessageSize, h.clientMaxMessageSize)
+}
+
+// RateLimit returns the messages per second each client may send (0 or less disables)
+func (h *Hub) RateLimit() int {
+	return h.rateLimitPerSec
+}
+
+// messageLimit returns the message size limit for the given client ID
+func (h *Hub) messageLimit(clientID string) int64 {
+	if clientID == h.HostID() {
+		return h.hostMaxMessageSize
+	}
+	return h.clientMaxMessageSize
+}
+
+// DefaultSizeWarnRatio is the share of the size limit above which a sender is warned
+const DefaultSizeWarnRatio = 0.8
+
+// SetMessageWarnRatio warns senders whose accepted message is larger than ratio times their size limit
+// The warning lets the UI show that content is getting large before it is rejected
+// Ratios outside (0, 1) disable it. Must be called before Run
+func (h *Hub) SetMessageWarnRatio(ratio float64) {
+	if ratio <= 0 || ratio >= 1 {
+		ratio = 0
+	}
+	h.sizeWarnRatio = ratio
+}
+
+// SetLogContent includes message content, truncated to LogContentLength, in logs
+// Off by default so clipboard contents (often passwords) never reach the logs
+// Must be called before Run
+func (h *Hub) SetLogContent(enabled bool) {
+	h.logContent = enabled
+}
+
+// loggedContent returns content as it may appear in logs
+func (h *Hub) loggedContent(content string) string {
+	if !h.logContent {
+		return "[redacted]"
+	}
+	if runes := []rune(content); len(runes) > LogContentLength {
+		return string(runes[:LogContentLength]) + "…"
+	}
+	return content
+}
+
+// SetMaxSessionLifetime closes clients that have been connected longer than d (0 disables)
+// Unlike token expiry or an idle timeout, activity doesn't extend it; exemptHost spares the current host
+// Must be called before Run
+func (h *Hub) SetMaxSessionLifetime(d time.Duration, exemptHost bool) {
+	if d < 0 {
+		d = 0
+	}
+	h.maxSessionLifetime = d
+	h.lifetimeExemptsHost = exemptHost
+}
+
+// MaxSessionLifetime returns how long a client may stay connected (0 = unlimited)
+func (h *Hub) MaxSessionLifetime() time.Duration {
+	return h.maxSessionLifetime
+}
+
+// SetMaxMessagesPerConnection closes a WebSocket client once it has sent more than n messages (0 disables)
+// This catches slow floods that stay under the per-second rate limit. Must be called before Run
+func (h *Hub) SetMaxMessagesPerConnection(n int) {
+	if n < 0 {
+		n = 0
+	}
+	h.maxMessagesPerConn = n
+}
+
+// SetMaxTextRunes limits text messages to n characters (0 disables)
+// Must be called before Run
+func (h *Hub) SetMaxTextRunes(n int) {
+	if n < 0 {
+		n = 0
+	}
+	h.maxTextRunes = n
+}
+
+// checkContent validates the decoded size of the message content
+// Images are checked by their decoded byte length, text by its rune count
+func (h *Hub) checkContent(clientID string, msg Message) error {
+	switch msg.Type {
+	case "image":
+		data := msg.Content
+		// Accept data URLs as well as bare base64
+		if strings.HasPrefix(data, "data:") {
+			i := strings.Index(data, ";base64,")
+			if i < 0 {
+				return ErrInvalidContent
+			}
+			data = data[i+len(";base64,"):]
+		}
+		decoded, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			if decoded, err = base64.RawStdEncoding.DecodeString(data); err != nil {
+				return ErrInvalidContent
+			}
+		}
+		if limit := h.messageLimit(clientID); int64(len(decoded)) > limit {
+			log.Printf("Image too large from %s: %d decoded bytes (max: %d)", clientID, len(decoded), limit)
+			return ErrMessageTooLarge
+		}
+	case "text":
+		// Links may be rendered clickable, so block javascript:, data: and other schemes
+		if msg.Format == "url" && !isWebURL(msg.Content) {
+			log.Printf("Rejected non-http(s) link from %s", clientID)
+			return ErrInvalidURL
+		}
+		if h.maxTextRunes > 0 {
+			if n := utf8.RuneCountInString(msg.Content); n > h.maxTextRunes {
+				log.Printf("Text too long from %s: %d characters (max: %d)", clientID, n, h.maxTextRunes)
+				return ErrTextTooLong
+			}
+		}
+	}
+	return nil
+}
+
+// isWebURL reports whether s is an absolute http or https URL with a host
+func isWebURL(s string) bool {
+	u, err := url.Parse(strings.TrimSpace(s))
+	if err != nil || u.Host == "" {
+		return false
+	}
+	scheme := strings.ToLower(u.Scheme)
+	return scheme == "http" || scheme == "https"
+}
+
+// addClient registers client in both the lookup map and the ordered list
+// Caller must hold h.mu
+func (h *Hub) addClient(client *Client) {
+	h.clients[client.ID] = client
+	h.order = append(h.order, client)
+	h.observe(func(o HubObserver) { o.ClientConnected(client.ID, client.Mobile) })
+}
+
+// removeClient forgets a registered client, keeping the others in registration order
+// Caller must hold h.mu
+func (h *Hub) removeClient(id string) {
+	c, ok := h.clients[id]
+	if !ok {
+		return
+	}
+	h.clientDrops += c.dropped.Load()
+	h.observe(func(o HubObserver) { o.ClientDisconnected(id) })
+	delete(h.clients, id)
+	h.order = slices.DeleteFunc(h.order, func(c *Client) bool { return c.ID == id })
+	h.dropClientChunks(id)
+}
+
+// SetMaxClientsPerIP caps how many clients one IP address may have connected (0 disables)
+// This keeps a device opening many tabs from crowding others out. Must be called before Run
+func (h *Hub) SetMaxClientsPerIP(n int) {
+	h.maxClientsPerIP = max(n, 0)
+}
+
+// AtIPLimit reports whether ip already has the most clients allowed, counting ones awaiting approval
+func (h *Hub) AtIPLimit(ip string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.atIPLimit(ip)
+}
+
+// atIPLimit is AtIPLimit for callers holding h.mu
+func (h *Hub) atIPLimit(ip string) bool {
+	if h.maxClientsPerIP == 0 || ip == "" {
+		return false
+	}
+	n := 0
+	for _, c := range h.order {
+		if c.IP == ip {
+			n++
+		}
+	}
+	for _, p := range h.pending {
+		if p.client.IP == ip {
+			n++
+		}
+	}
+	return n >= h.maxClientsPerIP
+}
+
+// ClientIDs returns the connected clients' IDs in registration order
+func (h *Hub) ClientIDs() []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	ids := make([]string, len(h.order))
+	for i, c := range h.order {
+		ids[i] = c.ID
+	}
+	return ids
+}
+
+// broadcastPresence tells every client except clientID that it joined or left
+// Caller must hold h.mu
+func (h *Hub) broadcastPresence(event, clientID, reason string) {
+	if !h.presence {
+		return
+	}
+	msgBytes, err := json.Marshal(Presence{Type: "presence", Event: event, ClientID: clientID, Reason: reason, Clients: len(h.clients)})
+	if err != nil {
+		log.Printf("Failed to marshal presence message: %v", err)
+		return
+	}
+	for _, c := range h.order {
+		if c.ID == clientID {
+			continue
+		}
+		select {
+		case c.Send <- msgBytes:
+		default:
+			log.Printf("Client %s send channel full, dropping presence update", c.ID)
+			c.dropped.Add(1)
+		}
+	}
+}
+
+// SetHistorySize sets how many recent broadcasts are kept (0 disables history)
+// Must be called before Run
+func (h *Hub) SetHistorySize(size int) {
+	h.historySize = max(size, 0)
+}
+
+// recordHistory appends a broadcast to the history ring buffer
+// Caller must hold h.mu
+func (h *Hub) recordHistory(raw []byte) {
+	if h.historySize == 0 {
+		return
+	}
+	var msg Message
+	if err := json.Unmarshal(raw, &msg); err != nil || msg.Content == "" || msg.Type == "title" {
+		return
+	}
+	h.history = append(h.history, HistoryEntry{
+		Type:      msg.Type,
+		Content:   msg.Content,
+		From:      msg.From,
+		Timestamp: time.Now(),
+	})
+	if over := len(h.history) - h.historySize; over > 0 {
+		h.history = slices.Delete(h.history, 0, over)
+	}
+}
+
+// SetTitle sets the session title shown to clients, truncated to MaxTitleLength
+func (h *Hub) SetTitle(title string) {
+	title = strings.TrimSpace(title)
+	if runes := []rune(title); len(runes) > MaxTitleLength {
+		title = string(runes[:MaxTitleLength])
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.title = title
+}
+
+// Title returns the current session title
+func (h *Hub) Title() string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.title
+}
+
+// History returns a copy of the recent broadcasts, oldest first
+func (h *Hub) History() []HistoryEntry {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return slices.Clone(h.history)
+}
+
+// SetGlobalRateLimit caps total broadcasts per second across all clients (0 disables)
+// Must be called before Run
+func (h *Hub) SetGlobalRateLimit(perSec int) {
+	h.globalRateLimit = perSec
+	h.globalTokens = float64(perSec)
+	h.globalLastRefill = time.Now()
+}
+
+// SetTypeRateLimits gives message types their own per-client limit in messages per second
+// Each listed type is counted separately; the rest share the hub's rate limit. Must be called before Run
+func (h *Hub) SetTypeRateLimits(limits map[string]int) {
+	h.typeRateLimits = make(map[string]int, len(limits))
+	for msgType, perSec := range limits {
+		if perSec > 0 {
+			h.typeRateLimits[msgType] = perSec
+		}
+	}
+}
+
+// allowGlobal takes a token from the global bucket, refilling it at globalRateLimit per second
+func (h *Hub) allowGlobal() bool {
+	if h.globalRateLimit <= 0 {
+		return true
+	}
+
+	now := time.Now()
+	h.globalTokens += now.Sub(h.globalLastRefill).Seconds() * float64(h.globalRateLimit)
+	h.globalLastRefill = now
+	if limit := float64(h.globalRateLimit); h.globalTokens > limit {
+		h.globalTokens = limit
+	}
+
+	if h.globalTokens < 1 {
+		return false
+	}
+	h.globalTokens--
+	return true
+}
+
+// nack tells a client its message was not delivered
+// Caller must hold h.mu
+func (h *Hub) nack(clientID, reason string) {
+	client, ok := h.clients[clientID]
+	if !ok {
+		return
+	}
+	msgBytes, err := json.Marshal(Message{Type: "nack", Content: reason})
+	if err != nil {
+		log.Printf("Failed to marshal nack message: %v", err)
+		return
+	}
+	select {
+	case client.Send <- msgBytes:
+	default:
+		log.Printf("Client %s send channel full, dropping nack", clientID)
+		client.dropped.Add(1)
+	}
+}
+
+// IsRunning reports whether the hub has not been stopped
+func (h *Hub) IsRunning() bool {
+	select {
+	case <-h.stop:
+		return false
+	default:
+		return true
+	}
+}
+
+// notifyHostChanged tells every client who the new host is after a promotion
+// Caller must hold h.mu
+func (h *Hub) notifyHostChanged() {
+	hostID := h.hostID
+	h.observe(func(o HubObserver) { o.HostChanged(hostID) })
+	msgBytes, err := json.Marshal(Message{Type: "host_changed", Content: h.hostID})
+	if err != nil {
+		log.Printf("Failed to marshal host change message: %v", err)
+		return
+	}
+	for _, c := range h.order {
+		select {
+		case c.Send <- msgBytes:
+		default:
+			log.Printf("Client %s send channel full, dropping host change", c.ID)
+			c.dropped.Add(1)
+		}
+	}
+}
+
+// demoteHost tells a replaced host that it is now a client and announces the new host
+// Caller must hold h.mu
+func (h *Hub) demoteHost(c *Client) {
+	msgBytes, err := json.Marshal(Message{Type: "role", Role: "client"})
+	if err != nil {
+		log.Printf("Failed to marshal role message: %v", err)
+		return
+	}
+	select {
+	case c.Send <- msgBytes:
+		log.Printf("Client %s demoted to client", c.ID)
+	default:
+		log.Printf("Client %s send channel full, dropping demotion", c.ID)
+		c.dropped.Add(1)
+	}
+	h.notifyHostChanged()
+}
+
+// sendWelcome sends the welcome message to a newly joined client
+// Caller must hold h.mu
+func (h *Hub) sendWelcome(client *Client) {
+	msgBytes, err := json.Marshal(Welcome{
+		Type:           "welcome",
+		Title:          h.title,
+		ServerTime:     time.Now().UnixMilli(),
+		ReconnectToken: h.issueReconnectToken(client),
+	})
+	if err != nil {
+		log.Printf("Failed to marshal welcome message: %v", err)
+		return
+	}
+	select {
+	case client.Send <- msgBytes:
+	default:
+		log.Printf("Client %s send channel full, dropping welcome", client.ID)
+		client.dropped.Add(1)
 	}
 }
 
@@ -70,49 +883,189 @@ func (h *Hub) Done() <-chan struct{} {
 	return h.stop
 }
 
+// admit adds client to the session, assigns its role and announces it
+// Caller must hold h.mu
+func (h *Hub) admit(client *Client) {
+	h.addClient(client)
+
+	// First client becomes host; a host secret holder takes over from the current one
+	var demoted *Client
+	if h.noHost {
+		log.Printf("Client connected: %s (mobile: %v)", client.ID, client.Mobile)
+	} else if h.hostID == "" {
+		h.hostID = client.ID
+		log.Printf("Client %s is now HOST (mobile: %v)", client.ID, client.Mobile)
+		h.observe(func(o HubObserver) { o.HostChanged(client.ID) })
+	} else if client.ClaimHost {
+		demoted = h.clients[h.hostID]
+		h.hostID = client.ID
+		log.Printf("Client %s claimed HOST with the host secret (mobile: %v)", client.ID, client.Mobile)
+	} else {
+		log.Printf("Client connected: %s (mobile: %v)", client.ID, client.Mobile)
+	}
+
+	// Send role assignment to this client
+	role := "client"
+	if client.ID == h.hostID {
+		role = "host"
+	}
+	roleMsg := Message{Type: "role", Role: role}
+	msgBytes, err := json.Marshal(roleMsg)
+	if err != nil {
+		log.Printf("Failed to marshal role message: %v", err)
+		return
+	}
+	select {
+	case client.Send <- msgBytes:
+	case <-time.After(500 * time.Millisecond):
+		log.Printf("Client %s send channel full/blocked, failed role assignment. Closing.", client.ID)
+		if client.Conn != nil {
+			client.Conn.Close()
+		}
+		h.removeClient(client.ID)
+		return
+	}
+
+	// Tell joining clients which session they reached
+	if role == "client" {
+		h.sendWelcome(client)
+	}
+	if demoted != nil {
+		h.demoteHost(demoted)
+	}
+	h.sendRestored(client)
+	h.broadcastPresence("join", client.ID, "")
+}
+
+// Large broadcasts are split across up to maxBroadcastWorkers goroutines, each sending to
+// fanOutChunk or more clients; smaller audiences are served inline
+const (
+	maxBroadcastWorkers = 8
+	fanOutChunk         = 32
+)
+
+// deliver records msg and offers it to every recipient in registration order, kicking clients whose queue is full
+// h.mu is held only to snapshot the recipients and to remove kicked clients, not while sending
+func (h *Hub) deliver(msg BroadcastMessage) Delivery {
+	h.mu.Lock()
+	h.messagesBroadcast++
+	h.bytesBroadcast += int64(len(msg.Message))
+	h.recordHistory(msg.Message)
+	recipients := make([]*Client, 0, len(h.order))
+	for _, client := range h.order {
+		// Don't send back to the sender unless it asked for an echo
+		if (client.ID != msg.From || msg.Echo) && audienceIncludes(msg.Audience, client.Mobile) {
+			recipients = append(recipients, client)
+		}
+	}
+	h.mu.Unlock()
+
+	// Queued before fanning out, so a message anyone has received is saved by the time Stop returns
+	h.persistLast(msg)
+	full := fanOut(recipients, msg.Message)
+	h.observe(func(o HubObserver) { o.MessageBroadcast(msg.From, msg.Type, len(msg.Message)) })
+	result := Delivery{Delivered: len(recipients) - len(full), Dropped: len(full)}
+	if len(full) == 0 {
+		return result
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, client := range full {
+		dropped := client.dropped.Add(1)
+		log.Printf("Client %s send channel full, removing from hub (dropped: %d)", client.ID, dropped)
+		h.audit(AuditKicked, client.ID, "send queue full")
+		h.messagesDropped++
+		h.slowClients++
+		h.removeClient(client.ID)
+		go client.closeSlow()
+	}
+	return result
+}
+
+// fanOut offers payload to each recipient without blocking and returns those whose queue was full,
+// in recipient order
+func fanOut(recipients []*Client, payload []byte) []*Client {
+	full := make([]bool, len(recipients))
+	send := func(lo, hi int) {
+		for i := lo; i < hi; i++ {
+			full[i] = !recipients[i].offer(payload)
+		}
+	}
+
+	workers := min(maxBroadcastWorkers, (len(recipients)+fanOutChunk-1)/fanOutChunk)
+	if workers <= 1 {
+		send(0, len(recipients))
+	} else {
+		var wg sync.WaitGroup
+		per := (len(recipients) + workers - 1) / workers
+		for lo := 0; lo < len(recipients); lo += per {
+			hi := min(lo+per, len(recipients))
+			wg.Go(func() { send(lo, hi) })
+		}
+		wg.Wait()
+	}
+
+	var kicked []*Client
+	for i, f := range full {
+		if f {
+			kicked = append(kicked, recipients[i])
+		}
+	}
+	return kicked
+}
+
+// offer queues payload for c without blocking, reporting false when the queue is full
+// A closed client counts as served since it is already leaving
+func (c *Client) offer(payload []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return true
+	}
+	select {
+	case c.Send <- payload:
+		return true
+	default:
+		return false
+	}
+}
+
 // Run starts the hub's main loop
 func (h *Hub) Run() {
 	for {
 		select {
 		case client := <-h.Register:
 			h.mu.Lock()
-			h.clients[client.ID] = client
-
-			// First client becomes host
-			if h.hostID == "" {
-				h.hostID = client.ID
-				log.Printf("Client %s is now HOST (mobile: %v)", client.ID, client.Mobile)
+			var released []BroadcastMessage
+			prevHost := h.hostID
+			if h.atIPLimit(client.IP) {
+				log.Printf("Client %s rejected: %s already has %d clients", client.ID, client.IP, h.maxClientsPerIP)
+				h.sendControl(client, Message{Type: "error", Content: client.localize("errors.too_many_clients_ip", "Too many connections from this address.")})
+				client.closeSend()
+			} else if !h.claimResume(client) {
+				log.Printf("Client %s rejected: reconnect token no longer valid", client.ID)
+				h.sendControl(client, Message{Type: "error", Content: client.localize("errors.reconnect_invalid", "Reconnect token no longer valid. Scan the QR code again.")})
+				client.closeSend()
+			} else if h.needsApproval(client) {
+				h.holdForApproval(client)
 			} else {
-				log.Printf("Client connected: %s (mobile: %v)", client.ID, client.Mobile)
-			}
-
-			// Send role assignment to this client
-			role := "client"
-			if client.ID == h.hostID {
-				role = "host"
+				h.admit(client)
 			}
-			roleMsg := Message{Type: "role", Role: role}
-			msgBytes, err := json.Marshal(roleMsg)
-			if err != nil {
-				log.Printf("Failed to marshal role message: %v", err)
-				h.mu.Unlock()
-				continue
-			}
-			select {
-			case client.Send <- msgBytes:
-			case <-time.After(500 * time.Millisecond):
-				log.Printf("Client %s send channel full/blocked, failed role assignment. Closing.", client.ID)
-				client.Conn.Close()
-				delete(h.clients, client.ID)
-				continue
+			if prevHost != "" && h.hostID != prevHost {
+				released = h.endPause()
 			}
-
 			h.mu.Unlock()
+			for _, msg := range released {
+				h.deliver(msg)
+			}
 
 		case client := <-h.Unregister:
 			h.mu.Lock()
+			var released []BroadcastMessage
 			if _, ok := h.clients[client.ID]; ok {
-				delete(h.clients, client.ID)
+				h.removeClient(client.ID)
+				h.graceReconnect(client)
 				// Safely close the Send channel only if not already closed
 				client.mu.Lock()
 				if !client.closed {
@@ -121,11 +1074,21 @@ func (h *Hub) Run() {
 				}
 				client.mu.Unlock()
 
-				// If host disconnects, assign new host
+				// A pause ends with the host that set it
 				if client.ID == h.hostID {
+					released = h.endPause()
+				}
+
+				// If host disconnects, assign new host (unless the host slot is reserved)
+				if client.ID == h.hostID && h.fixedHost {
 					h.hostID = ""
-					// Assign first remaining client as new host
-					for id, c := range h.clients {
+					log.Printf("Host %s left, waiting for it to reconnect (fixed host)", client.ID)
+					h.observe(func(o HubObserver) { o.HostChanged("") })
+				} else if client.ID == h.hostID {
+					h.hostID = ""
+					// Assign the longest-connected remaining client as new host
+					for _, c := range h.order {
+						id := c.ID
 						h.hostID = id
 						newHostMsg := Message{Type: "role", Role: "host"}
 						msgBytes, err := json.Marshal(newHostMsg)
@@ -141,34 +1104,70 @@ func (h *Hub) Run() {
 						}
 						break
 					}
+					if h.hostID != "" {
+						h.notifyHostChanged()
+					} else {
+						h.observe(func(o HubObserver) { o.HostChanged("") })
+					}
 				}
 
-				log.Printf("Client disconnected: %s", client.ID)
+				client.mu.Lock()
+				reason := client.byeReason
+				sent := client.messagesSent
+				client.mu.Unlock()
+				dropped := client.dropped.Load()
+				h.broadcastPresence("leave", client.ID, reason)
+
+				duration := time.Since(client.connectedAt).Round(time.Millisecond)
+				if reason != "" {
+					log.Printf("Client disconnected: client_id=%s mobile=%t duration=%s messages_sent=%d dropped=%d reason=%q",
+						client.ID, client.Mobile, duration, sent, dropped, h.loggedContent(reason))
+				} else {
+					log.Printf("Client disconnected: client_id=%s mobile=%t duration=%s messages_sent=%d dropped=%d",
+						client.ID, client.Mobile, duration, sent, dropped)
+				}
+			} else {
+				h.dropPending(client)
 			}
 			h.mu.Unlock()
+			for _, msg := range released {
+				h.deliver(msg)
+			}
 
 		case broadcastMsg := <-h.broadcast:
 			h.mu.Lock()
-			for id, client := range h.clients {
-				// Don't send back to the sender
-				if id != broadcastMsg.From {
-					select {
-					case client.Send <- broadcastMsg.Message:
-					default:
-						log.Printf("Client %s send channel full, removing from hub", id)
-						// Safely close the Send channel only if not already closed
-						client.mu.Lock()
-						if !client.closed {
-							close(client.Send)
-							client.closed = true
-						}
-						client.mu.Unlock()
-						delete(h.clients, id)
-					}
-				}
+			if !h.allowGlobal() {
+				log.Printf("Global rate limit exceeded (%d/sec), dropping message from %s", h.globalRateLimit, broadcastMsg.From)
+				h.audit(AuditRateLimited, broadcastMsg.From, "global limit")
+				h.nack(broadcastMsg.From, "Server is busy, message was not delivered. Please try again.")
+				h.messagesDropped++
+				h.mu.Unlock()
+				broadcastMsg.report(Delivery{}, ErrBroadcastFull)
+				continue
+			}
+
+			// The host's pause and resume notices reach everyone; content waits while paused
+			var queued []BroadcastMessage
+			switch {
+			case broadcastMsg.Type == "pause":
+				h.paused = true
+			case broadcastMsg.Type == "resume":
+				h.paused = false
+				queued = h.takePaused()
+			case h.paused && pausedTypes[broadcastMsg.Type]:
+				broadcastMsg.report(Delivery{}, nil)
+				broadcastMsg.result = nil
+				h.holdPaused(broadcastMsg)
+				h.mu.Unlock()
+				continue
 			}
 			h.mu.Unlock()
 
+			broadcastMsg.report(h.deliver(broadcastMsg), nil)
+			for _, msg := range queued {
+				h.deliver(msg)
+			}
+
 		case <-h.stop:
 			// Stop signal received, exit the loop
 			return
@@ -179,109 +1178,489 @@ func (h *Hub) Run() {
 // Stop gracefully stops the hub
 func (h *Hub) Stop() {
 	h.mu.Lock()
-	defer h.mu.Unlock()
 	select {
 	case <-h.stop:
 		// Already stopped
 	default:
 		close(h.stop)
 	}
+	h.mu.Unlock()
+
+	// Wait for the last message to reach the disk (see SetPersistLast)
+	if h.persistDone != nil {
+		<-h.persistDone
+	}
+}
+
+// NotifyShutdown sends every connected client a "shutdown" message so it can tell the user
+// the server is going away instead of reporting a lost connection
+func (h *Hub) NotifyShutdown() {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, c := range h.order {
+		h.sendControl(c, Message{Type: "shutdown"})
+	}
 }
 
-// checkRateLimit checks if client has exceeded rate limit using sliding window
-func (c *Client) checkRateLimit(hub *Hub) bool {
+// DisconnectAll sends every client, pending ones included, a message of type msgType and closes its connection
+// The room is left without a host. Returns the number of clients disconnected
+func (h *Hub) DisconnectAll(msgType string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	n := 0
+	for _, c := range slices.Clone(h.order) {
+		h.sendControl(c, Message{Type: msgType})
+		c.closeSend()
+		h.removeClient(c.ID)
+		n++
+	}
+	for id, p := range h.pending {
+		p.timer.Stop()
+		delete(h.pending, id)
+		h.sendControl(p.client, Message{Type: msgType})
+		p.client.closeSend()
+		n++
+	}
+	if h.hostID != "" {
+		h.hostID = ""
+		h.observe(func(o HubObserver) { o.HostChanged("") })
+	}
+	return n
+}
+
+// Clients throttled this many times within RateLimitWarnWindow trigger a tuning warning
+const (
+	RateLimitWarnThreshold = 10
+	RateLimitWarnWindow    = time.Minute
+)
+
+// noteThrottled counts a rate limit rejection and warns once per window when it happens often
+// Caller must hold c.mu
+func (c *Client) noteThrottled(now time.Time, msgType string) {
+	if now.Sub(c.throttledSince) >= RateLimitWarnWindow {
+		c.throttled = 0
+		c.throttledSince = now
+	}
+	c.throttled++
+	if c.throttled == RateLimitWarnThreshold {
+		if perSec, ok := c.Hub.typeRateLimits[msgType]; ok {
+			log.Printf("Warning: client %s hit the %q rate limit %d times within %v; consider raising --type-rate-limit (currently %d/sec)",
+				c.ID, msgType, c.throttled, RateLimitWarnWindow, perSec)
+			return
+		}
+		log.Printf("Warning: client %s hit the rate limit %d times within %v; consider raising --rate-limit (currently %d/sec)",
+			c.ID, c.throttled, RateLimitWarnWindow, c.Hub.rateLimitPerSec)
+	}
+}
+
+// rateWindow counts a client's messages of one type within the sliding window
+type rateWindow struct {
+	last  time.Time
+	count int
+}
+
+// checkRateLimit checks if client has exceeded the rate limit for msgType using sliding window
+func (c *Client) checkRateLimit(hub *Hub, msgType string) bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	limit := hub.rateLimitPerSec
+	last, count := &c.lastMessage, &c.messageCount
+	if perSec, ok := hub.typeRateLimits[msgType]; ok {
+		if c.typeWindows == nil {
+			c.typeWindows = make(map[string]*rateWindow)
+		}
+		w, ok := c.typeWindows[msgType]
+		if !ok {
+			w = &rateWindow{}
+			c.typeWindows[msgType] = w
+		}
+		limit, last, count = perSec, &w.last, &w.count
+	}
+
 	now := time.Now()
-	timeSinceLast := now.Sub(c.lastMessage)
+	timeSinceLast := now.Sub(*last)
 
 	// Reset count if more than a second has passed
 	if timeSinceLast >= time.Second {
-		c.messageCount = 1 // Count this message
-		c.lastMessage = now
+		*count = 1 // Count this message
+		*last = now
 		return true
 	}
 
 	// Check if rate limit exceeded BEFORE incrementing
-	if c.messageCount >= hub.rateLimitPerSec {
-		log.Printf("Rate limit exceeded for client %s", c.ID)
+	if *count >= limit {
+		log.Printf("Rate limit exceeded for client %s (type: %s)", c.ID, msgType)
+		c.noteThrottled(now, msgType)
 		return false
 	}
 
-	c.messageCount++
-	c.lastMessage = now // Update timestamp on each message to prevent burst attacks
+	*count++
+	*last = now // Update timestamp on each message to prevent burst attacks
 	return true
 }
 
+// lastActive returns when the client last sent a message of any type
+// Caller must hold c.mu
+func (c *Client) lastActive() time.Time {
+	last := c.lastMessage
+	for _, w := range c.typeWindows {
+		if w.last.After(last) {
+			last = w.last
+		}
+	}
+	return last
+}
+
+// flushCloseDelay is how long ReadPump lets WritePump flush a parting notice before closing the connection itself
+const flushCloseDelay = time.Second
+
 // ReadPump reads messages from the WebSocket connection
 func (c *Client) ReadPump() {
+	// Set when a parting notice is queued: unregistering closes Send, and WritePump closes the
+	// connection once the notice is written
+	flush := false
 	defer func() {
 		select {
 		case c.Hub.Unregister <- c:
 		case <-c.Hub.stop:
 		}
-		c.Conn.Close()
+		if flush {
+			time.AfterFunc(flushCloseDelay, func() { c.Conn.Close() })
+		} else {
+			c.Conn.Close()
+		}
 	}()
 
-	c.Conn.SetReadLimit(c.Hub.maxMessageSize + 1024)
-	c.Conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+	// Until the first message arrives, pongs can't push the deadline past the greeting window
+	var greetBy time.Time
+	if d := c.Hub.firstMessageTimeout; d > 0 {
+		greetBy = time.Now().Add(d)
+	}
+	readDeadline := func() time.Time {
+		deadline := time.Now().Add(c.Hub.readTimeout())
+		if !greetBy.IsZero() && greetBy.Before(deadline) {
+			return greetBy
+		}
+		return deadline
+	}
+
+	// Clients can be promoted to host, so read up to the larger of the two limits
+	c.Conn.SetReadLimit(c.Hub.MaxMessageSize() + 1024)
+	c.Conn.SetReadDeadline(readDeadline())
 	c.Conn.SetPongHandler(func(string) error {
-		c.Conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+		c.notePong()
+		c.Conn.SetReadDeadline(readDeadline())
 		return nil
 	})
 
 	for {
 		_, message, err := c.Conn.ReadMessage()
 		if err != nil {
+			if !greetBy.IsZero() && !time.Now().Before(greetBy) {
+				log.Printf("Client %s sent nothing within %v, disconnecting", c.ID, c.Hub.firstMessageTimeout)
+				c.Hub.audit(AuditKicked, c.ID, "no first message")
+			}
 			break
 		}
+		if !greetBy.IsZero() {
+			greetBy = time.Time{}
+			c.Conn.SetReadDeadline(readDeadline())
+		}
 
-		// Check message size
-		if int64(len(message)) > c.Hub.maxMessageSize {
-			log.Printf("Message too large from %s: %d bytes (max: %d)", c.ID, len(message), c.Hub.maxMessageSize)
-			errorMsg := Message{Type: "error", Content: fmt.Sprintf("Message too large. Maximum size is %d bytes.", c.Hub.maxMessageSize)}
-			errorBytes, _ := json.Marshal(errorMsg)
-			c.Conn.WriteMessage(websocket.TextMessage, errorBytes)
-			continue
+		// A "bye" ends the session gracefully; the deferred unregister announces the reason
+		if reason, ok := parseBye(message); ok {
+			c.mu.Lock()
+			c.byeReason = reason
+			c.mu.Unlock()
+			log.Printf("Client %s said bye: %q", c.ID, c.Hub.loggedContent(reason))
+			return
 		}
 
-		// Check rate limit
-		if !c.checkRateLimit(c.Hub) {
-			errorMsg := Message{Type: "error", Content: fmt.Sprintf("Rate limit exceeded. Maximum %d messages per second allowed.", c.Hub.rateLimitPerSec)}
-			errorBytes, _ := json.Marshal(errorMsg)
-			c.Conn.WriteMessage(websocket.TextMessage, errorBytes)
-			continue
+		c.messagesRead++
+		if limit := c.Hub.maxMessagesPerConn; limit > 0 && c.messagesRead > limit {
+			log.Printf("Client %s exceeded its quota of %d messages, disconnecting", c.ID, limit)
+			c.Hub.audit(AuditKicked, c.ID, "message quota exceeded")
+			c.Hub.sendControl(c, Message{Type: "error", Content: "message quota exceeded"})
+			flush = true
+			return
 		}
 
-		// Parse message
-		var msg Message
-		if err := json.Unmarshal(message, &msg); err == nil {
-			// Broadcast to all other clients (not back to sender)
-			msg.From = c.ID
-			msgBytes, err := json.Marshal(msg)
-			if err != nil {
-				log.Printf("Failed to marshal message from %s: %v", c.ID, err)
-				continue
+		if err := c.Submit(message); err != nil {
+			if errors.Is(err, ErrMalformed) {
+				now := time.Now()
+				if now.Sub(c.lastMalformedReply) < malformedReplyInterval {
+					continue
+				}
+				c.lastMalformedReply = now
+				log.Printf("Malformed message from %s: %v", c.ID, err)
 			}
-			broadcastMsg := BroadcastMessage{
-				Message: msgBytes,
-				From:    c.ID,
+			// Queued rather than written here: only WritePump may write data frames to the connection
+			if content := c.errorMessage(err); content != "" {
+				c.Hub.sendControl(c, Message{Type: "error", Content: content})
 			}
-			c.Hub.broadcast <- broadcastMsg
-			log.Printf("Message from %s (type: %s, bytes: %d)", c.ID, msg.Type, len(msg.Content))
 		}
 	}
 }
 
+// parseBye reports whether message is a "bye" and returns its truncated reason
+func parseBye(message []byte) (string, bool) {
+	var msg Message
+	if err := json.Unmarshal(message, &msg); err != nil || msg.Type != "bye" {
+		return "", false
+	}
+	reason := strings.TrimSpace(msg.Content)
+	if runes := []rune(reason); len(runes) > MaxByeReasonLength {
+		reason = string(runes[:MaxByeReasonLength])
+	}
+	if reason == "" {
+		reason = "bye"
+	}
+	return reason, true
+}
+
+// Submit checks size and rate limits, then broadcasts a raw JSON message from this client
+// Used by ReadPump and by HTTP transports that have no WebSocket connection
+func (c *Client) Submit(message []byte) error {
+	return c.submitRaw(message, func(msg Message) error {
+		return c.Hub.Broadcast(msg, c.ID)
+	})
+}
+
+// SubmitWait is Submit, but waits for the hub to fan the message out and reports who received it
+// Messages the hub handles itself (greetings, join decisions, chunk parts) report no delivery
+func (c *Client) SubmitWait(ctx context.Context, message []byte) (Delivery, error) {
+	var delivery Delivery
+	err := c.submitRaw(message, func(msg Message) error {
+		var err error
+		delivery, err = c.Hub.BroadcastWait(ctx, msg, c.ID)
+		return err
+	})
+	return delivery, err
+}
+
+// submitRaw parses and checks a raw message, handing it to broadcast once it passes
+func (c *Client) submitRaw(message []byte, broadcast func(Message) error) error {
+	// Check message size against the host or client limit
+	if limit := c.Hub.messageLimit(c.ID); int64(len(message)) > limit {
+		log.Printf("Message too large from %s: %d bytes (max: %d)", c.ID, len(message), limit)
+		return ErrMessageTooLarge
+	}
+
+	// Parse message; malformed messages still count against the rate limit
+	var msg Message
+	parseErr := json.Unmarshal(message, &msg)
+
+	// Check rate limit
+	if !c.checkRateLimit(c.Hub, msg.Type) {
+		c.Hub.mu.Lock()
+		c.Hub.rateLimited++
+		c.Hub.mu.Unlock()
+		c.Hub.audit(AuditRateLimited, c.ID, "per-client limit")
+		return ErrRateLimited
+	}
+
+	if parseErr != nil {
+		return fmt.Errorf("%w: %v", ErrMalformed, parseErr)
+	}
+	return c.submit(msg, len(message), broadcast)
+}
+
+// submit checks and broadcasts a parsed message of size bytes; reassembled chunked messages come back through here
+func (c *Client) submit(msg Message, size int, broadcast func(Message) error) error {
+	if !knownTypes[msg.Type] && !c.Hub.allowUnknownTypes {
+		log.Printf("Unknown message type from %s: %q", c.ID, msg.Type)
+		return ErrUnknownType
+	}
+
+	// A greeting only shows the client is alive (see SetFirstMessageTimeout); it isn't relayed
+	if msg.Type == "hello" {
+		return nil
+	}
+
+	switch msg.Audience {
+	case "", "all", "mobile", "desktop":
+	default:
+		return ErrInvalidAudience
+	}
+
+	if metaSize(msg.Meta) > MaxMetaSize {
+		return ErrMetaTooLarge
+	}
+
+	if err := validateMessage(msg); err != nil {
+		log.Printf("Rejected message from %s: %v", c.ID, err)
+		return err
+	}
+
+	// Pings are answered by the hub and round-trip reports recorded, even while waiting for approval; neither is relayed
+	switch msg.Type {
+	case "ping":
+		c.Hub.pong(c, msg)
+		return nil
+	case "rtt":
+		return c.recordRTT(msg)
+	}
+
+	if c.Hub.isPending(c.ID) {
+		return ErrPendingApproval
+	}
+
+	// Parts of a larger message are held until the last one arrives, then the whole is checked like any other
+	if msg.Type == "chunk" {
+		assembled, err := c.Hub.addChunk(c.ID, msg)
+		if err != nil || assembled == nil {
+			return err
+		}
+		var whole Message
+		if err := json.Unmarshal(assembled, &whole); err != nil {
+			return &SchemaError{Type: msg.Type, Reason: "reassembled content is not a message"}
+		}
+		if whole.Type == "chunk" {
+			return &SchemaError{Type: msg.Type, Reason: "chunks can't be nested"}
+		}
+		return c.submit(whole, len(assembled), broadcast)
+	}
+
+	// "e2e" content is encrypted by the clients and relayed without inspection
+	if c.Hub.e2eOnly && (msg.Type == "text" || msg.Type == "image") {
+		return ErrPlaintext
+	}
+
+	if err := c.Hub.checkContent(c.ID, msg); err != nil {
+		return err
+	}
+
+	// Only the host may label the session
+	if msg.Type == "title" {
+		if c.ID != c.Hub.HostID() {
+			return ErrNotHost
+		}
+		c.Hub.SetTitle(msg.Content)
+		msg.Content = c.Hub.Title()
+	}
+
+	// Only the host may hold back delivery; clients are told so they can show it
+	if (msg.Type == "pause" || msg.Type == "resume") && c.ID != c.Hub.HostID() {
+		return ErrNotHost
+	}
+
+	// Join decisions go to the hub, never to other clients
+	if msg.Type == "approve" || msg.Type == "deny" {
+		if c.ID != c.Hub.HostID() {
+			return ErrNotHost
+		}
+		if !c.Hub.resolveJoin(msg.Content, msg.Type == "approve") {
+			log.Printf("Host %s answered unknown join request %q", c.ID, msg.Content)
+		}
+		return nil
+	}
+
+	msg, keep := c.Hub.transform(c.ID, msg)
+	if !keep {
+		return nil
+	}
+
+	if err := broadcast(msg); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.messagesSent++
+	c.mu.Unlock()
+	if ratio := c.Hub.sizeWarnRatio; ratio > 0 && float64(size) > ratio*float64(c.Hub.messageLimit(c.ID)) {
+		c.Hub.sendControl(c, Message{Type: "warning", Content: "approaching size limit"})
+	}
+	if c.Hub.logContent {
+		log.Printf("Message from %s (type: %s, bytes: %d): %q", c.ID, msg.Type, len(msg.Content), c.Hub.loggedContent(msg.Content))
+	} else {
+		log.Printf("Message from %s (type: %s, bytes: %d)", c.ID, msg.Type, len(msg.Content))
+	}
+	return nil
+}
+
+// Broadcast queues msg from the given client ID for every other client (and the sender too if msg.Echo is set)
+// It never blocks: ErrBroadcastFull is returned when the queue is full, ErrHubStopped once the hub stops
+func (h *Hub) Broadcast(msg Message, from string) error {
+	return h.queue(msg, from, nil)
+}
+
+// BroadcastWait is Broadcast, but waits until the hub has fanned the message out and reports who received it
+// It gives up when ctx ends or the hub stops; ErrBroadcastFull also covers the global rate limit dropping it
+func (h *Hub) BroadcastWait(ctx context.Context, msg Message, from string) (Delivery, error) {
+	result := make(chan deliveryResult, 1)
+	if err := h.queue(msg, from, result); err != nil {
+		return Delivery{}, err
+	}
+	select {
+	case r := <-result:
+		return r.Delivery, r.err
+	case <-h.stop:
+		return Delivery{}, ErrHubStopped
+	case <-ctx.Done():
+		return Delivery{}, ctx.Err()
+	}
+}
+
+// queue hands msg to the hub loop without blocking, with an optional channel for the outcome
+func (h *Hub) queue(msg Message, from string, result chan<- deliveryResult) error {
+	msg.From = from
+	msgBytes, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("Failed to marshal message from %s: %v", from, err)
+		return err
+	}
+	// The broadcast channel is buffered, so check explicitly rather than queueing into a dead hub
+	if !h.IsRunning() {
+		return ErrHubStopped
+	}
+	select {
+	case h.broadcast <- BroadcastMessage{Message: msgBytes, From: from, Echo: msg.Echo, Audience: msg.Audience, Type: msg.Type, result: result}:
+		return nil
+	default:
+		log.Printf("Broadcast queue full, dropping message from %s", from)
+		h.mu.Lock()
+		h.messagesDropped++
+		h.mu.Unlock()
+		return ErrBroadcastFull
+	}
+}
+
+// slowCloseReason is the close frame reason sent to a client dropped for not keeping up
+const slowCloseReason = "send buffer full"
+
+// closeSlow makes one attempt to tell a client that fell behind why it is being disconnected, then closes it
+// It can block for a second on a stalled connection, so the hub runs it on its own goroutine
+func (c *Client) closeSlow() {
+	if c.Conn != nil {
+		closeMsg := websocket.FormatCloseMessage(websocket.CloseTryAgainLater, slowCloseReason)
+		if err := c.Conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second)); err != nil {
+			log.Printf("Failed to send close frame to client %s: %v", c.ID, err)
+		}
+	}
+	c.closeSend()
+}
+
 // WritePump writes messages to the WebSocket connection
 func (c *Client) WritePump() {
 	defer c.Conn.Close()
 
 	// Send periodic pings to detect dead connections
-	ticker := time.NewTicker(30 * time.Second)
+	jitter := c.jitter
+	if jitter == nil {
+		jitter = rand.Float64
+	}
+	ticker := time.NewTicker(jitteredInterval(c.Hub.pingInterval, jitter()))
 	defer ticker.Stop()
 
+	// Fires once the client reaches the hub's max session lifetime, never when it's disabled
+	var expired <-chan time.Time
+	if end, ok := c.LifetimeEnd(); ok {
+		timer := time.NewTimer(time.Until(end))
+		defer timer.Stop()
+		expired = timer.C
+	}
+
 	for {
 		select {
 		case message, ok := <-c.Send:
@@ -293,16 +1672,137 @@ func (c *Client) WritePump() {
 				return
 			}
 		case <-ticker.C:
+			if !c.notePing() {
+				return
+			}
 			if err := c.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				log.Printf("Ping error for client %s: %v", c.ID, err)
 				return
 			}
+		case <-expired:
+			if c.LifetimeExempt() {
+				expired = nil
+				continue
+			}
+			// Closing the connection ends ReadPump, which unregisters the client
+			log.Printf("Client %s reached the max session lifetime (%s), closing", c.ID, c.Hub.maxSessionLifetime)
+			if msgBytes, err := json.Marshal(Message{Type: "session_expired"}); err == nil {
+				c.Conn.WriteMessage(websocket.TextMessage, msgBytes)
+			}
+			return
 		case <-c.Hub.stop:
 			return
 		}
 	}
 }
 
+// LifetimeEnd returns when the client reaches the hub's max session lifetime, or false when it's disabled
+// Connections the hub doesn't pump itself, such as SSE streams, use it to end on time
+func (c *Client) LifetimeEnd() (time.Time, bool) {
+	lifetime := c.Hub.maxSessionLifetime
+	if lifetime == 0 {
+		return time.Time{}, false
+	}
+	return c.connectedAt.Add(lifetime), true
+}
+
+// LifetimeExempt reports whether the client is spared the max session lifetime, being the host
+// of a hub set to exempt it
+func (c *Client) LifetimeExempt() bool {
+	return c.Hub.lifetimeExemptsHost && c.Hub.HostID() == c.ID
+}
+
+// DefaultReadTimeout is how long ReadPump waits for any frame, pongs included, before closing
+const DefaultReadTimeout = 60 * time.Second
+
+// SetFeatures applies the hub's on/off behaviors in one call; it is the only way to set them:
+//   - Presence broadcasts join/leave presence updates
+//   - UnknownTypes lets clients send message types outside the known set
+//   - FixedHost never promotes a client when the host disconnects; the slot stays empty until the
+//     next tokenless connection (the returning host) claims it
+//   - NoHost turns the hub into a plain relay: every connection gets the "client" role and
+//     host-only messages such as "title" are rejected for everyone
+//   - E2EOnly rejects plaintext "text" and "image" messages so only "e2e" content is relayed
+//
+// The settings that also take a size or timeout keep their own setters. Must be called before Run
+func (h *Hub) SetFeatures(f features.Set) {
+	h.presence = f.Presence
+	h.allowUnknownTypes = f.UnknownTypes
+	h.fixedHost = f.FixedHost
+	h.noHost = f.NoHost
+	h.e2eOnly = f.E2EOnly
+}
+
+// SetFirstMessageTimeout closes clients that send nothing for d after connecting (0 disables)
+// This frees connections that upgrade and then stall; the bundled pages and companion send a "hello"
+// as soon as they connect. Must be called before Run
+func (h *Hub) SetFirstMessageTimeout(d time.Duration) {
+	h.firstMessageTimeout = max(d, 0)
+}
+
+// SetMissedPongTolerance lets a client miss n consecutive pongs before it is closed (0 disables)
+// A brief stall on a spotty mobile network then doesn't end the session; the read deadline is
+// stretched to cover the tolerated pings. Must be called before Run
+func (h *Hub) SetMissedPongTolerance(n int) {
+	h.missedPongTolerance = max(n, 0)
+}
+
+// readTimeout returns the read deadline ReadPump extends on every pong
+func (h *Hub) readTimeout() time.Duration {
+	if h.missedPongTolerance == 0 {
+		return DefaultReadTimeout
+	}
+	return max(DefaultReadTimeout, time.Duration(h.missedPongTolerance+2)*h.pingInterval)
+}
+
+// notePing records a ping about to be sent, reporting false once the client
+// has left more consecutive pings unanswered than the hub tolerates
+func (c *Client) notePing() bool {
+	if tolerance := c.Hub.missedPongTolerance; tolerance > 0 && c.awaitingPong.Swap(true) {
+		if missed := int(c.missedPongs.Add(1)); missed > tolerance {
+			log.Printf("Client %s missed %d pongs in a row (tolerance %d), closing", c.ID, missed, tolerance)
+			return false
+		}
+	}
+	return true
+}
+
+// notePong records a pong from the client, forgiving earlier missed ones
+func (c *Client) notePong() {
+	c.awaitingPong.Store(false)
+	c.missedPongs.Store(0)
+}
+
+// jitteredInterval shifts base by up to ±pingJitter, with r in [0, 1) picking the offset
+func jitteredInterval(base time.Duration, r float64) time.Duration {
+	return base + time.Duration((2*r-1)*pingJitter*float64(base))
+}
+
+// Sender returns the unregistered client that submits messages for key (e.g. a client IP), creating it if needed
+// HTTP senders that reuse it share one per-client rate limit, the same a WebSocket client has
+func (h *Hub) Sender(key string) *Client {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// Forget senders whose rate limit window has passed; a fresh client behaves the same
+	now := time.Now()
+	for k, c := range h.senders {
+		c.mu.Lock()
+		idle := now.Sub(c.lastActive()) >= time.Second
+		c.mu.Unlock()
+		if idle && k != key {
+			delete(h.senders, k)
+		}
+	}
+
+	c, ok := h.senders[key]
+	if !ok {
+		c = NewClient(nil, h, false)
+		h.senders[key] = c
+	}
+	return c
+}
+
 // HostID returns the current host's ID
 func (h *Hub) HostID() string {
 	h.mu.RLock()
@@ -324,6 +1824,27 @@ func (h *Hub) ClientCount() int {
 	return len(h.clients)
 }
 
+// Stats returns a snapshot of the hub's counters
+func (h *Hub) Stats() HubStats {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	clientDrops := h.clientDrops
+	for _, c := range h.order {
+		clientDrops += c.dropped.Load()
+	}
+	return HubStats{
+		ClientCount:       len(h.clients),
+		HostID:            h.hostID,
+		MessagesBroadcast: h.messagesBroadcast,
+		MessagesDropped:   h.messagesDropped,
+		BytesBroadcast:    h.bytesBroadcast,
+		RateLimited:       h.rateLimited,
+		ClientDrops:       clientDrops,
+		SlowClients:       h.slowClients,
+		Uptime:            time.Since(h.started),
+	}
+}
+
 // SetHostID sets the host ID (for testing only)
 func (h *Hub) SetHostID(id string) {
 	h.mu.Lock()
@@ -332,7 +1853,7 @@ func (h *Hub) SetHostID(id string) {
 }
 
 // NewClient creates a new Client instance
-func NewClient(conn *websocket.Conn, hub *Hub, mobile bool) *Client {
+func NewClient(conn WSConn, hub *Hub, mobile bool) *Client {
 	return &Client{
 		ID:           uuid.New().String(),
 		Conn:         conn,
@@ -341,5 +1862,7 @@ func NewClient(conn *websocket.Conn, hub *Hub, mobile bool) *Client {
 		Mobile:       mobile,
 		lastMessage:  time.Now(),
 		messageCount: 0,
+		jitter:       rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64())).Float64,
+		connectedAt:  time.Now(),
 	}
 }
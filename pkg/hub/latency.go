@@ -0,0 +1,81 @@
+package hub
+
+import (
+	"maps"
+	"strconv"
+	"time"
+)
+
+// maxRTT is the largest round-trip time a client may report; anything slower is a broken measurement
+const maxRTT = time.Minute
+
+// rttSmoothing weighs each new sample into a client's average round-trip time, as in TCP's SRTT
+const rttSmoothing = 8
+
+// ClientStats is a snapshot of one connected client, e.g. for an admin view of connection quality
+type ClientStats struct {
+	ID           string
+	Room         string // Set by RoomManager.Clients; "" for the default room
+	Host         bool
+	Mobile       bool
+	ConnectedAt  time.Time
+	MessagesSent int
+	LastRTT      time.Duration // Latest round-trip time the client reported, 0 before the first report
+	AvgRTT       time.Duration // Smoothed round-trip time
+	RTTSamples   int
+	Dropped      int64 // Messages not queued because the client's send buffer was full
+}
+
+// pong answers a client's "ping" with the time it arrived, echoing the ping's meta so the client
+// can match it (e.g. a "t" send timestamp) and work out the round trip
+func (h *Hub) pong(c *Client, ping Message) {
+	meta := maps.Clone(ping.Meta)
+	if meta == nil {
+		meta = make(map[string]string, 1)
+	}
+	meta["serverTime"] = strconv.FormatInt(time.Now().UnixMilli(), 10)
+	h.sendControl(c, Message{Type: "pong", Meta: meta})
+}
+
+// recordRTT stores a round-trip time the client measured from a ping, reported in milliseconds in an "rtt" message
+func (c *Client) recordRTT(msg Message) error {
+	ms, err := strconv.ParseFloat(msg.Content, 64)
+	if err != nil || ms < 0 || ms > float64(maxRTT.Milliseconds()) {
+		return &SchemaError{Type: msg.Type, Reason: "content must be a round-trip time in milliseconds"}
+	}
+	rtt := time.Duration(ms * float64(time.Millisecond))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rttSamples++
+	c.lastRTT = rtt
+	if c.rttSamples == 1 {
+		c.avgRTT = rtt
+	} else {
+		c.avgRTT += (rtt - c.avgRTT) / rttSmoothing
+	}
+	return nil
+}
+
+// Clients returns a snapshot of the connected clients in registration order
+func (h *Hub) Clients() []ClientStats {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	stats := make([]ClientStats, 0, len(h.order))
+	for _, c := range h.order {
+		c.mu.Lock()
+		stats = append(stats, ClientStats{
+			ID:           c.ID,
+			Host:         c.ID == h.hostID,
+			Mobile:       c.Mobile,
+			ConnectedAt:  c.connectedAt,
+			MessagesSent: c.messagesSent,
+			LastRTT:      c.lastRTT,
+			AvgRTT:       c.avgRTT,
+			RTTSamples:   c.rttSamples,
+			Dropped:      c.dropped.Load(),
+		})
+		c.mu.Unlock()
+	}
+	return stats
+}
@@ -0,0 +1,72 @@
+package hub
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPingPong(t *testing.T) {
+	h := NewHub(1024*1024, 1000)
+	go h.Run()
+	defer h.Stop()
+
+	pinger, pingerConn := registerMemoryClient(t, h)
+	_, otherConn := registerMemoryClient(t, h)
+
+	before := time.Now().UnixMilli()
+	if err := pinger.Submit([]byte(`{"type":"ping","meta":{"t":"12345"}}`)); err != nil {
+		t.Fatalf("Ping rejected: %v", err)
+	}
+	pong := nextMessage(t, pingerConn)
+	for pong.Type != "pong" {
+		pong = nextMessage(t, pingerConn) // skip presence and host updates
+	}
+	if pong.Meta["t"] != "12345" {
+		t.Errorf("Expected the ping's meta echoed, got %v", pong.Meta)
+	}
+	if serverTime, err := strconv.ParseInt(pong.Meta["serverTime"], 10, 64); err != nil || serverTime < before || serverTime > time.Now().UnixMilli() {
+		t.Errorf("Expected the arrival time in Unix milliseconds, got %q", pong.Meta["serverTime"])
+	}
+
+	select {
+	case out := <-otherConn.Outbound():
+		t.Errorf("Expected pings not to be relayed, got %s", out)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestRTTReport(t *testing.T) {
+	h := NewHub(1024*1024, 1000)
+	go h.Run()
+	defer h.Stop()
+
+	client, _ := registerMemoryClient(t, h)
+	if stats := h.Clients(); len(stats) != 1 || stats[0].ID != client.ID || stats[0].RTTSamples != 0 {
+		t.Fatalf("Expected one client without RTT samples, got %+v", stats)
+	}
+
+	for _, ms := range []string{"80", "160"} {
+		if err := client.Submit([]byte(`{"type":"rtt","content":"` + ms + `"}`)); err != nil {
+			t.Fatalf("RTT report %s rejected: %v", ms, err)
+		}
+	}
+	stats := h.Clients()[0]
+	if stats.RTTSamples != 2 || stats.LastRTT != 160*time.Millisecond {
+		t.Errorf("Expected 2 samples ending at 160ms, got %+v", stats)
+	}
+	// The average moves an eighth of the way towards each new sample
+	if stats.AvgRTT != 90*time.Millisecond {
+		t.Errorf("Expected a smoothed average of 90ms, got %v", stats.AvgRTT)
+	}
+
+	for _, bad := range []string{"fast", "-1", "600000"} {
+		if err := client.Submit([]byte(`{"type":"rtt","content":"` + bad + `"}`)); !errors.Is(err, ErrInvalidMessage) {
+			t.Errorf("Expected rtt %q to be invalid, got %v", bad, err)
+		}
+	}
+	if stats := h.Clients()[0]; stats.RTTSamples != 2 {
+		t.Errorf("Expected invalid reports to be ignored, got %d samples", stats.RTTSamples)
+	}
+}
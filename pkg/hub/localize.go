@@ -0,0 +1,66 @@
+package hub
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Translator localizes the error messages the hub sends to clients
+// TranslateLang returns key unchanged when it has no translation; i18n.I18n implements it
+type Translator interface {
+	TranslateLang(lang, key string, args ...any) string
+}
+
+// SetTranslator sets how error messages are localized (nil keeps the built-in English)
+// Must be called before Run
+func (h *Hub) SetTranslator(t Translator) {
+	h.translator = t
+}
+
+// localize translates key into the client's language, falling back to the English format
+func (c *Client) localize(key, fallback string, args ...any) string {
+	if c.Hub.translator != nil {
+		if text := c.Hub.translator.TranslateLang(c.Lang, key, args...); text != key {
+			return text
+		}
+	}
+	return fmt.Sprintf(fallback, args...)
+}
+
+// errorMessage returns the text of the "error" message sent for a Submit error, or "" to send none
+func (c *Client) errorMessage(err error) string {
+	var schemaErr *SchemaError
+	switch {
+	case errors.As(err, &schemaErr):
+		return c.localize("errors.invalid_message", "Invalid %s message.", schemaErr.Type)
+	case errors.Is(err, ErrMessageTooLarge):
+		return c.localize("errors.too_large", "Message too large. Maximum size is %d bytes.", c.Hub.messageLimit(c.ID))
+	case errors.Is(err, ErrTransferTooLarge):
+		return c.localize("errors.transfer_too_large", "Transfer too large. Maximum size is %d bytes.", c.Hub.maxChunkedSize)
+	case errors.Is(err, ErrTextTooLong):
+		return c.localize("errors.text_too_long", "Text too long. Maximum %d characters allowed.", c.Hub.maxTextRunes)
+	case errors.Is(err, ErrBroadcastFull):
+		return c.localize("errors.server_busy", "Server is busy, message was not delivered. Please try again.")
+	case errors.Is(err, ErrInvalidAudience):
+		return c.localize("errors.invalid_audience", "Unknown audience. Use all, mobile or desktop.")
+	case errors.Is(err, ErrMetaTooLarge):
+		return c.localize("errors.meta_too_large", "Message metadata too large. Maximum %d bytes.", MaxMetaSize)
+	case errors.Is(err, ErrInvalidURL):
+		return c.localize("errors.invalid_url", "Only http and https links are allowed.")
+	case errors.Is(err, ErrPlaintext):
+		return c.localize("errors.plaintext_rejected", "This session requires end-to-end encryption. Plaintext messages are not allowed.")
+	case errors.Is(err, ErrInvalidContent):
+		return c.localize("errors.invalid_content", "Invalid message content.")
+	case errors.Is(err, ErrRateLimited):
+		return c.localize("errors.rate_limit", "Rate limit exceeded. Maximum %d messages per second allowed.", c.Hub.rateLimitPerSec)
+	case errors.Is(err, ErrNotHost):
+		return c.localize("errors.not_host", "Only the host can do that.")
+	case errors.Is(err, ErrPendingApproval):
+		return c.localize("errors.pending_approval", "Waiting for the host to approve this device.")
+	case errors.Is(err, ErrMalformed):
+		return c.localize("errors.malformed_message", "Malformed message: it is not valid JSON.")
+	case errors.Is(err, ErrUnknownType):
+		return c.localize("errors.unknown_type", "Unknown message type.")
+	}
+	return ""
+}
@@ -0,0 +1,208 @@
+package hub
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrMemoryConnClosed is returned by MemoryConn operations after Close
+var ErrMemoryConnClosed = errors.New("memory connection closed")
+
+// MemoryConn is an in-memory WSConn for tests and in-process transports
+// Deliver plays the remote peer sending a message; Outbound yields what the server wrote
+type MemoryConn struct {
+	inbound   chan []byte
+	outbound  chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+	mu        sync.Mutex
+	readLimit int64
+	pong      func(string) error
+	dropPings bool
+	deadline  time.Time
+	closeMsg  []byte // Payload of the close frame written by the server, nil before one
+}
+
+// NewMemoryConn creates an open in-memory connection
+func NewMemoryConn() *MemoryConn {
+	return &MemoryConn{
+		inbound:  make(chan []byte, 256),
+		outbound: make(chan []byte, 256),
+		closed:   make(chan struct{}),
+	}
+}
+
+// NewMemoryClient creates a Client backed by a MemoryConn
+// The client is not registered; send it on h.Register and start its pumps as with a real connection
+func NewMemoryClient(h *Hub, mobile bool) (*Client, *MemoryConn) {
+	conn := NewMemoryConn()
+	return NewClient(conn, h, mobile), conn
+}
+
+// Deliver queues a message as if the remote peer had sent it
+func (m *MemoryConn) Deliver(message []byte) error {
+	select {
+	case <-m.closed:
+		return ErrMemoryConnClosed
+	default:
+	}
+	select {
+	case m.inbound <- message:
+		return nil
+	case <-m.closed:
+		return ErrMemoryConnClosed
+	}
+}
+
+// Outbound returns the channel of data messages written to the connection
+func (m *MemoryConn) Outbound() <-chan []byte {
+	return m.outbound
+}
+
+// Done returns a channel that closes when the connection is closed
+func (m *MemoryConn) Done() <-chan struct{} {
+	return m.closed
+}
+
+// ReadMessage blocks until a delivered message is available, the read deadline passes or the connection closes
+// Like a real connection, a read that times out closes it
+func (m *MemoryConn) ReadMessage() (int, []byte, error) {
+	for {
+		m.mu.Lock()
+		deadline := m.deadline
+		m.mu.Unlock()
+
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			timeout = time.After(time.Until(deadline))
+		}
+
+		select {
+		case message := <-m.inbound:
+			m.mu.Lock()
+			limit := m.readLimit
+			m.mu.Unlock()
+			if limit > 0 && int64(len(message)) > limit {
+				m.Close()
+				return 0, nil, websocket.ErrReadLimit
+			}
+			return websocket.TextMessage, message, nil
+		case <-m.closed:
+			return 0, nil, ErrMemoryConnClosed
+		case <-timeout:
+			// A pong may have pushed the deadline out while we waited
+			m.mu.Lock()
+			extended := m.deadline.After(deadline)
+			m.mu.Unlock()
+			if extended {
+				continue
+			}
+			m.Close()
+			return 0, nil, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+// WriteMessage records data messages on Outbound; control messages are accepted and dropped
+func (m *MemoryConn) WriteMessage(messageType int, data []byte) error {
+	select {
+	case <-m.closed:
+		return ErrMemoryConnClosed
+	default:
+	}
+	if messageType == websocket.PingMessage {
+		m.mu.Lock()
+		drop := m.dropPings
+		m.mu.Unlock()
+		if !drop {
+			m.Pong()
+		}
+		return nil
+	}
+	if messageType != websocket.TextMessage && messageType != websocket.BinaryMessage {
+		return nil
+	}
+	select {
+	case m.outbound <- append([]byte(nil), data...):
+		return nil
+	case <-m.closed:
+		return ErrMemoryConnClosed
+	}
+}
+
+// WriteControl accepts control frames; a close frame closes the connection like a real peer would
+func (m *MemoryConn) WriteControl(messageType int, data []byte, _ time.Time) error {
+	select {
+	case <-m.closed:
+		return ErrMemoryConnClosed
+	default:
+	}
+	if messageType == websocket.CloseMessage {
+		m.mu.Lock()
+		m.closeMsg = append([]byte{}, data...)
+		m.mu.Unlock()
+		m.Close()
+	}
+	return nil
+}
+
+// CloseFrame returns the status code and reason of the close frame the server wrote, ok false before one
+func (m *MemoryConn) CloseFrame() (code int, reason string, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.closeMsg) < 2 {
+		return 0, "", m.closeMsg != nil
+	}
+	return int(binary.BigEndian.Uint16(m.closeMsg)), string(m.closeMsg[2:]), true
+}
+
+// SetReadLimit sets the largest message ReadMessage accepts
+func (m *MemoryConn) SetReadLimit(limit int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.readLimit = limit
+}
+
+// SetReadDeadline sets when a blocked ReadMessage gives up; the zero time means never
+func (m *MemoryConn) SetReadDeadline(t time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deadline = t
+	return nil
+}
+
+// SetPongHandler sets the handler called when the peer answers a ping (see Pong)
+func (m *MemoryConn) SetPongHandler(h func(string) error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pong = h
+}
+
+// SetDropPings stops the peer from answering pings, as if its network stalled
+// By default every ping is answered with a pong right away
+func (m *MemoryConn) SetDropPings(drop bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dropPings = drop
+}
+
+// Pong plays the remote peer answering a ping
+func (m *MemoryConn) Pong() {
+	m.mu.Lock()
+	h := m.pong
+	m.mu.Unlock()
+	if h != nil {
+		h("")
+	}
+}
+
+// Close closes the connection, unblocking pending reads and writes
+func (m *MemoryConn) Close() error {
+	m.closeOnce.Do(func() { close(m.closed) })
+	return nil
+}
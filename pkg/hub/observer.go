@@ -0,0 +1,30 @@
+package hub
+
+// HubObserver is told about a hub's lifecycle events, e.g. to feed metrics or an embedding app's UI
+// Each call runs in its own goroutine so a slow observer never stalls the hub; calls may therefore
+// arrive out of order and implementations must be safe for concurrent use
+type HubObserver interface {
+	// ClientConnected is called when a client joins the session (after approval, if required)
+	ClientConnected(clientID string, mobile bool)
+	// ClientDisconnected is called when a client leaves or is removed from the session
+	ClientDisconnected(clientID string)
+	// HostChanged is called when the host is assigned, replaced or leaves ("" means no host)
+	HostChanged(hostID string)
+	// MessageBroadcast is called for each message relayed to the session
+	MessageBroadcast(from, msgType string, size int)
+}
+
+// AddObserver registers an observer for the hub's lifecycle events; there are none by default
+// Rooms created from this hub share its observers. Must be called before Run
+func (h *Hub) AddObserver(o HubObserver) {
+	if o != nil {
+		h.observers = append(h.observers, o)
+	}
+}
+
+// observe calls fn for every observer without waiting for it
+func (h *Hub) observe(fn func(HubObserver)) {
+	for _, o := range h.observers {
+		go fn(o)
+	}
+}
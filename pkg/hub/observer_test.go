@@ -0,0 +1,85 @@
+package hub
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingObserver collects observed events as short strings for assertions
+type recordingObserver struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (r *recordingObserver) record(format string, args ...any) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, fmt.Sprintf(format, args...))
+}
+
+func (r *recordingObserver) ClientConnected(clientID string, mobile bool) {
+	r.record("connected %s %v", clientID, mobile)
+}
+
+func (r *recordingObserver) ClientDisconnected(clientID string) {
+	r.record("disconnected %s", clientID)
+}
+
+func (r *recordingObserver) HostChanged(hostID string) {
+	r.record("host %s", hostID)
+}
+
+func (r *recordingObserver) MessageBroadcast(from, msgType string, size int) {
+	r.record("broadcast %s %s", from, msgType)
+}
+
+// waitFor waits until the observer has recorded event
+func (r *recordingObserver) waitFor(t *testing.T, event string) {
+	t.Helper()
+	deadline := time.After(2 * time.Second)
+	for {
+		r.mu.Lock()
+		seen := slices.Contains(r.events, event)
+		r.mu.Unlock()
+		if seen {
+			return
+		}
+		select {
+		case <-deadline:
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			t.Fatalf("Expected event %q, got %v", event, r.events)
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+}
+
+func TestHubObserver(t *testing.T) {
+	first, second := &recordingObserver{}, &recordingObserver{}
+	h := NewHub(1024*1024, 1000)
+	h.AddObserver(first)
+	h.AddObserver(second)
+	go h.Run()
+	defer h.Stop()
+
+	host, hostConn := registerMemoryClient(t, h)
+	client, _ := registerMemoryClient(t, h)
+	for _, o := range []*recordingObserver{first, second} {
+		o.waitFor(t, "connected "+host.ID+" true")
+		o.waitFor(t, "host "+host.ID)
+		o.waitFor(t, "connected "+client.ID+" true")
+	}
+
+	if err := host.Submit([]byte(`{"type":"text","content":"hello"}`)); err != nil {
+		t.Fatalf("Submit failed: %v", err)
+	}
+	first.waitFor(t, "broadcast "+host.ID+" text")
+
+	// The host leaving promotes the client
+	hostConn.Close()
+	first.waitFor(t, "disconnected "+host.ID)
+	first.waitFor(t, "host "+client.ID)
+}
@@ -0,0 +1,73 @@
+package hub
+
+import (
+	"encoding/json"
+	"log"
+)
+
+// DefaultPauseQueueSize is how many messages a paused hub holds before dropping the oldest
+const DefaultPauseQueueSize = 50
+
+// pausedTypes are the content messages held while the host is paused; control messages still flow
+var pausedTypes = map[string]bool{
+	"text":  true,
+	"image": true,
+	"e2e":   true,
+}
+
+// SetPauseQueueSize sets how many messages are held while the host is paused (size <= 0 uses the default)
+// Must be called before Run
+func (h *Hub) SetPauseQueueSize(size int) {
+	if size <= 0 {
+		size = DefaultPauseQueueSize
+	}
+	h.pauseQueueSize = size
+}
+
+// IsPaused reports whether the host has paused delivery
+func (h *Hub) IsPaused() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.paused
+}
+
+// holdPaused queues a content message until the host resumes, dropping the oldest when full
+// Caller must hold h.mu
+func (h *Hub) holdPaused(msg BroadcastMessage) {
+	if len(h.pauseQueue) >= h.pauseQueueSize {
+		dropped := h.pauseQueue[0]
+		h.pauseQueue = h.pauseQueue[1:]
+		h.messagesDropped++
+		log.Printf("Pause queue full (%d), dropping oldest message from %s", h.pauseQueueSize, dropped.From)
+		h.nack(dropped.From, "The host is paused and its queue is full, an older message was dropped.")
+	}
+	h.pauseQueue = append(h.pauseQueue, msg)
+}
+
+// endPause lifts the pause when the host that set it is gone (it left or was replaced with the host
+// secret), since only a host can send "resume". Returns a resume notice followed by the held messages
+// Caller must hold h.mu and deliver them after unlocking
+func (h *Hub) endPause() []BroadcastMessage {
+	if !h.paused {
+		return nil
+	}
+	h.paused = false
+	log.Printf("Host changed while paused, resuming delivery")
+	notice, err := json.Marshal(Message{Type: "resume"})
+	if err != nil {
+		log.Printf("Failed to marshal resume message: %v", err)
+		return h.takePaused()
+	}
+	return append([]BroadcastMessage{{Message: notice, Type: "resume"}}, h.takePaused()...)
+}
+
+// takePaused empties the pause queue, returning the held messages in the order they arrived
+// Caller must hold h.mu and deliver them after the resume notice
+func (h *Hub) takePaused() []BroadcastMessage {
+	queued := h.pauseQueue
+	h.pauseQueue = nil
+	if len(queued) > 0 {
+		log.Printf("Host resumed, delivering %d queued messages", len(queued))
+	}
+	return queued
+}
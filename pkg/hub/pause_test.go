@@ -0,0 +1,134 @@
+package hub
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPauseBuffersUntilResume(t *testing.T) {
+	h := NewHub(1024*1024, 1000)
+	go h.Run()
+	defer h.Stop()
+
+	host, hostConn := registerMemoryClient(t, h)
+	phone, phoneConn := registerMemoryClient(t, h)
+
+	if err := phone.Submit([]byte(`{"type":"pause"}`)); !errors.Is(err, ErrNotHost) {
+		t.Errorf("Expected ErrNotHost for a client pause, got %v", err)
+	}
+
+	if err := host.Submit([]byte(`{"type":"pause"}`)); err != nil {
+		t.Fatalf("Pause failed: %v", err)
+	}
+	if msg := nextMessage(t, phoneConn); msg.Type != "pause" {
+		t.Fatalf("Expected pause notice, got %+v", msg)
+	}
+
+	for _, content := range []string{"one", "two"} {
+		if err := phone.Submit([]byte(`{"type":"text","content":"` + content + `"}`)); err != nil {
+			t.Fatalf("Submit failed: %v", err)
+		}
+	}
+	// Control messages still flow while paused
+	phone.Submit([]byte(`{"type":"typing"}`))
+	if msg := nextMessage(t, hostConn); msg.Type != "typing" {
+		t.Fatalf("Expected typing to pass through the pause, got %+v", msg)
+	}
+	if !h.IsPaused() {
+		t.Error("Expected hub to be paused")
+	}
+
+	if err := host.Submit([]byte(`{"type":"resume"}`)); err != nil {
+		t.Fatalf("Resume failed: %v", err)
+	}
+	for _, want := range []string{"one", "two"} {
+		if msg := nextMessage(t, hostConn); msg.Type != "text" || msg.Content != want {
+			t.Fatalf("Expected queued %q on resume, got %+v", want, msg)
+		}
+	}
+	if h.IsPaused() {
+		t.Error("Expected hub to be resumed")
+	}
+}
+
+func TestPauseQueueDropsOldest(t *testing.T) {
+	h := NewHub(1024*1024, 1000)
+	h.SetPauseQueueSize(2)
+	go h.Run()
+	defer h.Stop()
+
+	host, hostConn := registerMemoryClient(t, h)
+	phone, phoneConn := registerMemoryClient(t, h)
+
+	host.Submit([]byte(`{"type":"pause"}`))
+	nextMessage(t, phoneConn) // pause notice
+
+	for _, content := range []string{"one", "two", "three"} {
+		phone.Submit([]byte(`{"type":"text","content":"` + content + `"}`))
+	}
+	if msg := nextMessage(t, phoneConn); msg.Type != "nack" {
+		t.Fatalf("Expected nack for the dropped message, got %+v", msg)
+	}
+
+	host.Submit([]byte(`{"type":"resume"}`))
+	for _, want := range []string{"two", "three"} {
+		if msg := nextMessage(t, hostConn); msg.Content != want {
+			t.Fatalf("Expected %q after the oldest was dropped, got %+v", want, msg)
+		}
+	}
+}
+
+// TestPauseEndsWithHost tests that a pause is lifted and its queue delivered when the host leaves or is replaced,
+// since only a host can resume
+func TestPauseEndsWithHost(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(h *Hub, hostConn *MemoryConn)
+	}{
+		{"host leaves", func(h *Hub, hostConn *MemoryConn) { hostConn.Close() }},
+		{"host replaced", func(h *Hub, hostConn *MemoryConn) {
+			claimer, _ := NewMemoryClient(h, false)
+			claimer.ClaimHost = true
+			h.Register <- claimer
+			go claimer.WritePump()
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHub(1024*1024, 1000)
+			go h.Run()
+			defer h.Stop()
+
+			host, hostConn := registerMemoryClient(t, h)
+			phone, phoneConn := registerMemoryClient(t, h)
+			_, tvConn := registerMemoryClient(t, h)
+
+			host.Submit([]byte(`{"type":"pause"}`))
+			nextMessage(t, phoneConn) // pause notice
+			nextMessage(t, tvConn)    // pause notice
+			if err := phone.Submit([]byte(`{"type":"text","content":"held"}`)); err != nil {
+				t.Fatalf("Submit failed: %v", err)
+			}
+
+			tt.change(h, hostConn)
+
+			// Role and host change notices may come first; the resume notice precedes the held message
+			resumed := false
+			for {
+				msg := nextMessage(t, tvConn)
+				if msg.Type == "resume" {
+					resumed = true
+				}
+				if msg.Type == "text" {
+					if !resumed || msg.Content != "held" {
+						t.Fatalf("Expected a resume notice and then the held message, got %+v (resumed: %v)", msg, resumed)
+					}
+					break
+				}
+			}
+			if h.IsPaused() {
+				t.Error("Expected the pause to end with its host")
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package hub
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// SetPersistLast saves the most recent "text" broadcast to path and loads the one saved there,
+// so a rebooted kiosk can show it again: the loaded message is sent to the first client that connects.
+// Images aren't persisted because of their size. "" disables it. Must be called before Run
+// Saving happens on a background writer so broadcasts never wait on the disk; Stop flushes it
+func (h *Hub) SetPersistLast(path string) error {
+	h.persistPath = path
+	h.restored = nil
+	if path == "" {
+		return nil
+	}
+	if h.persistQueue == nil {
+		h.persistQueue = make(chan []byte, 1)
+		h.persistDone = make(chan struct{})
+		go h.runPersist()
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read last message: %w", err)
+	}
+	var msg Message
+	if err := json.Unmarshal(data, &msg); err != nil || msg.Type != "text" || msg.Content == "" {
+		log.Printf("Ignoring invalid last message in %s", path)
+		return nil
+	}
+	h.restored = data
+	log.Printf("Restored last message from %s", path)
+	return nil
+}
+
+// persistLast hands a "text" broadcast to the background writer, replacing any message still waiting
+// to be restored. Only the latest message matters, so one the writer hasn't picked up yet is replaced
+// Only called from the Run loop, so there is a single producer
+func (h *Hub) persistLast(msg BroadcastMessage) {
+	if h.persistPath == "" || msg.Type != "text" {
+		return
+	}
+	h.mu.Lock()
+	h.restored = nil
+	h.mu.Unlock()
+	for {
+		select {
+		case h.persistQueue <- msg.Message:
+			return
+		default:
+			select {
+			case <-h.persistQueue:
+			default:
+			}
+		}
+	}
+}
+
+// runPersist writes queued messages to the persist path until the hub stops, then flushes the last one
+func (h *Hub) runPersist() {
+	defer close(h.persistDone)
+	write := func(data []byte) {
+		if err := writeFileAtomic(h.persistPath, data); err != nil {
+			log.Printf("Failed to persist last message: %v", err)
+		}
+	}
+	for {
+		select {
+		case data := <-h.persistQueue:
+			write(data)
+		case <-h.stop:
+			select {
+			case data := <-h.persistQueue:
+				write(data)
+			default:
+			}
+			return
+		}
+	}
+}
+
+// sendRestored sends the message loaded by SetPersistLast to client, once
+// Caller must hold h.mu
+func (h *Hub) sendRestored(client *Client) {
+	if h.restored == nil {
+		return
+	}
+	select {
+	case client.Send <- h.restored:
+		log.Printf("Sent restored last message to %s", client.ID)
+	default:
+		log.Printf("Client %s send channel full, dropping restored message", client.ID)
+		client.dropped.Add(1)
+	}
+	h.restored = nil
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it over path,
+// so readers never see a partial file
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // No-op once renamed
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
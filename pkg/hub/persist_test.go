@@ -0,0 +1,100 @@
+package hub
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestPersistLastAcrossRestart tests that the last text is saved and shown to the first client of a new hub
+func TestPersistLastAcrossRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "last.json")
+
+	h := NewHub(1024*1024, 1000)
+	if err := h.SetPersistLast(path); err != nil {
+		t.Fatalf("SetPersistLast failed: %v", err)
+	}
+	go h.Run()
+
+	host, hostConn := registerMemoryClient(t, h)
+	_, conn := registerMemoryClient(t, h)
+	for _, content := range []string{"first", "second"} {
+		if err := host.Submit([]byte(`{"type":"text","content":"` + content + `"}`)); err != nil {
+			t.Fatalf("Submit failed: %v", err)
+		}
+		nextMessage(t, conn)
+	}
+	// Images are too large to keep
+	if err := host.Submit([]byte(`{"type":"image","content":"AAAA"}`)); err != nil {
+		t.Fatalf("Submit failed: %v", err)
+	}
+	nextMessage(t, conn)
+	h.Stop()
+	hostConn.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Expected the last message on disk: %v", err)
+	}
+	if !strings.Contains(string(data), `"second"`) {
+		t.Fatalf("Expected the last text to be persisted, got %s", data)
+	}
+
+	// A new hub reading the same file plays it back once
+	restarted := NewHub(1024*1024, 1000)
+	if err := restarted.SetPersistLast(path); err != nil {
+		t.Fatalf("SetPersistLast failed: %v", err)
+	}
+	go restarted.Run()
+	defer restarted.Stop()
+
+	_, firstConn := registerMemoryClient(t, restarted)
+	if msg := nextMessage(t, firstConn); msg.Type != "text" || msg.Content != "second" {
+		t.Fatalf("Expected the restored message, got %+v", msg)
+	}
+	_, laterConn := registerMemoryClient(t, restarted)
+	select {
+	case raw := <-laterConn.Outbound():
+		t.Errorf("Expected the restored message only once, got %s", raw)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestPersistLastMissingOrInvalidFile(t *testing.T) {
+	dir := t.TempDir()
+	h := NewHub(1024*1024, 1000)
+	if err := h.SetPersistLast(filepath.Join(dir, "missing.json")); err != nil {
+		t.Errorf("Expected a missing file to be fine, got %v", err)
+	}
+
+	invalid := filepath.Join(dir, "invalid.json")
+	os.WriteFile(invalid, []byte(`{"type":"clear"}`), 0600)
+	if err := h.SetPersistLast(invalid); err != nil || h.restored != nil {
+		t.Errorf("Expected a non-text file to be ignored, got %v with %s", err, h.restored)
+	}
+}
+
+// TestPersistLastKeepsLatest tests that only the newest pending message is written, and that Stop flushes it
+func TestPersistLastKeepsLatest(t *testing.T) {
+	h := NewHub(1024*1024, 1000)
+	h.persistPath = filepath.Join(t.TempDir(), "last.json")
+	h.persistQueue = make(chan []byte, 1)
+	h.persistDone = make(chan struct{})
+
+	// With no writer running yet, each message replaces the pending one instead of blocking
+	for _, content := range []string{"first", "second", "third"} {
+		h.persistLast(BroadcastMessage{Type: "text", Message: []byte(`{"type":"text","content":"` + content + `"}`)})
+	}
+	if len(h.persistQueue) != 1 {
+		t.Fatalf("Expected one pending message, got %d", len(h.persistQueue))
+	}
+
+	go h.runPersist()
+	h.Stop()
+	data, err := os.ReadFile(h.persistPath)
+	if err != nil || !strings.Contains(string(data), `"third"`) {
+		t.Fatalf("Expected the latest message flushed on Stop, got %s, %v", data, err)
+	}
+}
@@ -0,0 +1,149 @@
+package hub
+
+import (
+	"crypto/rand"
+	"errors"
+	"log"
+	"time"
+)
+
+// DefaultReconnectGrace is how long after dropping a client may rejoin with its reconnect token
+const DefaultReconnectGrace = 2 * time.Minute
+
+// Errors returned by RedeemReconnectToken
+var (
+	ErrReconnectInvalid = errors.New("invalid reconnect token")
+	ErrReconnectExpired = errors.New("reconnect token expired")
+)
+
+// ReconnectGrant identifies the client a redeemed reconnect token was issued to, see Client.Resume
+type ReconnectGrant struct {
+	ClientID    string
+	ConnectedAt time.Time // When the client first connected, so its max session lifetime keeps counting
+
+	token string // Set by CheckReconnectToken: the token is still unspent and Register consumes it
+}
+
+// reconnectGrant lets a dropped client rejoin until expires
+type reconnectGrant struct {
+	ReconnectGrant
+	expires time.Time
+}
+
+// SetReconnectGrace sets how long after disconnecting a client may rejoin with the reconnect token
+// from its welcome message, keeping its client ID (0 disables and stops issuing them). Must be called before Run
+func (h *Hub) SetReconnectGrace(d time.Duration) {
+	h.reconnectGrace = max(d, 0)
+}
+
+// issueReconnectToken gives client a fresh reconnect token for its welcome message ("" when disabled)
+// The token only becomes redeemable once the client disconnects, see graceReconnect
+// Caller must hold h.mu
+func (h *Hub) issueReconnectToken(client *Client) string {
+	if h.reconnectGrace == 0 {
+		return ""
+	}
+	client.reconnectToken = rand.Text()
+	return client.reconnectToken
+}
+
+// graceReconnect opens the reconnect window for a client that disconnected on its own
+// Clients the hub removes itself (kicked, shut down) get none, so they can't come straight back,
+// and the window never outlasts the client's max session lifetime, so rejoining can't dodge a rescan
+// Caller must hold h.mu
+func (h *Hub) graceReconnect(client *Client) {
+	if client.reconnectToken == "" {
+		return
+	}
+	now := time.Now()
+	for tok, g := range h.reconnects {
+		if now.After(g.expires) {
+			delete(h.reconnects, tok)
+		}
+	}
+
+	expires := now.Add(h.reconnectGrace)
+	if h.maxSessionLifetime > 0 {
+		end := client.connectedAt.Add(h.maxSessionLifetime)
+		if !now.Before(end) {
+			return
+		}
+		expires = minTime(expires, end)
+	}
+	h.reconnects[client.reconnectToken] = reconnectGrant{
+		ReconnectGrant: ReconnectGrant{ClientID: client.ID, ConnectedAt: client.connectedAt},
+		expires:        expires,
+	}
+}
+
+// minTime returns the earlier of a and b
+func minTime(a, b time.Time) time.Time {
+	if b.Before(a) {
+		return b
+	}
+	return a
+}
+
+// RedeemReconnectToken consumes a reconnect token and returns the client it was issued to
+// Tokens are single use and only valid within the grace window after that client disconnected
+func (h *Hub) RedeemReconnectToken(tok string) (ReconnectGrant, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.redeemLocked(tok)
+}
+
+// CheckReconnectToken returns the client a reconnect token was issued to without spending it
+// A client resuming with the grant spends it on Register, so a connection that fails before then
+// (hub stopped, per-IP limit, failed upgrade) leaves the token usable for the next attempt
+func (h *Hub) CheckReconnectToken(tok string) (ReconnectGrant, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	g, ok := h.reconnects[tok]
+	if !ok {
+		return ReconnectGrant{}, ErrReconnectInvalid
+	}
+	if time.Now().After(g.expires) {
+		return ReconnectGrant{}, ErrReconnectExpired
+	}
+	grant := g.ReconnectGrant
+	grant.token = tok
+	return grant, nil
+}
+
+// redeemLocked consumes tok and returns its grant
+// Caller must hold h.mu
+func (h *Hub) redeemLocked(tok string) (ReconnectGrant, error) {
+	g, ok := h.reconnects[tok]
+	if !ok {
+		return ReconnectGrant{}, ErrReconnectInvalid
+	}
+	delete(h.reconnects, tok)
+	if time.Now().After(g.expires) {
+		return ReconnectGrant{}, ErrReconnectExpired
+	}
+	log.Printf("Client %s reconnecting", g.ClientID)
+	return g.ReconnectGrant, nil
+}
+
+// claimResume spends the reconnect token a client resumes with, reporting false when it was spent
+// or expired since CheckReconnectToken. Clients not resuming a checked grant always pass
+// Caller must hold h.mu
+func (h *Hub) claimResume(client *Client) bool {
+	if client.resumeToken == "" {
+		return true
+	}
+	g, err := h.redeemLocked(client.resumeToken)
+	return err == nil && g.ClientID == client.ID
+}
+
+// Resume makes a new connection continue the client a reconnect token was issued to: it takes the
+// client's ID and original connect time and skips join approval. Call before Register
+// A grant from CheckReconnectToken is spent when the hub accepts the client; one from
+// RedeemReconnectToken already is
+func (c *Client) Resume(g ReconnectGrant) {
+	c.ID = g.ClientID
+	c.connectedAt = g.ConnectedAt
+	c.Reconnected = true
+	c.resumeToken = g.token
+}
@@ -0,0 +1,219 @@
+package hub
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// reconnectTokenOf returns the reconnect token client got in its welcome message
+func reconnectTokenOf(h *Hub, client *Client) string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return client.reconnectToken
+}
+
+// waitForGrant waits until the hub holds n reconnect grants
+func waitForGrant(t *testing.T, h *Hub, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		h.mu.RLock()
+		got := len(h.reconnects)
+		h.mu.RUnlock()
+		if got == n {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for %d reconnect grants", n)
+}
+
+func TestReconnectToken(t *testing.T) {
+	h := NewHub(1024*1024, 1000)
+	go h.Run()
+	defer h.Stop()
+
+	registerMemoryClient(t, h) // host
+	client, conn := registerMemoryClient(t, h)
+	tok := reconnectTokenOf(h, client)
+	if tok == "" {
+		t.Fatal("Expected the welcome to carry a reconnect token")
+	}
+
+	// Not redeemable while the client is still connected
+	if _, err := h.RedeemReconnectToken(tok); !errors.Is(err, ErrReconnectInvalid) {
+		t.Errorf("Expected ErrReconnectInvalid for a connected client, got %v", err)
+	}
+
+	conn.Close()
+	waitForGrant(t, h, 1)
+
+	grant, err := h.RedeemReconnectToken(tok)
+	if err != nil || grant.ClientID != client.ID || !grant.ConnectedAt.Equal(client.connectedAt) {
+		t.Fatalf("Expected to reconnect as %s, got %+v, %v", client.ID, grant, err)
+	}
+	if _, err := h.RedeemReconnectToken(tok); !errors.Is(err, ErrReconnectInvalid) {
+		t.Errorf("Expected reconnect tokens to be single use, got %v", err)
+	}
+
+	// The rejoining client keeps its ID and is welcomed with a fresh token
+	again, againConn := NewMemoryClient(h, true)
+	again.Resume(grant)
+	h.Register <- again
+	go again.WritePump()
+	if role := nextMessage(t, againConn); role.Type != "role" || role.Role != "client" {
+		t.Fatalf("Expected a client role, got %+v", role)
+	}
+	if welcome := nextMessage(t, againConn); welcome.Type != "welcome" {
+		t.Fatalf("Expected a welcome, got %+v", welcome)
+	}
+	if next := reconnectTokenOf(h, again); next == "" || next == tok {
+		t.Errorf("Expected a fresh reconnect token, got %q", next)
+	}
+}
+
+func TestReconnectTokenExpired(t *testing.T) {
+	h := NewHub(1024*1024, 1000)
+	h.SetReconnectGrace(20 * time.Millisecond)
+	go h.Run()
+	defer h.Stop()
+
+	registerMemoryClient(t, h) // host
+	client, conn := registerMemoryClient(t, h)
+	tok := reconnectTokenOf(h, client)
+
+	conn.Close()
+	waitForGrant(t, h, 1)
+	time.Sleep(40 * time.Millisecond)
+
+	if _, err := h.RedeemReconnectToken(tok); !errors.Is(err, ErrReconnectExpired) {
+		t.Errorf("Expected ErrReconnectExpired after the grace window, got %v", err)
+	}
+}
+
+func TestReconnectTokenNotForRemovedClients(t *testing.T) {
+	h := NewHub(1024*1024, 1000)
+	go h.Run()
+	defer h.Stop()
+
+	registerMemoryClient(t, h) // host
+	client, _ := registerMemoryClient(t, h)
+	tok := reconnectTokenOf(h, client)
+
+	h.DisconnectAll("shutdown")
+	time.Sleep(20 * time.Millisecond)
+	if _, err := h.RedeemReconnectToken(tok); !errors.Is(err, ErrReconnectInvalid) {
+		t.Errorf("Expected no reconnect for clients the hub removed, got %v", err)
+	}
+}
+
+func TestReconnectDisabled(t *testing.T) {
+	h := NewHub(1024*1024, 1000)
+	h.SetReconnectGrace(0)
+	go h.Run()
+	defer h.Stop()
+
+	registerMemoryClient(t, h) // host
+	client, _ := registerMemoryClient(t, h)
+	if tok := reconnectTokenOf(h, client); tok != "" {
+		t.Errorf("Expected no reconnect token when disabled, got %q", tok)
+	}
+}
+
+func TestReconnectTokenSessionLifetime(t *testing.T) {
+	h := NewHub(1024*1024, 1000)
+	h.SetMaxSessionLifetime(300*time.Millisecond, false)
+	go h.Run()
+	defer h.Stop()
+
+	registerMemoryClient(t, h) // host
+	client, conn := registerMemoryClient(t, h)
+	tok := reconnectTokenOf(h, client)
+
+	// Dropping shortly before the lifetime ends leaves a window only until it ends
+	conn.Close()
+	waitForGrant(t, h, 1)
+	h.mu.RLock()
+	expires := h.reconnects[tok].expires
+	h.mu.RUnlock()
+	if end := client.connectedAt.Add(300 * time.Millisecond); !expires.Equal(end) {
+		t.Errorf("Expected the grant to end with the session lifetime at %v, got %v", end, expires)
+	}
+
+	// The rejoined client keeps its first connect time, so the lifetime keeps counting
+	grant, err := h.RedeemReconnectToken(tok)
+	if err != nil {
+		t.Fatalf("Expected to reconnect within the lifetime, got %v", err)
+	}
+	again, againConn := NewMemoryClient(h, true)
+	again.Resume(grant)
+	h.Register <- again
+	go again.WritePump()
+	go again.ReadPump()
+	nextMessage(t, againConn) // role
+	nextMessage(t, againConn) // welcome
+	next := reconnectTokenOf(h, again)
+	if !again.connectedAt.Equal(client.connectedAt) {
+		t.Errorf("Expected the lifetime to count from the first connection at %v, got %v", client.connectedAt, again.connectedAt)
+	}
+
+	select {
+	case <-againConn.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the rejoined client to be closed at the original lifetime")
+	}
+
+	// Past the lifetime the fresh token never becomes redeemable
+	deadline := time.Now().Add(2 * time.Second)
+	for h.ClientCount() != 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, err := h.RedeemReconnectToken(next); !errors.Is(err, ErrReconnectInvalid) {
+		t.Errorf("Expected no reconnect past the session lifetime, got %v", err)
+	}
+}
+
+func TestCheckReconnectToken(t *testing.T) {
+	h := NewHub(1024*1024, 1000)
+	go h.Run()
+	defer h.Stop()
+
+	registerMemoryClient(t, h) // host
+	client, conn := registerMemoryClient(t, h)
+	tok := reconnectTokenOf(h, client)
+	conn.Close()
+	waitForGrant(t, h, 1)
+
+	// Checking leaves the token in place
+	grant, err := h.CheckReconnectToken(tok)
+	if err != nil || grant.ClientID != client.ID {
+		t.Fatalf("Expected the grant for %s, got %+v, %v", client.ID, grant, err)
+	}
+	if _, err := h.CheckReconnectToken(tok); err != nil {
+		t.Fatalf("Expected checking to leave the token usable, got %v", err)
+	}
+
+	// Registering spends it, so a second connection with the same grant is turned away
+	first, firstConn := NewMemoryClient(h, true)
+	first.Resume(grant)
+	h.Register <- first
+	go first.WritePump()
+	if role := nextMessage(t, firstConn); role.Type != "role" {
+		t.Fatalf("Expected the resumed client to be admitted, got %+v", role)
+	}
+	waitForGrant(t, h, 0)
+
+	second, secondConn := NewMemoryClient(h, true)
+	second.Resume(grant)
+	h.Register <- second
+	go second.WritePump()
+	if msg := nextMessage(t, secondConn); msg.Type != "error" {
+		t.Fatalf("Expected a spent grant to be rejected, got %+v", msg)
+	}
+	select {
+	case <-secondConn.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the rejected client to be closed")
+	}
+}
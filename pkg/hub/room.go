@@ -0,0 +1,213 @@
+package hub
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// MaxRooms is the hard limit for simultaneously open rooms
+	MaxRooms = 1000
+	// roomIdleTimeout is how long an empty room is kept before it is removed
+	roomIdleTimeout = 1 * time.Minute
+)
+
+// roomCodeRegex matches valid room codes (short URL-safe identifiers)
+var roomCodeRegex = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// ValidRoomCode reports whether code can be used as a room code
+// The empty string is the default room and is always valid
+func ValidRoomCode(code string) bool {
+	return code == "" || roomCodeRegex.MatchString(code)
+}
+
+// RoomManager maps room codes to independent hubs
+// The default room ("") is backed by the hub passed to NewRoomManager and is never removed
+type RoomManager struct {
+	defaultHub *Hub
+	rooms      map[string]*Hub
+	lastUsed   map[string]time.Time
+	mu         sync.Mutex
+}
+
+// NewRoomManager creates a RoomManager whose rooms share defaultHub's settings
+func NewRoomManager(defaultHub *Hub) *RoomManager {
+	return &RoomManager{
+		defaultHub: defaultHub,
+		rooms:      make(map[string]*Hub),
+		lastUsed:   make(map[string]time.Time),
+	}
+}
+
+// Get returns the hub for a room, creating and starting it if needed
+func (rm *RoomManager) Get(code string) (*Hub, error) {
+	if code == "" {
+		return rm.defaultHub, nil
+	}
+	if !ValidRoomCode(code) {
+		return nil, fmt.Errorf("invalid room code")
+	}
+
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	h, ok := rm.rooms[code]
+	if !ok {
+		if len(rm.rooms) >= MaxRooms {
+			return nil, fmt.Errorf("too many rooms (max: %d)", MaxRooms)
+		}
+		h = rm.defaultHub.newRoomHub()
+		go h.Run()
+		rm.rooms[code] = h
+		log.Printf("Room created: %s", code)
+	}
+	rm.lastUsed[code] = time.Now()
+	return h, nil
+}
+
+// Lookup returns the hub for an existing room without creating it
+func (rm *RoomManager) Lookup(code string) (*Hub, bool) {
+	if code == "" {
+		return rm.defaultHub, true
+	}
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	h, ok := rm.rooms[code]
+	return h, ok
+}
+
+// RoomCount returns the number of open rooms, excluding the default room
+func (rm *RoomManager) RoomCount() int {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	return len(rm.rooms)
+}
+
+// cleanupEmpty stops and removes rooms that have been empty for longer than idle
+func (rm *RoomManager) cleanupEmpty(idle time.Duration) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	for code, h := range rm.rooms {
+		if h.ClientCount() > 0 || time.Since(rm.lastUsed[code]) < idle {
+			continue
+		}
+		h.Stop()
+		delete(rm.rooms, code)
+		delete(rm.lastUsed, code)
+		log.Printf("Room removed: %s", code)
+	}
+}
+
+// StartCleanup starts a background goroutine that periodically removes empty rooms
+// Returns a cancel function to stop the cleanup routine
+func (rm *RoomManager) StartCleanup(interval time.Duration) context.CancelFunc {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				rm.cleanupEmpty(roomIdleTimeout)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return cancel
+}
+
+// forEach calls fn with the default hub and then every room's hub
+// The rooms are copied first so fn runs without rm.mu: a slow hub mustn't hold up Get and Lookup
+func (rm *RoomManager) forEach(fn func(*Hub)) {
+	rm.mu.Lock()
+	hubs := append([]*Hub{rm.defaultHub}, slices.Collect(maps.Values(rm.rooms))...)
+	rm.mu.Unlock()
+	for _, h := range hubs {
+		fn(h)
+	}
+}
+
+// NotifyShutdown sends a "shutdown" message to the clients of every room, including the default one
+func (rm *RoomManager) NotifyShutdown() {
+	rm.forEach((*Hub).NotifyShutdown)
+}
+
+// DisconnectAll disconnects the clients of every room with a message of type msgType (see Hub.DisconnectAll)
+// Returns the number of clients disconnected
+func (rm *RoomManager) DisconnectAll(msgType string) int {
+	n := 0
+	rm.forEach(func(h *Hub) {
+		n += h.DisconnectAll(msgType)
+	})
+	return n
+}
+
+// Broadcast sends msg from the server to the clients of every room, hosts included (see Hub.BroadcastWait)
+// Every room is tried and the deliveries are added up; the first error is returned
+func (rm *RoomManager) Broadcast(ctx context.Context, msg Message) (Delivery, error) {
+	var total Delivery
+	var firstErr error
+	rm.forEach(func(h *Hub) {
+		d, err := h.BroadcastWait(ctx, msg, "")
+		total.Delivered += d.Delivered
+		total.Dropped += d.Dropped
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	})
+	return total, firstErr
+}
+
+// Clients lists the connected clients of every room, the default room first and the others by code
+func (rm *RoomManager) Clients() []ClientStats {
+	clients := rm.defaultHub.Clients()
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	for _, code := range slices.Sorted(maps.Keys(rm.rooms)) {
+		for _, c := range rm.rooms[code].Clients() {
+			c.Room = code
+			clients = append(clients, c)
+		}
+	}
+	return clients
+}
+
+// RoomStats is the counters of one room's hub; Room is "" for the default room
+type RoomStats struct {
+	Room string
+	HubStats
+}
+
+// Stats returns the counters of every room, the default room first and the others by code
+// A room removed by StartCleanup takes its counters with it
+func (rm *RoomManager) Stats() []RoomStats {
+	stats := []RoomStats{{HubStats: rm.defaultHub.Stats()}}
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	for _, code := range slices.Sorted(maps.Keys(rm.rooms)) {
+		stats = append(stats, RoomStats{Room: code, HubStats: rm.rooms[code].Stats()})
+	}
+	return stats
+}
+
+// Stop stops all non-default rooms
+func (rm *RoomManager) Stop() {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	for code, h := range rm.rooms {
+		h.Stop()
+		delete(rm.rooms, code)
+		delete(rm.lastUsed, code)
+	}
+}
@@ -0,0 +1,129 @@
+package hub
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// TestValidRoomCode tests room code validation
+func TestValidRoomCode(t *testing.T) {
+	tests := []struct {
+		code string
+		want bool
+	}{
+		{"", true},
+		{"abc", true},
+		{"Living-Room_2", true},
+		{"has space", false},
+		{"../etc", false},
+		{"a-very-long-room-code-that-exceeds-the-limit", false},
+	}
+
+	for _, tt := range tests {
+		if got := ValidRoomCode(tt.code); got != tt.want {
+			t.Errorf("ValidRoomCode(%q) = %v, want %v", tt.code, got, tt.want)
+		}
+	}
+}
+
+// TestRoomManagerGet tests lazy room creation and the default room
+func TestRoomManagerGet(t *testing.T) {
+	defaultHub := NewHub(1024, 10)
+	rm := NewRoomManager(defaultHub)
+	defer rm.Stop()
+
+	h, err := rm.Get("")
+	if err != nil || h != defaultHub {
+		t.Fatalf("Empty room code should return default hub, got %v (err: %v)", h, err)
+	}
+
+	a, err := rm.Get("abc")
+	if err != nil {
+		t.Fatalf("Failed to get room: %v", err)
+	}
+	if a == defaultHub {
+		t.Error("Named room should not share the default hub")
+	}
+	if a.maxMessageSize != defaultHub.maxMessageSize || a.rateLimitPerSec != defaultHub.rateLimitPerSec {
+		t.Error("Room hub should inherit default hub settings")
+	}
+
+	again, _ := rm.Get("abc")
+	if again != a {
+		t.Error("Getting the same room twice should return the same hub")
+	}
+
+	if _, ok := rm.Lookup("missing"); ok {
+		t.Error("Lookup should not create rooms")
+	}
+	if rm.RoomCount() != 1 {
+		t.Errorf("Expected 1 room, got %d", rm.RoomCount())
+	}
+
+	if _, err := rm.Get("bad room"); err == nil {
+		t.Error("Invalid room code should be rejected")
+	}
+
+	stats := rm.Stats()
+	if len(stats) != 2 || stats[0].Room != "" || stats[1].Room != "abc" {
+		t.Errorf("Expected stats for the default room and abc, got %+v", stats)
+	}
+}
+
+// TestRoomManagerCleanupEmpty tests that idle empty rooms are removed and stopped
+func TestRoomManagerCleanupEmpty(t *testing.T) {
+	rm := NewRoomManager(NewHub(1024, 10))
+
+	h, _ := rm.Get("abc")
+
+	// Recently used rooms are kept
+	rm.cleanupEmpty(time.Minute)
+	if rm.RoomCount() != 1 {
+		t.Fatal("Recently used room should not be removed")
+	}
+
+	rm.cleanupEmpty(0)
+	if rm.RoomCount() != 0 {
+		t.Errorf("Empty room should be removed, got %d rooms", rm.RoomCount())
+	}
+
+	select {
+	case <-h.Done():
+	default:
+		t.Error("Removed room hub should be stopped")
+	}
+}
+
+// TestRoomManagerBroadcastDoesNotBlockLookup tests that a stalled room doesn't hold the room lock during a broadcast
+func TestRoomManagerBroadcastDoesNotBlockLookup(t *testing.T) {
+	defaultHub := NewHub(1024, 10)
+	go defaultHub.Run()
+	defer defaultHub.Stop()
+	rm := NewRoomManager(defaultHub)
+	defer rm.Stop()
+
+	// Never run, so its deliveries are never reported and the broadcast waits for the context
+	stalled := NewHub(1024, 10)
+	rm.mu.Lock()
+	rm.rooms["stalled"] = stalled
+	rm.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		rm.Broadcast(ctx, Message{Type: "announcement", Content: "hi"})
+		close(done)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	if _, ok := rm.Lookup("stalled"); !ok {
+		t.Error("Expected the stalled room to be found")
+	}
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("Expected Lookup not to wait for the broadcast, took %v", elapsed)
+	}
+	<-done
+}
@@ -0,0 +1,87 @@
+package hub
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrInvalidMessage is wrapped by every *SchemaError
+var ErrInvalidMessage = errors.New("invalid message")
+
+// SchemaError reports a message that doesn't fit its type's schema
+type SchemaError struct {
+	Type   string // Message type
+	Reason string // What is wrong, e.g. "content is required"
+}
+
+func (e *SchemaError) Error() string {
+	return fmt.Sprintf("invalid %s message: %s", e.Type, e.Reason)
+}
+
+func (e *SchemaError) Unwrap() error {
+	return ErrInvalidMessage
+}
+
+// contentRule says whether a message type needs or forbids Content
+type contentRule int
+
+const (
+	contentAny contentRule = iota
+	contentRequired
+	contentForbidden
+)
+
+// contentRules lists the types with Content constraints; the rest accept any content
+var contentRules = map[string]contentRule{
+	"text":    contentRequired,
+	"image":   contentRequired,
+	"e2e":     contentRequired,
+	"approve": contentRequired, // The pending client's ID
+	"deny":    contentRequired,
+	"clear":   contentForbidden,
+	"ping":    contentForbidden,
+	"pause":   contentForbidden,
+	"resume":  contentForbidden,
+	"chunk":   contentRequired, // A base64 slice of the complete message
+	"rtt":     contentRequired, // Milliseconds
+}
+
+// imageMIMETypes are the types an "image" data URL may declare
+// SVG is left out because it can carry script
+var imageMIMETypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+	"image/bmp":  true,
+}
+
+// validateMessage checks msg against its type's schema
+// Decoding and size checks on the content are left to checkContent
+func validateMessage(msg Message) error {
+	switch contentRules[msg.Type] {
+	case contentRequired:
+		if msg.Content == "" {
+			return &SchemaError{Type: msg.Type, Reason: "content is required"}
+		}
+	case contentForbidden:
+		if msg.Content != "" {
+			return &SchemaError{Type: msg.Type, Reason: "content is not allowed"}
+		}
+	}
+
+	// Bare base64 is accepted as before; a data URL must declare an image type and carry data
+	if msg.Type == "image" {
+		if rest, ok := strings.CutPrefix(msg.Content, "data:"); ok {
+			mime, data, found := strings.Cut(rest, ";base64,")
+			if !found || !imageMIMETypes[strings.ToLower(mime)] {
+				return &SchemaError{Type: msg.Type, Reason: fmt.Sprintf("unsupported image type %q", mime)}
+			}
+			if data == "" {
+				return &SchemaError{Type: msg.Type, Reason: "image data is empty"}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package hub
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidateMessage(t *testing.T) {
+	tests := []struct {
+		name  string
+		msg   Message
+		valid bool
+	}{
+		{"text", Message{Type: "text", Content: "hello"}, true},
+		{"text empty", Message{Type: "text"}, false},
+		{"image base64", Message{Type: "image", Content: "AAAA"}, true},
+		{"image data URL", Message{Type: "image", Content: "data:image/png;base64,AAAA"}, true},
+		{"image mime case", Message{Type: "image", Content: "data:IMAGE/JPEG;base64,AAAA"}, true},
+		{"image empty", Message{Type: "image"}, false},
+		{"image empty data", Message{Type: "image", Content: "data:image/png;base64,"}, false},
+		{"image svg", Message{Type: "image", Content: "data:image/svg+xml;base64,AAAA"}, false},
+		{"image html", Message{Type: "image", Content: "data:text/html;base64,AAAA"}, false},
+		{"image no mime", Message{Type: "image", Content: "data:;base64,AAAA"}, false},
+		{"image not base64 data URL", Message{Type: "image", Content: "data:image/png,AAAA"}, false},
+		{"e2e", Message{Type: "e2e", Content: "ciphertext"}, true},
+		{"e2e empty", Message{Type: "e2e"}, false},
+		{"approve", Message{Type: "approve", Content: "client-id"}, true},
+		{"approve empty", Message{Type: "approve"}, false},
+		{"deny empty", Message{Type: "deny"}, false},
+		{"clear", Message{Type: "clear"}, true},
+		{"clear with content", Message{Type: "clear", Content: "x"}, false},
+		{"ping", Message{Type: "ping"}, true},
+		{"ping with content", Message{Type: "ping", Content: "x"}, false},
+		{"pause with content", Message{Type: "pause", Content: "x"}, false},
+		{"resume", Message{Type: "resume"}, true},
+		{"bye with reason", Message{Type: "bye", Content: "closed"}, true},
+		{"bye", Message{Type: "bye"}, true},
+		{"title cleared", Message{Type: "title"}, true},
+		{"typing", Message{Type: "typing"}, true},
+		{"unknown type", Message{Type: "custom", Content: "x"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateMessage(tt.msg)
+			if tt.valid && err != nil {
+				t.Errorf("Expected %+v to be valid, got %v", tt.msg, err)
+			}
+			if !tt.valid {
+				var schemaErr *SchemaError
+				if !errors.As(err, &schemaErr) || !errors.Is(err, ErrInvalidMessage) {
+					t.Errorf("Expected a SchemaError for %+v, got %v", tt.msg, err)
+				} else if schemaErr.Type != tt.msg.Type {
+					t.Errorf("Expected SchemaError for type %q, got %q", tt.msg.Type, schemaErr.Type)
+				}
+			}
+		})
+	}
+}
+
+// TestInvalidMessageNotBroadcast tests that a message failing its schema gets an error reply and reaches no one
+func TestInvalidMessageNotBroadcast(t *testing.T) {
+	h := NewHub(1024*1024, 1000)
+	go h.Run()
+	defer h.Stop()
+
+	_, hostConn := registerMemoryClient(t, h)
+	_, conn := registerMemoryClient(t, h)
+
+	conn.Deliver([]byte(`{"type":"text","content":""}`))
+	if msg := nextMessage(t, conn); msg.Type != "error" || msg.Content != "Invalid text message." {
+		t.Fatalf("Expected an invalid message error, got %+v", msg)
+	}
+
+	conn.Deliver([]byte(`{"type":"text","content":"valid"}`))
+	if msg := nextMessage(t, hostConn); msg.Type != "text" || msg.Content != "valid" {
+		t.Errorf("Expected only the valid message to reach the host, got %+v", msg)
+	}
+}
@@ -0,0 +1,28 @@
+package hub
+
+import "log"
+
+// MessageTransformer inspects a client's message after it passed validation, just before it is broadcast,
+// e.g. to shorten links or mask secrets. It returns the message to relay, possibly modified, and false to drop it.
+// It runs synchronously on the sender's read path, once per message and from many clients at once: keep it fast
+// and safe for concurrent use, and hand slow work (network lookups, heavy scanning) to a goroutine of its own
+type MessageTransformer func(msg Message) (Message, bool)
+
+// SetMessageTransformer sets the hook applied to client messages before broadcast (nil relays them unchanged)
+// Messages the hub consumes itself (pings, join decisions, chunk parts) and server broadcasts such as
+// announcements are not transformed. Rooms created from this hub share it. Must be called before Run
+func (h *Hub) SetMessageTransformer(t MessageTransformer) {
+	h.transformer = t
+}
+
+// transform applies the hub's transformer to a message from clientID, reporting false when it is dropped
+func (h *Hub) transform(clientID string, msg Message) (Message, bool) {
+	if h.transformer == nil {
+		return msg, true
+	}
+	out, keep := h.transformer(msg)
+	if !keep {
+		log.Printf("Message from %s (type: %s) dropped by the message transformer", clientID, msg.Type)
+	}
+	return out, keep
+}
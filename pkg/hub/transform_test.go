@@ -0,0 +1,61 @@
+package hub
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMessageTransformerModifies(t *testing.T) {
+	h := NewHub(1024*1024, 1000)
+	h.SetMessageTransformer(func(msg Message) (Message, bool) {
+		msg.Content = strings.ToUpper(msg.Content)
+		return msg, true
+	})
+	go h.Run()
+	defer h.Stop()
+
+	sender, _ := registerMemoryClient(t, h)
+	_, conn := registerMemoryClient(t, h)
+
+	if err := sender.Submit([]byte(`{"type":"text","content":"hello there"}`)); err != nil {
+		t.Fatalf("Submit failed: %v", err)
+	}
+	if msg := nextMessage(t, conn); msg.Content != "HELLO THERE" || msg.From != sender.ID {
+		t.Errorf("Expected the uppercased message from %s, got %+v", sender.ID, msg)
+	}
+}
+
+func TestMessageTransformerDrops(t *testing.T) {
+	secret := regexp.MustCompile(`(?i)password`)
+	h := NewHub(1024*1024, 1000)
+	h.SetMessageTransformer(func(msg Message) (Message, bool) {
+		return msg, !secret.MatchString(msg.Content)
+	})
+	go h.Run()
+	defer h.Stop()
+
+	sender, _ := registerMemoryClient(t, h)
+	_, conn := registerMemoryClient(t, h)
+
+	// Dropping isn't an error for the sender; the message just goes nowhere
+	if err := sender.Submit([]byte(`{"type":"text","content":"my Password is hunter2"}`)); err != nil {
+		t.Fatalf("Expected a dropped message to be accepted, got %v", err)
+	}
+	select {
+	case out := <-conn.Outbound():
+		t.Fatalf("Expected the matching message to be dropped, got %s", out)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := sender.Submit([]byte(`{"type":"text","content":"just a note"}`)); err != nil {
+		t.Fatalf("Submit failed: %v", err)
+	}
+	if msg := nextMessage(t, conn); msg.Content != "just a note" {
+		t.Errorf("Expected other messages to pass unchanged, got %+v", msg)
+	}
+	if stats := h.Stats(); stats.MessagesBroadcast != 1 {
+		t.Errorf("Expected only the kept message to be broadcast, got %d", stats.MessagesBroadcast)
+	}
+}
@@ -1,7 +1,15 @@
 package qrcode
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	stdhtml "html"
+	"image/jpeg"
 	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -11,36 +19,193 @@ import (
 
 // Generator handles QR code generation
 type Generator struct {
-	host    string
-	scheme  string
+	targets []Target // Addresses QR codes can point at, the first is the default
 	timeout time.Duration
 }
 
+// Target is one address phones can reach the server on, e.g. the LAN IP or a public tunnel
+type Target struct {
+	Name   string // Selects the target with ?target=, e.g. "lan" or "public"
+	Scheme string
+	Host   string
+}
+
 // NewGenerator creates a new QR code generator
 func NewGenerator(host, scheme string, timeout time.Duration) *Generator {
 	return &Generator{
-		host:    host,
-		scheme:  scheme,
+		targets: []Target{{Scheme: scheme, Host: host}},
 		timeout: timeout,
 	}
 }
 
+// SetTargets replaces the addresses QR codes can point at; the first becomes the default
+// An empty list keeps the current targets
+func (g *Generator) SetTargets(targets ...Target) {
+	if len(targets) > 0 {
+		g.targets = targets
+	}
+}
+
+// Targets returns the addresses QR codes can point at, the default first
+func (g *Generator) Targets() []Target {
+	return slices.Clone(g.targets)
+}
+
+// Target looks up a target by name or by index into Targets ("" is the default)
+func (g *Generator) Target(key string) (Target, bool) {
+	if key == "" {
+		return g.targets[0], true
+	}
+	for _, t := range g.targets {
+		if t.Name != "" && strings.EqualFold(t.Name, key) {
+			return t, true
+		}
+	}
+	if i, err := strconv.Atoi(key); err == nil && i >= 0 && i < len(g.targets) {
+		return g.targets[i], true
+	}
+	return Target{}, false
+}
+
+// Format is an image encoding QR codes can be served in
+type Format string
+
+const (
+	FormatPNG  Format = "png"
+	FormatJPEG Format = "jpeg"
+)
+
+// jpegQuality keeps QR module edges crisp enough to scan
+const jpegQuality = 90
+
+// ContentType returns the MIME type of the format
+func (f Format) ContentType() string {
+	if f == FormatJPEG {
+		return "image/jpeg"
+	}
+	return "image/png"
+}
+
+// NegotiateFormat picks the image format from ?format= (png, jpeg or jpg), then the Accept header
+// PNG is the default; it reports false only for an unknown ?format=
+func NegotiateFormat(r *http.Request) (Format, bool) {
+	switch strings.ToLower(r.URL.Query().Get("format")) {
+	case "png":
+		return FormatPNG, true
+	case "jpeg", "jpg":
+		return FormatJPEG, true
+	case "":
+	default:
+		return "", false
+	}
+
+	// Only switch to JPEG for browsers that ask for it and not for PNG
+	accept := r.Header.Get("Accept")
+	if strings.Contains(accept, "image/jpeg") && !strings.Contains(accept, "image/png") {
+		return FormatJPEG, true
+	}
+	return FormatPNG, true
+}
+
+// encode returns the QR code image for url
+// Nothing is cached: every URL carries a freshly minted token, so no two requests encode the same one
+// It gives up with ctx's error once ctx is done, before or after the (uninterruptible) encoding
+func (g *Generator) encode(ctx context.Context, url string, format Format) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var img []byte
+	var err error
+	if format == FormatJPEG {
+		img, err = encodeJPEG(url)
+	} else {
+		img, err = qrcode.Encode(url, qrcode.Medium, 256)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// encodeJPEG renders the QR code for url as a JPEG
+func encodeJPEG(url string) ([]byte, error) {
+	q, err := qrcode.New(url, qrcode.Medium)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, q.Image(256), &jpeg.Options{Quality: jpegQuality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
 // GenerateQRCodeURL generates a URL for the QR code with a token ID
 func (g *Generator) GenerateQRCodeURL(tokenID string) string {
-	return g.scheme + "://" + g.host + "?token=" + tokenID + "&mode=client"
+	return g.GenerateTargetQRCodeURL(g.targets[0], tokenID, "")
+}
+
+// GenerateRoomQRCodeURL generates a URL for the QR code with a token ID and room code
+// An empty room yields the same URL as GenerateQRCodeURL
+func (g *Generator) GenerateRoomQRCodeURL(tokenID, room string) string {
+	return g.GenerateTargetQRCodeURL(g.targets[0], tokenID, room)
+}
+
+// GenerateTargetQRCodeURL generates a client URL on the given target with a token ID and optional room code
+func (g *Generator) GenerateTargetQRCodeURL(t Target, tokenID, room string) string {
+	u := t.Scheme + "://" + t.Host + "?token=" + tokenID + "&mode=client"
+	if room != "" {
+		u += "&room=" + url.QueryEscape(room)
+	}
+	return u
 }
 
-// ServeQRCode serves a PNG QR code image
+// ServeQRCode serves a QR code image, PNG unless another format is negotiated
 func (g *Generator) ServeQRCode(w http.ResponseWriter, r *http.Request, tokenID string) {
-	url := g.GenerateQRCodeURL(tokenID)
-	png, err := qrcode.Encode(url, qrcode.Medium, 256)
+	g.ServeRoomQRCode(w, r, tokenID, "")
+}
+
+// ServeRoomQRCode serves a QR code image pointing at a room
+// The ?target= query parameter picks the address (see Target) and the format is negotiated
+// with NegotiateFormat; unknown targets and formats get a 400
+// Nothing is written once the request context is cancelled, e.g. when the client disconnects
+func (g *Generator) ServeRoomQRCode(w http.ResponseWriter, r *http.Request, tokenID, room string) {
+	target, ok := g.Target(r.URL.Query().Get("target"))
+	if !ok {
+		http.Error(w, "Bad request: unknown QR code target", http.StatusBadRequest)
+		return
+	}
+	format, ok := NegotiateFormat(r)
+	if !ok {
+		http.Error(w, "Bad request: unknown QR code format", http.StatusBadRequest)
+		return
+	}
+	url := g.GenerateTargetQRCodeURL(target, tokenID, room)
+	img, err := g.encode(r.Context(), url, format)
+	if r.Context().Err() != nil {
+		return
+	}
 	if err != nil {
 		http.Error(w, "Failed to generate QR code", http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Set("Content-Type", "image/png")
-	w.Write(png)
+	w.Header().Set("Content-Type", format.ContentType())
+	w.Header().Add("Vary", "Accept")
+	w.Write(img)
+}
+
+// DataURI returns the PNG QR code for a client URL on t as a data: URI, for embedding in a page
+func (g *Generator) DataURI(ctx context.Context, t Target, tokenID, room string) (string, error) {
+	img, err := g.encode(ctx, g.GenerateTargetQRCodeURL(t, tokenID, room), FormatPNG)
+	if err != nil {
+		return "", err
+	}
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(img), nil
 }
 
 // SessionTimeoutSeconds returns the session timeout in seconds
@@ -48,21 +213,49 @@ func (g *Generator) SessionTimeoutSeconds() int {
 	return int(g.timeout.Seconds())
 }
 
-// Host returns the configured host
+// RefreshFraction is the share of the session timeout after which the host should fetch a new QR code
+// Refreshing before expiry leaves a margin for a phone that is mid-scan
+const RefreshFraction = 0.8
+
+// RefreshSeconds returns the recommended QR code refresh interval in seconds (at least 1)
+func (g *Generator) RefreshSeconds() int {
+	return max(1, int(g.timeout.Seconds()*RefreshFraction))
+}
+
+// Host returns the default target's host
 func (g *Generator) Host() string {
-	return g.host
+	return g.targets[0].Host
 }
 
-// Scheme returns the configured scheme (http or https)
+// Scheme returns the default target's scheme (http or https)
 func (g *Generator) Scheme() string {
-	return g.scheme
+	return g.targets[0].Scheme
 }
 
+// containerTagRegex matches the opening tag of the page container, including injected attributes
+var containerTagRegex = regexp.MustCompile(`<div class="container"[^>]*>`)
+
 // InjectSessionTimeout injects the session timeout into HTML as a data attribute
 func InjectSessionTimeout(html string, timeoutSec int) string {
-	tag := `<div class="container" data-session-timeout="` + strconv.Itoa(timeoutSec) + `">`
-	oldTag := `<div class="container">`
-	return htmlReplace(html, oldTag, tag)
+	return InjectContainerAttributes(html, "data-session-timeout", strconv.Itoa(timeoutSec))
+}
+
+// InjectContainerAttributes adds attributes to the page container's opening tag
+// attrs are name/value pairs; values are HTML-escaped
+func InjectContainerAttributes(html string, attrs ...string) string {
+	loc := containerTagRegex.FindStringIndex(html)
+	if loc == nil {
+		return html
+	}
+
+	var b strings.Builder
+	for i := 0; i+1 < len(attrs); i += 2 {
+		b.WriteString(" " + attrs[i] + `="` + stdhtml.EscapeString(attrs[i+1]) + `"`)
+	}
+
+	// Insert before the closing '>' so attributes from earlier calls are kept
+	end := loc[1] - 1
+	return html[:end] + b.String() + html[end:]
 }
 
 // htmlReplace replaces the first occurrence of old with new in html
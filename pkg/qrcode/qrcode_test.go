@@ -2,6 +2,7 @@ package qrcode
 
 import (
 	"bytes"
+	"context"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -108,6 +109,13 @@ func TestQRCodeGenerator(t *testing.T) {
 	if g.SessionTimeoutSeconds() != 600 {
 		t.Errorf("Expected timeout 600 seconds, got %d", g.SessionTimeoutSeconds())
 	}
+
+	if g.RefreshSeconds() != 480 {
+		t.Errorf("Expected refresh after 480 seconds, got %d", g.RefreshSeconds())
+	}
+	if short := NewGenerator("localhost:3333", "http", time.Second); short.RefreshSeconds() != 1 {
+		t.Errorf("Expected refresh interval clamped to 1 second, got %d", short.RefreshSeconds())
+	}
 }
 
 // TestInjectSessionTimeout tests that session timeout is injected into HTML
@@ -251,3 +259,161 @@ func TestServeQRCodeDirectly(t *testing.T) {
 		t.Error("Response should be a valid PNG file")
 	}
 }
+
+// TestGenerateRoomQRCodeURL tests that room codes are included in the QR URL
+func TestGenerateRoomQRCodeURL(t *testing.T) {
+	gen := NewGenerator("localhost:3333", "http", 10*time.Minute)
+
+	if got := gen.GenerateRoomQRCodeURL("TOKEN123", ""); got != gen.GenerateQRCodeURL("TOKEN123") {
+		t.Errorf("Default room URL should match plain URL, got %s", got)
+	}
+
+	want := "http://localhost:3333?token=TOKEN123&mode=client&room=abc"
+	if got := gen.GenerateRoomQRCodeURL("TOKEN123", "abc"); got != want {
+		t.Errorf("GenerateRoomQRCodeURL() = %s, want %s", got, want)
+	}
+}
+
+// TestQRTargets tests that ?target= picks the QR code address by name or index
+func TestQRTargets(t *testing.T) {
+	gen := NewGenerator("localhost:3333", "http", 10*time.Minute)
+	gen.SetTargets(
+		Target{Name: "public", Scheme: "https", Host: "tv.example.com"},
+		Target{Name: "lan", Scheme: "http", Host: "192.168.1.10:3333"},
+	)
+
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"", "https://tv.example.com?token=TOKEN123&mode=client"},
+		{"public", "https://tv.example.com?token=TOKEN123&mode=client"},
+		{"lan", "http://192.168.1.10:3333?token=TOKEN123&mode=client"},
+		{"1", "http://192.168.1.10:3333?token=TOKEN123&mode=client"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		gen.ServeRoomQRCode(w, httptest.NewRequest("GET", "/qrcode.png?target="+tt.target, nil), "TOKEN123", "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("target %q: expected 200, got %d", tt.target, w.Code)
+		}
+		want, err := qrcodeLib.Encode(tt.want, qrcodeLib.Medium, 256)
+		if err != nil {
+			t.Fatalf("Failed to encode %s: %v", tt.want, err)
+		}
+		if !bytes.Equal(w.Body.Bytes(), want) {
+			t.Errorf("target %q: QR code doesn't encode %s", tt.target, tt.want)
+		}
+	}
+
+	for _, target := range []string{"tunnel", "2", "-1"} {
+		w := httptest.NewRecorder()
+		gen.ServeRoomQRCode(w, httptest.NewRequest("GET", "/qrcode.png?target="+target, nil), "TOKEN123", "")
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("target %q: expected 400, got %d", target, w.Code)
+		}
+	}
+}
+
+// TestInjectContainerAttributes tests attribute injection into the container tag
+func TestInjectContainerAttributes(t *testing.T) {
+	html := `<body><div class="container">content</div></body>`
+
+	injected := InjectContainerAttributes(html, "data-theme", "dark", "data-label", `a"b<c`)
+	expected := `<div class="container" data-theme="dark" data-label="a&#34;b&lt;c">content`
+	if !strings.Contains(injected, expected) {
+		t.Errorf("Expected %s, got: %s", expected, injected)
+	}
+
+	// Successive injections keep earlier attributes
+	injected = InjectContainerAttributes(InjectSessionTimeout(html, 60), "data-theme", "light")
+	expected = `<div class="container" data-session-timeout="60" data-theme="light">`
+	if !strings.Contains(injected, expected) {
+		t.Errorf("Expected %s, got: %s", expected, injected)
+	}
+
+	// HTML without a container is unchanged
+	plain := `<body><div class="other"></div></body>`
+	if got := InjectContainerAttributes(plain, "data-theme", "dark"); got != plain {
+		t.Errorf("Expected unchanged HTML, got: %s", got)
+	}
+}
+
+// TestServeQRCodeFormats tests that ?format= and the Accept header select the image encoding
+func TestServeQRCodeFormats(t *testing.T) {
+	g := NewGenerator("localhost:3333", "http", 10*time.Minute)
+	pngMagic := []byte{0x89, 0x50, 0x4E, 0x47, 0x0D, 0x0A, 0x1A, 0x0A}
+	jpegMagic := []byte{0xFF, 0xD8, 0xFF}
+
+	tests := []struct {
+		name        string
+		query       string
+		accept      string
+		contentType string
+		magic       []byte
+	}{
+		{"default", "", "", "image/png", pngMagic},
+		{"format png", "?format=png", "", "image/png", pngMagic},
+		{"format jpeg", "?format=jpeg", "", "image/jpeg", jpegMagic},
+		{"format jpg", "?format=JPG", "", "image/jpeg", jpegMagic},
+		{"accept jpeg", "", "image/jpeg", "image/jpeg", jpegMagic},
+		{"accept both", "", "image/png,image/jpeg;q=0.8", "image/png", pngMagic},
+		{"accept any", "", "image/webp,*/*", "image/png", pngMagic},
+		{"format wins over accept", "?format=png", "image/jpeg", "image/png", pngMagic},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/qrcode.png"+tt.query, nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			g.ServeQRCode(w, r, "formattok")
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d", w.Code)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != tt.contentType {
+				t.Errorf("Expected content-type %s, got %s", tt.contentType, ct)
+			}
+			if !bytes.HasPrefix(w.Body.Bytes(), tt.magic) {
+				t.Errorf("Expected body to start with % X, got % X", tt.magic, w.Body.Bytes()[:min(8, w.Body.Len())])
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	g.ServeQRCode(w, httptest.NewRequest("GET", "/qrcode.png?format=bmp", nil), "formattok")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown format, got %d", w.Code)
+	}
+}
+
+// TestServeQRCodeCancelled tests that a cancelled request gets no body and is not encoded
+func TestServeQRCodeCancelled(t *testing.T) {
+	g := NewGenerator("localhost:3333", "http", 10*time.Minute)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/qrcode.png", nil).WithContext(ctx)
+
+	done := make(chan struct{})
+	go func() {
+		g.ServeQRCode(w, r, "canceltok")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected handler to return promptly for a cancelled request")
+	}
+
+	if w.Body.Len() != 0 {
+		t.Errorf("Expected no body for a cancelled request, got %d bytes", w.Body.Len())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "" {
+		t.Errorf("Expected no content type for a cancelled request, got %s", ct)
+	}
+}
@@ -1,16 +1,35 @@
 package server
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"html/template"
+	"io"
 	"io/fs"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"regexp"
+	"runtime/debug"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gorilla/websocket"
 	"tvclipboard/i18n"
+	"tvclipboard/pkg/features"
 	"tvclipboard/pkg/hub"
 	"tvclipboard/pkg/qrcode"
 	"tvclipboard/pkg/token"
@@ -28,10 +47,27 @@ var upgrader = websocket.Upgrader{
 	WriteBufferSize: 1024,
 }
 
+// localUpgrader is used for trusted local (Unix socket) connections, which skip origin checks
+var localUpgrader = websocket.Upgrader{
+	CheckOrigin:     func(r *http.Request) bool { return true },
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// localConnKey marks requests that arrived on the local Unix socket listener
+type localConnKey struct{}
+
+// isLocalRequest reports whether r arrived through LocalHandler
+func isLocalRequest(r *http.Request) bool {
+	local, _ := r.Context().Value(localConnKey{}).(bool)
+	return local
+}
+
 // isOriginAllowed checks if the given origin is in the allowed origins list
-func isOriginAllowed(origin string, allowedOrigins []string) bool {
+// An empty list allows every origin, unless strict is set, in which case it allows none
+func isOriginAllowed(origin string, allowedOrigins []string, strict bool) bool {
 	if len(allowedOrigins) == 0 {
-		return true
+		return !strict
 	}
 	for _, allowed := range allowedOrigins {
 		// Exact match first (most common case)
@@ -85,8 +121,44 @@ func matchesWildcard(origin, pattern string) bool {
 	return false
 }
 
+// isHostAllowed checks the request Host header against the allowed hosts list
+// Entries without a port match any port; an empty list allows every host
+func isHostAllowed(host string, allowedHosts []string) bool {
+	if len(allowedHosts) == 0 {
+		return true
+	}
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	for _, allowed := range allowedHosts {
+		if strings.EqualFold(host, allowed) || strings.EqualFold(hostname, strings.Trim(allowed, "[]")) {
+			return true
+		}
+	}
+	return false
+}
+
+// isSameOrigin reports whether origin points at the host the request was sent to
+func isSameOrigin(origin, host string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	return strings.EqualFold(u.Host, host)
+}
+
+// checkOrigin applies the origin policy to a request with a non-empty Origin header
+// In strict mode an empty allowlist still admits same-origin requests (the pages we serve)
+func checkOrigin(r *http.Request, origin string, allowedOrigins []string, strict bool) bool {
+	if strict && len(allowedOrigins) == 0 && isSameOrigin(origin, r.Host) {
+		return true
+	}
+	return isOriginAllowed(origin, allowedOrigins, strict)
+}
+
 // setUpgraderOrigins configures the WebSocket upgrader with allowed origins
-func setUpgraderOrigins(allowedOrigins []string) {
+func setUpgraderOrigins(allowedOrigins []string, strict bool) {
 	upgrader.CheckOrigin = func(r *http.Request) bool {
 		origin := r.Header.Get("Origin")
 		// If allowedOrigins is configured, require a valid Origin header
@@ -98,7 +170,7 @@ func setUpgraderOrigins(allowedOrigins []string) {
 			}
 			return true // Allow requests without Origin header only when no restrictions configured
 		}
-		allowed := isOriginAllowed(origin, allowedOrigins)
+		allowed := checkOrigin(r, origin, allowedOrigins, strict)
 		if !allowed {
 			log.Printf("Origin check failed: %s not in allowed origins", origin)
 		}
@@ -109,205 +181,1931 @@ func setUpgraderOrigins(allowedOrigins []string) {
 // Server handles HTTP requests and WebSocket connections
 type Server struct {
 	hub            *hub.Hub
+	rooms          *hub.RoomManager
 	tokenManager   *token.TokenManager
 	qrGenerator    *qrcode.Generator
 	staticFiles    fs.FS
 	allowedOrigins []string
+	allowedHosts   []string
 	version        string
 	i18n           *i18n.I18n
+	handlerTimeout time.Duration
+	defaultTheme   string
+	trustLocal     bool
+	maxTokenLength int
+	allowedNets    []*net.IPNet
+
+	// Send "/" without a mode to the client page when the room already has a host
+	autoClientRedirect bool
+
+	auditLog hub.AuditLogger
+
+	// Deny cross-origin upgrades when allowedOrigins is empty instead of allowing all
+	strictOrigins bool
+
+	// Serve /ws?mode=debug echo connections
+	debugWS bool
+
+	// Embed the QR codes in the host page instead of loading /qrcode.png
+	inlineQR bool
+
+	// Optional behaviors reported by /api/info
+	features features.Set
+
+	// Path the WebSocket endpoint is registered on, DefaultWSPath unless configured
+	wsPath string
+
+	// Connections presenting this secret always become host ("" disables)
+	hostSecret string
+
+	// Every connection needs a token and no one becomes host
+	noHost bool
+
+	// Set by Shutdown; no new QR tokens are issued while draining
+	draining atomic.Bool
+
+	// Leave static asset URLs without the ?v= cache-busting version
+	noCacheBust bool
+
+	// Bearer token for /api/maintenance and /api/announce ("" disables the endpoints)
+	adminToken string
+
+	// Pages show a maintenance notice and new connections are refused while set
+	maintenance atomic.Bool
+}
+
+// sendBodyLimit caps /api/send bodies; the hub enforces the configured message size
+const sendBodyLimit = 10 * 1024 * 1024
+
+// gzipExpansionLimit caps a decompressed /api/send body at this multiple of the message size limit
+// Anything larger is rejected while decompressing, so a small gzip bomb can't exhaust memory
+const gzipExpansionLimit = 4
+
+// Errors returned by readSendBody
+var (
+	errUnsupportedEncoding = errors.New("unsupported content encoding")
+	errBadGzip             = errors.New("invalid gzip body")
+	errBodyTooLarge        = errors.New("body too large")
+)
+
+// readSendBody reads an /api/send body, transparently decompressing Content-Encoding: gzip
+func readSendBody(w http.ResponseWriter, r *http.Request, messageLimit int64) ([]byte, error) {
+	body := io.Reader(http.MaxBytesReader(w, r.Body, sendBodyLimit))
+
+	switch strings.ToLower(r.Header.Get("Content-Encoding")) {
+	case "", "identity":
+		data, err := io.ReadAll(body)
+		if err != nil {
+			return nil, errBodyTooLarge
+		}
+		return data, nil
+	case "gzip":
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, errBadGzip
+		}
+		defer zr.Close()
+		limit := messageLimit * gzipExpansionLimit
+		data, err := io.ReadAll(io.LimitReader(zr, limit+1))
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				return nil, errBodyTooLarge
+			}
+			return nil, errBadGzip
+		}
+		if int64(len(data)) > limit {
+			log.Printf("Send request rejected: gzip body expands beyond %d bytes", limit)
+			return nil, errBodyTooLarge
+		}
+		return data, nil
+	default:
+		return nil, errUnsupportedEncoding
+	}
+}
+
+// BuildVersion is injected at build time with
+// -ldflags "-X tvclipboard/pkg/server.BuildVersion=v1.2.3"
+var BuildVersion string
+
+// resolveVersion returns BuildVersion, else the VCS revision from build info, else the start time
+// The result is used for cache busting and reported by /api/info and /healthz
+func resolveVersion() string {
+	if BuildVersion != "" {
+		return BuildVersion
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		var revision string
+		var modified bool
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				revision = setting.Value
+			case "vcs.modified":
+				modified = setting.Value == "true"
+			}
+		}
+		if len(revision) > 12 {
+			revision = revision[:12]
+		}
+		// A dirty tree can change without a new revision, so keep timestamp busting for it
+		if revision != "" && !modified {
+			return revision
+		}
+	}
+	return time.Now().Format("20060102150405")
 }
 
+// DefaultMaxTokenLength is the longest token accepted on the WebSocket handshake
+const DefaultMaxTokenLength = 256
+
+// maxHandshakeURLLength caps the request URI of WebSocket and SSE handshakes
+const maxHandshakeURLLength = 4096
+
+// DefaultHandlerTimeout bounds how long page, QR and i18n handlers may run
+const DefaultHandlerTimeout = 5 * time.Second
+
 // NewServer creates a new Server instance
 func NewServer(h *hub.Hub, tm *token.TokenManager, qrGen *qrcode.Generator, staticFiles fs.FS, allowedOrigins []string, i18n *i18n.I18n) *Server {
 	return &Server{
 		hub:            h,
+		rooms:          hub.NewRoomManager(h),
 		tokenManager:   tm,
 		qrGenerator:    qrGen,
 		staticFiles:    staticFiles,
 		allowedOrigins: allowedOrigins,
-		version:        time.Now().Format("20060102150405"),
+		version:        resolveVersion(),
 		i18n:           i18n,
+		handlerTimeout: DefaultHandlerTimeout,
+		defaultTheme:   "auto",
+		trustLocal:     true,
+		maxTokenLength: DefaultMaxTokenLength,
+		auditLog:       hub.NopAuditLogger{},
+		wsPath:         DefaultWSPath,
 	}
 }
 
-// Shutdown gracefully shuts down the server
-func (s *Server) Shutdown() {
-	// No-op: server shutdown is handled by http.Server.Shutdown()
+// SetAuditLogger sets where rejected connections are reported (nil disables)
+// Hub events (rate limiting, kicked clients) are configured with Hub.SetAuditLogger
+func (s *Server) SetAuditLogger(l hub.AuditLogger) {
+	if l == nil {
+		l = hub.NopAuditLogger{}
+	}
+	s.auditLog = l
 }
 
-// securityHeaders middleware adds security headers to all responses
-func securityHeaders(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("X-Content-Type-Options", "nosniff")
-		w.Header().Set("X-Frame-Options", "DENY")
-		w.Header().Set("X-XSS-Protection", "1; mode=block")
-		w.Header().Set("Strict-Transport-Security", "max-age=31536000; includeSubDomains")
-		w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'self' 'unsafe-inline'; style-src 'self' 'unsafe-inline' https://cdnjs.cloudflare.com; font-src https://cdnjs.cloudflare.com; img-src 'self' data:;")
-		next(w, r)
+// audit reports a rejected request to the audit logger
+func (s *Server) audit(r *http.Request, eventType, detail string) {
+	s.auditLog.Event(hub.AuditEvent{
+		Time:       time.Now(),
+		Type:       eventType,
+		RemoteAddr: r.RemoteAddr,
+		Room:       r.URL.Query().Get("room"),
+		Detail:     detail,
+	})
+}
+
+// tokenAuditType maps a token validation error to its audit event type
+func tokenAuditType(err error) string {
+	if errors.Is(err, token.ErrTokenExpired) || errors.Is(err, hub.ErrReconnectExpired) {
+		return hub.AuditTokenExpired
 	}
+	return hub.AuditTokenInvalid
 }
 
-// RegisterRoutes registers all HTTP routes
-func (s *Server) RegisterRoutes() {
-	// Configure WebSocket upgrader with allowed origins
-	setUpgraderOrigins(s.allowedOrigins)
+// SetMaxTokenLength sets the longest token accepted on handshakes (<= 0 restores the default)
+func (s *Server) SetMaxTokenLength(n int) {
+	if n <= 0 {
+		n = DefaultMaxTokenLength
+	}
+	s.maxTokenLength = n
+}
 
-	// Main page handler
-	http.HandleFunc("/", securityHeaders(s.handleIndex))
+// checkHandshakeLength rejects over-long handshake URLs (414) and tokens (400) before any token lookup
+func (s *Server) checkHandshakeLength(w http.ResponseWriter, r *http.Request, token string) bool {
+	if len(r.URL.RequestURI()) > maxHandshakeURLLength {
+		log.Printf("Connection rejected: request URI too long (%d bytes)", len(r.URL.RequestURI()))
+		http.Error(w, "Request URI too long", http.StatusRequestURITooLong)
+		return false
+	}
+	if len(token) > s.maxTokenLength {
+		log.Printf("Connection rejected: token too long (%d bytes, max: %d)", len(token), s.maxTokenLength)
+		http.Error(w, "Bad request: token too long", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
 
-	// QR code endpoint
-	http.HandleFunc("/qrcode.png", s.handleQRCode)
+// SetTrustLocal sets whether Unix socket connections skip origin, host and token checks
+func (s *Server) SetTrustLocal(trust bool) {
+	s.trustLocal = trust
+}
 
-	// WebSocket endpoint
-	http.HandleFunc("/ws", s.handleWebSocket)
+// LocalHandler wraps next for serving on a local Unix socket listener
+func (s *Server) LocalHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), localConnKey{}, true)))
+	})
+}
 
-	// i18n endpoint
-	http.HandleFunc("/i18n.json", s.handleI18n)
+// normalizeTheme returns theme if it is light, dark or auto, and auto otherwise
+func normalizeTheme(theme string) string {
+	switch theme {
+	case "light", "dark", "auto":
+		return theme
+	default:
+		return "auto"
+	}
+}
 
-	// Serve static files (CSS, JS)
-	staticContent, err := fs.Sub(s.staticFiles, "static")
-	if err != nil {
-		log.Printf("Failed to create sub filesystem: %v", err)
-		return
+// SetDefaultTheme sets the theme hint used when the page has no ?theme= override
+func (s *Server) SetDefaultTheme(theme string) {
+	s.defaultTheme = normalizeTheme(theme)
+}
+
+// SetHandlerTimeout sets the deadline for page, QR and i18n handlers (0 disables)
+func (s *Server) SetHandlerTimeout(timeout time.Duration) {
+	s.handlerTimeout = timeout
+}
+
+// SetAllowedHosts restricts WebSocket upgrades to requests whose Host header is listed
+func (s *Server) SetAllowedHosts(hosts []string) {
+	s.allowedHosts = hosts
+}
+
+// SetAutoClientRedirect redirects "/" without a mode to "?mode=client" when the room already has a host
+// Someone opening the bare URL then most likely followed a stale link from a phone
+func (s *Server) SetAutoClientRedirect(enabled bool) {
+	s.autoClientRedirect = enabled
+}
+
+// SetNoCacheBust leaves /static/ URLs in pages without the ?v=<version> query,
+// for CDNs that strip query strings or when caching is controlled externally
+func (s *Server) SetNoCacheBust(disabled bool) {
+	s.noCacheBust = disabled
+}
+
+// SetStrictOrigins makes an empty allowed-origins list deny cross-origin WebSocket upgrades
+// Same-origin and no-origin requests are still accepted. Must be called before RegisterRoutes
+func (s *Server) SetStrictOrigins(strict bool) {
+	s.strictOrigins = strict
+}
+
+// DefaultWSPath is where the WebSocket endpoint is served unless SetWSPath moves it
+const DefaultWSPath = "/ws"
+
+// SetWSPath serves the WebSocket endpoint on path instead of /ws, e.g. when a proxy routes /ws elsewhere
+// A missing leading slash is added and "" restores the default. Must be called before RegisterRoutes
+func (s *Server) SetWSPath(path string) {
+	if path == "" {
+		path = DefaultWSPath
 	}
-	fileServer := http.FileServer(http.FS(staticContent))
-	http.Handle("/static/", http.StripPrefix("/static/", fileServer))
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	s.wsPath = path
 }
 
-// handleIndex serves the host or client HTML page
-func (s *Server) handleIndex(w http.ResponseWriter, r *http.Request) {
-	mode := r.URL.Query().Get("mode")
+// SetHostSecret lets a connection with ?host_secret=<secret> always take the host role
+// This lets an unattended host reclaim its room after a restart without racing phones ("" disables)
+func (s *Server) SetHostSecret(secret string) {
+	s.hostSecret = secret
+}
 
-	var templateFile string
-	if mode == "client" {
-		templateFile = "client.html"
-	} else {
-		templateFile = "host.html"
+// hasHostSecret reports whether the request presents the configured host secret
+func (s *Server) hasHostSecret(r *http.Request) bool {
+	if s.hostSecret == "" {
+		return false
 	}
+	secret := r.URL.Query().Get("host_secret")
+	return secret != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(s.hostSecret)) == 1
+}
 
-	// Read and serve the template
-	content, err := fs.ReadFile(s.staticFiles, "static/"+templateFile)
-	if err != nil {
-		http.Error(w, "Not found", http.StatusNotFound)
-		return
+// SetAdminToken enables /api/maintenance and /api/announce for requests with "Authorization: Bearer <token>" ("" disables it)
+func (s *Server) SetAdminToken(token string) {
+	s.adminToken = token
+}
+
+// hasAdminToken reports whether the request presents the configured admin token
+func (s *Server) hasAdminToken(r *http.Request) bool {
+	if s.adminToken == "" {
+		return false
 	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) == 1
+}
 
-	// Inject session timeout as a data attribute and cache busting version
-	htmlContent := string(content)
-	htmlContent = qrcode.InjectSessionTimeout(htmlContent, s.qrGenerator.SessionTimeoutSeconds())
+// SetMaintenance puts the server into or out of maintenance mode
+func (s *Server) SetMaintenance(enabled bool) {
+	if s.maintenance.Swap(enabled) != enabled {
+		log.Printf("Maintenance mode: %v", enabled)
+	}
+}
 
-	// Add version to all static JS files (using pre-compiled regex)
-	htmlContent = jsRegex.ReplaceAllString(htmlContent, `$1?v=`+s.version+`">`)
+// InMaintenance reports whether the server is in maintenance mode
+func (s *Server) InMaintenance() bool {
+	return s.maintenance.Load()
+}
 
-	// Add version to all static CSS files (using pre-compiled regex)
-	htmlContent = cssRegex.ReplaceAllStringFunc(htmlContent, func(match string) string {
-		return strings.Replace(match, ".css", `.css?v=`+s.version, 1)
-	})
+// requiresToken reports whether a connection to a room needs a token
+// Normally only joining a room that already has a host does
+func (s *Server) requiresToken(hostExists bool) bool {
+	return hostExists || s.noHost
+}
 
-	// Add i18n script before body closing tag
-	// Note: ToJSON() uses json.Marshal which properly escapes special characters
-	i18nJSON, err := s.i18n.ToJSON()
+// SetFeatures applies the server's on/off behaviors and reports every feature in /api/info so the
+// frontend can adapt; it is the only way to set them:
+//   - DebugWS enables /ws?mode=debug, which echoes messages back to the sender for connectivity testing
+//   - NoHost requires a valid token from every connection, including the first one in a room; pass the
+//     same Set to hub.SetFeatures so the hub never assigns a host. The host secret is ignored
+//   - InlineQR embeds the QR codes in the host page as data: URIs, saving the /qrcode.png round trip;
+//     each page load spends a fresh token, so the page is never cached
+func (s *Server) SetFeatures(f features.Set) {
+	s.features = f
+	s.debugWS = f.DebugWS
+	s.noHost = f.NoHost
+	s.inlineQR = f.InlineQR
+}
+
+// SetAllowedCIDRs restricts connections to clients whose IP is in one of nets (nil allows all)
+func (s *Server) SetAllowedCIDRs(nets []*net.IPNet) {
+	s.allowedNets = nets
+}
+
+// remoteIP returns the request's client address without the port
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		log.Printf("Failed to serialize i18n translations: %v", err)
-		i18nJSON = []byte("{}")
+		return r.RemoteAddr
 	}
+	return host
+}
 
-	// Inject translations as properly escaped JSON (json.Marshal handles escaping)
-	safeJSON := strings.ReplaceAll(string(i18nJSON), "</", "<\\/")
-	htmlContent = strings.Replace(htmlContent, "</body>", `<script>window.translations = `+safeJSON+`;</script></body>`, 1)
-
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	if _, err := w.Write([]byte(htmlContent)); err != nil {
-		log.Printf("Failed to write response: %v", err)
+// isIPAllowed reports whether the request's client IP is in an allowed network
+func (s *Server) isIPAllowed(r *http.Request) bool {
+	if len(s.allowedNets) == 0 {
+		return true
+	}
+	ip := net.ParseIP(remoteIP(r))
+	if ip == nil {
+		return false
 	}
+	for _, n := range s.allowedNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
 }
 
-// handleI18n serves i18n translations as JSON
-func (s *Server) handleI18n(w http.ResponseWriter, r *http.Request) {
-	translations, err := s.i18n.GetTranslations()
-	if err != nil {
-		http.Error(w, "Failed to get translations", http.StatusInternalServerError)
-		return
+// checkClientIP rejects requests from outside the allowed networks with 403
+func (s *Server) checkClientIP(w http.ResponseWriter, r *http.Request) bool {
+	if s.isIPAllowed(r) {
+		return true
 	}
+	log.Printf("Connection rejected: client IP not allowed - %s", r.RemoteAddr)
+	s.audit(r, hub.AuditIPRejected, "")
+	http.Error(w, "Forbidden: client IP not allowed", http.StatusForbidden)
+	return false
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(translations); err != nil {
-		log.Printf("Failed to encode i18n response: %v", err)
+// checkClientsPerIP rejects a connection with 429 when its IP already has the most clients a room allows
+// The hub enforces the same limit on registration; checking first gives the client a clear HTTP error
+func (s *Server) checkClientsPerIP(w http.ResponseWriter, r *http.Request, roomHub *hub.Hub) bool {
+	ip := remoteIP(r)
+	if !roomHub.AtIPLimit(ip) {
+		return true
 	}
+	log.Printf("Connection rejected: too many clients from %s", ip)
+	w.Header().Set(actionHeader, actionRetry)
+	http.Error(w, "Too many connections from this address", http.StatusTooManyRequests)
+	return false
 }
 
-// handleQRCode generates and serves a QR code with a session token
-func (s *Server) handleQRCode(w http.ResponseWriter, r *http.Request) {
-	// Generate new session token
-	token, err := s.tokenManager.GenerateToken()
-	if err != nil {
-		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
-		return
+// actionHeader tells the frontend how to recover from a rejected connection
+const actionHeader = "X-TVClipboard-Action"
+
+const (
+	actionRescan = "rescan" // The token can never work again; scan a fresh QR code
+	actionRetry  = "retry"  // Transient failure; retrying the same URL may succeed
+)
+
+// tokenAction maps a token validation error to the recovery action for the client
+func tokenAction(err error) string {
+	switch {
+	case errors.Is(err, token.ErrTokenExpired),
+		errors.Is(err, token.ErrTokenNotFound),
+		errors.Is(err, token.ErrTokenWrongRoom),
+		errors.Is(err, hub.ErrReconnectInvalid),
+		errors.Is(err, hub.ErrReconnectExpired):
+		return actionRescan
+	default:
+		return actionRetry
 	}
-	log.Printf("Generated new session token (expires in %v)", s.tokenManager.Timeout())
+}
 
-	s.qrGenerator.ServeQRCode(w, r, token)
+// hubRetryAfter is the Retry-After hint, in seconds, sent when a hub is stopped
+const hubRetryAfter = "5"
+
+// hubUnavailable responds 503 with Retry-After when the hub is stopped (e.g. during shutdown)
+func hubUnavailable(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", hubRetryAfter)
+	w.Header().Set(actionHeader, actionRetry)
+	http.Error(w, "Service unavailable: hub stopped", http.StatusServiceUnavailable)
 }
 
-// handleWebSocket handles WebSocket connection upgrades
-func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
-	token := r.URL.Query().Get("token")
+// maintenanceUnavailable responds 503 with Retry-After while the server is in maintenance mode
+func maintenanceUnavailable(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", hubRetryAfter)
+	w.Header().Set(actionHeader, actionRetry)
+	http.Error(w, "Service unavailable: server in maintenance", http.StatusServiceUnavailable)
+}
 
-	// Check origin before proceeding with WebSocket upgrade
-	origin := r.Header.Get("Origin")
-	if origin != "" {
-		if !isOriginAllowed(origin, s.allowedOrigins) {
-			log.Printf("Connection rejected: origin not allowed - %s", origin)
-			http.Error(w, "Forbidden: Origin not allowed", http.StatusForbidden)
-			return
-		}
+// maintenancePage is served instead of the host and client pages during maintenance
+const maintenancePage = `<!DOCTYPE html>
+<html lang="%s">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>TV Clipboard</title>
+<link rel="stylesheet" href="/static/css/style.css">
+</head>
+<body>
+<div class="container">
+<h1>%s</h1>
+<p>%s</p>
+</div>
+</body>
+</html>
+`
+
+// serveMaintenancePage responds 503 with a maintenance notice in the browser's language
+func (s *Server) serveMaintenancePage(w http.ResponseWriter, r *http.Request) {
+	lang := s.i18n.MatchLanguage(r.Header.Get("Accept-Language"))
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Retry-After", hubRetryAfter)
+	w.WriteHeader(http.StatusServiceUnavailable)
+	fmt.Fprintf(w, maintenancePage, html.EscapeString(lang),
+		html.EscapeString(s.i18n.TranslateLang(lang, "backend.maintenance_title")),
+		html.EscapeString(s.i18n.TranslateLang(lang, "backend.maintenance_message")))
+}
+
+// maintenanceRequest is the JSON body accepted by /api/maintenance
+type maintenanceRequest struct {
+	Enabled bool `json:"enabled"`
+	Drain   bool `json:"drain"` // Also disconnect everyone already connected
+}
+
+// maintenanceResponse is the JSON body returned by /api/maintenance
+type maintenanceResponse struct {
+	Maintenance  bool `json:"maintenance"`
+	Disconnected int  `json:"disconnected"`
+}
+
+// handleMaintenance turns maintenance mode on or off; it needs the admin token
+func (s *Server) handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	if s.adminToken == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.hasAdminToken(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized: valid admin token required", http.StatusUnauthorized)
+		return
 	}
 
-	hostExists := s.hub.HasHost()
+	var req maintenanceRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024)).Decode(&req); err != nil {
+		http.Error(w, "Bad request: invalid JSON body", http.StatusBadRequest)
+		return
+	}
 
-	// Log connection attempt without exposing the token value
-	log.Printf("WebSocket connection attempt, hasToken: %v, hostExists: %v", token != "", hostExists)
+	s.SetMaintenance(req.Enabled)
+	resp := maintenanceResponse{Maintenance: req.Enabled}
+	if req.Enabled && req.Drain {
+		resp.Disconnected = s.rooms.DisconnectAll("maintenance")
+		log.Printf("Maintenance drain disconnected %d clients", resp.Disconnected)
+	}
 
-	// Require token for client connections (when host already exists)
-	if hostExists {
-		if token == "" {
-			log.Printf("Connection rejected: no token provided (host exists)")
-			http.Error(w, "Unauthorized: valid token required", http.StatusUnauthorized)
-			return
-		}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
 
-		err := s.tokenManager.ValidateToken(token)
-		if err != nil {
-			log.Printf("Token validation failed: %v", err)
-			http.Error(w, "Unauthorized: invalid or expired token", http.StatusUnauthorized)
-			return
-		}
-	} else if token != "" {
-		// First connection (host) shouldn't have a token
-		log.Printf("Connection rejected: token provided for first connection")
-		http.Error(w, "Bad request: first connection should not include token", http.StatusBadRequest)
+// MaxAnnouncementRunes is the longest announcement /api/announce accepts
+const MaxAnnouncementRunes = 500
+
+// announceRequest is the JSON body accepted by /api/announce
+type announceRequest struct {
+	Content string `json:"content"`
+}
+
+// handleAnnounce broadcasts an "announcement" message to every client of every room; it needs the admin token
+func (s *Server) handleAnnounce(w http.ResponseWriter, r *http.Request) {
+	if s.adminToken == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.hasAdminToken(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized: valid admin token required", http.StatusUnauthorized)
 		return
 	}
 
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Println("WebSocket upgrade error:", err)
+	var req announceRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4*MaxAnnouncementRunes+1024)).Decode(&req); err != nil {
+		http.Error(w, "Bad request: invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	content := strings.TrimSpace(req.Content)
+	if content == "" {
+		http.Error(w, "Bad request: announcement content is required", http.StatusBadRequest)
+		return
+	}
+	if utf8.RuneCountInString(content) > MaxAnnouncementRunes {
+		http.Error(w, fmt.Sprintf("Bad request: announcement longer than %d characters", MaxAnnouncementRunes), http.StatusBadRequest)
 		return
 	}
 
-	log.Printf("WebSocket connection established")
+	delivery, err := s.rooms.Broadcast(r.Context(), hub.Message{Type: "announcement", Content: content})
+	if err != nil {
+		log.Printf("Announcement not delivered everywhere: %v", err)
+		w.Header().Set("Retry-After", hubRetryAfter)
+		http.Error(w, "Service unavailable: announcement could not be queued", http.StatusServiceUnavailable)
+		return
+	}
+	log.Printf("Announcement sent to %d clients (%d dropped): %q", delivery.Delivered, delivery.Dropped, content)
+	writeDelivery(w, delivery)
+}
 
-	mobile := r.URL.Query().Get("mobile") == "true"
-	client := hub.NewClient(conn, s.hub, mobile)
+// tokenInfo is one entry of the JSON list returned by GET /api/tokens
+type tokenInfo struct {
+	ID               string `json:"id"`
+	Room             string `json:"room,omitempty"`
+	IssuedAt         int64  `json:"issuedAt"` // Unix seconds
+	RemainingSeconds int    `json:"remainingSeconds"`
+}
 
-	select {
-	case s.hub.Register <- client:
-	case <-s.hub.Done():
-		log.Printf("Hub stopped, rejecting connection")
-		conn.Close()
+// handleTokens lists the active tokens (GET /api/tokens) or revokes one (DELETE /api/tokens/{id})
+// Like the other admin endpoints it needs the admin token and is a 404 without one configured
+func (s *Server) handleTokens(w http.ResponseWriter, r *http.Request) {
+	if s.adminToken == "" {
+		http.NotFound(w, r)
+		return
+	}
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/tokens"), "/")
+	method := http.MethodGet
+	if id != "" {
+		method = http.MethodDelete
+	}
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.hasAdminToken(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized: valid admin token required", http.StatusUnauthorized)
 		return
 	}
 
-	go client.WritePump()
-	go client.ReadPump()
+	if id != "" {
+		if !s.tokenManager.Revoke(id) {
+			http.Error(w, "Not found: no such token", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	resp := []tokenInfo{}
+	for _, t := range s.tokenManager.ListTokens() {
+		resp = append(resp, tokenInfo{
+			ID:               t.ID,
+			Room:             t.Room,
+			IssuedAt:         t.Timestamp,
+			RemainingSeconds: int(t.Remaining.Seconds()),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Failed to encode tokens response: %v", err)
+	}
+}
+
+// clientInfo is one entry of the JSON list returned by GET /api/clients
+type clientInfo struct {
+	ID           string    `json:"id"`
+	Room         string    `json:"room,omitempty"`
+	Host         bool      `json:"host"`
+	Mobile       bool      `json:"mobile"`
+	ConnectedAt  time.Time `json:"connectedAt"`
+	MessagesSent int       `json:"messagesSent"`
+	// Round-trip times the client reported with "rtt" messages, in milliseconds
+	LastRTTMillis float64 `json:"lastRttMs"`
+	AvgRTTMillis  float64 `json:"avgRttMs"`
+	RTTSamples    int     `json:"rttSamples"`
+	// Messages not queued because the client's send buffer was full
+	Dropped int64 `json:"dropped"`
+}
+
+// roomStatsInfo is one room's hub counters in /api/clients
+type roomStatsInfo struct {
+	Room              string `json:"room"`
+	Clients           int    `json:"clients"`
+	HostID            string `json:"hostId,omitempty"`
+	MessagesBroadcast int64  `json:"messagesBroadcast"`
+	MessagesDropped   int64  `json:"messagesDropped"`
+	BytesBroadcast    int64  `json:"bytesBroadcast"`
+	RateLimited       int64  `json:"rateLimited"`
+	ClientDrops       int64  `json:"clientDrops"`
+	SlowClients       int64  `json:"slowClients"`
+	UptimeSeconds     int64  `json:"uptimeSeconds"`
+}
+
+// clientsResponse is the JSON body returned by /api/clients
+type clientsResponse struct {
+	Clients []clientInfo    `json:"clients"`
+	Rooms   []roomStatsInfo `json:"rooms"`
+}
+
+// handleClients lists the connected clients of every room with their connection quality, and each
+// room's counters (Hub.Stats); it needs the admin token
+func (s *Server) handleClients(w http.ResponseWriter, r *http.Request) {
+	if s.adminToken == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.hasAdminToken(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized: valid admin token required", http.StatusUnauthorized)
+		return
+	}
+
+	resp := clientsResponse{Clients: []clientInfo{}}
+	for _, c := range s.rooms.Clients() {
+		resp.Clients = append(resp.Clients, clientInfo{
+			ID:            c.ID,
+			Room:          c.Room,
+			Host:          c.Host,
+			Mobile:        c.Mobile,
+			ConnectedAt:   c.ConnectedAt,
+			MessagesSent:  c.MessagesSent,
+			LastRTTMillis: float64(c.LastRTT) / float64(time.Millisecond),
+			AvgRTTMillis:  float64(c.AvgRTT) / float64(time.Millisecond),
+			RTTSamples:    c.RTTSamples,
+			Dropped:       c.Dropped,
+		})
+	}
+	for _, st := range s.rooms.Stats() {
+		resp.Rooms = append(resp.Rooms, roomStatsInfo{
+			Room:              st.Room,
+			Clients:           st.ClientCount,
+			HostID:            st.HostID,
+			MessagesBroadcast: st.MessagesBroadcast,
+			MessagesDropped:   st.MessagesDropped,
+			BytesBroadcast:    st.BytesBroadcast,
+			RateLimited:       st.RateLimited,
+			ClientDrops:       st.ClientDrops,
+			SlowClients:       st.SlowClients,
+			UptimeSeconds:     int64(st.Uptime.Seconds()),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Failed to encode clients response: %v", err)
+	}
+}
+
+// handleMetrics reports the hub counters of all rooms added together in the Prometheus text format;
+// it needs the admin token. A room removed for being idle takes its counts with it, which Prometheus
+// treats as a counter reset
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if s.adminToken == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.hasAdminToken(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized: valid admin token required", http.StatusUnauthorized)
+		return
+	}
+
+	rooms := s.rooms.Stats()
+	var total hub.HubStats
+	for _, st := range rooms {
+		total.ClientCount += st.ClientCount
+		total.MessagesBroadcast += st.MessagesBroadcast
+		total.MessagesDropped += st.MessagesDropped
+		total.BytesBroadcast += st.BytesBroadcast
+		total.RateLimited += st.RateLimited
+		total.ClientDrops += st.ClientDrops
+		total.SlowClients += st.SlowClients
+	}
+
+	var b bytes.Buffer
+	metric := func(name, kind, help string, value int64) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, value)
+	}
+	metric("tvclipboard_clients", "gauge", "Connected clients in all rooms.", int64(total.ClientCount))
+	metric("tvclipboard_rooms", "gauge", "Rooms with a hub, including the default one.", int64(len(rooms)))
+	metric("tvclipboard_messages_broadcast_total", "counter", "Messages accepted for broadcast.", total.MessagesBroadcast)
+	metric("tvclipboard_bytes_broadcast_total", "counter", "Bytes of messages accepted for broadcast.", total.BytesBroadcast)
+	metric("tvclipboard_messages_dropped_total", "counter", "Messages dropped by the global rate limit or a full hub or client queue.", total.MessagesDropped)
+	fmt.Fprintf(&b, "# HELP tvclipboard_messages_rejected_total Messages rejected before broadcast.\n"+
+		"# TYPE tvclipboard_messages_rejected_total counter\n"+
+		"tvclipboard_messages_rejected_total{reason=\"rate_limit\"} %d\n", total.RateLimited)
+	metric("tvclipboard_client_drops_total", "counter", "Messages not queued for a client because its send buffer was full.", total.ClientDrops)
+	metric("tvclipboard_slow_clients_total", "counter", "Clients disconnected because their send buffer was full.", total.SlowClients)
+	metric("tvclipboard_uptime_seconds", "gauge", "Seconds since the default hub started.", int64(rooms[0].Uptime.Seconds()))
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(b.Bytes())
+}
+
+// writeDelivery reports how many clients a message reached and how many were dropped for a full queue
+func writeDelivery(w http.ResponseWriter, delivery hub.Delivery) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(delivery); err != nil {
+		log.Printf("Error encoding delivery response: %v", err)
+	}
+}
+
+// registerTimeout bounds how long a handler waits for the hub to accept a new client
+var registerTimeout = 2 * time.Second
+
+// registerClient hands client to the hub without blocking forever if the hub loop has exited
+func registerClient(roomHub *hub.Hub, client *hub.Client) error {
+	timer := time.NewTimer(registerTimeout)
+	defer timer.Stop()
+
+	select {
+	case roomHub.Register <- client:
+		return nil
+	case <-roomHub.Done():
+		return fmt.Errorf("hub stopped")
+	case <-timer.C:
+		return fmt.Errorf("hub did not accept client within %v", registerTimeout)
+	}
+}
+
+// withTimeout wraps a handler so it responds 503 if it runs past the handler timeout
+func (s *Server) withTimeout(next http.HandlerFunc) http.HandlerFunc {
+	if s.handlerTimeout <= 0 {
+		return next
+	}
+	return http.TimeoutHandler(next, s.handlerTimeout, "Service unavailable: request timed out").ServeHTTP
+}
+
+// Shutdown gracefully shuts down the server
+// Stops issuing QR tokens, sends connected clients a "shutdown" notice and stops all room hubs;
+// the default hub and HTTP server are stopped by the caller
+func (s *Server) Shutdown() {
+	if s.draining.Swap(true) {
+		return
+	}
+	s.rooms.NotifyShutdown()
+	s.rooms.Stop()
+}
+
+// StartRoomCleanup starts periodic removal of empty rooms
+// Returns a cancel function to stop the cleanup routine
+func (s *Server) StartRoomCleanup(interval time.Duration) context.CancelFunc {
+	return s.rooms.StartCleanup(interval)
+}
+
+// securityHeaders middleware adds security headers to all responses
+func securityHeaders(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("X-Frame-Options", "DENY")
+		w.Header().Set("X-XSS-Protection", "1; mode=block")
+		w.Header().Set("Strict-Transport-Security", "max-age=31536000; includeSubDomains")
+		w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'self' 'unsafe-inline'; style-src 'self' 'unsafe-inline' https://cdnjs.cloudflare.com; font-src https://cdnjs.cloudflare.com; img-src 'self' data:;")
+		next(w, r)
+	}
+}
+
+// RegisterRoutes registers all HTTP routes on mux
+// The same mux can be served on several listeners (TCP and Unix socket)
+func (s *Server) RegisterRoutes(mux *http.ServeMux) {
+	// Configure WebSocket upgrader with allowed origins
+	setUpgraderOrigins(s.allowedOrigins, s.strictOrigins)
+
+	// Main page handler
+	mux.HandleFunc("/", securityHeaders(s.withTimeout(s.handleIndex)))
+
+	// QR code endpoint
+	mux.HandleFunc("/qrcode.png", s.withTimeout(s.handleQRCode))
+
+	// QR target URL endpoint (for embedders rendering their own QR code)
+	mux.HandleFunc("/api/qr-url", s.withTimeout(s.handleQRURL))
+
+	// Recent clipboard history (token-gated)
+	mux.HandleFunc("/api/history", s.handleHistory)
+
+	// WebSocket endpoint
+	mux.HandleFunc(s.wsPath, s.handleWebSocket)
+
+	// Server-Sent Events fallback for networks that block WebSockets
+	mux.HandleFunc("/events", s.handleEvents)
+	mux.HandleFunc("/api/send", s.handleSend)
+
+	// Server info and health check
+	mux.HandleFunc("/api/info", s.handleInfo)
+	mux.HandleFunc("/api/maintenance", s.handleMaintenance)
+	mux.HandleFunc("/api/announce", s.handleAnnounce)
+	mux.HandleFunc("/api/tokens", s.handleTokens)
+	mux.HandleFunc("/api/tokens/", s.handleTokens)
+	mux.HandleFunc("/api/clients", s.handleClients)
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	mux.HandleFunc("/api/time", s.handleTime)
+	mux.HandleFunc("/healthz", s.handleHealthz)
+
+	// i18n endpoint
+	mux.HandleFunc("/i18n.json", s.withTimeout(s.handleI18n))
+
+	// Serve static files (CSS, JS)
+	staticContent, err := fs.Sub(s.staticFiles, "static")
+	if err != nil {
+		log.Printf("Failed to create sub filesystem: %v", err)
+		return
+	}
+	fileServer := http.FileServer(http.FS(staticContent))
+	mux.Handle("/static/", http.StripPrefix("/static/", withETags(staticContent, fileServer)))
+}
+
+// withETags sets a content-hash ETag on files served from fsys
+// Embedded files have no modification time, so without it http.FileServer never answers 304;
+// with it, FileServer handles If-None-Match itself. Hashes are cached since the files never change
+func withETags(fsys fs.FS, next http.Handler) http.Handler {
+	var etags sync.Map // path → quoted ETag
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/")
+		etag, ok := etags.Load(name)
+		if !ok {
+			if content, err := fs.ReadFile(fsys, name); err == nil {
+				sum := sha256.Sum256(content)
+				etag, _ = etags.LoadOrStore(name, `"`+hex.EncodeToString(sum[:8])+`"`)
+			}
+		}
+		if etag != nil {
+			w.Header().Set("ETag", etag.(string))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleIndex serves the host or client HTML page
+func (s *Server) handleIndex(w http.ResponseWriter, r *http.Request) {
+	// "/" is the mux's catch-all; unknown paths (such as /ws after --ws-path moved it) aren't pages
+	if r.URL.Path != "/" {
+		s.serveNotFound(w, r)
+		return
+	}
+
+	if s.maintenance.Load() {
+		s.serveMaintenancePage(w, r)
+		return
+	}
+
+	mode := r.URL.Query().Get("mode")
+
+	if !hub.ValidRoomCode(r.URL.Query().Get("room")) {
+		http.Error(w, "Bad request: invalid room code", http.StatusBadRequest)
+		return
+	}
+
+	// Reject unknown modes so a typo doesn't turn a phone into an accidental host
+	var templateFile string
+	switch mode {
+	case "client":
+		templateFile = "client.html"
+	case "host":
+		templateFile = "host.html"
+	case "":
+		if s.autoClientRedirect {
+			if roomHub, ok := s.rooms.Lookup(r.URL.Query().Get("room")); ok && roomHub.HasHost() {
+				query := r.URL.Query()
+				query.Set("mode", "client")
+				http.Redirect(w, r, "/?"+query.Encode(), http.StatusFound)
+				return
+			}
+		}
+		log.Printf("No mode specified, serving host page")
+		templateFile = "host.html"
+	default:
+		http.Error(w, fmt.Sprintf("Bad request: unknown mode %q (use mode=host or mode=client)", mode), http.StatusBadRequest)
+		return
+	}
+
+	// Read and serve the template
+	content, err := fs.ReadFile(s.staticFiles, "static/"+templateFile)
+	if err != nil {
+		s.serveNotFound(w, r)
+		return
+	}
+
+	theme := r.URL.Query().Get("theme")
+	if theme == "" {
+		theme = s.defaultTheme
+	}
+
+	// Inject session timeout, theme and WebSocket path as data attributes and cache busting version
+	htmlContent := string(content)
+	attrs := []string{
+		"data-session-timeout", strconv.Itoa(s.qrGenerator.SessionTimeoutSeconds()),
+		"data-theme", normalizeTheme(theme),
+	}
+	// The frontend falls back to /ws, so only a moved endpoint needs announcing
+	if s.wsPath != DefaultWSPath {
+		attrs = append(attrs, "data-ws-path", s.wsPath)
+	}
+	// Likewise only list QR code targets when the host page has more than one to show
+	if names := s.qrTargetNames(); len(names) > 1 {
+		attrs = append(attrs, "data-qr-targets", strings.Join(names, ","))
+	}
+	htmlContent = qrcode.InjectContainerAttributes(htmlContent, attrs...)
+
+	if templateFile == "host.html" && s.inlineQR {
+		htmlContent = s.injectInlineQR(w, r, htmlContent)
+	}
+
+	if !s.noCacheBust {
+		// Add version to all static JS files (using pre-compiled regex)
+		htmlContent = jsRegex.ReplaceAllString(htmlContent, `$1?v=`+s.version+`">`)
+
+		// Add version to all static CSS files (using pre-compiled regex)
+		htmlContent = cssRegex.ReplaceAllStringFunc(htmlContent, func(match string) string {
+			return strings.Replace(match, ".css", `.css?v=`+s.version, 1)
+		})
+	}
+
+	// Add i18n script before body closing tag
+	// Note: ToJSONLang() uses json.Marshal which properly escapes special characters
+	lang := s.pageLanguage(w, r)
+	if lang != "" {
+		htmlContent = strings.Replace(htmlContent, `<html lang="en">`, `<html lang="`+html.EscapeString(lang)+`">`, 1)
+	}
+	i18nJSON, err := s.i18n.ToJSONLang(lang)
+	if err != nil {
+		log.Printf("Failed to serialize i18n translations: %v", err)
+		i18nJSON = []byte("{}")
+	}
+
+	// Inject translations as properly escaped JSON (json.Marshal handles escaping)
+	safeJSON := strings.ReplaceAll(string(i18nJSON), "</", "<\\/")
+	htmlContent = strings.Replace(htmlContent, "</body>", `<script>window.translations = `+safeJSON+`;</script></body>`, 1)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if _, err := w.Write([]byte(htmlContent)); err != nil {
+		log.Printf("Failed to write response: %v", err)
+	}
+}
+
+// notFoundPage holds what static/404.html shows, already translated
+type notFoundPage struct {
+	Lang    string
+	Theme   string
+	Title   string
+	Message string
+	Home    string
+}
+
+// serveNotFound responds 404 with static/404.html in the page language, or plain text when the file is missing
+func (s *Server) serveNotFound(w http.ResponseWriter, r *http.Request) {
+	content, err := fs.ReadFile(s.staticFiles, "static/404.html")
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	page, err := template.New("404").Parse(string(content))
+	if err != nil {
+		log.Printf("Failed to parse 404 page: %v", err)
+		http.NotFound(w, r)
+		return
+	}
+
+	lang := s.pageLanguage(w, r)
+	data := notFoundPage{
+		Lang:    lang,
+		Theme:   normalizeTheme(s.defaultTheme),
+		Title:   s.i18n.TranslateLang(lang, "backend.not_found"),
+		Message: s.i18n.TranslateLang(lang, "backend.not_found_message"),
+		Home:    s.i18n.TranslateLang(lang, "backend.not_found_home"),
+	}
+	if data.Lang == "" {
+		data.Lang = s.i18n.GetLanguage()
+	}
+	var body strings.Builder
+	if err := page.Execute(&body, data); err != nil {
+		log.Printf("Failed to render 404 page: %v", err)
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusNotFound)
+	io.WriteString(w, body.String())
+}
+
+// langCookie remembers the language picked with ?lang= so later page loads don't need the parameter
+const langCookie = "tvclip_lang"
+
+// pageLanguage picks the language of a page: ?lang= (remembered in langCookie), then the cookie, then Accept-Language
+// Values are matched against the loaded languages; "" means the server's language
+func (s *Server) pageLanguage(w http.ResponseWriter, r *http.Request) string {
+	if lang := s.i18n.MatchLanguage(r.URL.Query().Get("lang")); lang != "" {
+		http.SetCookie(w, &http.Cookie{
+			Name:     langCookie,
+			Value:    lang,
+			Path:     "/",
+			MaxAge:   365 * 24 * 60 * 60,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+		return lang
+	}
+	if cookie, err := r.Cookie(langCookie); err == nil {
+		if lang := s.i18n.MatchLanguage(cookie.Value); lang != "" {
+			return lang
+		}
+	}
+	return s.i18n.MatchLanguage(r.Header.Get("Accept-Language"))
+}
+
+// handleI18n serves i18n translations as JSON
+func (s *Server) handleI18n(w http.ResponseWriter, r *http.Request) {
+	translations, err := s.i18n.GetTranslations()
+	if err != nil {
+		http.Error(w, "Failed to get translations", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(translations); err != nil {
+		log.Printf("Failed to encode i18n response: %v", err)
+	}
+}
+
+// qrRefreshHeader tells the host page how many seconds to wait before fetching a fresh QR code
+// It scales with the session timeout, so the frontend adapts when --expires changes
+const qrRefreshHeader = "X-QR-Refresh-Seconds"
+
+// handleQRCode generates and serves a QR code with a session token
+func (s *Server) handleQRCode(w http.ResponseWriter, r *http.Request) {
+	// A code scanned now would only reach a server that is about to go away
+	if s.draining.Load() {
+		w.Header().Set("Retry-After", hubRetryAfter)
+		w.Header().Set(actionHeader, actionRetry)
+		http.Error(w, "Service unavailable: server shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	room := r.URL.Query().Get("room")
+	if !hub.ValidRoomCode(room) {
+		http.Error(w, "Bad request: invalid room code", http.StatusBadRequest)
+		return
+	}
+	if _, ok := s.qrGenerator.Target(r.URL.Query().Get("target")); !ok {
+		http.Error(w, "Bad request: unknown QR code target", http.StatusBadRequest)
+		return
+	}
+	if _, ok := qrcode.NegotiateFormat(r); !ok {
+		http.Error(w, "Bad request: unknown QR code format", http.StatusBadRequest)
+		return
+	}
+	// ?ttl=<seconds> gives this code its own lifetime, up to the token manager's MaxTTL
+	var ttl time.Duration
+	if v := r.URL.Query().Get("ttl"); v != "" {
+		seconds, err := strconv.Atoi(v)
+		if err != nil || seconds <= 0 {
+			http.Error(w, "Bad request: ttl must be a positive number of seconds", http.StatusBadRequest)
+			return
+		}
+		// Clamp to MaxTTL before converting, so absurd values can't overflow
+		maxSeconds := int(s.tokenManager.MaxTTL() / time.Second)
+		ttl = time.Duration(min(seconds, maxSeconds)) * time.Second
+	}
+
+	// Don't spend a token on a client that already went away
+	if r.Context().Err() != nil {
+		return
+	}
+
+	// Generate new session token scoped to the room
+	token, err := s.tokenManager.GenerateRoomTokenTTL(room, ttl)
+	if err != nil {
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+	refresh := s.qrGenerator.RefreshSeconds()
+	if ttl > 0 {
+		ttl = s.tokenManager.TTL(token)
+		refresh = max(1, int(ttl.Seconds()*qrcode.RefreshFraction))
+	} else {
+		ttl = s.tokenManager.Timeout()
+	}
+	log.Printf("Generated new session token (expires in %v)", ttl)
+
+	w.Header().Set(qrRefreshHeader, strconv.Itoa(refresh))
+	s.qrGenerator.ServeRoomQRCode(w, r, token, room)
+}
+
+// qrContainer is the host page's QR code placeholder, filled by host.js or by injectInlineQR
+const qrContainer = `<div id="qrcode"></div>`
+
+// injectInlineQR fills the host page's QR code container with one data: URI image per target
+// They share a token generated for this page load, so reloading the page rotates it like /qrcode.png does
+// The page is returned unchanged (and host.js fetches the images) when it has no container or generation fails
+func (s *Server) injectInlineQR(w http.ResponseWriter, r *http.Request, htmlContent string) string {
+	if !strings.Contains(htmlContent, qrContainer) || s.draining.Load() {
+		return htmlContent
+	}
+	room := r.URL.Query().Get("room")
+	token, err := s.tokenManager.GenerateRoomToken(room)
+	if err != nil {
+		log.Printf("Failed to generate token for inline QR code: %v", err)
+		return htmlContent
+	}
+	log.Printf("Generated new session token (expires in %v)", s.tokenManager.Timeout())
+
+	names := s.qrTargetNames()
+	var b strings.Builder
+	for i, target := range s.qrGenerator.Targets() {
+		uri, err := s.qrGenerator.DataURI(r.Context(), target, token, room)
+		if err != nil {
+			log.Printf("Failed to generate inline QR code: %v", err)
+			return htmlContent
+		}
+		b.WriteString(`<figure><img src="` + uri + `" alt="QR Code" width="200" height="200"`)
+		if len(names) > 1 {
+			b.WriteString(` data-qr-target="` + html.EscapeString(names[i]) + `"`)
+		}
+		b.WriteString(`></figure>`)
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	return strings.Replace(htmlContent, qrContainer, `<div id="qrcode" data-inline="true">`+b.String()+`</div>`, 1)
+}
+
+// qrTargetNames lists the QR code targets by name, or by index when unnamed
+func (s *Server) qrTargetNames() []string {
+	var names []string
+	for i, t := range s.qrGenerator.Targets() {
+		if t.Name == "" {
+			names = append(names, strconv.Itoa(i))
+		} else {
+			names = append(names, t.Name)
+		}
+	}
+	return names
+}
+
+// infoResponse is the JSON body returned by /api/info
+type infoResponse struct {
+	Version        string `json:"version"`
+	SessionTimeout int    `json:"sessionTimeout"` // seconds
+	WSPath         string `json:"wsPath"`
+	// QRTargets names the addresses /qrcode.png?target= can point at, the default first
+	QRTargets []string `json:"qrTargets"`
+	// Languages lists the loaded translation codes, sorted, for language switchers
+	Languages []string `json:"languages"`
+	// Features lists the optional behaviors enabled on this server
+	Features features.Set `json:"features"`
+}
+
+// handleInfo returns public server information for the frontend and integrations
+func (s *Server) handleInfo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	resp := infoResponse{
+		Version:        s.version,
+		SessionTimeout: s.qrGenerator.SessionTimeoutSeconds(),
+		WSPath:         s.wsPath,
+		QRTargets:      s.qrTargetNames(),
+		Languages:      s.i18n.GetAvailableLanguages(),
+		Features:       s.features,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Failed to encode info response: %v", err)
+	}
+}
+
+// timeResponse is the JSON body returned by /api/time
+type timeResponse struct {
+	UnixMillis int64 `json:"unixMillis"`
+}
+
+// handleTime returns the server clock so clients can correct countdowns for clock skew
+func (s *Server) handleTime(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(timeResponse{UnixMillis: time.Now().UnixMilli()}); err != nil {
+		log.Printf("Failed to encode time response: %v", err)
+	}
+}
+
+// healthResponse is the JSON body returned by /healthz
+type healthResponse struct {
+	Status            string `json:"status"`
+	Version           string `json:"version"`
+	Clients           int    `json:"clients"`
+	MessagesBroadcast int64  `json:"messagesBroadcast"`
+	MessagesDropped   int64  `json:"messagesDropped"`
+	RateLimited       int64  `json:"rateLimited"`
+	ClientDrops       int64  `json:"clientDrops"`
+	SlowClients       int64  `json:"slowClients"`
+	UptimeSeconds     int64  `json:"uptimeSeconds"`
+}
+
+// handleHealthz reports whether the default hub is running, with its counters
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	stats := s.hub.Stats()
+	resp := healthResponse{
+		Status:            "ok",
+		Version:           s.version,
+		Clients:           stats.ClientCount,
+		MessagesBroadcast: stats.MessagesBroadcast,
+		MessagesDropped:   stats.MessagesDropped,
+		RateLimited:       stats.RateLimited,
+		ClientDrops:       stats.ClientDrops,
+		SlowClients:       stats.SlowClients,
+		UptimeSeconds:     int64(stats.Uptime.Seconds()),
+	}
+	status := http.StatusOK
+	if !s.hub.IsRunning() {
+		resp.Status = "stopped"
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Failed to encode health response: %v", err)
+	}
+}
+
+// qrURLResponse is the JSON body returned by /api/qr-url
+type qrURLResponse struct {
+	URL       string `json:"url"`
+	ExpiresAt int64  `json:"expiresAt"` // Unix seconds
+}
+
+// handleQRURL generates a session token and returns the QR target URL as JSON
+func (s *Server) handleQRURL(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// Same as handleQRCode: don't hand out a token for a server that is going away
+	if s.draining.Load() {
+		w.Header().Set("Retry-After", hubRetryAfter)
+		w.Header().Set(actionHeader, actionRetry)
+		http.Error(w, "Service unavailable: server shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	room := r.URL.Query().Get("room")
+	if !hub.ValidRoomCode(room) {
+		http.Error(w, "Bad request: invalid room code", http.StatusBadRequest)
+		return
+	}
+
+	token, err := s.tokenManager.GenerateRoomToken(room)
+	if err != nil {
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Generated new session token (expires in %v)", s.tokenManager.Timeout())
+
+	resp := qrURLResponse{
+		URL:       s.qrGenerator.GenerateRoomQRCodeURL(token, room),
+		ExpiresAt: time.Now().Add(s.tokenManager.Timeout()).Unix(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Failed to encode QR URL response: %v", err)
+	}
+}
+
+// requestToken returns the session token from the Authorization header or ?token= query param
+func requestToken(r *http.Request) string {
+	if auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(auth)
+	}
+	return r.URL.Query().Get("token")
+}
+
+// historyResponse is the JSON body returned by /api/history
+type historyResponse struct {
+	Messages []hub.HistoryEntry `json:"messages"`
+}
+
+// handleHistory returns the room's recent broadcasts to holders of a valid session token
+func (s *Server) handleHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	room := r.URL.Query().Get("room")
+	if !hub.ValidRoomCode(room) {
+		http.Error(w, "Bad request: invalid room code", http.StatusBadRequest)
+		return
+	}
+
+	token := requestToken(r)
+	if token == "" {
+		http.Error(w, "Unauthorized: valid token required", http.StatusUnauthorized)
+		return
+	}
+	if err := s.tokenManager.ValidateRoomToken(token, room); err != nil {
+		log.Printf("History request rejected: %v", err)
+		http.Error(w, "Unauthorized: invalid or expired token", http.StatusUnauthorized)
+		return
+	}
+
+	resp := historyResponse{Messages: []hub.HistoryEntry{}}
+	if roomHub, ok := s.rooms.Lookup(room); ok {
+		if history := roomHub.History(); history != nil {
+			resp.Messages = history
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Failed to encode history response: %v", err)
+	}
+}
+
+// handleWebSocket handles WebSocket connection upgrades
+func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	if s.maintenance.Load() {
+		maintenanceUnavailable(w)
+		return
+	}
+
+	token := r.URL.Query().Get("token")
+	room := r.URL.Query().Get("room")
+	reconnect := r.URL.Query().Get("reconnect")
+
+	if !s.checkHandshakeLength(w, r, token) || !s.checkHandshakeLength(w, r, reconnect) {
+		return
+	}
+
+	if !hub.ValidRoomCode(room) {
+		log.Printf("Connection rejected: invalid room code")
+		http.Error(w, "Bad request: invalid room code", http.StatusBadRequest)
+		return
+	}
+
+	// Trusted local connections (Unix socket) skip host, origin and token checks
+	trusted := s.trustLocal && isLocalRequest(r)
+
+	if !trusted && !s.checkClientIP(w, r) {
+		return
+	}
+
+	// Check Host header to guard against DNS rebinding
+	if !trusted && !isHostAllowed(r.Host, s.allowedHosts) {
+		log.Printf("Connection rejected: host not allowed - %s", r.Host)
+		s.audit(r, hub.AuditHostRejected, r.Host)
+		http.Error(w, "Forbidden: Host not allowed", http.StatusForbidden)
+		return
+	}
+
+	// Check origin before proceeding with WebSocket upgrade
+	origin := r.Header.Get("Origin")
+	if origin != "" && !trusted {
+		if !checkOrigin(r, origin, s.allowedOrigins, s.strictOrigins) {
+			log.Printf("Connection rejected: origin not allowed - %s", origin)
+			s.audit(r, hub.AuditOriginRejected, origin)
+			http.Error(w, "Forbidden: Origin not allowed", http.StatusForbidden)
+			return
+		}
+	}
+
+	if r.URL.Query().Get("mode") == "debug" {
+		s.handleDebugWebSocket(w, r, token, room, trusted)
+		return
+	}
+
+	// Tokens only authorize joining an existing room; a host opens a room by connecting to it
+	roomHub, exists := s.rooms.Lookup(room)
+	hostExists := exists && roomHub.HasHost()
+
+	// A wrong secret falls through to the normal client rules
+	claimHost := !s.noHost && s.hasHostSecret(r)
+
+	// Log connection attempt without exposing the token value
+	log.Printf("WebSocket connection attempt, hasToken: %v, hostExists: %v, room: %q, local: %v, hostSecret: %v", token != "", hostExists, room, trusted, claimHost)
+
+	// A reconnect token from an earlier welcome rejoins as the same client in place of the QR token
+	// When it fails, a QR token sent alongside still gets the client in, under a new ID
+	var resume *hub.ReconnectGrant
+	if reconnect != "" && exists && s.requiresToken(hostExists) && !trusted && !claimHost {
+		// Only checked here; Register spends it, so a failure before then leaves it usable
+		grant, err := roomHub.CheckReconnectToken(reconnect)
+		switch {
+		case err == nil:
+			resume = &grant
+		case token == "":
+			log.Printf("Reconnect token rejected: %v", err)
+			s.audit(r, tokenAuditType(err), err.Error())
+			w.Header().Set(actionHeader, tokenAction(err))
+			http.Error(w, "Unauthorized: invalid or expired reconnect token", http.StatusUnauthorized)
+			return
+		default:
+			log.Printf("Reconnect token rejected, falling back to the session token: %v", err)
+		}
+	}
+
+	// Require token for client connections (when host already exists, or always without a host)
+	if s.requiresToken(hostExists) && !trusted && !claimHost && resume == nil {
+		if token == "" {
+			log.Printf("Connection rejected: no token provided (host exists)")
+			s.audit(r, hub.AuditTokenMissing, "")
+			w.Header().Set(actionHeader, actionRescan)
+			http.Error(w, "Unauthorized: valid token required", http.StatusUnauthorized)
+			return
+		}
+
+		err := s.tokenManager.ValidateRoomToken(token, room)
+		if err != nil {
+			log.Printf("Token validation failed: %v", err)
+			s.audit(r, tokenAuditType(err), err.Error())
+			w.Header().Set(actionHeader, tokenAction(err))
+			http.Error(w, "Unauthorized: invalid or expired token", http.StatusUnauthorized)
+			return
+		}
+	} else if !s.requiresToken(hostExists) && token != "" {
+		// First connection (host) shouldn't have a token
+		log.Printf("Connection rejected: token provided for first connection")
+		http.Error(w, "Bad request: first connection should not include token", http.StatusBadRequest)
+		return
+	}
+
+	if !exists {
+		var err error
+		roomHub, err = s.rooms.Get(room)
+		if err != nil {
+			log.Printf("Connection rejected: %v", err)
+			http.Error(w, "Service unavailable: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	// A stopped hub never drains Register, so refuse before upgrading
+	if !roomHub.IsRunning() {
+		log.Printf("Connection rejected: hub stopped")
+		hubUnavailable(w)
+		return
+	}
+
+	if !trusted && !s.checkClientsPerIP(w, r, roomHub) {
+		return
+	}
+
+	up := &upgrader
+	if trusted {
+		up = &localUpgrader
+	}
+	conn, err := up.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("WebSocket upgrade error:", err)
+		return
+	}
+
+	log.Printf("WebSocket connection established")
+
+	mobile := r.URL.Query().Get("mobile") == "true"
+	client := hub.NewClient(conn, roomHub, mobile)
+	client.ClaimHost = claimHost
+	if resume != nil {
+		client.Resume(*resume)
+	}
+	client.Lang = s.i18n.MatchLanguage(r.Header.Get("Accept-Language"))
+	if !trusted {
+		client.IP = remoteIP(r)
+	}
+
+	if err := registerClient(roomHub, client); err != nil {
+		log.Printf("Connection rejected: %v", err)
+		closeMsg := websocket.FormatCloseMessage(websocket.CloseTryAgainLater, err.Error())
+		conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second))
+		conn.Close()
+		return
+	}
+
+	go client.WritePump()
+	go client.ReadPump()
+}
+
+// debugEcho is sent back for every message on a debug WebSocket
+type debugEcho struct {
+	Type       string `json:"type"`
+	ReceivedAt int64  `json:"receivedAt"` // Unix milliseconds
+	Bytes      int    `json:"bytes"`
+	Content    string `json:"content"`
+}
+
+// handleDebugWebSocket serves /ws?mode=debug, which echoes each message back to its sender only
+// It never joins the room's hub, so users can check that WebSockets get through their proxy, but it
+// keeps the room's per-IP, rate and lifetime limits and closes after DefaultReadTimeout of silence
+func (s *Server) handleDebugWebSocket(w http.ResponseWriter, r *http.Request, token, room string, trusted bool) {
+	if !s.debugWS {
+		http.Error(w, "Not found: debug mode is disabled", http.StatusNotFound)
+		return
+	}
+
+	if !trusted {
+		if token == "" {
+			s.audit(r, hub.AuditTokenMissing, "debug")
+			w.Header().Set(actionHeader, actionRescan)
+			http.Error(w, "Unauthorized: valid token required", http.StatusUnauthorized)
+			return
+		}
+		if err := s.tokenManager.ValidateRoomToken(token, room); err != nil {
+			log.Printf("Debug connection rejected: %v", err)
+			s.audit(r, tokenAuditType(err), err.Error())
+			w.Header().Set(actionHeader, tokenAction(err))
+			http.Error(w, "Unauthorized: invalid or expired token", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	roomHub, ok := s.rooms.Lookup(room)
+	if !ok {
+		roomHub = s.hub
+	}
+	if !trusted && !s.checkClientsPerIP(w, r, roomHub) {
+		return
+	}
+
+	up := &upgrader
+	if trusted {
+		up = &localUpgrader
+	}
+	conn, err := up.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("WebSocket upgrade error:", err)
+		return
+	}
+	log.Printf("Debug WebSocket connection established")
+
+	go func() {
+		defer conn.Close()
+		conn.SetReadLimit(roomHub.MaxMessageSize() + 1024)
+		if lifetime := roomHub.MaxSessionLifetime(); lifetime > 0 {
+			timer := time.AfterFunc(lifetime, func() { conn.Close() })
+			defer timer.Stop()
+		}
+
+		limit := roomHub.RateLimit()
+		var window time.Time
+		count := 0
+		for {
+			conn.SetReadDeadline(time.Now().Add(hub.DefaultReadTimeout))
+			_, message, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			received := time.Now()
+
+			// Past the hub's per-second limit, hold the echo until the window ends so a flood only slows itself
+			if limit > 0 {
+				if received.Sub(window) >= time.Second {
+					window, count = received, 0
+				}
+				if count >= limit {
+					time.Sleep(time.Second - received.Sub(window))
+					window, count = time.Now(), 0
+				}
+				count++
+			}
+
+			echo := debugEcho{
+				Type:       "debug",
+				ReceivedAt: received.UnixMilli(),
+				Bytes:      len(message),
+				Content:    string(message),
+			}
+			if err := conn.WriteJSON(echo); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// sseWriteTimeout bounds each write to an event stream, replacing the server-wide WriteTimeout
+const sseWriteTimeout = 10 * time.Second
+
+// handleEvents streams hub messages as Server-Sent Events
+// Connection rules mirror /ws: the first connection opens the room, later ones need a token
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	if s.maintenance.Load() {
+		maintenanceUnavailable(w)
+		return
+	}
+
+	token := requestToken(r)
+	room := r.URL.Query().Get("room")
+
+	if !s.checkHandshakeLength(w, r, token) {
+		return
+	}
+
+	if !hub.ValidRoomCode(room) {
+		http.Error(w, "Bad request: invalid room code", http.StatusBadRequest)
+		return
+	}
+
+	trusted := s.trustLocal && isLocalRequest(r)
+
+	if !trusted && !s.checkClientIP(w, r) {
+		return
+	}
+
+	if !trusted && !isHostAllowed(r.Host, s.allowedHosts) {
+		log.Printf("SSE connection rejected: host not allowed - %s", r.Host)
+		s.audit(r, hub.AuditHostRejected, r.Host)
+		http.Error(w, "Forbidden: Host not allowed", http.StatusForbidden)
+		return
+	}
+
+	roomHub, exists := s.rooms.Lookup(room)
+	hostExists := exists && roomHub.HasHost()
+
+	if s.requiresToken(hostExists) && !trusted {
+		if token == "" {
+			log.Printf("SSE connection rejected: no token provided (host exists)")
+			s.audit(r, hub.AuditTokenMissing, "")
+			w.Header().Set(actionHeader, actionRescan)
+			http.Error(w, "Unauthorized: valid token required", http.StatusUnauthorized)
+			return
+		}
+		if err := s.tokenManager.ValidateRoomToken(token, room); err != nil {
+			log.Printf("SSE token validation failed: %v", err)
+			s.audit(r, tokenAuditType(err), err.Error())
+			w.Header().Set(actionHeader, tokenAction(err))
+			http.Error(w, "Unauthorized: invalid or expired token", http.StatusUnauthorized)
+			return
+		}
+	} else if !s.requiresToken(hostExists) && token != "" {
+		http.Error(w, "Bad request: first connection should not include token", http.StatusBadRequest)
+		return
+	}
+
+	if !exists {
+		var err error
+		roomHub, err = s.rooms.Get(room)
+		if err != nil {
+			log.Printf("SSE connection rejected: %v", err)
+			http.Error(w, "Service unavailable: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	if !roomHub.IsRunning() {
+		hubUnavailable(w)
+		return
+	}
+
+	if !trusted && !s.checkClientsPerIP(w, r, roomHub) {
+		return
+	}
+
+	// Pseudo-client without a WebSocket; the hub only needs its Send channel
+	client := hub.NewClient(nil, roomHub, r.URL.Query().Get("mobile") == "true")
+	if !trusted {
+		client.IP = remoteIP(r)
+	}
+
+	if err := registerClient(roomHub, client); err != nil {
+		log.Printf("SSE connection rejected: %v", err)
+		hubUnavailable(w)
+		return
+	}
+	defer func() {
+		select {
+		case roomHub.Unregister <- client:
+		case <-roomHub.Done():
+		}
+	}()
+
+	// The server's WriteTimeout would cut the stream after a few seconds, so each write gets its own
+	// deadline instead; a client that stops reading still gets dropped
+	rc := http.NewResponseController(w)
+	extendDeadline := func() {
+		if err := rc.SetWriteDeadline(time.Now().Add(sseWriteTimeout)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			log.Printf("Failed to extend SSE write deadline: %v", err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	extendDeadline()
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	log.Printf("SSE connection established: %s", client.ID)
+
+	// Comment lines keep idle proxies from closing the stream
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	// The hub's max session lifetime applies as it does to WebSocket clients
+	var expired <-chan time.Time
+	if end, ok := client.LifetimeEnd(); ok {
+		timer := time.NewTimer(time.Until(end))
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	for {
+		select {
+		case message, ok := <-client.Send:
+			if !ok {
+				return
+			}
+			extendDeadline()
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", message); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-ticker.C:
+			extendDeadline()
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-expired:
+			if client.LifetimeExempt() {
+				expired = nil
+				continue
+			}
+			log.Printf("SSE client %s reached the max session lifetime, closing", client.ID)
+			if msgBytes, err := json.Marshal(hub.Message{Type: "session_expired"}); err == nil {
+				extendDeadline()
+				fmt.Fprintf(w, "data: %s\n\n", msgBytes)
+				flusher.Flush()
+			}
+			return
+		case <-r.Context().Done():
+			return
+		case <-roomHub.Done():
+			return
+		}
+	}
+}
+
+// handleSend broadcasts a JSON message posted over plain HTTP to the room
+func (s *Server) handleSend(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	room := r.URL.Query().Get("room")
+	if !hub.ValidRoomCode(room) {
+		http.Error(w, "Bad request: invalid room code", http.StatusBadRequest)
+		return
+	}
+
+	token := requestToken(r)
+	if trusted := s.trustLocal && isLocalRequest(r); !trusted {
+		if !s.checkClientIP(w, r) {
+			return
+		}
+		if token == "" {
+			s.audit(r, hub.AuditTokenMissing, "")
+			w.Header().Set(actionHeader, actionRescan)
+			http.Error(w, "Unauthorized: valid token required", http.StatusUnauthorized)
+			return
+		}
+		if err := s.tokenManager.ValidateRoomToken(token, room); err != nil {
+			log.Printf("Send request rejected: %v", err)
+			s.audit(r, tokenAuditType(err), err.Error())
+			w.Header().Set(actionHeader, tokenAction(err))
+			http.Error(w, "Unauthorized: invalid or expired token", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	roomHub, ok := s.rooms.Lookup(room)
+	if !ok {
+		http.Error(w, "Not found: room has no connected host", http.StatusNotFound)
+		return
+	}
+
+	body, err := readSendBody(w, r, roomHub.MaxMessageSize())
+	if err != nil {
+		switch {
+		case errors.Is(err, errUnsupportedEncoding):
+			http.Error(w, "Unsupported Content-Encoding", http.StatusUnsupportedMediaType)
+		case errors.Is(err, errBadGzip):
+			http.Error(w, "Bad request: invalid gzip body", http.StatusBadRequest)
+		default:
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		}
+		return
+	}
+
+	// Requests from the same IP share a sender and its rate limit, like WebSocket clients share the
+	// per-IP client limit. Keying by token would let a caller reset the limit by minting fresh tokens
+	//
+	// Not registered with the hub, so every connected client receives the message
+	// SubmitWait validates it like a WebSocket message, then waits for the hub to fan it out
+	client := roomHub.Sender("ip:" + remoteIP(r))
+	delivery, err := client.SubmitWait(r.Context(), body)
+	if err != nil {
+		writeSendError(w, err)
+		return
+	}
+	writeDelivery(w, delivery)
+}
+
+// writeSendError answers an /api/send request whose message the hub refused
+func writeSendError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, hub.ErrMessageTooLarge), errors.Is(err, hub.ErrTextTooLong), errors.Is(err, hub.ErrTransferTooLarge):
+		http.Error(w, "Message too large", http.StatusRequestEntityTooLarge)
+	case errors.Is(err, hub.ErrRateLimited):
+		http.Error(w, "Too many requests", http.StatusTooManyRequests)
+	case errors.Is(err, hub.ErrHubStopped):
+		hubUnavailable(w)
+	case errors.Is(err, hub.ErrBroadcastFull):
+		w.Header().Set("Retry-After", "1")
+		w.Header().Set(actionHeader, actionRetry)
+		http.Error(w, "Service unavailable: server busy", http.StatusServiceUnavailable)
+	case errors.Is(err, hub.ErrUnknownType):
+		http.Error(w, "Bad request: unknown message type", http.StatusBadRequest)
+	case errors.Is(err, hub.ErrPlaintext):
+		http.Error(w, "Bad request: end-to-end encryption required", http.StatusBadRequest)
+	case errors.Is(err, hub.ErrInvalidAudience):
+		http.Error(w, "Bad request: unknown audience", http.StatusBadRequest)
+	case errors.Is(err, hub.ErrInvalidURL):
+		http.Error(w, "Bad request: only http and https links are allowed", http.StatusBadRequest)
+	case errors.Is(err, hub.ErrInvalidContent):
+		http.Error(w, "Bad request: invalid message content", http.StatusBadRequest)
+	case errors.Is(err, hub.ErrInvalidMessage):
+		http.Error(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+	case errors.Is(err, hub.ErrNotHost):
+		http.Error(w, "Forbidden: only the host can do that", http.StatusForbidden)
+	case errors.Is(err, hub.ErrMetaTooLarge):
+		http.Error(w, "Message metadata too large", http.StatusRequestEntityTooLarge)
+	case errors.Is(err, hub.ErrPendingApproval):
+		http.Error(w, "Forbidden: waiting for host approval", http.StatusForbidden)
+	case errors.Is(err, hub.ErrMalformed):
+		http.Error(w, "Bad request: malformed message", http.StatusBadRequest)
+	default:
+		http.Error(w, "Bad request: invalid message JSON", http.StatusBadRequest)
+	}
 }
@@ -1,16 +1,31 @@
 package server
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"io/fs"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"tvclipboard/i18n"
+	"tvclipboard/pkg/features"
 	"tvclipboard/pkg/hub"
 	"tvclipboard/pkg/qrcode"
 	"tvclipboard/pkg/token"
@@ -31,6 +46,7 @@ func (testFS) ReadFile(name string) ([]byte, error) {
 <html>
 <body>
 <link rel="stylesheet" href="/static/css/style.css">
+<div class="container"></div>
 <script src="/static/js/common.js"></script>
 <script src="/static/js/host.js"></script>
 </body>
@@ -191,6 +207,57 @@ func TestWebSocketConnectionWithExpiredToken(t *testing.T) {
 	}
 }
 
+// TestTokenAction tests that token errors map to the recovery action header
+func TestTokenAction(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{token.ErrTokenExpired, actionRescan},
+		{token.ErrTokenNotFound, actionRescan},
+		{token.ErrTokenWrongRoom, actionRescan},
+		{fmt.Errorf("wrapped: %w", token.ErrTokenExpired), actionRescan},
+		{errors.New("temporary failure"), actionRetry},
+	}
+	for _, tt := range tests {
+		if got := tokenAction(tt.err); got != tt.want {
+			t.Errorf("tokenAction(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+
+	tm := token.NewTokenManager(1)
+	h := hub.NewHub(1024*1024, 10)
+	go h.Run()
+	defer h.Stop()
+	h.SetHostID("test-host")
+	qrGen := qrcode.NewGenerator("localhost:3333", "http", 60*1e9)
+	srv := NewServer(h, tm, qrGen, mockStaticFiles, []string{"http://localhost:*"}, mockI18n)
+
+	expired, err := tm.GenerateToken()
+	if err != nil {
+		t.Fatalf("Failed to generate token: %v", err)
+	}
+	tm.StoreToken(token.SessionToken{ID: expired, Timestamp: time.Now().Add(-2 * time.Minute).Unix()})
+
+	for _, query := range []string{"?token=" + expired, "?token=unknown1", ""} {
+		rec := httptest.NewRecorder()
+		srv.handleWebSocket(rec, httptest.NewRequest(http.MethodGet, "/ws"+query, nil))
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("%q: expected 401, got %d", query, rec.Code)
+		}
+		if got := rec.Header().Get(actionHeader); got != actionRescan {
+			t.Errorf("%q: expected %s: rescan, got %q", query, actionHeader, got)
+		}
+	}
+
+	h.Stop()
+	rec := httptest.NewRecorder()
+	hubUnavailable(rec)
+	if got := rec.Header().Get(actionHeader); got != actionRetry {
+		t.Errorf("Expected %s: retry for a stopped hub, got %q", actionHeader, got)
+	}
+}
+
 // TestWebSocketConnectionHostWithoutToken tests that host can connect without token
 func TestWebSocketConnectionHostWithoutToken(t *testing.T) {
 	tm := token.NewTokenManager(10)
@@ -457,7 +524,7 @@ func TestIsOriginAllowed(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := isOriginAllowed(tt.origin, tt.allowedOrigins)
+			got := isOriginAllowed(tt.origin, tt.allowedOrigins, false)
 			if got != tt.wantAllowed {
 				t.Errorf("isOriginAllowed(%q, %v) = %v, want %v",
 					tt.origin, tt.allowedOrigins, got, tt.wantAllowed)
@@ -595,8 +662,2429 @@ func TestRegisterRoutes(t *testing.T) {
 	srv := NewServer(h, tm, qrGen, mockStaticFiles, []string{"http://localhost:*"}, mockI18n)
 
 	// Register routes
-	srv.RegisterRoutes()
+	mux := http.NewServeMux()
+	srv.RegisterRoutes(mux)
+
+	// Routes resolve to registered patterns
+	for _, path := range []string{"/", "/qrcode.png", "/ws", "/events", "/api/send", "/api/info", "/api/time", "/healthz", "/i18n.json", "/static/css/style.css"} {
+		if _, pattern := mux.Handler(httptest.NewRequest(http.MethodGet, path, nil)); pattern == "" {
+			t.Errorf("Expected a route for %s", path)
+		}
+	}
+}
+
+// TestRoomsAreIsolated tests that messages sent in one room don't reach another room
+func TestRoomsAreIsolated(t *testing.T) {
+	tm := token.NewTokenManager(10)
+	h := hub.NewHub(1024*1024, 10)
+	go h.Run()
+	defer h.Stop()
+
+	qrGen := qrcode.NewGenerator("localhost:3333", "http", 10*60*1e9)
+
+	srv := NewServer(h, tm, qrGen, mockStaticFiles, []string{"http://localhost:*"}, mockI18n)
+	defer srv.Shutdown()
+	setUpgraderOrigins(srv.allowedOrigins, srv.strictOrigins)
+	origin := http.Header{"Origin": {"http://localhost"}}
+
+	server := httptest.NewServer(http.HandlerFunc(srv.handleWebSocket))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+
+	// Each room gets its own host
+	hostA, _, err := websocket.DefaultDialer.Dial(wsURL+"?room=a", origin)
+	if err != nil {
+		t.Fatalf("Host A should connect: %v", err)
+	}
+	defer hostA.Close()
+	hostB, _, err := websocket.DefaultDialer.Dial(wsURL+"?room=b", origin)
+	if err != nil {
+		t.Fatalf("Host B should connect: %v", err)
+	}
+	defer hostB.Close()
+
+	readRole(t, hostA, "host")
+	readRole(t, hostB, "host")
+
+	// A token for room A must not work in room B
+	tokenA, _ := tm.GenerateRoomToken("a")
+	if _, _, err := websocket.DefaultDialer.Dial(wsURL+"?room=b&token="+tokenA, origin); err == nil {
+		t.Error("Room A token should be rejected in room B")
+	}
+
+	clientA, _, err := websocket.DefaultDialer.Dial(wsURL+"?room=a&token="+tokenA, origin)
+	if err != nil {
+		t.Fatalf("Client should join room A: %v", err)
+	}
+	defer clientA.Close()
+	readRole(t, clientA, "client")
+
+	if err := clientA.WriteJSON(hub.Message{Type: "text", Content: "hello room a"}); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+
+	var msg hub.Message
+	hostA.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if err := hostA.ReadJSON(&msg); err != nil || msg.Content != "hello room a" {
+		t.Errorf("Host A should receive the message, got %+v (err: %v)", msg, err)
+	}
+
+	hostB.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if err := hostB.ReadJSON(&msg); err == nil {
+		t.Errorf("Host B should not receive messages from room A, got %+v", msg)
+	}
+}
+
+// TestInvalidRoomCodeRejected tests that malformed room codes are rejected
+func TestInvalidRoomCodeRejected(t *testing.T) {
+	tm := token.NewTokenManager(10)
+	h := hub.NewHub(1024*1024, 10)
+	qrGen := qrcode.NewGenerator("localhost:3333", "http", 10*60*1e9)
+	srv := NewServer(h, tm, qrGen, mockStaticFiles, []string{}, mockI18n)
+
+	for _, handler := range []http.HandlerFunc{srv.handleIndex, srv.handleQRCode, srv.handleWebSocket} {
+		req := httptest.NewRequest(http.MethodGet, "/?room=bad%20room", nil)
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for invalid room code, got %d", rec.Code)
+		}
+	}
+}
+
+// readRole reads the role assignment message from conn and checks it
+func readRole(t *testing.T, conn *websocket.Conn, want string) {
+	t.Helper()
+	var msg hub.Message
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatalf("Failed to read role message: %v", err)
+	}
+	if msg.Type != "role" || msg.Role != want {
+		t.Fatalf("Expected role %q, got %+v", want, msg)
+	}
+	conn.SetReadDeadline(time.Time{})
+}
+
+// slowFS wraps testFS and delays every read
+type slowFS struct {
+	delay time.Duration
+}
+
+func (f slowFS) Open(name string) (fs.File, error) {
+	time.Sleep(f.delay)
+	return testFS{}.Open(name)
+}
+
+func (f slowFS) ReadFile(name string) ([]byte, error) {
+	time.Sleep(f.delay)
+	return testFS{}.ReadFile(name)
+}
+
+// TestHandlerTimeout tests that a slow static source results in a 503
+func TestHandlerTimeout(t *testing.T) {
+	tm := token.NewTokenManager(10)
+	h := hub.NewHub(1024*1024, 10)
+	qrGen := qrcode.NewGenerator("localhost:3333", "http", 10*60*1e9)
+
+	srv := NewServer(h, tm, qrGen, slowFS{delay: 200 * time.Millisecond}, []string{"http://localhost:*"}, mockI18n)
+	srv.SetHandlerTimeout(50 * time.Millisecond)
+
+	rec := httptest.NewRecorder()
+	start := time.Now()
+	srv.withTimeout(srv.handleIndex)(rec, httptest.NewRequest(http.MethodGet, "/?mode=host", nil))
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 after handler timeout, got %d", rec.Code)
+	}
+	if elapsed := time.Since(start); elapsed >= 200*time.Millisecond {
+		t.Errorf("Expected response at the deadline, took %v", elapsed)
+	}
+
+	// A fast source is unaffected
+	srv = NewServer(h, tm, qrGen, mockStaticFiles, []string{"http://localhost:*"}, mockI18n)
+	srv.SetHandlerTimeout(50 * time.Millisecond)
+	rec = httptest.NewRecorder()
+	srv.withTimeout(srv.handleIndex)(rec, httptest.NewRequest(http.MethodGet, "/?mode=host", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected 200 within handler timeout, got %d", rec.Code)
+	}
+}
+
+// TestIsHostAllowed tests Host header matching
+func TestIsHostAllowed(t *testing.T) {
+	tests := []struct {
+		name         string
+		host         string
+		allowedHosts []string
+		want         bool
+	}{
+		{"no restriction", "evil.com", nil, true},
+		{"hostname matches any port", "tv.local:3333", []string{"tv.local"}, true},
+		{"exact host and port", "tv.local:3333", []string{"tv.local:3333"}, true},
+		{"case insensitive", "TV.Local:3333", []string{"tv.local"}, true},
+		{"wrong port", "tv.local:4444", []string{"tv.local:3333"}, false},
+		{"mismatched host", "evil.com:3333", []string{"tv.local"}, false},
+		{"ipv6 host", "[::1]:3333", []string{"[::1]"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isHostAllowed(tt.host, tt.allowedHosts); got != tt.want {
+				t.Errorf("isHostAllowed(%q, %v) = %v, want %v", tt.host, tt.allowedHosts, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestWebSocketAllowedHosts tests the Host check together with the origin check
+func TestWebSocketAllowedHosts(t *testing.T) {
+	tests := []struct {
+		name         string
+		allowedHosts []string
+		origin       string
+		wantStatus   int
+	}{
+		{"matching host", []string{"127.0.0.1"}, "http://localhost", http.StatusSwitchingProtocols},
+		{"mismatched host", []string{"tv.local"}, "http://localhost", http.StatusForbidden},
+		{"matching host, bad origin", []string{"127.0.0.1"}, "http://evil.com", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tm := token.NewTokenManager(10)
+			h := hub.NewHub(1024*1024, 10)
+			go h.Run()
+			defer h.Stop()
+			qrGen := qrcode.NewGenerator("localhost:3333", "http", 10*60*1e9)
+
+			srv := NewServer(h, tm, qrGen, mockStaticFiles, []string{"http://localhost:*"}, mockI18n)
+			srv.SetAllowedHosts(tt.allowedHosts)
+			setUpgraderOrigins(srv.allowedOrigins, srv.strictOrigins)
+
+			server := httptest.NewServer(http.HandlerFunc(srv.handleWebSocket))
+			defer server.Close()
+
+			wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+			conn, resp, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Origin": {tt.origin}})
+			if conn != nil {
+				conn.Close()
+			}
+			if resp == nil {
+				t.Fatalf("Expected HTTP response, got error: %v", err)
+			}
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("Expected status %d, got %d", tt.wantStatus, resp.StatusCode)
+			}
+		})
+	}
+}
+
+// TestThemeInjection tests the data-theme attribute for defaults, overrides and invalid values
+func TestThemeInjection(t *testing.T) {
+	tm := token.NewTokenManager(10)
+	h := hub.NewHub(1024*1024, 10)
+	qrGen := qrcode.NewGenerator("localhost:3333", "http", 10*60*1e9)
+
+	tests := []struct {
+		name         string
+		defaultTheme string
+		query        string
+		want         string
+	}{
+		{"default auto", "", "", "auto"},
+		{"configured dark", "dark", "", "dark"},
+		{"configured light", "light", "", "light"},
+		{"query override", "dark", "&theme=light", "light"},
+		{"query auto", "dark", "&theme=auto", "auto"},
+		{"invalid query falls back", "dark", "&theme=neon", "auto"},
+		{"invalid default falls back", "neon", "", "auto"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := NewServer(h, tm, qrGen, mockStaticFiles, []string{"http://localhost:*"}, mockI18n)
+			if tt.defaultTheme != "" {
+				srv.SetDefaultTheme(tt.defaultTheme)
+			}
+
+			rec := httptest.NewRecorder()
+			srv.handleIndex(rec, httptest.NewRequest(http.MethodGet, "/?mode=host"+tt.query, nil))
+
+			body := rec.Body.String()
+			want := `<div class="container" data-session-timeout="600" data-theme="` + tt.want + `">`
+			if !strings.Contains(body, want) {
+				t.Errorf("Expected %s in body, got: %s", want, body)
+			}
+		})
+	}
+}
+
+// TestIndexModes tests that host and client modes are served and unknown modes are rejected
+func TestIndexModes(t *testing.T) {
+	h := hub.NewHub(1024*1024, 10)
+	qrGen := qrcode.NewGenerator("localhost:3333", "http", 10*60*1e9)
+	srv := NewServer(h, token.NewTokenManager(10), qrGen, mockStaticFiles, []string{"http://localhost:*"}, mockI18n)
+
+	tests := []struct {
+		query      string
+		wantStatus int
+		wantScript string
+	}{
+		{"/", http.StatusOK, "host.js"},
+		{"/?mode=host", http.StatusOK, "host.js"},
+		{"/?mode=client", http.StatusOK, "client.js"},
+		{"/?mode=cleint", http.StatusBadRequest, ""},
+		{"/?mode=HOST", http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			srv.handleIndex(rec, httptest.NewRequest(http.MethodGet, tt.query, nil))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("Expected status %d, got %d", tt.wantStatus, rec.Code)
+			}
+			if tt.wantScript != "" && !strings.Contains(rec.Body.String(), tt.wantScript) {
+				t.Errorf("Expected %s page, got: %s", tt.wantScript, rec.Body.String())
+			}
+			if tt.wantStatus == http.StatusBadRequest && !strings.Contains(rec.Body.String(), "mode=client") {
+				t.Errorf("Expected helpful error message, got: %s", rec.Body.String())
+			}
+		})
+	}
+}
+
+// TestAutoClientRedirect tests that "/" redirects to the client page only when a host exists
+func TestAutoClientRedirect(t *testing.T) {
+	h := hub.NewHub(1024*1024, 10)
+	qrGen := qrcode.NewGenerator("localhost:3333", "http", 10*60*1e9)
+	srv := NewServer(h, token.NewTokenManager(10), qrGen, mockStaticFiles, []string{"http://localhost:*"}, mockI18n)
+	srv.SetAutoClientRedirect(true)
+
+	rec := httptest.NewRecorder()
+	srv.handleIndex(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "host.js") {
+		t.Errorf("Expected host page without a host, got %d", rec.Code)
+	}
+
+	h.SetHostID("existing-host")
+	rec = httptest.NewRecorder()
+	srv.handleIndex(rec, httptest.NewRequest(http.MethodGet, "/?theme=dark", nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("Expected redirect with a host, got %d", rec.Code)
+	}
+	if loc := rec.Header().Get("Location"); loc != "/?mode=client&theme=dark" {
+		t.Errorf("Expected redirect to client page keeping the query, got %q", loc)
+	}
+
+	// An explicit mode is never redirected
+	rec = httptest.NewRecorder()
+	srv.handleIndex(rec, httptest.NewRequest(http.MethodGet, "/?mode=host", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected explicit host mode to be served, got %d", rec.Code)
+	}
+
+	srv.SetAutoClientRedirect(false)
+	rec = httptest.NewRecorder()
+	srv.handleIndex(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected no redirect when disabled, got %d", rec.Code)
+	}
+}
+
+// TestQRURLEndpoint tests that /api/qr-url returns a client URL with a usable token
+func TestQRURLEndpoint(t *testing.T) {
+	tm := token.NewTokenManager(10)
+	h := hub.NewHub(1024*1024, 10)
+	qrGen := qrcode.NewGenerator("localhost:3333", "http", 10*60*1e9)
+	srv := NewServer(h, tm, qrGen, mockStaticFiles, []string{"http://localhost:*"}, mockI18n)
+
+	rec := httptest.NewRecorder()
+	srv.handleQRURL(rec, httptest.NewRequest(http.MethodGet, "/api/qr-url", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Expected application/json, got %s", ct)
+	}
+
+	var resp qrURLResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+
+	if !strings.Contains(resp.URL, "token=") || !strings.Contains(resp.URL, "mode=client") {
+		t.Errorf("Expected URL with token and client mode, got %s", resp.URL)
+	}
+
+	expiresIn := time.Until(time.Unix(resp.ExpiresAt, 0))
+	if expiresIn <= 9*time.Minute || expiresIn > 10*time.Minute {
+		t.Errorf("Expected expiresAt about 10 minutes ahead, got %v", expiresIn)
+	}
+
+	// The token in the URL must validate
+	parsed, err := url.Parse(resp.URL)
+	if err != nil {
+		t.Fatalf("Invalid URL: %v", err)
+	}
+	if err := tm.ValidateToken(parsed.Query().Get("token")); err != nil {
+		t.Errorf("Token from URL should be valid: %v", err)
+	}
+}
+
+// TestHistoryEndpoint tests auth, empty history and populated history ordering
+func TestHistoryEndpoint(t *testing.T) {
+	tm := token.NewTokenManager(10)
+	h := hub.NewHub(1024*1024, 10)
+	go h.Run()
+	defer h.Stop()
+	qrGen := qrcode.NewGenerator("localhost:3333", "http", 10*60*1e9)
+	srv := NewServer(h, tm, qrGen, mockStaticFiles, []string{"http://localhost:*"}, mockI18n)
+	setUpgraderOrigins(srv.allowedOrigins, srv.strictOrigins)
+
+	getHistory := func(query string) (*httptest.ResponseRecorder, historyResponse) {
+		rec := httptest.NewRecorder()
+		srv.handleHistory(rec, httptest.NewRequest(http.MethodGet, "/api/history"+query, nil))
+		var resp historyResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec, resp
+	}
+
+	if rec, _ := getHistory(""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without token, got %d", rec.Code)
+	}
+	if rec, _ := getHistory("?token=invalid"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 with invalid token, got %d", rec.Code)
+	}
+
+	tokenID, _ := tm.GenerateToken()
+	rec, resp := getHistory("?token=" + tokenID)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200 with valid token, got %d", rec.Code)
+	}
+	if resp.Messages == nil || len(resp.Messages) != 0 {
+		t.Errorf("Expected empty message list, got %+v", resp.Messages)
+	}
+	if !strings.Contains(rec.Body.String(), `"messages":[]`) {
+		t.Errorf("Expected empty JSON array, got %s", rec.Body.String())
+	}
+
+	// Populate history through a real connection
+	server := httptest.NewServer(http.HandlerFunc(srv.handleWebSocket))
+	defer server.Close()
+	host := dialTestWS(t, server.URL, "")
+	defer host.Close()
+	readRole(t, host, "host")
+	client := dialTestWS(t, server.URL, "?token="+tokenID)
+	defer client.Close()
+	readRole(t, client, "client")
+
+	for _, content := range []string{"first", "second"} {
+		client.WriteJSON(hub.Message{Type: "text", Content: content})
+		var msg hub.Message
+		host.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if err := host.ReadJSON(&msg); err != nil {
+			t.Fatalf("Host should receive message: %v", err)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/history", nil)
+	req.Header.Set("Authorization", "Bearer "+tokenID)
+	rec = httptest.NewRecorder()
+	srv.handleHistory(rec, req)
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+
+	if len(resp.Messages) != 2 || resp.Messages[0].Content != "first" || resp.Messages[1].Content != "second" {
+		t.Errorf("Expected [first second] in order, got %+v", resp.Messages)
+	}
+}
+
+// dialTestWS connects to a test server's WebSocket handler with an allowed origin
+func dialTestWS(t *testing.T, serverURL, query string) *websocket.Conn {
+	t.Helper()
+	wsURL := "ws" + strings.TrimPrefix(serverURL, "http") + "/ws" + query
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Origin": {"http://localhost"}})
+	if err != nil {
+		t.Fatalf("Failed to connect to %s: %v", wsURL, err)
+	}
+	return conn
+}
+
+// TestUnixSocketListener tests that local clients connect over a Unix socket without a token
+func TestUnixSocketListener(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		tm := token.NewTokenManager(10)
+		h := hub.NewHub(1024*1024, 10)
+		go h.Run()
+		defer h.Stop()
+		h.SetHostID("existing-host")
+
+		qrGen := qrcode.NewGenerator("localhost:3333", "http", 10*60*1e9)
+		srv := NewServer(h, tm, qrGen, mockStaticFiles, []string{"http://localhost:*"}, mockI18n)
+		srv.SetTrustLocal(!strict)
+		mux := http.NewServeMux()
+		srv.RegisterRoutes(mux)
+
+		socketPath := filepath.Join(t.TempDir(), "tv.sock")
+		listener, err := net.Listen("unix", socketPath)
+		if err != nil {
+			t.Fatalf("Failed to listen on Unix socket: %v", err)
+		}
+		unixServer := &http.Server{Handler: srv.LocalHandler(mux)}
+		go unixServer.Serve(listener)
+		defer unixServer.Close()
+
+		dialer := websocket.Dialer{
+			NetDialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+			},
+		}
+		conn, resp, err := dialer.Dial("ws://localhost/ws", nil)
+
+		if strict {
+			if err == nil {
+				conn.Close()
+				t.Error("Strict mode should require a token on the Unix socket")
+			} else if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+				t.Errorf("Expected 401 in strict mode, got %v", err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("Trusted Unix socket client should connect without token: %v", err)
+		}
+		readRole(t, conn, "client")
+		conn.Close()
+	}
+}
+
+// readSSEMessage reads the next data: event from an SSE stream
+func readSSEMessage(t *testing.T, reader *bufio.Reader) hub.Message {
+	t.Helper()
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Failed to read SSE stream: %v", err)
+		}
+		data, ok := strings.CutPrefix(strings.TrimRight(line, "\n"), "data: ")
+		if !ok {
+			continue
+		}
+		var msg hub.Message
+		if err := json.Unmarshal([]byte(data), &msg); err != nil {
+			t.Fatalf("Failed to parse SSE data %q: %v", data, err)
+		}
+		return msg
+	}
+}
+
+// TestEventsAndSend tests that an SSE subscriber receives messages posted to /api/send
+func TestEventsAndSend(t *testing.T) {
+	tm := token.NewTokenManager(10)
+	h := hub.NewHub(1024*1024, 10)
+	go h.Run()
+	defer h.Stop()
+
+	qrGen := qrcode.NewGenerator("localhost:3333", "http", 10*60*1e9)
+	srv := NewServer(h, tm, qrGen, mockStaticFiles, []string{"http://localhost:*"}, mockI18n)
+	mux := http.NewServeMux()
+	srv.RegisterRoutes(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/events")
+	if err != nil {
+		t.Fatalf("Failed to open event stream: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Expected text/event-stream, got %q", ct)
+	}
+
+	reader := bufio.NewReader(resp.Body)
+	if msg := readSSEMessage(t, reader); msg.Type != "role" || msg.Role != "host" {
+		t.Fatalf("Expected host role event, got %+v", msg)
+	}
+
+	// A second subscriber without a token is rejected like /ws, audited and told to rescan
+	audit := &auditRecorder{}
+	srv.SetAuditLogger(audit)
+	noToken, err := http.Get(server.URL + "/events")
+	if err != nil {
+		t.Fatalf("Failed to request event stream: %v", err)
+	}
+	noToken.Body.Close()
+	if noToken.StatusCode != http.StatusUnauthorized || noToken.Header.Get(actionHeader) != actionRescan {
+		t.Errorf("Expected 401 with a rescan hint for second subscriber without token, got %d %q", noToken.StatusCode, noToken.Header.Get(actionHeader))
+	}
+	audit.mu.Lock()
+	if len(audit.events) != 1 || audit.events[0].Type != hub.AuditTokenMissing {
+		t.Errorf("Expected one %s event, got %+v", hub.AuditTokenMissing, audit.events)
+	}
+	audit.mu.Unlock()
+
+	body := strings.NewReader(`{"type":"text","content":"hello over http"}`)
+	sendResp, err := http.Post(server.URL+"/api/send", "application/json", body)
+	if err != nil {
+		t.Fatalf("Failed to post message: %v", err)
+	}
+	sendResp.Body.Close()
+	if sendResp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for send without token, got %d", sendResp.StatusCode)
+	}
+
+	tokenID, err := tm.GenerateToken()
+	if err != nil {
+		t.Fatalf("Failed to generate token: %v", err)
+	}
+	body = strings.NewReader(`{"type":"text","content":"hello over http"}`)
+	sendResp, err = http.Post(server.URL+"/api/send?token="+tokenID, "application/json", body)
+	if err != nil {
+		t.Fatalf("Failed to post message: %v", err)
+	}
+	var delivery hub.Delivery
+	decodeErr := json.NewDecoder(sendResp.Body).Decode(&delivery)
+	sendResp.Body.Close()
+	if sendResp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 from send, got %d", sendResp.StatusCode)
+	}
+	if decodeErr != nil || delivery.Delivered != 1 || delivery.Dropped != 0 {
+		t.Errorf("Expected the SSE client to be counted as delivered, got %+v (%v)", delivery, decodeErr)
+	}
 
-	// Routes are registered to global http package, so we can't easily test them directly
-	// But we can verify that the function doesn't panic
+	if msg := readSSEMessage(t, reader); msg.Type != "text" || msg.Content != "hello over http" {
+		t.Errorf("Expected posted text event, got %+v", msg)
+	}
+}
+
+// TestSendGzip tests that /api/send accepts gzip bodies and rejects ones that expand too far
+func TestSendGzip(t *testing.T) {
+	tm := token.NewTokenManager(10)
+	h := hub.NewHub(1024, 10)
+	go h.Run()
+	defer h.Stop()
+
+	qrGen := qrcode.NewGenerator("localhost:3333", "http", 10*60*1e9)
+	srv := NewServer(h, tm, qrGen, mockStaticFiles, []string{"http://localhost:*"}, mockI18n)
+	mux := http.NewServeMux()
+	srv.RegisterRoutes(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/events")
+	if err != nil {
+		t.Fatalf("Failed to open event stream: %v", err)
+	}
+	defer resp.Body.Close()
+	reader := bufio.NewReader(resp.Body)
+	readSSEMessage(t, reader) // role
+
+	tokenID, err := tm.GenerateToken()
+	if err != nil {
+		t.Fatalf("Failed to generate token: %v", err)
+	}
+
+	post := func(payload []byte, encoding string) int {
+		t.Helper()
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(payload)
+		zw.Close()
+		req, _ := http.NewRequest(http.MethodPost, server.URL+"/api/send?token="+tokenID, &buf)
+		req.Header.Set("Content-Encoding", encoding)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to post: %v", err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	if code := post([]byte(`{"type":"text","content":"compressed hello"}`), "gzip"); code != http.StatusOK {
+		t.Fatalf("Expected 200 for gzip body, got %d", code)
+	}
+	if msg := readSSEMessage(t, reader); msg.Content != "compressed hello" {
+		t.Errorf("Expected decompressed message to be broadcast, got %+v", msg)
+	}
+
+	// A few bytes of gzip expanding far beyond the limit
+	bomb := []byte(`{"type":"text","content":"` + strings.Repeat("A", 1024*1024) + `"}`)
+	if code := post(bomb, "gzip"); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for gzip bomb, got %d", code)
+	}
+
+	if code := post([]byte(`{}`), "br"); code != http.StatusUnsupportedMediaType {
+		t.Errorf("Expected 415 for unsupported encoding, got %d", code)
+	}
+
+	// The bomb is cut off while decompressing, not after reading it all
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(bomb)
+	zw.Close()
+	req := httptest.NewRequest(http.MethodPost, "/api/send", &buf)
+	req.Header.Set("Content-Encoding", "gzip")
+	if _, err := readSendBody(httptest.NewRecorder(), req, 1024); !errors.Is(err, errBodyTooLarge) {
+		t.Errorf("Expected errBodyTooLarge, got %v", err)
+	}
+}
+
+// TestWebSocketAfterHubStop tests that connecting after the hub stops gets a 503 instead of hanging
+func TestWebSocketAfterHubStop(t *testing.T) {
+	tm := token.NewTokenManager(10)
+	h := hub.NewHub(1024*1024, 10)
+	go h.Run()
+	h.Stop()
+
+	qrGen := qrcode.NewGenerator("localhost:3333", "http", 10*60*1e9)
+	srv := NewServer(h, tm, qrGen, mockStaticFiles, []string{"http://localhost:*"}, mockI18n)
+	setUpgraderOrigins(srv.allowedOrigins, srv.strictOrigins)
+
+	server := httptest.NewServer(http.HandlerFunc(srv.handleWebSocket))
+	defer server.Close()
+
+	dialer := websocket.Dialer{HandshakeTimeout: 2 * time.Second}
+	header := http.Header{"Origin": []string{"http://localhost"}}
+	conn, resp, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), header)
+	if err == nil {
+		conn.Close()
+		t.Fatal("Expected connection to a stopped hub to fail")
+	}
+	if resp == nil {
+		t.Fatalf("Expected an HTTP response, got %v", err)
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503, got %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Error("Expected Retry-After header on 503")
+	}
+}
+
+// TestWebSocketRegisterTimeout tests that a hub whose loop is not running cannot block the handler forever
+func TestWebSocketRegisterTimeout(t *testing.T) {
+	oldTimeout := registerTimeout
+	registerTimeout = 100 * time.Millisecond
+	defer func() { registerTimeout = oldTimeout }()
+
+	tm := token.NewTokenManager(10)
+	h := hub.NewHub(1024*1024, 10) // Run is never started, so Register is never drained
+	defer h.Stop()
+
+	qrGen := qrcode.NewGenerator("localhost:3333", "http", 10*60*1e9)
+	srv := NewServer(h, tm, qrGen, mockStaticFiles, []string{"http://localhost:*"}, mockI18n)
+	setUpgraderOrigins(srv.allowedOrigins, srv.strictOrigins)
+
+	server := httptest.NewServer(http.HandlerFunc(srv.handleWebSocket))
+	defer server.Close()
+
+	header := http.Header{"Origin": []string{"http://localhost"}}
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), header)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseTryAgainLater) {
+		t.Errorf("Expected close 1013 (try again later), got %v", err)
+	}
+}
+
+// TestWebSocketMaxTokenLength tests that over-long tokens and URLs are rejected before validation
+func TestWebSocketMaxTokenLength(t *testing.T) {
+	tm := token.NewTokenManager(10)
+	h := hub.NewHub(1024*1024, 10)
+	go h.Run()
+	defer h.Stop()
+	h.SetHostID("existing-host")
+
+	qrGen := qrcode.NewGenerator("localhost:3333", "http", 10*60*1e9)
+	srv := NewServer(h, tm, qrGen, mockStaticFiles, []string{"http://localhost:*"}, mockI18n)
+	srv.SetMaxTokenLength(16)
+	setUpgraderOrigins(srv.allowedOrigins, srv.strictOrigins)
+
+	server := httptest.NewServer(http.HandlerFunc(srv.handleWebSocket))
+	defer server.Close()
+
+	validToken, err := tm.GenerateToken()
+	if err != nil {
+		t.Fatalf("Failed to generate token: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		token      string
+		wantStatus int
+	}{
+		{"normal token", validToken, http.StatusSwitchingProtocols},
+		{"over-long token", strings.Repeat("x", 17), http.StatusBadRequest},
+		{"over-long URL", strings.Repeat("x", maxHandshakeURLLength), http.StatusRequestURITooLong},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "?token=" + tt.token
+			header := http.Header{"Origin": []string{"http://localhost"}}
+			conn, resp, err := websocket.DefaultDialer.Dial(wsURL, header)
+			if conn != nil {
+				conn.Close()
+			}
+			if resp == nil {
+				t.Fatalf("Expected HTTP response, got %v", err)
+			}
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("Expected status %d, got %d", tt.wantStatus, resp.StatusCode)
+			}
+		})
+	}
+}
+
+// TestBuildVersion tests that an injected build version is used and reported by /api/info and /healthz
+func TestAllowedCIDRs(t *testing.T) {
+	_, lan, _ := net.ParseCIDR("192.168.1.0/24")
+	srv := &Server{allowedNets: []*net.IPNet{lan}}
+
+	tests := []struct {
+		remoteAddr string
+		want       bool
+	}{
+		{"192.168.1.42:5555", true},
+		{"192.168.2.42:5555", false},
+		{"127.0.0.1:5555", false},
+		{"not-an-ip", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/ws", nil)
+		r.RemoteAddr = tt.remoteAddr
+		if got := srv.isIPAllowed(r); got != tt.want {
+			t.Errorf("isIPAllowed(%s) = %v, want %v", tt.remoteAddr, got, tt.want)
+		}
+	}
+
+	// A denied IP is rejected before any token or upgrade handling
+	h := hub.NewHub(1024*1024, 10)
+	go h.Run()
+	defer h.Stop()
+	qrGen := qrcode.NewGenerator("localhost:3333", "http", 10*60*1e9)
+	srv = NewServer(h, token.NewTokenManager(10), qrGen, mockStaticFiles, []string{"http://localhost:*"}, mockI18n)
+	srv.SetAllowedCIDRs([]*net.IPNet{lan})
+	setUpgraderOrigins(srv.allowedOrigins, srv.strictOrigins)
+
+	server := httptest.NewServer(http.HandlerFunc(srv.handleWebSocket))
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+	header := http.Header{"Origin": []string{"http://localhost"}}
+
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL, header)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected 403 for IP outside allowed CIDRs, got %v", resp)
+	}
+
+	// Allowing loopback lets the local host in
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	srv.SetAllowedCIDRs([]*net.IPNet{lan, loopback})
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, header)
+	if err != nil {
+		t.Fatalf("Expected loopback connection to be allowed, got %v", err)
+	}
+	conn.Close()
+}
+
+func TestTimeEndpoint(t *testing.T) {
+	srv := &Server{}
+	before := time.Now().UnixMilli()
+	w := httptest.NewRecorder()
+	srv.handleTime(w, httptest.NewRequest(http.MethodGet, "/api/time", nil))
+	after := time.Now().UnixMilli()
+
+	var resp timeResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode time response: %v", err)
+	}
+	if resp.UnixMillis < before || resp.UnixMillis > after {
+		t.Errorf("Expected server time between %d and %d, got %d", before, after, resp.UnixMillis)
+	}
+	if cc := w.Header().Get("Cache-Control"); cc != "no-store" {
+		t.Errorf("Expected Cache-Control no-store, got %q", cc)
+	}
+
+	w = httptest.NewRecorder()
+	srv.handleTime(w, httptest.NewRequest(http.MethodPost, "/api/time", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for POST, got %d", w.Code)
+	}
+}
+
+func TestBuildVersion(t *testing.T) {
+	oldVersion := BuildVersion
+	BuildVersion = "v1.2.3"
+	defer func() { BuildVersion = oldVersion }()
+
+	tm := token.NewTokenManager(10)
+	h := hub.NewHub(1024*1024, 10)
+	go h.Run()
+
+	qrGen := qrcode.NewGenerator("localhost:3333", "http", 10*60*1e9)
+	srv := NewServer(h, tm, qrGen, mockStaticFiles, []string{"http://localhost:*"}, mockI18n)
+
+	if srv.version != "v1.2.3" {
+		t.Fatalf("Expected version v1.2.3, got %q", srv.version)
+	}
+
+	mux := http.NewServeMux()
+	srv.RegisterRoutes(mux)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/info", nil))
+	var info infoResponse
+	if err := json.NewDecoder(w.Body).Decode(&info); err != nil {
+		t.Fatalf("Failed to decode info: %v", err)
+	}
+	if info.Version != "v1.2.3" || info.SessionTimeout != 600 {
+		t.Errorf("Unexpected info response: %+v", info)
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	var health healthResponse
+	if err := json.NewDecoder(w.Body).Decode(&health); err != nil {
+		t.Fatalf("Failed to decode health: %v", err)
+	}
+	if w.Code != http.StatusOK || health.Status != "ok" || health.Version != "v1.2.3" {
+		t.Errorf("Unexpected health response: %d %+v", w.Code, health)
+	}
+	if health.Clients != 0 || health.MessagesBroadcast != 0 || health.UptimeSeconds < 0 {
+		t.Errorf("Unexpected health stats: %+v", health)
+	}
+
+	h.Stop()
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 from /healthz after hub stop, got %d", w.Code)
+	}
+}
+
+// auditRecorder collects audit events for assertions
+type auditRecorder struct {
+	mu     sync.Mutex
+	events []hub.AuditEvent
+}
+
+func (a *auditRecorder) Event(e hub.AuditEvent) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.events = append(a.events, e)
+}
+
+func TestAuditEvents(t *testing.T) {
+	h := hub.NewHub(1024*1024, 10)
+	go h.Run()
+	defer h.Stop()
+	h.SetHostID("test-host")
+
+	tm := token.NewTokenManager(1)
+	expired, _ := tm.GenerateToken()
+	tm.StoreToken(token.SessionToken{ID: expired, Timestamp: time.Now().Add(-2 * time.Minute).Unix()})
+
+	qrGen := qrcode.NewGenerator("localhost:3333", "http", 10*60*1e9)
+	srv := NewServer(h, tm, qrGen, mockStaticFiles, []string{"http://localhost:*"}, mockI18n)
+	srv.SetAllowedHosts([]string{"localhost"})
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		host       string
+		origin     string
+		query      string
+		want       string
+	}{
+		{"denied ip", "10.0.0.1:5000", "localhost", "", "", hub.AuditIPRejected},
+		{"bad host", "127.0.0.1:5000", "evil.com", "", "", hub.AuditHostRejected},
+		{"bad origin", "127.0.0.1:5000", "localhost", "http://evil.com", "", hub.AuditOriginRejected},
+		{"missing token", "127.0.0.1:5000", "localhost", "", "", hub.AuditTokenMissing},
+		{"invalid token", "127.0.0.1:5000", "localhost", "", "?token=bogus", hub.AuditTokenInvalid},
+		{"expired token", "127.0.0.1:5000", "localhost", "", "?token=" + expired, hub.AuditTokenExpired},
+	}
+
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	srv.SetAllowedCIDRs([]*net.IPNet{loopback})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			audit := &auditRecorder{}
+			srv.SetAuditLogger(audit)
+
+			r := httptest.NewRequest("GET", "/ws"+tt.query, nil)
+			r.RemoteAddr = tt.remoteAddr
+			r.Host = tt.host
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			srv.handleWebSocket(httptest.NewRecorder(), r)
+
+			if len(audit.events) != 1 || audit.events[0].Type != tt.want {
+				t.Fatalf("Expected one %s event, got %+v", tt.want, audit.events)
+			}
+			if audit.events[0].RemoteAddr != tt.remoteAddr {
+				t.Errorf("Expected remote address %s, got %s", tt.remoteAddr, audit.events[0].RemoteAddr)
+			}
+		})
+	}
+}
+
+func TestStrictOrigins(t *testing.T) {
+	if !isOriginAllowed("http://evil.com", nil, false) {
+		t.Error("Expected an empty allowlist to allow all origins outside strict mode")
+	}
+	if isOriginAllowed("http://evil.com", nil, true) {
+		t.Error("Expected an empty allowlist to deny cross-origin requests in strict mode")
+	}
+	if !isOriginAllowed("http://localhost:3333", []string{"http://localhost:*"}, true) {
+		t.Error("Expected strict mode to honor an explicit allowlist")
+	}
+
+	h := hub.NewHub(1024*1024, 10)
+	go h.Run()
+	defer h.Stop()
+	qrGen := qrcode.NewGenerator("localhost:3333", "http", 10*60*1e9)
+	srv := NewServer(h, token.NewTokenManager(10), qrGen, mockStaticFiles, nil, mockI18n)
+	srv.SetStrictOrigins(true)
+	setUpgraderOrigins(srv.allowedOrigins, srv.strictOrigins)
+	defer setUpgraderOrigins(nil, false)
+
+	server := httptest.NewServer(http.HandlerFunc(srv.handleWebSocket))
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	tests := []struct {
+		name       string
+		origin     string
+		wantStatus int
+	}{
+		{"cross-origin", "http://evil.com", http.StatusForbidden},
+		{"same-origin", server.URL, http.StatusSwitchingProtocols},
+		{"no origin", "", http.StatusSwitchingProtocols},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.origin != "" {
+				header.Set("Origin", tt.origin)
+			}
+			// A room per case, so each accepted connection becomes its room's host
+			conn, resp, err := websocket.DefaultDialer.Dial(wsURL+"?room="+strconv.Itoa(i), header)
+			if conn != nil {
+				conn.Close()
+			}
+			if resp == nil {
+				t.Fatalf("Expected HTTP response, got error: %v", err)
+			}
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("Expected status %d, got %d", tt.wantStatus, resp.StatusCode)
+			}
+		})
+	}
+}
+
+// TestSendRateLimit tests that /api/send callers share a rate limit per IP, so fresh tokens can't bypass it
+func TestSendRateLimit(t *testing.T) {
+	tm := token.NewTokenManager(10)
+	h := hub.NewHub(1024*1024, 2)
+	go h.Run()
+	defer h.Stop()
+	h.SetHostID("test-host")
+
+	qrGen := qrcode.NewGenerator("localhost:3333", "http", 10*60*1e9)
+	srv := NewServer(h, tm, qrGen, mockStaticFiles, []string{"http://localhost:*"}, mockI18n)
+
+	remoteAddr := "192.0.2.1:1234"
+	send := func(query string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/api/send"+query, strings.NewReader(`{"type":"text","content":"hi"}`))
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		srv.handleSend(w, r)
+		return w
+	}
+
+	if w := send(""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without token while a host is connected, got %d", w.Code)
+	}
+
+	tokenID, err := tm.GenerateToken()
+	if err != nil {
+		t.Fatalf("Failed to generate token: %v", err)
+	}
+	for i := range 2 {
+		if w := send("?token=" + tokenID); w.Code != http.StatusOK {
+			t.Fatalf("Send %d: expected 200, got %d", i, w.Code)
+		}
+	}
+	if w := send("?token=" + tokenID); w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 once the rate limit is spent, got %d", w.Code)
+	}
+
+	// Minting a fresh token doesn't reset the limit for the same address
+	other, _ := tm.GenerateToken()
+	if w := send("?token=" + other); w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 for a fresh token from the same IP, got %d", w.Code)
+	}
+
+	// Another address has its own limit
+	remoteAddr = "192.0.2.2:1234"
+	if w := send("?token=" + other); w.Code != http.StatusOK {
+		t.Errorf("Expected 200 from a different IP, got %d", w.Code)
+	}
+}
+
+// TestSendErrorStatus tests that every hub rejection /api/send can hit maps to its own status
+func TestSendErrorStatus(t *testing.T) {
+	tests := []struct {
+		err  error
+		code int
+		body string
+	}{
+		{hub.ErrMetaTooLarge, http.StatusRequestEntityTooLarge, "Message metadata too large"},
+		{hub.ErrPendingApproval, http.StatusForbidden, "waiting for host approval"},
+		{fmt.Errorf("%w: unexpected end of JSON input", hub.ErrMalformed), http.StatusBadRequest, "malformed message"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		writeSendError(w, tt.err)
+		if w.Code != tt.code {
+			t.Errorf("%v: expected %d, got %d", tt.err, tt.code, w.Code)
+		}
+		if !strings.Contains(w.Body.String(), tt.body) {
+			t.Errorf("%v: expected body to contain %q, got %q", tt.err, tt.body, w.Body.String())
+		}
+	}
+
+	// The same mappings through the handler
+	h := hub.NewHub(1024*1024, 10)
+	go h.Run()
+	defer h.Stop()
+	qrGen := qrcode.NewGenerator("localhost:3333", "http", 10*60*1e9)
+	tm := token.NewTokenManager(10)
+	srv := NewServer(h, tm, qrGen, mockStaticFiles, []string{"http://localhost:*"}, mockI18n)
+	tokenID, err := tm.GenerateToken()
+	if err != nil {
+		t.Fatalf("Failed to generate token: %v", err)
+	}
+	send := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		srv.handleSend(w, httptest.NewRequest("POST", "/api/send?token="+tokenID, strings.NewReader(body)))
+		return w
+	}
+
+	if w := send(`{"type":"text",`); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "malformed message") {
+		t.Errorf("Expected 400 malformed message, got %d %q", w.Code, w.Body.String())
+	}
+	meta := fmt.Sprintf(`{"type":"text","content":"hi","meta":{"note":%q}}`, strings.Repeat("x", hub.MaxMetaSize))
+	if w := send(meta); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for oversized metadata, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+// TestQRRefreshHeader tests that the QR refresh hint scales with the session timeout
+func TestQRRefreshHeader(t *testing.T) {
+	tests := []struct {
+		timeout time.Duration
+		want    string
+	}{
+		{10 * time.Minute, "480"},
+		{time.Minute, "48"},
+	}
+	for _, tt := range tests {
+		h := hub.NewHub(1024*1024, 10)
+		qrGen := qrcode.NewGenerator("localhost:3333", "http", tt.timeout)
+		srv := NewServer(h, token.NewTokenManager(10), qrGen, mockStaticFiles, []string{"http://localhost:*"}, mockI18n)
+
+		w := httptest.NewRecorder()
+		srv.handleQRCode(w, httptest.NewRequest("GET", "/qrcode.png", nil))
+		if got := w.Header().Get(qrRefreshHeader); got != tt.want {
+			t.Errorf("%s with a %v timeout = %q, want %q", qrRefreshHeader, tt.timeout, got, tt.want)
+		}
+	}
+}
+
+// TestDebugWebSocket tests that debug connections get their own messages echoed and never reach the room
+func TestDebugWebSocket(t *testing.T) {
+	tm := token.NewTokenManager(10)
+	h := hub.NewHub(1024*1024, 10)
+	go h.Run()
+	defer h.Stop()
+
+	qrGen := qrcode.NewGenerator("localhost:3333", "http", 10*60*1e9)
+	srv := NewServer(h, tm, qrGen, mockStaticFiles, []string{"http://localhost:*"}, mockI18n)
+	defer srv.Shutdown()
+	setUpgraderOrigins(srv.allowedOrigins, srv.strictOrigins)
+
+	server := httptest.NewServer(http.HandlerFunc(srv.handleWebSocket))
+	defer server.Close()
+
+	host := dialTestWS(t, server.URL, "")
+	defer host.Close()
+	readRole(t, host, "host")
+
+	tokenID, err := tm.GenerateToken()
+	if err != nil {
+		t.Fatalf("Failed to generate token: %v", err)
+	}
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?mode=debug&token=" + tokenID
+	origin := http.Header{"Origin": {"http://localhost"}}
+
+	// Disabled by default
+	if _, resp, err := websocket.DefaultDialer.Dial(wsURL, origin); err == nil || resp == nil || resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected 404 while debug mode is disabled, got %v", resp)
+	}
+
+	srv.SetFeatures(features.Set{DebugWS: true})
+	debug := dialTestWS(t, server.URL, "?mode=debug&token="+tokenID)
+	defer debug.Close()
+
+	if err := debug.WriteMessage(websocket.TextMessage, []byte("ping-me")); err != nil {
+		t.Fatalf("Failed to send debug message: %v", err)
+	}
+	var echo debugEcho
+	debug.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if err := debug.ReadJSON(&echo); err != nil {
+		t.Fatalf("Failed to read echo: %v", err)
+	}
+	if echo.Type != "debug" || echo.Content != "ping-me" || echo.Bytes != 7 || echo.ReceivedAt == 0 {
+		t.Errorf("Unexpected echo: %+v", echo)
+	}
+
+	// The host never sees debug traffic
+	host.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, msg, err := host.ReadMessage(); err == nil {
+		t.Errorf("Expected no message for the host, got %s", msg)
+	}
+
+	// A debug connection still needs a valid token
+	if _, resp, err := websocket.DefaultDialer.Dial(strings.TrimSuffix(wsURL, tokenID)+"bogus", origin); err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a debug connection with an invalid token, got %v", resp)
+	}
+}
+
+// TestDebugWebSocketLimits tests that debug connections keep the per-IP cap and the per-client rate limit
+func TestDebugWebSocketLimits(t *testing.T) {
+	tm := token.NewTokenManager(10)
+	h := hub.NewHub(1024*1024, 2)
+	h.SetMaxClientsPerIP(1)
+	go h.Run()
+	defer h.Stop()
+
+	qrGen := qrcode.NewGenerator("localhost:3333", "http", 10*60*1e9)
+	srv := NewServer(h, tm, qrGen, mockStaticFiles, []string{"http://localhost:*"}, mockI18n)
+	defer srv.Shutdown()
+	srv.SetFeatures(features.Set{DebugWS: true})
+	setUpgraderOrigins(srv.allowedOrigins, srv.strictOrigins)
+
+	server := httptest.NewServer(http.HandlerFunc(srv.handleWebSocket))
+	defer server.Close()
+	tokenID, err := tm.GenerateToken()
+	if err != nil {
+		t.Fatalf("Failed to generate token: %v", err)
+	}
+
+	// Sending faster than the hub's 2 messages per second delays the third echo to the next window
+	debug := dialTestWS(t, server.URL, "?mode=debug&token="+tokenID)
+	defer debug.Close()
+	start := time.Now()
+	for i := range 3 {
+		if err := debug.WriteMessage(websocket.TextMessage, []byte(fmt.Sprint(i))); err != nil {
+			t.Fatalf("Failed to send debug message: %v", err)
+		}
+	}
+	debug.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for i := range 3 {
+		var echo debugEcho
+		if err := debug.ReadJSON(&echo); err != nil {
+			t.Fatalf("Failed to read echo %d: %v", i, err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Errorf("Expected the third echo to wait for the rate limit window, got all in %v", elapsed)
+	}
+
+	// The IP already has a client in the room, so debug connections are refused like /ws ones
+	host := dialTestWS(t, server.URL, "")
+	defer host.Close()
+	readRole(t, host, "host")
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?mode=debug&token=" + tokenID
+	if _, resp, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Origin": {"http://localhost"}}); err == nil || resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 at the per-IP limit, got %v", resp)
+	}
+}
+
+// TestCustomWSPath tests that --ws-path moves the WebSocket endpoint and tells the frontend
+func TestCustomWSPath(t *testing.T) {
+	h := hub.NewHub(1024*1024, 10)
+	go h.Run()
+	defer h.Stop()
+
+	qrGen := qrcode.NewGenerator("localhost:3333", "http", 10*60*1e9)
+	srv := NewServer(h, token.NewTokenManager(10), qrGen, mockStaticFiles, []string{"http://localhost:*"}, mockI18n)
+	defer srv.Shutdown()
+	srv.SetWSPath("clip/socket")
+	mux := http.NewServeMux()
+	srv.RegisterRoutes(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	wsBase := "ws" + strings.TrimPrefix(server.URL, "http")
+	origin := http.Header{"Origin": {"http://localhost"}}
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsBase+"/clip/socket", origin)
+	if err != nil {
+		t.Fatalf("Expected the custom path to accept WebSockets: %v", err)
+	}
+	readRole(t, conn, "host")
+	conn.Close()
+
+	if _, resp, err := websocket.DefaultDialer.Dial(wsBase+"/ws", origin); err == nil || resp == nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 on the default path, got %v", resp)
+	}
+
+	resp, err := http.Get(server.URL + "/")
+	if err != nil {
+		t.Fatalf("Failed to get index: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), `data-ws-path="/clip/socket"`) {
+		t.Errorf("Expected the page to announce the WebSocket path, got: %s", body)
+	}
+
+	resp, err = http.Get(server.URL + "/api/info")
+	if err != nil {
+		t.Fatalf("Failed to get info: %v", err)
+	}
+	var info infoResponse
+	json.NewDecoder(resp.Body).Decode(&info)
+	resp.Body.Close()
+	if info.WSPath != "/clip/socket" {
+		t.Errorf("Expected wsPath in /api/info, got %q", info.WSPath)
+	}
+}
+
+// TestHostSecret tests that the host secret grants the host role and a wrong one doesn't
+func TestHostSecret(t *testing.T) {
+	tm := token.NewTokenManager(10)
+	h := hub.NewHub(1024*1024, 10)
+	go h.Run()
+	defer h.Stop()
+
+	qrGen := qrcode.NewGenerator("localhost:3333", "http", 10*60*1e9)
+	srv := NewServer(h, tm, qrGen, mockStaticFiles, []string{"http://localhost:*"}, mockI18n)
+	defer srv.Shutdown()
+	srv.SetHostSecret("s3cret")
+	setUpgraderOrigins(srv.allowedOrigins, srv.strictOrigins)
+
+	server := httptest.NewServer(http.HandlerFunc(srv.handleWebSocket))
+	defer server.Close()
+
+	phone := dialTestWS(t, server.URL, "")
+	defer phone.Close()
+	readRole(t, phone, "host")
+
+	// A wrong secret is a normal client: without a token it's rejected
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?host_secret=wrong"
+	if _, resp, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Origin": {"http://localhost"}}); err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a wrong host secret without token, got %v", resp)
+	}
+	tokenID, err := tm.GenerateToken()
+	if err != nil {
+		t.Fatalf("Failed to generate token: %v", err)
+	}
+	wrong := dialTestWS(t, server.URL, "?host_secret=wrong&token="+tokenID)
+	defer wrong.Close()
+	readRole(t, wrong, "client")
+
+	// The right secret takes over, demoting the previous host
+	tv := dialTestWS(t, server.URL, "?host_secret=s3cret")
+	defer tv.Close()
+	readRole(t, tv, "host")
+	readRole(t, phone, "client")
+}
+
+// TestStaticETags tests that static assets carry an ETag and answer conditional requests with 304
+func TestStaticETags(t *testing.T) {
+	h := hub.NewHub(1024*1024, 10)
+	qrGen := qrcode.NewGenerator("localhost:3333", "http", 10*60*1e9)
+	files := fstest.MapFS{
+		"static/css/style.css": {Data: []byte("body { color: black; }")},
+		"static/js/common.js":  {Data: []byte("console.log('hi');")},
+	}
+	srv := NewServer(h, token.NewTokenManager(10), qrGen, files, []string{"http://localhost:*"}, mockI18n)
+	mux := http.NewServeMux()
+	srv.RegisterRoutes(mux)
+
+	get := func(path, ifNoneMatch string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		if ifNoneMatch != "" {
+			r.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	first := get("/static/css/style.css", "")
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || etag == "" {
+		t.Fatalf("Expected 200 with an ETag, got %d (ETag %q)", first.Code, etag)
+	}
+	if other := get("/static/js/common.js", "").Header().Get("ETag"); other == etag {
+		t.Errorf("Expected different files to get different ETags, both got %s", etag)
+	}
+
+	if w := get("/static/css/style.css", etag); w.Code != http.StatusNotModified {
+		t.Errorf("Expected 304 for a matching If-None-Match, got %d", w.Code)
+	}
+	if w := get("/static/css/style.css", `"stale"`); w.Code != http.StatusOK {
+		t.Errorf("Expected 200 for a stale If-None-Match, got %d", w.Code)
+	}
+}
+
+// TestNoHost tests that without a host every connection, even the first, needs a token
+func TestNoHost(t *testing.T) {
+	tm := token.NewTokenManager(10)
+	h := hub.NewHub(1024*1024, 10)
+	h.SetFeatures(features.Set{NoHost: true})
+	go h.Run()
+	defer h.Stop()
+
+	qrGen := qrcode.NewGenerator("localhost:3333", "http", 10*60*1e9)
+	srv := NewServer(h, tm, qrGen, mockStaticFiles, []string{"http://localhost:*"}, mockI18n)
+	defer srv.Shutdown()
+	srv.SetFeatures(features.Set{NoHost: true})
+	srv.SetHostSecret("s3cret")
+	setUpgraderOrigins(srv.allowedOrigins, srv.strictOrigins)
+
+	server := httptest.NewServer(http.HandlerFunc(srv.handleWebSocket))
+	defer server.Close()
+
+	for _, query := range []string{"", "?host_secret=s3cret"} {
+		wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws" + query
+		if _, resp, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Origin": {"http://localhost"}}); err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Expected 401 for first connection %q without token, got %v", query, resp)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		tokenID, err := tm.GenerateToken()
+		if err != nil {
+			t.Fatalf("Failed to generate token: %v", err)
+		}
+		conn := dialTestWS(t, server.URL, "?token="+tokenID)
+		defer conn.Close()
+		readRole(t, conn, "client")
+	}
+	if h.HasHost() {
+		t.Errorf("Expected no host, got %q", h.HostID())
+	}
+}
+
+// TestLocalizedErrors tests that WebSocket error messages follow the client's Accept-Language
+func TestLocalizedErrors(t *testing.T) {
+	if err := mockI18n.LoadAllLanguages(); err != nil {
+		t.Fatalf("Failed to load languages: %v", err)
+	}
+	tm := token.NewTokenManager(10)
+	h := hub.NewHub(1024*1024, 1)
+	h.SetTranslator(mockI18n)
+	go h.Run()
+	defer h.Stop()
+
+	qrGen := qrcode.NewGenerator("localhost:3333", "http", 10*60*1e9)
+	srv := NewServer(h, tm, qrGen, mockStaticFiles, []string{"http://localhost:*"}, mockI18n)
+	defer srv.Shutdown()
+	setUpgraderOrigins(srv.allowedOrigins, srv.strictOrigins)
+
+	server := httptest.NewServer(http.HandlerFunc(srv.handleWebSocket))
+	defer server.Close()
+
+	host := dialTestWS(t, server.URL, "")
+	defer host.Close()
+	readRole(t, host, "host")
+
+	tests := []struct {
+		acceptLanguage string
+		want           string
+	}{
+		{"pt-BR,pt;q=0.9,en;q=0.8", "Limite de taxa excedido. Máximo de 1 mensagens por segundo permitidas."},
+		{"pt", "Limite de taxa excedido. Máximo de 1 mensagens por segundo permitidas."},
+		{"fr-FR, en;q=0.5", "Rate limit exceeded. Maximum 1 messages per second allowed."},
+	}
+	for _, tt := range tests {
+		tokenID, err := tm.GenerateToken()
+		if err != nil {
+			t.Fatalf("Failed to generate token: %v", err)
+		}
+		wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?token=" + tokenID
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{
+			"Origin":          {"http://localhost"},
+			"Accept-Language": {tt.acceptLanguage},
+		})
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		defer conn.Close()
+		readRole(t, conn, "client")
+
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"text","content":"one"}`))
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"text","content":"two"}`))
+
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for {
+			var msg hub.Message
+			if err := conn.ReadJSON(&msg); err != nil {
+				t.Fatalf("%s: expected an error message: %v", tt.acceptLanguage, err)
+			}
+			if msg.Type == "error" {
+				if msg.Content != tt.want {
+					t.Errorf("%s: expected %q, got %q", tt.acceptLanguage, tt.want, msg.Content)
+				}
+				break
+			}
+		}
+	}
+}
+
+// TestQRTargets tests that host pages and /api/info list the QR code targets and unknown ones are rejected
+func TestQRTargets(t *testing.T) {
+	h := hub.NewHub(1024*1024, 10)
+	qrGen := qrcode.NewGenerator("localhost:3333", "http", 10*time.Minute)
+	qrGen.SetTargets(
+		qrcode.Target{Name: "public", Scheme: "https", Host: "tv.example.com"},
+		qrcode.Target{Name: "lan", Scheme: "http", Host: "192.168.1.10:3333"},
+	)
+	srv := NewServer(h, token.NewTokenManager(10), qrGen, mockStaticFiles, []string{"http://localhost:*"}, mockI18n)
+
+	w := httptest.NewRecorder()
+	srv.handleIndex(w, httptest.NewRequest("GET", "/", nil))
+	if !strings.Contains(w.Body.String(), `data-qr-targets="public,lan"`) {
+		t.Errorf("Expected host page to list QR targets, got %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	srv.handleInfo(w, httptest.NewRequest("GET", "/api/info", nil))
+	var info infoResponse
+	if err := json.NewDecoder(w.Body).Decode(&info); err != nil {
+		t.Fatalf("Failed to decode info: %v", err)
+	}
+	if strings.Join(info.QRTargets, ",") != "public,lan" {
+		t.Errorf("Expected QR targets in /api/info, got %v", info.QRTargets)
+	}
+
+	for target, want := range map[string]int{"lan": http.StatusOK, "public": http.StatusOK, "tunnel": http.StatusBadRequest} {
+		w := httptest.NewRecorder()
+		srv.handleQRCode(w, httptest.NewRequest("GET", "/qrcode.png?target="+target, nil))
+		if w.Code != want {
+			t.Errorf("target %q: expected %d, got %d", target, want, w.Code)
+		}
+	}
+}
+
+// TestInfoLanguages tests that /api/info lists the loaded languages in sorted order
+func TestInfoLanguages(t *testing.T) {
+	if err := mockI18n.LoadAllLanguages(); err != nil {
+		t.Fatalf("Failed to load languages: %v", err)
+	}
+	h := hub.NewHub(1024*1024, 10)
+	qrGen := qrcode.NewGenerator("localhost:3333", "http", 10*time.Minute)
+	srv := NewServer(h, token.NewTokenManager(10), qrGen, mockStaticFiles, []string{"http://localhost:*"}, mockI18n)
+
+	for i := 0; i < 5; i++ {
+		w := httptest.NewRecorder()
+		srv.handleInfo(w, httptest.NewRequest("GET", "/api/info", nil))
+		var info infoResponse
+		if err := json.NewDecoder(w.Body).Decode(&info); err != nil {
+			t.Fatalf("Failed to decode info: %v", err)
+		}
+		if got := strings.Join(info.Languages, ","); got != "en,pt-BR" {
+			t.Fatalf("Expected sorted languages en,pt-BR, got %q", got)
+		}
+	}
+}
+
+// TestMaxClientsPerIP tests that connections beyond the per-IP limit are rejected with 429
+func TestMaxClientsPerIP(t *testing.T) {
+	tm := token.NewTokenManager(10)
+	h := hub.NewHub(1024*1024, 10)
+	h.SetMaxClientsPerIP(2)
+	go h.Run()
+	defer h.Stop()
+
+	qrGen := qrcode.NewGenerator("localhost:3333", "http", 10*60*1e9)
+	srv := NewServer(h, tm, qrGen, mockStaticFiles, []string{"http://localhost:*"}, mockI18n)
+	defer srv.Shutdown()
+	setUpgraderOrigins(srv.allowedOrigins, srv.strictOrigins)
+
+	server := httptest.NewServer(http.HandlerFunc(srv.handleWebSocket))
+	defer server.Close()
+
+	dialClient := func() (*websocket.Conn, *http.Response, error) {
+		tokenID, err := tm.GenerateToken()
+		if err != nil {
+			t.Fatalf("Failed to generate token: %v", err)
+		}
+		wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?token=" + tokenID
+		return websocket.DefaultDialer.Dial(wsURL, http.Header{"Origin": {"http://localhost"}})
+	}
+
+	// Every test connection comes from 127.0.0.1
+	host := dialTestWS(t, server.URL, "")
+	defer host.Close()
+	readRole(t, host, "host")
+
+	phone, _, err := dialClient()
+	if err != nil {
+		t.Fatalf("Expected the second connection to be allowed: %v", err)
+	}
+	readRole(t, phone, "client")
+
+	if _, resp, err := dialClient(); err == nil || resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429 for a third connection from the same IP, got %v", resp)
+	}
+
+	// A slot frees up once a client leaves
+	phone.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for h.AtIPLimit("127.0.0.1") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	again, _, err := dialClient()
+	if err != nil {
+		t.Fatalf("Expected a connection after a client left: %v", err)
+	}
+	defer again.Close()
+	readRole(t, again, "client")
+}
+
+// TestShutdownDraining tests that no QR tokens are issued once shutdown starts and connected clients are told
+func TestShutdownDraining(t *testing.T) {
+	h := hub.NewHub(1024*1024, 10)
+	go h.Run()
+	defer h.Stop()
+
+	tm := token.NewTokenManager(10)
+	qrGen := qrcode.NewGenerator("localhost:3333", "http", 10*time.Minute)
+	srv := NewServer(h, tm, qrGen, mockStaticFiles, []string{"http://localhost:*"}, mockI18n)
+	setUpgraderOrigins(srv.allowedOrigins, srv.strictOrigins)
+
+	server := httptest.NewServer(http.HandlerFunc(srv.handleWebSocket))
+	defer server.Close()
+	host := dialTestWS(t, server.URL, "")
+	defer host.Close()
+	readRole(t, host, "host")
+
+	srv.Shutdown()
+
+	w := httptest.NewRecorder()
+	srv.handleQRCode(w, httptest.NewRequest("GET", "/qrcode.png", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 while draining, got %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("Expected a Retry-After header while draining")
+	}
+	w = httptest.NewRecorder()
+	srv.handleQRURL(w, httptest.NewRequest("GET", "/api/qr-url", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected /api/qr-url to return 503 with Retry-After while draining, got %d", w.Code)
+	}
+	if n := tm.TokenCount(); n != 0 {
+		t.Errorf("Expected no tokens issued while draining, got %d", n)
+	}
+
+	host.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		var msg hub.Message
+		if err := host.ReadJSON(&msg); err != nil {
+			t.Fatalf("Expected a shutdown notice: %v", err)
+		}
+		if msg.Type == "shutdown" {
+			break
+		}
+	}
+}
+
+// TestMaintenanceMode tests entering and leaving maintenance through /api/maintenance
+func TestMaintenanceMode(t *testing.T) {
+	h := hub.NewHub(1024*1024, 10)
+	go h.Run()
+	defer h.Stop()
+
+	tm := token.NewTokenManager(10)
+	qrGen := qrcode.NewGenerator("localhost:3333", "http", 10*time.Minute)
+	srv := NewServer(h, tm, qrGen, mockStaticFiles, []string{"http://localhost:*"}, mockI18n)
+	setUpgraderOrigins(srv.allowedOrigins, srv.strictOrigins)
+	mux := http.NewServeMux()
+	srv.RegisterRoutes(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	setMaintenance := func(body, adminToken string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest("POST", server.URL+"/api/maintenance", strings.NewReader(body))
+		if adminToken != "" {
+			req.Header.Set("Authorization", "Bearer "+adminToken)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Maintenance request failed: %v", err)
+		}
+		return resp
+	}
+
+	// Without an admin token the endpoint doesn't exist
+	if resp := setMaintenance(`{"enabled":true}`, "anything"); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected 404 without an admin token, got %d", resp.StatusCode)
+	}
+
+	srv.SetAdminToken("ops-token")
+	if resp := setMaintenance(`{"enabled":true}`, "wrong"); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 for a wrong admin token, got %d", resp.StatusCode)
+	}
+	if srv.InMaintenance() {
+		t.Fatal("Expected a rejected request not to enter maintenance")
+	}
+
+	host := dialTestWS(t, server.URL, "")
+	defer host.Close()
+	readRole(t, host, "host")
+
+	resp := setMaintenance(`{"enabled":true,"drain":true}`, "ops-token")
+	var state maintenanceResponse
+	if err := json.NewDecoder(resp.Body).Decode(&state); err != nil {
+		t.Fatalf("Failed to decode maintenance response: %v", err)
+	}
+	resp.Body.Close()
+	if !state.Maintenance || state.Disconnected != 1 {
+		t.Errorf("Expected maintenance with 1 client drained, got %+v", state)
+	}
+
+	// The drained host is told why before its connection closes
+	host.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		var msg hub.Message
+		if err := host.ReadJSON(&msg); err != nil {
+			t.Fatalf("Expected a maintenance notice: %v", err)
+		}
+		if msg.Type == "maintenance" {
+			break
+		}
+	}
+
+	page, err := http.Get(server.URL + "/")
+	if err != nil {
+		t.Fatalf("Index request failed: %v", err)
+	}
+	body, _ := io.ReadAll(page.Body)
+	page.Body.Close()
+	if page.StatusCode != http.StatusServiceUnavailable || !strings.Contains(string(body), "maintenance") {
+		t.Errorf("Expected maintenance page, got %d: %s", page.StatusCode, body)
+	}
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+	if _, resp, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Origin": {"http://localhost"}}); err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Expected 503 for a WebSocket during maintenance, got %v", resp)
+	}
+
+	// Leaving maintenance restores pages and connections
+	setMaintenance(`{"enabled":false}`, "ops-token").Body.Close()
+	page, err = http.Get(server.URL + "/")
+	if err != nil {
+		t.Fatalf("Index request failed: %v", err)
+	}
+	page.Body.Close()
+	if page.StatusCode != http.StatusOK {
+		t.Errorf("Expected host page after maintenance, got %d", page.StatusCode)
+	}
+	again := dialTestWS(t, server.URL, "")
+	defer again.Close()
+	readRole(t, again, "host")
+}
+
+// TestNoCacheBust tests that static asset URLs are left without ?v= when cache busting is disabled
+func TestNoCacheBust(t *testing.T) {
+	h := hub.NewHub(1024*1024, 10)
+	qrGen := qrcode.NewGenerator("localhost:3333", "http", 10*time.Minute)
+	srv := NewServer(h, token.NewTokenManager(10), qrGen, mockStaticFiles, []string{"http://localhost:*"}, mockI18n)
+
+	for _, disabled := range []bool{false, true} {
+		srv.SetNoCacheBust(disabled)
+		w := httptest.NewRecorder()
+		srv.handleIndex(w, httptest.NewRequest("GET", "/?mode=host", nil))
+		body := w.Body.String()
+
+		if disabled {
+			if strings.Contains(body, "?v=") {
+				t.Errorf("Expected no ?v= with cache busting disabled, got: %s", body)
+			}
+			if !strings.Contains(body, `<script src="/static/js/host.js">`) || !strings.Contains(body, `href="/static/css/style.css"`) {
+				t.Errorf("Expected plain asset URLs, got: %s", body)
+			}
+		} else if !strings.Contains(body, `<script src="/static/js/host.js?v=`+srv.version+`">`) {
+			t.Errorf("Expected versioned asset URLs by default, got: %s", body)
+		}
+	}
+}
+
+func TestAnnounce(t *testing.T) {
+	h := hub.NewHub(1024*1024, 10)
+	go h.Run()
+	defer h.Stop()
+
+	tm := token.NewTokenManager(10)
+	qrGen := qrcode.NewGenerator("localhost:3333", "http", 10*time.Minute)
+	srv := NewServer(h, tm, qrGen, mockStaticFiles, []string{"http://localhost:*"}, mockI18n)
+	setUpgraderOrigins(srv.allowedOrigins, srv.strictOrigins)
+	mux := http.NewServeMux()
+	srv.RegisterRoutes(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	announce := func(body, adminToken string) int {
+		t.Helper()
+		req, _ := http.NewRequest("POST", server.URL+"/api/announce", strings.NewReader(body))
+		if adminToken != "" {
+			req.Header.Set("Authorization", "Bearer "+adminToken)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Announce request failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := announce(`{"content":"hi"}`, "anything"); code != http.StatusNotFound {
+		t.Fatalf("Expected 404 without an admin token, got %d", code)
+	}
+
+	srv.SetAdminToken("ops-token")
+	if code := announce(`{"content":"hi"}`, ""); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without credentials, got %d", code)
+	}
+	if code := announce(`{"content":"hi"}`, "wrong"); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a wrong admin token, got %d", code)
+	}
+	if code := announce(`{"content":""}`, "ops-token"); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an empty announcement, got %d", code)
+	}
+	long, _ := json.Marshal(announceRequest{Content: strings.Repeat("é", MaxAnnouncementRunes+1)})
+	if code := announce(string(long), "ops-token"); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an announcement over %d characters, got %d", MaxAnnouncementRunes, code)
+	}
+
+	host := dialTestWS(t, server.URL, "")
+	defer host.Close()
+	readRole(t, host, "host")
+	tokenID, _ := tm.GenerateToken()
+	client := dialTestWS(t, server.URL, "?token="+tokenID)
+	defer client.Close()
+	readRole(t, client, "client")
+
+	if code := announce(`{"content":"Server restarting in 5 minutes"}`, "ops-token"); code != http.StatusOK {
+		t.Fatalf("Expected 200 for an authorized announcement, got %d", code)
+	}
+
+	// Host and client both get it
+	for name, conn := range map[string]*websocket.Conn{"host": host, "client": client} {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for {
+			var msg hub.Message
+			if err := conn.ReadJSON(&msg); err != nil {
+				t.Fatalf("Expected %s to receive the announcement: %v", name, err)
+			}
+			if msg.Type == "announcement" {
+				if msg.Content != "Server restarting in 5 minutes" {
+					t.Errorf("Expected announcement content for %s, got %q", name, msg.Content)
+				}
+				break
+			}
+		}
+	}
+}
+
+// TestInfoFeatures tests that /api/info reports the enabled features and SetFeatures applies the server's own
+func TestInfoFeatures(t *testing.T) {
+	h := hub.NewHub(1024*1024, 10)
+	qrGen := qrcode.NewGenerator("localhost:3333", "http", 10*time.Minute)
+	srv := NewServer(h, token.NewTokenManager(10), qrGen, mockStaticFiles, []string{"http://localhost:*"}, mockI18n)
+	srv.SetFeatures(features.Set{History: true, Presence: true, NoHost: true, DebugWS: true})
+
+	if !srv.debugWS || !srv.noHost {
+		t.Errorf("Expected debug WebSocket and no host to be applied, got debugWS=%v noHost=%v", srv.debugWS, srv.noHost)
+	}
+
+	w := httptest.NewRecorder()
+	srv.handleInfo(w, httptest.NewRequest("GET", "/api/info", nil))
+	var info map[string]any
+	if err := json.NewDecoder(w.Body).Decode(&info); err != nil {
+		t.Fatalf("Failed to decode info: %v", err)
+	}
+	features, ok := info["features"].(map[string]any)
+	if !ok {
+		t.Fatalf("Expected a features object in /api/info, got %v", info["features"])
+	}
+	for name, want := range map[string]bool{"history": true, "presence": true, "noHost": true, "debugWs": true, "e2eOnly": false, "chunking": false} {
+		if features[name] != want {
+			t.Errorf("Expected feature %s=%v, got %v", name, want, features[name])
+		}
+	}
+}
+
+// TestLanguageCookie tests that ?lang= picks the page language and a cookie remembers it on later loads
+func TestLanguageCookie(t *testing.T) {
+	if err := mockI18n.LoadAllLanguages(); err != nil {
+		t.Fatalf("Failed to load languages: %v", err)
+	}
+	h := hub.NewHub(1024*1024, 10)
+	qrGen := qrcode.NewGenerator("localhost:3333", "http", 10*time.Minute)
+	srv := NewServer(h, token.NewTokenManager(10), qrGen, mockStaticFiles, []string{"http://localhost:*"}, mockI18n)
+
+	load := func(query string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/"+query, nil)
+		r.Header.Set("Accept-Language", "en")
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		srv.handleIndex(w, r)
+		return w
+	}
+	const portuguese = "Área de Transferência da TV"
+
+	w := load("?lang=pt-BR", nil)
+	if !strings.Contains(w.Body.String(), portuguese) {
+		t.Errorf("Expected Portuguese translations for ?lang=pt-BR")
+	}
+	var picked *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == langCookie {
+			picked = c
+		}
+	}
+	if picked == nil || picked.Value != "pt-BR" {
+		t.Fatalf("Expected a %s=pt-BR cookie, got %v", langCookie, w.Result().Cookies())
+	}
+
+	// The cookie wins over Accept-Language once the parameter is gone
+	w = load("", picked)
+	if !strings.Contains(w.Body.String(), portuguese) {
+		t.Errorf("Expected the remembered language to be used without ?lang=")
+	}
+	if len(w.Result().Cookies()) != 0 {
+		t.Errorf("Expected no new cookie without ?lang=, got %v", w.Result().Cookies())
+	}
+
+	// Unknown languages are ignored, in the parameter and in the cookie
+	w = load("?lang=xx", &http.Cookie{Name: langCookie, Value: "<script>"})
+	if strings.Contains(w.Body.String(), portuguese) || len(w.Result().Cookies()) != 0 {
+		t.Errorf("Expected unknown languages to fall back to Accept-Language without a cookie")
+	}
+}
+
+// TestNotFoundPage tests that missing pages get the localized HTML 404, or plain text without static/404.html
+func TestNotFoundPage(t *testing.T) {
+	if err := mockI18n.LoadAllLanguages(); err != nil {
+		t.Fatalf("Failed to load languages: %v", err)
+	}
+	page, err := os.ReadFile("../../static/404.html")
+	if err != nil {
+		t.Fatalf("Failed to read 404 page: %v", err)
+	}
+	// Only the 404 page, so the client page is missing as well
+	files := fstest.MapFS{"static/404.html": {Data: page}}
+
+	h := hub.NewHub(1024*1024, 10)
+	qrGen := qrcode.NewGenerator("localhost:3333", "http", 10*time.Minute)
+	srv := NewServer(h, token.NewTokenManager(10), qrGen, files, []string{"http://localhost:*"}, mockI18n)
+
+	get := func(srv *Server, target, acceptLanguage string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", target, nil)
+		r.Header.Set("Accept-Language", acceptLanguage)
+		w := httptest.NewRecorder()
+		srv.handleIndex(w, r)
+		return w
+	}
+
+	for _, target := range []string{"/nope", "/?mode=client"} {
+		w := get(srv, target, "en")
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s: expected 404, got %d", target, w.Code)
+		}
+		if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+			t.Errorf("%s: expected an HTML 404, got %q", target, ct)
+		}
+		if body := w.Body.String(); !strings.Contains(body, `<html lang="en">`) || !strings.Contains(body, "Not found") {
+			t.Errorf("%s: expected the English 404 page, got %s", target, body)
+		}
+	}
+
+	if w := get(srv, "/nope", "pt-BR"); !strings.Contains(w.Body.String(), "Não encontrado") {
+		t.Errorf("Expected the 404 page in Portuguese, got %s", w.Body.String())
+	}
+
+	// Unknown modes stay a 400 that names the valid ones
+	if w := get(srv, "/?mode=tv", "en"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown mode, got %d", w.Code)
+	}
+
+	plain := NewServer(h, token.NewTokenManager(10), qrGen, mockStaticFiles, []string{"http://localhost:*"}, mockI18n)
+	w := get(plain, "/nope", "en")
+	if w.Code != http.StatusNotFound || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("Expected a plain text 404 without static/404.html, got %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+}
+
+// TestInlineQR tests that --inline-qr embeds a QR code for a fresh token in every host page load
+func TestInlineQR(t *testing.T) {
+	page, err := os.ReadFile("../../static/host.html")
+	if err != nil {
+		t.Fatalf("Failed to read host page: %v", err)
+	}
+	files := fstest.MapFS{"static/host.html": {Data: page}}
+
+	tm := token.NewTokenManager(10)
+	h := hub.NewHub(1024*1024, 10)
+	qrGen := qrcode.NewGenerator("localhost:3333", "http", 10*time.Minute)
+	srv := NewServer(h, tm, qrGen, files, []string{"http://localhost:*"}, mockI18n)
+
+	load := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		srv.handleIndex(w, httptest.NewRequest("GET", "/?mode=host", nil))
+		return w
+	}
+
+	if w := load(); strings.Contains(w.Body.String(), "data:image/png;base64") {
+		t.Errorf("Expected no inline QR code without --inline-qr")
+	}
+
+	srv.SetFeatures(features.Set{InlineQR: true})
+	first, second := load(), load()
+	for _, w := range []*httptest.ResponseRecorder{first, second} {
+		if !strings.Contains(w.Body.String(), `<img src="data:image/png;base64,`) {
+			t.Fatalf("Expected an inline data:image/png;base64 img, got %s", w.Body.String())
+		}
+		if cc := w.Header().Get("Cache-Control"); cc != "no-store" {
+			t.Errorf("Expected an inline QR page not to be cached, got Cache-Control %q", cc)
+		}
+	}
+	// Each load spends its own token, so a reload shows a different code
+	if first.Body.String() == second.Body.String() {
+		t.Errorf("Expected a fresh token on every page load")
+	}
+
+	// Client pages have no QR code to embed
+	w := httptest.NewRecorder()
+	srv.handleIndex(w, httptest.NewRequest("GET", "/?mode=client", nil))
+	if strings.Contains(w.Body.String(), "data:image/png;base64") {
+		t.Errorf("Expected no inline QR code on the client page")
+	}
+}
+
+// TestTokensAPI tests that admins can list active tokens and revoke one before it is used
+func TestTokensAPI(t *testing.T) {
+	h := hub.NewHub(1024*1024, 10)
+	tm := token.NewTokenManager(10)
+	qrGen := qrcode.NewGenerator("localhost:3333", "http", 10*time.Minute)
+	srv := NewServer(h, tm, qrGen, mockStaticFiles, []string{"http://localhost:*"}, mockI18n)
+	mux := http.NewServeMux()
+	srv.RegisterRoutes(mux)
+
+	call := func(method, path, adminToken string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		if adminToken != "" {
+			r.Header.Set("Authorization", "Bearer "+adminToken)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := call("GET", "/api/tokens", "anything"); w.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 without an admin token, got %d", w.Code)
+	}
+	srv.SetAdminToken("ops-token")
+	if w := call("GET", "/api/tokens", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a wrong admin token, got %d", w.Code)
+	}
+	if w := call("POST", "/api/tokens", "ops-token"); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for POST, got %d", w.Code)
+	}
+
+	tokenID, _ := tm.GenerateRoomToken("kitchen")
+	w := call("GET", "/api/tokens", "ops-token")
+	var listed []tokenInfo
+	if err := json.NewDecoder(w.Body).Decode(&listed); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Expected a JSON token list, got %d (%v)", w.Code, err)
+	}
+	if len(listed) != 1 || listed[0].ID != tokenID || listed[0].Room != "kitchen" || listed[0].RemainingSeconds <= 0 {
+		t.Errorf("Expected the kitchen token to be listed, got %+v", listed)
+	}
+
+	if w := call("DELETE", "/api/tokens/"+tokenID, "ops-token"); w.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204 revoking the token, got %d", w.Code)
+	}
+	if err := tm.ValidateRoomToken(tokenID, "kitchen"); err == nil {
+		t.Error("Expected the revoked token to fail validation")
+	}
+	if w := call("DELETE", "/api/tokens/"+tokenID, "ops-token"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 revoking an unknown token, got %d", w.Code)
+	}
+	if w := call("GET", "/api/tokens", "ops-token"); strings.TrimSpace(w.Body.String()) != "[]" {
+		t.Errorf("Expected an empty list after revoking, got %s", w.Body.String())
+	}
+}
+
+// TestClientsAPI tests that /api/clients reports the round-trip times clients sent
+func TestClientsAPI(t *testing.T) {
+	h := hub.NewHub(1024*1024, 10)
+	go h.Run()
+	defer h.Stop()
+
+	qrGen := qrcode.NewGenerator("localhost:3333", "http", 10*time.Minute)
+	srv := NewServer(h, token.NewTokenManager(10), qrGen, mockStaticFiles, []string{"http://localhost:*"}, mockI18n)
+	srv.SetAdminToken("ops-token")
+	setUpgraderOrigins(srv.allowedOrigins, srv.strictOrigins)
+	server := httptest.NewServer(http.HandlerFunc(srv.handleWebSocket))
+	defer server.Close()
+
+	host := dialTestWS(t, server.URL, "")
+	defer host.Close()
+	readRole(t, host, "host")
+	if err := host.WriteJSON(hub.Message{Type: "rtt", Content: "42"}); err != nil {
+		t.Fatalf("Failed to send rtt report: %v", err)
+	}
+
+	list := func(adminToken string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/api/clients", nil)
+		r.Header.Set("Authorization", "Bearer "+adminToken)
+		w := httptest.NewRecorder()
+		srv.handleClients(w, r)
+		return w
+	}
+	if w := list("wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a wrong admin token, got %d", w.Code)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		var resp clientsResponse
+		w := list("ops-token")
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("Expected a JSON client list, got %d (%v)", w.Code, err)
+		}
+		clients := resp.Clients
+		if len(clients) == 1 && clients[0].RTTSamples == 1 {
+			if !clients[0].Host || clients[0].LastRTTMillis != 42 || clients[0].AvgRTTMillis != 42 {
+				t.Errorf("Expected the host with a 42ms round trip, got %+v", clients[0])
+			}
+			// The default room's counters come along, host included
+			if len(resp.Rooms) != 1 || resp.Rooms[0].Clients != 1 || resp.Rooms[0].HostID != clients[0].ID {
+				t.Errorf("Expected the default room's stats with the host, got %+v", resp.Rooms)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the rtt report to be recorded, got %+v", clients)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestMetricsEndpoint tests that /metrics needs the admin token and reports the hub counters
+func TestMetricsEndpoint(t *testing.T) {
+	h := hub.NewHub(1024*1024, 10)
+	go h.Run()
+	defer h.Stop()
+
+	qrGen := qrcode.NewGenerator("localhost:3333", "http", 10*time.Minute)
+	srv := NewServer(h, token.NewTokenManager(10), qrGen, mockStaticFiles, []string{"http://localhost:*"}, mockI18n)
+
+	metrics := func(adminToken string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/metrics", nil)
+		r.Header.Set("Authorization", "Bearer "+adminToken)
+		w := httptest.NewRecorder()
+		srv.handleMetrics(w, r)
+		return w
+	}
+	if w := metrics(""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 without an admin token configured, got %d", w.Code)
+	}
+	srv.SetAdminToken("ops-token")
+	if w := metrics("wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a wrong admin token, got %d", w.Code)
+	}
+
+	if _, err := h.BroadcastWait(context.Background(), hub.Message{Type: "text", Content: "hello"}, ""); err != nil {
+		t.Fatalf("Broadcast failed: %v", err)
+	}
+	w := metrics("ops-token")
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Expected the Prometheus text format, got %s", ct)
+	}
+	body := w.Body.String()
+	for _, want := range []string{
+		"tvclipboard_clients 0\n",
+		"tvclipboard_messages_broadcast_total 1\n",
+		`tvclipboard_messages_rejected_total{reason="rate_limit"} 0` + "\n",
+		"# TYPE tvclipboard_client_drops_total counter\n",
+		"tvclipboard_bytes_broadcast_total ",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected %q in metrics, got:\n%s", want, body)
+		}
+	}
+}
+
+// TestQRCodeTTL tests that /qrcode.png?ttl= issues tokens with their own, clamped lifetime
+func TestQRCodeTTL(t *testing.T) {
+	h := hub.NewHub(1024*1024, 10)
+	tm := token.NewTokenManager(10)
+	tm.SetMaxTTL(time.Hour)
+	qrGen := qrcode.NewGenerator("localhost:3333", "http", 10*time.Minute)
+	srv := NewServer(h, tm, qrGen, mockStaticFiles, []string{"http://localhost:*"}, mockI18n)
+
+	tests := []struct {
+		query       string
+		wantStatus  int
+		wantTTL     time.Duration
+		wantRefresh string
+	}{
+		{"?ttl=60", http.StatusOK, time.Minute, "48"},
+		{"?ttl=86400", http.StatusOK, time.Hour, "2880"},
+		{"?ttl=99999999999999999", http.StatusOK, time.Hour, "2880"},
+		{"?ttl=0", http.StatusBadRequest, 0, ""},
+		{"?ttl=soon", http.StatusBadRequest, 0, ""},
+	}
+	for _, tt := range tests {
+		before := tm.ListTokens()
+		w := httptest.NewRecorder()
+		srv.handleQRCode(w, httptest.NewRequest("GET", "/qrcode.png"+tt.query, nil))
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s: expected %d, got %d", tt.query, tt.wantStatus, w.Code)
+			continue
+		}
+		if tt.wantStatus != http.StatusOK {
+			continue
+		}
+		after := tm.ListTokens()
+		if len(after) != len(before)+1 {
+			t.Fatalf("%s: expected one new token, got %d", tt.query, len(after)-len(before))
+		}
+		if ttl := tm.TTL(after[len(after)-1].ID); ttl != tt.wantTTL {
+			t.Errorf("%s: expected a %v token, got %v", tt.query, tt.wantTTL, ttl)
+		}
+		if got := w.Header().Get(qrRefreshHeader); got != tt.wantRefresh {
+			t.Errorf("%s: expected refresh %s, got %s", tt.query, tt.wantRefresh, got)
+		}
+	}
+}
+
+// TestReconnectToken tests that a client rejoins as itself with the reconnect token from its welcome,
+// without its QR token, and that the token stops working after the grace window
+func TestReconnectToken(t *testing.T) {
+	h := hub.NewHub(1024*1024, 10)
+	h.SetReconnectGrace(300 * time.Millisecond)
+	go h.Run()
+	defer h.Stop()
+	tm := token.NewTokenManager(10)
+	qrGen := qrcode.NewGenerator("localhost:3333", "http", 10*time.Minute)
+	srv := NewServer(h, tm, qrGen, mockStaticFiles, []string{"http://localhost:*"}, mockI18n)
+	setUpgraderOrigins(srv.allowedOrigins, srv.strictOrigins)
+	server := httptest.NewServer(http.HandlerFunc(srv.handleWebSocket))
+	defer server.Close()
+
+	host := dialTestWS(t, server.URL, "")
+	defer host.Close()
+	readRole(t, host, "host")
+
+	// join connects with query, reads its welcome and returns the reconnect token
+	join := func(query string) (*websocket.Conn, string) {
+		t.Helper()
+		conn := dialTestWS(t, server.URL, query)
+		readRole(t, conn, "client")
+		var welcome hub.Welcome
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if err := conn.ReadJSON(&welcome); err != nil || welcome.Type != "welcome" {
+			t.Fatalf("Expected a welcome, got %+v (%v)", welcome, err)
+		}
+		if welcome.ReconnectToken == "" {
+			t.Fatal("Expected the welcome to carry a reconnect token")
+		}
+		return conn, welcome.ReconnectToken
+	}
+	// drop closes conn and waits for the hub to notice
+	drop := func(conn *websocket.Conn) {
+		t.Helper()
+		conn.Close()
+		deadline := time.Now().Add(2 * time.Second)
+		for len(h.ClientIDs()) != 1 {
+			if time.Now().After(deadline) {
+				t.Fatal("Timed out waiting for the client to disconnect")
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	tokenID, _ := tm.GenerateToken()
+	client, reconnect := join("?token=" + tokenID)
+	clientID := h.ClientIDs()[1]
+	tm.Revoke(tokenID)
+	drop(client)
+
+	client, reconnect = join("?reconnect=" + reconnect)
+	if ids := h.ClientIDs(); len(ids) != 2 || ids[1] != clientID {
+		t.Errorf("Expected to rejoin as %s, got %v", clientID, ids)
+	}
+	drop(client)
+
+	time.Sleep(400 * time.Millisecond)
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?reconnect=" + reconnect
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Origin": {"http://localhost"}})
+	if err == nil {
+		t.Fatal("Expected an expired reconnect token to be rejected")
+	}
+	if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get(actionHeader) != actionRescan {
+		t.Errorf("Expected 401 with a rescan hint, got %d %q", resp.StatusCode, resp.Header.Get(actionHeader))
+	}
+}
+
+// TestReconnectTokenKeptOnRejection tests that a reconnect refused before registration doesn't spend the token
+func TestReconnectTokenKeptOnRejection(t *testing.T) {
+	h := hub.NewHub(1024*1024, 10)
+	h.SetMaxClientsPerIP(2)
+	go h.Run()
+	defer h.Stop()
+	tm := token.NewTokenManager(10)
+	qrGen := qrcode.NewGenerator("localhost:3333", "http", 10*time.Minute)
+	srv := NewServer(h, tm, qrGen, mockStaticFiles, []string{"http://localhost:*"}, mockI18n)
+	setUpgraderOrigins(srv.allowedOrigins, srv.strictOrigins)
+	server := httptest.NewServer(http.HandlerFunc(srv.handleWebSocket))
+	defer server.Close()
+
+	host := dialTestWS(t, server.URL, "")
+	defer host.Close()
+	readRole(t, host, "host")
+
+	tokenID, _ := tm.GenerateToken()
+	client := dialTestWS(t, server.URL, "?token="+tokenID)
+	readRole(t, client, "client")
+	var welcome hub.Welcome
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if err := client.ReadJSON(&welcome); err != nil || welcome.ReconnectToken == "" {
+		t.Fatalf("Expected a welcome with a reconnect token, got %+v (%v)", welcome, err)
+	}
+	client.Close()
+
+	// Another connection takes the freed slot, so the reconnect hits the per-IP limit
+	deadline := time.Now().Add(2 * time.Second)
+	for len(h.ClientIDs()) != 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	other, _ := tm.GenerateToken()
+	filler := dialTestWS(t, server.URL, "?token="+other)
+	readRole(t, filler, "client")
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?reconnect=" + welcome.ReconnectToken
+	origin := http.Header{"Origin": {"http://localhost"}}
+	if _, resp, err := websocket.DefaultDialer.Dial(wsURL, origin); err == nil || resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429 at the per-IP limit, got %v", resp)
+	}
+
+	// Once the slot is free again the same token still works
+	filler.Close()
+	deadline = time.Now().Add(2 * time.Second)
+	for len(h.ClientIDs()) != 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	again := dialTestWS(t, server.URL, "?reconnect="+welcome.ReconnectToken)
+	defer again.Close()
+	readRole(t, again, "client")
+}
+
+// TestEventsSessionLifetime tests that an SSE stream ends with session_expired at the max session lifetime
+func TestEventsSessionLifetime(t *testing.T) {
+	h := hub.NewHub(1024*1024, 10)
+	h.SetMaxSessionLifetime(200*time.Millisecond, false)
+	go h.Run()
+	defer h.Stop()
+
+	qrGen := qrcode.NewGenerator("localhost:3333", "http", 10*time.Minute)
+	srv := NewServer(h, token.NewTokenManager(10), qrGen, mockStaticFiles, []string{"http://localhost:*"}, mockI18n)
+	mux := http.NewServeMux()
+	srv.RegisterRoutes(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/events")
+	if err != nil {
+		t.Fatalf("Failed to open event stream: %v", err)
+	}
+	defer resp.Body.Close()
+	reader := bufio.NewReader(resp.Body)
+	if msg := readSSEMessage(t, reader); msg.Type != "role" {
+		t.Fatalf("Expected a role event, got %+v", msg)
+	}
+	if msg := readSSEMessage(t, reader); msg.Type != "session_expired" {
+		t.Fatalf("Expected session_expired at the lifetime, got %+v", msg)
+	}
+	ended := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, reader)
+		close(ended)
+	}()
+	select {
+	case <-ended:
+	case <-time.After(2 * time.Second):
+		t.Error("Expected the stream to end after session_expired")
+	}
+}
+
+// TestEventsOutliveWriteTimeout tests that an event stream keeps delivering past the server's WriteTimeout
+func TestEventsOutliveWriteTimeout(t *testing.T) {
+	h := hub.NewHub(1024*1024, 10)
+	go h.Run()
+	defer h.Stop()
+
+	tm := token.NewTokenManager(10)
+	qrGen := qrcode.NewGenerator("localhost:3333", "http", 10*time.Minute)
+	srv := NewServer(h, tm, qrGen, mockStaticFiles, []string{"http://localhost:*"}, mockI18n)
+	mux := http.NewServeMux()
+	srv.RegisterRoutes(mux)
+	server := httptest.NewUnstartedServer(mux)
+	server.Config.WriteTimeout = 100 * time.Millisecond
+	server.Start()
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/events")
+	if err != nil {
+		t.Fatalf("Failed to open event stream: %v", err)
+	}
+	defer resp.Body.Close()
+	reader := bufio.NewReader(resp.Body)
+	if msg := readSSEMessage(t, reader); msg.Type != "role" {
+		t.Fatalf("Expected role event, got %+v", msg)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	if err := h.Broadcast(hub.Message{Type: "text", Content: "still here"}, ""); err != nil {
+		t.Fatalf("Broadcast failed: %v", err)
+	}
+	if msg := readSSEMessage(t, reader); msg.Type != "text" || msg.Content != "still here" {
+		t.Errorf("Expected the event after the write timeout, got %+v", msg)
+	}
 }
@@ -2,10 +2,19 @@ package token
 
 import (
 	"context"
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"maps"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -15,6 +24,15 @@ const (
 	TokenLength = 8
 	// MaxTokens is the hard limit for in-memory token storage
 	MaxTokens = 10000
+	// PrivateKeySize is the size in bytes of an AES-256 private key
+	PrivateKeySize = 32
+)
+
+// Errors returned by ValidateRoomToken
+var (
+	ErrTokenNotFound  = errors.New("token not found")
+	ErrTokenWrongRoom = errors.New("token not valid for this room")
+	ErrTokenExpired   = errors.New("token expired")
 )
 
 // SessionToken represents a token with ID and timestamp
@@ -25,23 +43,30 @@ type SessionToken struct {
 
 // TokenManager manages session tokens with in-memory storage and size limits
 type TokenManager struct {
-	tokens     map[string]int64 // token ID → timestamp
-	tokenOrder []string         // FIFO order for rotation
+	tokens     map[string]int64  // token ID → timestamp
+	rooms      map[string]string // token ID → room code (only for non-default rooms)
+	ttls       map[string]time.Duration // token ID → lifetime (only for tokens with their own)
+	maxTTL     time.Duration            // Longest lifetime a token may ask for, the timeout unless set
+	tokenOrder []string          // FIFO order for rotation
 	timeout    time.Duration
 	maxTokens  int
+	keys       [][]byte // The first encrypts; all are tried when decrypting
+	revoked    map[string]int64 // Revoked sealed token → Unix expiry, so decrypting can't bring it back
+	random     io.Reader // Source of token ID bytes, crypto/rand unless overridden
+	now        func() time.Time // Clock for issuing and expiring tokens, time.Now unless overridden
 	mu         *sync.RWMutex
 }
 
 // base62 characters for generating short alphanumeric IDs
 const base62Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
 
-// generateRandomID generates a short alphanumeric ID using crypto/rand
-func generateRandomID() (string, error) {
+// generateRandomID generates a short alphanumeric ID from the random bytes in r
+func generateRandomID(r io.Reader) (string, error) {
 	b := make([]byte, TokenLength)
 	// Generate random bytes - need more bytes to avoid modulo bias
 	// Using 256 possible values mod 62 has slight bias, but acceptable for tokens
 	randomBytes := make([]byte, TokenLength)
-	if _, err := rand.Read(randomBytes); err != nil {
+	if _, err := io.ReadFull(r, randomBytes); err != nil {
 		return "", fmt.Errorf("failed to generate random bytes: %w", err)
 	}
 	for i := range b {
@@ -50,6 +75,27 @@ func generateRandomID() (string, error) {
 	return string(b), nil
 }
 
+// GeneratePrivateKey returns a new random private key as a hex string
+func GeneratePrivateKey() (string, error) {
+	key := make([]byte, PrivateKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", fmt.Errorf("failed to generate private key: %w", err)
+	}
+	return hex.EncodeToString(key), nil
+}
+
+// ParsePrivateKey decodes a hex private key and checks that it is PrivateKeySize bytes
+func ParsePrivateKey(keyHex string) ([]byte, error) {
+	key, err := hex.DecodeString(keyHex)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key format: %w", err)
+	}
+	if len(key) != PrivateKeySize {
+		return nil, fmt.Errorf("invalid private key size: got %d bytes, want %d", len(key), PrivateKeySize)
+	}
+	return key, nil
+}
+
 // NewTokenManager creates a new TokenManager with timeout and size limits
 func NewTokenManager(timeoutMinutes int) *TokenManager {
 	timeout := 10 * time.Minute
@@ -59,30 +105,58 @@ func NewTokenManager(timeoutMinutes int) *TokenManager {
 
 	tm := &TokenManager{
 		tokens:     make(map[string]int64),
+		rooms:      make(map[string]string),
+		ttls:       make(map[string]time.Duration),
+		revoked:    make(map[string]int64),
 		tokenOrder: make([]string, 0, MaxTokens),
 		timeout:    timeout,
 		maxTokens:  MaxTokens,
+		random:     rand.Reader,
+		now:        time.Now,
 		mu:         &sync.RWMutex{},
 	}
 
 	return tm
 }
 
-// GenerateToken creates and returns a short session token ID
+// GenerateToken creates and returns a short session token ID for the default room
 func (tm *TokenManager) GenerateToken() (string, error) {
+	return tm.GenerateRoomToken("")
+}
+
+// GenerateRoomToken creates and returns a short session token ID scoped to a room
+func (tm *TokenManager) GenerateRoomToken(room string) (string, error) {
+	return tm.GenerateRoomTokenTTL(room, 0)
+}
+
+// GenerateRoomTokenTTL creates a token scoped to a room that stays valid for ttl instead of the timeout
+// ttl is clamped to MaxTTL; 0 uses the timeout
+// With private keys set the token is sealed with the first one and carries its room, issue time and
+// lifetime, so any instance sharing the keys accepts it (see ValidateRoomToken); otherwise it is a short ID
+func (tm *TokenManager) GenerateRoomTokenTTL(room string, ttl time.Duration) (string, error) {
 	tm.mu.Lock()
 	defer tm.mu.Unlock()
 
+	now := tm.now().Unix()
+	if ttl > 0 {
+		ttl = min(ttl, tm.maxTTLLocked())
+	}
+
 	// Generate random ID and check for collision
 	var tokenID string
 	var err error
 	maxAttempts := 100
 
 	for i := range maxAttempts {
-		tokenID, err = generateRandomID()
+		tokenID, err = generateRandomID(tm.random)
 		if err != nil {
 			return "", err
 		}
+		if len(tm.keys) > 0 {
+			if tokenID, err = tm.sealLocked(tokenID, room, now, ttl); err != nil {
+				return "", err
+			}
+		}
 		// Check if ID already exists
 		if _, exists := tm.tokens[tokenID]; !exists {
 			break // Found a unique ID
@@ -94,14 +168,21 @@ func (tm *TokenManager) GenerateToken() (string, error) {
 	}
 
 	// Add token to map and order list
-	now := time.Now().Unix()
 	tm.tokens[tokenID] = now
+	if room != "" {
+		tm.rooms[tokenID] = room
+	}
+	if ttl > 0 {
+		tm.ttls[tokenID] = ttl
+	}
 	tm.tokenOrder = append(tm.tokenOrder, tokenID)
 
 	// Enforce max tokens limit by removing oldest entries
 	for len(tm.tokens) > tm.maxTokens {
 		oldestID := tm.tokenOrder[0]
 		delete(tm.tokens, oldestID)
+		delete(tm.rooms, oldestID)
+		delete(tm.ttls, oldestID)
 		// Remove from order list (optimized slice logic)
 		tm.tokenOrder = tm.tokenOrder[1:]
 		log.Printf("Rotated out oldest token due to max limit: %s", oldestID)
@@ -110,23 +191,281 @@ func (tm *TokenManager) GenerateToken() (string, error) {
 	return tokenID, nil
 }
 
-// ValidateToken validates a token ID and returns if it's still valid
+// ValidateToken validates a token ID for the default room and returns if it's still valid
 func (tm *TokenManager) ValidateToken(tokenID string) error {
+	return tm.ValidateRoomToken(tokenID, "")
+}
+
+// ValidateRoomToken validates a token ID and checks that it was issued for room
+func (tm *TokenManager) ValidateRoomToken(tokenID, room string) error {
 	tm.mu.RLock()
 	defer tm.mu.RUnlock()
 
 	timestamp, exists := tm.tokens[tokenID]
 	if !exists {
-		return fmt.Errorf("token not found")
+		return tm.validateSealed(tokenID, room)
+	}
+
+	if tm.rooms[tokenID] != room {
+		return ErrTokenWrongRoom
 	}
 
-	if time.Since(time.Unix(timestamp, 0)) > tm.timeout {
-		return fmt.Errorf("token expired")
+	if tm.now().Sub(time.Unix(timestamp, 0)) > tm.ttl(tokenID) {
+		return ErrTokenExpired
 	}
 
 	return nil
 }
 
+// SetTimeout sets how long tokens stay valid, allowing sub-minute precision
+// Values <= 0 are ignored
+func (tm *TokenManager) SetTimeout(timeout time.Duration) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	if timeout > 0 {
+		tm.timeout = timeout
+	}
+}
+
+// SetMaxTTL sets the longest lifetime GenerateRoomTokenTTL grants (<= 0 restores the default, the timeout)
+func (tm *TokenManager) SetMaxTTL(maxTTL time.Duration) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	tm.maxTTL = max(maxTTL, 0)
+}
+
+// MaxTTL returns the longest lifetime a token may be given
+func (tm *TokenManager) MaxTTL() time.Duration {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+	return tm.maxTTLLocked()
+}
+
+// maxTTLLocked returns MaxTTL; caller must hold tm.mu
+func (tm *TokenManager) maxTTLLocked() time.Duration {
+	if tm.maxTTL > 0 {
+		return tm.maxTTL
+	}
+	return tm.timeout
+}
+
+// TTL returns how long tokenID stays valid after it is issued: its own lifetime or the timeout
+func (tm *TokenManager) TTL(tokenID string) time.Duration {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+	return tm.ttl(tokenID)
+}
+
+// ttl returns TTL; caller must hold tm.mu
+func (tm *TokenManager) ttl(tokenID string) time.Duration {
+	if ttl, ok := tm.ttls[tokenID]; ok {
+		return ttl
+	}
+	return tm.timeout
+}
+
+// SetMaxTokens sets the cap on active tokens; the oldest tokens are evicted beyond it
+// Values <= 0 restore the default MaxTokens
+func (tm *TokenManager) SetMaxTokens(maxTokens int) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	if maxTokens <= 0 {
+		maxTokens = MaxTokens
+	}
+	tm.maxTokens = maxTokens
+}
+
+// SetRandSource sets where token ID bytes come from (nil restores crypto/rand)
+// Tests pass a fixed reader to get predictable token IDs; nonces still use crypto/rand
+func (tm *TokenManager) SetRandSource(r io.Reader) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	if r == nil {
+		r = rand.Reader
+	}
+	tm.random = r
+}
+
+// SetClock sets the clock used to issue and expire tokens (nil restores time.Now)
+// Tests pass a fake clock to expire tokens without sleeping
+func (tm *TokenManager) SetClock(now func() time.Time) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	if now == nil {
+		now = time.Now
+	}
+	tm.now = now
+}
+
+// SetPrivateKey sets the private key used by the token manager
+func (tm *TokenManager) SetPrivateKey(key []byte) {
+	tm.SetPrivateKeys(key)
+}
+
+// SetPrivateKeys sets the keys used by the token manager: tokens are encrypted with the first
+// and decrypted with whichever one matches, so a fleet sharing the list can roll keys without downtime
+func (tm *TokenManager) SetPrivateKeys(keys ...[]byte) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	tm.keys = keys
+}
+
+// newGCMs builds an AES-GCM cipher for each private key, the encryption key first
+func (tm *TokenManager) newGCMs() ([]cipher.AEAD, error) {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+	return tm.gcmsLocked()
+}
+
+// gcmsLocked is newGCMs for callers holding tm.mu
+func (tm *TokenManager) gcmsLocked() ([]cipher.AEAD, error) {
+	keys := tm.keys
+	if len(keys) == 0 || len(keys[0]) == 0 {
+		return nil, fmt.Errorf("no private key configured")
+	}
+	gcms := make([]cipher.AEAD, 0, len(keys))
+	for _, key := range keys {
+		gcm, err := newGCM(key)
+		if err != nil {
+			return nil, err
+		}
+		gcms = append(gcms, gcm)
+	}
+	return gcms, nil
+}
+
+// newGCM builds an AES-GCM cipher from a private key
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %w", err)
+	}
+	return gcm, nil
+}
+
+// EncryptToken encrypts a token ID with AES-GCM and returns it URL-safe base64 encoded
+func (tm *TokenManager) EncryptToken(tokenID string) (string, error) {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+	return tm.encryptLocked(tokenID)
+}
+
+// encryptLocked is EncryptToken for callers holding tm.mu
+func (tm *TokenManager) encryptLocked(plaintext string) (string, error) {
+	gcms, err := tm.gcmsLocked()
+	if err != nil {
+		return "", err
+	}
+	gcm := gcms[0]
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// DecryptToken reverses EncryptToken and returns the token ID, trying every private key in order
+func (tm *TokenManager) DecryptToken(encrypted string) (string, error) {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+	return tm.decryptLocked(encrypted)
+}
+
+// decryptLocked is DecryptToken for callers holding tm.mu
+func (tm *TokenManager) decryptLocked(encrypted string) (string, error) {
+	gcms, err := tm.gcmsLocked()
+	if err != nil {
+		return "", err
+	}
+	data, err := base64.RawURLEncoding.DecodeString(encrypted)
+	if err != nil {
+		return "", fmt.Errorf("invalid token encoding: %w", err)
+	}
+	for _, gcm := range gcms {
+		if len(data) < gcm.NonceSize() {
+			return "", fmt.Errorf("encrypted token too short")
+		}
+		nonce, ciphertext := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+		if plaintext, err := gcm.Open(nil, nonce, ciphertext, nil); err == nil {
+			return string(plaintext), nil
+		}
+	}
+	return "", fmt.Errorf("failed to decrypt token: no private key matches")
+}
+
+// sealLocked encrypts a token's ID, issue time, lifetime (0 for the timeout) and room into the token itself
+// Caller must hold tm.mu
+func (tm *TokenManager) sealLocked(id, room string, issued int64, ttl time.Duration) (string, error) {
+	return tm.encryptLocked(fmt.Sprintf("%s|%d|%d|%s", id, issued, int64(ttl/time.Second), room))
+}
+
+// validateSealed checks a token this manager doesn't hold, e.g. one issued by another instance,
+// by decrypting it with the private keys. Caller must hold tm.mu
+func (tm *TokenManager) validateSealed(tokenID, room string) error {
+	if len(tm.keys) == 0 {
+		return ErrTokenNotFound
+	}
+	if _, revoked := tm.revoked[tokenID]; revoked {
+		return ErrTokenNotFound
+	}
+	plaintext, err := tm.decryptLocked(tokenID)
+	if err != nil {
+		return ErrTokenNotFound
+	}
+	parts := strings.SplitN(plaintext, "|", 4)
+	if len(parts) != 4 {
+		return ErrTokenNotFound
+	}
+	issued, err1 := strconv.ParseInt(parts[1], 10, 64)
+	ttlSeconds, err2 := strconv.ParseInt(parts[2], 10, 64)
+	if err1 != nil || err2 != nil {
+		return ErrTokenNotFound
+	}
+
+	if parts[3] != room {
+		return ErrTokenWrongRoom
+	}
+
+	// The issuer already clamped the lifetime; clamping again bounds tokens from a misconfigured peer
+	ttl := tm.timeout
+	if ttlSeconds > 0 {
+		ttl = min(time.Duration(ttlSeconds)*time.Second, tm.maxTTLLocked())
+	}
+	if tm.now().Sub(time.Unix(issued, 0)) > ttl {
+		return ErrTokenExpired
+	}
+	return nil
+}
+
+// SelfCheck issues a token and validates it, then validates it again the way another instance sharing the
+// private keys would, from the token alone. It uses the configured clock and random source and every key
+// Call at startup to catch a missing or corrupted key before any QR code is shown
+func (tm *TokenManager) SelfCheck() error {
+	if _, err := tm.newGCMs(); err != nil {
+		return fmt.Errorf("token self-check: %w", err)
+	}
+	tokenID, err := tm.GenerateToken()
+	if err != nil {
+		return fmt.Errorf("token self-check: %w", err)
+	}
+	if err := tm.ValidateToken(tokenID); err != nil {
+		return fmt.Errorf("token self-check: %w", err)
+	}
+
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	tm.forgetLocked(tokenID)
+	if err := tm.validateSealed(tokenID, ""); err != nil {
+		return fmt.Errorf("token self-check: sealed token rejected: %w", err)
+	}
+	return nil
+}
+
 // Timeout returns the token timeout duration
 func (tm *TokenManager) Timeout() time.Duration {
 	return tm.timeout
@@ -157,12 +496,70 @@ func (tm *TokenManager) TokenCount() int {
 	return len(tm.tokens)
 }
 
+// TokenInfo describes an active token for admin tools
+type TokenInfo struct {
+	ID        string
+	Room      string        // "" for the default room
+	Timestamp int64         // Unix time the token was issued
+	Remaining time.Duration // Time left before it expires
+}
+
+// ListTokens returns the tokens that haven't expired, oldest first
+func (tm *TokenManager) ListTokens() []TokenInfo {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+
+	now := tm.now()
+	infos := make([]TokenInfo, 0, len(tm.tokens))
+	for _, id := range tm.tokenOrder {
+		timestamp, exists := tm.tokens[id]
+		if !exists {
+			continue
+		}
+		remaining := tm.ttl(id) - now.Sub(time.Unix(timestamp, 0))
+		if remaining < 0 {
+			continue
+		}
+		infos = append(infos, TokenInfo{ID: id, Room: tm.rooms[id], Timestamp: timestamp, Remaining: remaining})
+	}
+	return infos
+}
+
+// Revoke forgets a token so it no longer validates, reporting whether it existed
+// Clients already connected with it stay connected
+func (tm *TokenManager) Revoke(tokenID string) bool {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	timestamp, exists := tm.tokens[tokenID]
+	if !exists {
+		return false
+	}
+	// A sealed token would still decrypt, so remember it until it expires anyway
+	if len(tm.keys) > 0 {
+		tm.revoked[tokenID] = time.Unix(timestamp, 0).Add(tm.ttl(tokenID)).Unix()
+	}
+	tm.forgetLocked(tokenID)
+	log.Printf("Revoked token: %s", tokenID)
+	return true
+}
+
+// forgetLocked drops a token from local storage; caller must hold tm.mu
+func (tm *TokenManager) forgetLocked(tokenID string) {
+	delete(tm.tokens, tokenID)
+	delete(tm.rooms, tokenID)
+	delete(tm.ttls, tokenID)
+	if i := slices.Index(tm.tokenOrder, tokenID); i >= 0 {
+		tm.tokenOrder = slices.Delete(tm.tokenOrder, i, i+1)
+	}
+}
+
 // cleanupExpired removes expired tokens from storage
 func (tm *TokenManager) cleanupExpired() {
 	tm.mu.Lock()
 	defer tm.mu.Unlock()
 
-	now := time.Now()
+	now := tm.now()
 	expiredCount := 0
 	activeCount := 0
 	
@@ -175,9 +572,11 @@ func (tm *TokenManager) cleanupExpired() {
 		timestamp, exists := tm.tokens[id]
 		
 		// If token doesn't exist in map (should not happen) or is expired
-		if !exists || now.Sub(time.Unix(timestamp, 0)) > tm.timeout {
+		if !exists || now.Sub(time.Unix(timestamp, 0)) > tm.ttl(id) {
 			if exists {
 				delete(tm.tokens, id)
+				delete(tm.rooms, id)
+				delete(tm.ttls, id)
 				expiredCount++
 			}
 			continue
@@ -191,6 +590,12 @@ func (tm *TokenManager) cleanupExpired() {
 	// Truncate the slice to the new length
 	tm.tokenOrder = tm.tokenOrder[:activeCount]
 
+	for id, expires := range tm.revoked {
+		if now.Unix() > expires {
+			delete(tm.revoked, id)
+		}
+	}
+
 	if expiredCount > 0 {
 		log.Printf("Cleaned up %d expired tokens", expiredCount)
 	}
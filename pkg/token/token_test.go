@@ -1,6 +1,8 @@
 package token
 
 import (
+	"bytes"
+	"errors"
 	"strings"
 	"testing"
 	"time"
@@ -383,3 +385,416 @@ func TestTokenCount(t *testing.T) {
 		t.Errorf("Count should be 5, got %d", count)
 	}
 }
+
+// TestGeneratePrivateKey tests that generated keys are 32 random bytes in hex
+func TestGeneratePrivateKey(t *testing.T) {
+	key, err := GeneratePrivateKey()
+	if err != nil {
+		t.Fatalf("Failed to generate private key: %v", err)
+	}
+
+	if len(key) != PrivateKeySize*2 {
+		t.Errorf("Expected %d hex chars, got %d", PrivateKeySize*2, len(key))
+	}
+
+	other, err := GeneratePrivateKey()
+	if err != nil {
+		t.Fatalf("Failed to generate private key: %v", err)
+	}
+	if key == other {
+		t.Error("Generated keys should differ")
+	}
+}
+
+// TestParsePrivateKey tests private key decoding and size validation
+func TestParsePrivateKey(t *testing.T) {
+	key, err := GeneratePrivateKey()
+	if err != nil {
+		t.Fatalf("Failed to generate private key: %v", err)
+	}
+
+	parsed, err := ParsePrivateKey(key)
+	if err != nil {
+		t.Fatalf("Generated key should parse: %v", err)
+	}
+	if len(parsed) != PrivateKeySize {
+		t.Errorf("Expected %d bytes, got %d", PrivateKeySize, len(parsed))
+	}
+
+	for _, invalid := range []string{"", "zz", "deadbeef", key + "00"} {
+		if _, err := ParsePrivateKey(invalid); err == nil {
+			t.Errorf("Expected error for invalid key %q", invalid)
+		}
+	}
+}
+
+// TestRoomTokenScope tests that room tokens only validate for their room
+func TestRoomTokenScope(t *testing.T) {
+	tm := NewTokenManager(10)
+
+	roomToken, err := tm.GenerateRoomToken("abc")
+	if err != nil {
+		t.Fatalf("Failed to generate room token: %v", err)
+	}
+
+	if err := tm.ValidateRoomToken(roomToken, "abc"); err != nil {
+		t.Errorf("Room token should validate for its room: %v", err)
+	}
+	if err := tm.ValidateRoomToken(roomToken, "other"); err == nil {
+		t.Error("Room token should not validate for another room")
+	}
+	if err := tm.ValidateToken(roomToken); err == nil {
+		t.Error("Room token should not validate for the default room")
+	}
+
+	defaultToken, _ := tm.GenerateToken()
+	if err := tm.ValidateRoomToken(defaultToken, "abc"); err == nil {
+		t.Error("Default room token should not validate for a named room")
+	}
+}
+
+// TestSetMaxTokens tests that a configured cap keeps storage bounded and evicts oldest first
+func TestSetMaxTokens(t *testing.T) {
+	tm := NewTokenManager(10)
+	tm.SetMaxTokens(5)
+
+	var tokenIDs []string
+	for range 20 {
+		tokenID, err := tm.GenerateToken()
+		if err != nil {
+			t.Fatalf("Failed to generate token: %v", err)
+		}
+		tokenIDs = append(tokenIDs, tokenID)
+	}
+
+	if count := tm.TokenCount(); count != 5 {
+		t.Errorf("Expected token count capped at 5, got %d", count)
+	}
+
+	for _, id := range tokenIDs[:15] {
+		if err := tm.ValidateToken(id); err == nil {
+			t.Errorf("Old token %s should have been evicted", id)
+		}
+	}
+	for _, id := range tokenIDs[15:] {
+		if err := tm.ValidateToken(id); err != nil {
+			t.Errorf("Newest token %s should remain: %v", id, err)
+		}
+	}
+
+	tm.SetMaxTokens(0)
+	if tm.maxTokens != MaxTokens {
+		t.Errorf("Expected non-positive cap to restore default %d, got %d", MaxTokens, tm.maxTokens)
+	}
+}
+
+// TestStartCleanupInterval tests that expired tokens are purged within the cleanup interval
+func TestStartCleanupInterval(t *testing.T) {
+	tm := NewTokenManager(1)
+	tm.StoreToken(SessionToken{ID: "expired1", Timestamp: time.Now().Add(-2 * time.Minute).Unix()})
+	tm.StoreToken(SessionToken{ID: "fresh001", Timestamp: time.Now().Unix()})
+
+	stop := tm.StartCleanup(20 * time.Millisecond)
+	defer stop()
+
+	deadline := time.Now().Add(500 * time.Millisecond)
+	for tm.TokenCount() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expired token not purged within interval, count: %d", tm.TokenCount())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if _, exists := tm.GetTokens()["fresh001"]; !exists {
+		t.Error("Fresh token should survive cleanup")
+	}
+}
+
+// TestSelfCheck tests that the startup check issues and validates a sealed token
+func TestSelfCheck(t *testing.T) {
+	keyHex, err := GeneratePrivateKey()
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	key, err := ParsePrivateKey(keyHex)
+	if err != nil {
+		t.Fatalf("Failed to parse key: %v", err)
+	}
+
+	tm := NewTokenManager(10)
+	tm.SetPrivateKey(key)
+	if err := tm.SelfCheck(); err != nil {
+		t.Errorf("Expected valid manager to pass self-check, got %v", err)
+	}
+	if n := tm.TokenCount(); n != 0 {
+		t.Errorf("Expected the self-check token to be forgotten, got %d tokens", n)
+	}
+
+	// It issues a real token, so a broken random source fails it
+	tm.SetRandSource(bytes.NewReader(nil))
+	if err := tm.SelfCheck(); err == nil {
+		t.Error("Expected self-check to fail with an exhausted random source")
+	}
+
+	broken := NewTokenManager(10)
+	broken.SetPrivateKey([]byte("short"))
+	if err := broken.SelfCheck(); err == nil {
+		t.Error("Expected self-check to fail with a wrong-size key")
+	}
+
+	if err := NewTokenManager(10).SelfCheck(); err == nil {
+		t.Error("Expected self-check to fail without a private key")
+	}
+}
+
+// TestEncryptDecryptToken tests token encryption with matching and mismatched keys
+func TestEncryptDecryptToken(t *testing.T) {
+	tm := NewTokenManager(10)
+	tm.SetPrivateKey(make([]byte, PrivateKeySize))
+
+	encrypted, err := tm.EncryptToken("abc12345")
+	if err != nil {
+		t.Fatalf("Failed to encrypt token: %v", err)
+	}
+	if decrypted, err := tm.DecryptToken(encrypted); err != nil || decrypted != "abc12345" {
+		t.Errorf("Expected abc12345, got %q (err: %v)", decrypted, err)
+	}
+
+	other := NewTokenManager(10)
+	otherKey := make([]byte, PrivateKeySize)
+	otherKey[0] = 1
+	other.SetPrivateKey(otherKey)
+	if _, err := other.DecryptToken(encrypted); err == nil {
+		t.Error("Expected decryption with a different key to fail")
+	}
+}
+
+// TestSetTimeout tests sub-minute timeouts and that non-positive values are ignored
+func TestSetTimeout(t *testing.T) {
+	tm := NewTokenManager(10)
+	tm.SetTimeout(30 * time.Second)
+	if got := tm.Timeout(); got != 30*time.Second {
+		t.Errorf("Timeout() = %v, want 30s", got)
+	}
+	tm.SetTimeout(0)
+	if got := tm.Timeout(); got != 30*time.Second {
+		t.Errorf("Timeout() after SetTimeout(0) = %v, want 30s", got)
+	}
+}
+
+func TestSetRandSource(t *testing.T) {
+	tm := NewTokenManager(10)
+	tm.SetRandSource(bytes.NewReader([]byte{0, 1, 2, 3, 4, 5, 6, 7, 10, 11, 12, 13, 14, 15, 16, 79}))
+
+	for _, want := range []string{"01234567", "ABCDEFGH"} {
+		got, err := tm.GenerateToken()
+		if err != nil {
+			t.Fatalf("GenerateToken failed: %v", err)
+		}
+		if got != want {
+			t.Errorf("GenerateToken() = %q, want %q", got, want)
+		}
+		if err := tm.ValidateToken(got); err != nil {
+			t.Errorf("Generated token %q should be valid: %v", got, err)
+		}
+	}
+
+	// An exhausted source fails instead of producing a short ID
+	if _, err := tm.GenerateToken(); err == nil {
+		t.Error("Expected an error once the random source is exhausted")
+	}
+
+	tm.SetRandSource(nil)
+	if _, err := tm.GenerateToken(); err != nil {
+		t.Errorf("Expected crypto/rand to be restored, got %v", err)
+	}
+}
+
+// TestPrivateKeyRotation tests that instances sharing a key list accept each other's tokens while a key is rolled
+func TestPrivateKeyRotation(t *testing.T) {
+	oldKey := make([]byte, PrivateKeySize)
+	newKey := make([]byte, PrivateKeySize)
+	newKey[0] = 1
+
+	// Instance A still encrypts with the old key, instance B already rolled to the new one
+	a := NewTokenManager(10)
+	a.SetPrivateKeys(oldKey, newKey)
+	b := NewTokenManager(10)
+	b.SetPrivateKeys(newKey, oldKey)
+
+	for _, tt := range []struct {
+		name     string
+		from, to *TokenManager
+	}{
+		{"A to B", a, b},
+		{"B to A", b, a},
+		{"A to A", a, a},
+	} {
+		tokenID, err := tt.from.GenerateRoomToken("kitchen")
+		if err != nil {
+			t.Fatalf("%s: failed to generate token: %v", tt.name, err)
+		}
+		if err := tt.to.ValidateRoomToken(tokenID, "kitchen"); err != nil {
+			t.Errorf("%s: expected the token to validate, got %v", tt.name, err)
+		}
+		if err := tt.to.ValidateRoomToken(tokenID, ""); !errors.Is(err, ErrTokenWrongRoom) {
+			t.Errorf("%s: expected ErrTokenWrongRoom for another room, got %v", tt.name, err)
+		}
+	}
+
+	// The token carries its own lifetime, so B expires it without ever having seen it
+	clock := time.Now()
+	b.SetClock(func() time.Time { return clock })
+	short, err := a.GenerateRoomTokenTTL("", time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to generate token: %v", err)
+	}
+	if err := b.ValidateToken(short); err != nil {
+		t.Errorf("Expected a fresh token from A to validate on B, got %v", err)
+	}
+	clock = clock.Add(2 * time.Minute)
+	if err := b.ValidateToken(short); !errors.Is(err, ErrTokenExpired) {
+		t.Errorf("Expected ErrTokenExpired once its own lifetime passed, got %v", err)
+	}
+
+	// Once the old key is dropped, its tokens no longer validate
+	tokenID, err := a.GenerateToken()
+	if err != nil {
+		t.Fatalf("Failed to generate token: %v", err)
+	}
+	rolled := NewTokenManager(10)
+	rolled.SetPrivateKeys(newKey)
+	if err := rolled.ValidateToken(tokenID); !errors.Is(err, ErrTokenNotFound) {
+		t.Errorf("Expected a token from a retired key to fail, got %v", err)
+	}
+
+	// Revoking a token stops it validating on the issuer even though it still decrypts
+	if !a.Revoke(tokenID) {
+		t.Fatal("Expected the token to be revoked")
+	}
+	if err := a.ValidateToken(tokenID); !errors.Is(err, ErrTokenNotFound) {
+		t.Errorf("Expected a revoked token to fail, got %v", err)
+	}
+
+	// Every key must be usable
+	broken := NewTokenManager(10)
+	broken.SetPrivateKeys(newKey, []byte("short"))
+	if err := broken.SelfCheck(); err == nil {
+		t.Error("Expected self-check to fail with a wrong-size secondary key")
+	}
+}
+
+func TestFakeClockExpiry(t *testing.T) {
+	tm := NewTokenManager(10)
+	clock := time.Unix(1700000000, 0)
+	tm.SetClock(func() time.Time { return clock })
+
+	tokenID, err := tm.GenerateToken()
+	if err != nil {
+		t.Fatalf("Failed to generate token: %v", err)
+	}
+	if ts := tm.GetTokens()[tokenID]; ts != clock.Unix() {
+		t.Errorf("Expected token issued at the fake time %d, got %d", clock.Unix(), ts)
+	}
+
+	// Still valid right at the timeout
+	clock = clock.Add(tm.Timeout())
+	if err := tm.ValidateToken(tokenID); err != nil {
+		t.Fatalf("Expected token valid at the timeout, got %v", err)
+	}
+
+	clock = clock.Add(time.Second)
+	if err := tm.ValidateToken(tokenID); err != ErrTokenExpired {
+		t.Fatalf("Expected ErrTokenExpired after the timeout, got %v", err)
+	}
+	tm.cleanupExpired()
+	if tm.TokenCount() != 0 {
+		t.Errorf("Expected cleanup to remove the expired token, got %d tokens", tm.TokenCount())
+	}
+}
+
+func TestListAndRevokeTokens(t *testing.T) {
+	tm := NewTokenManager(10)
+	clock := time.Unix(1700000000, 0)
+	tm.SetClock(func() time.Time { return clock })
+
+	first, _ := tm.GenerateToken()
+	clock = clock.Add(time.Minute)
+	second, _ := tm.GenerateRoomToken("kitchen")
+
+	infos := tm.ListTokens()
+	if len(infos) != 2 || infos[0].ID != first || infos[1].ID != second {
+		t.Fatalf("Expected both tokens oldest first, got %+v", infos)
+	}
+	if infos[0].Remaining != 9*time.Minute || infos[1].Remaining != 10*time.Minute {
+		t.Errorf("Expected 9m and 10m remaining, got %v and %v", infos[0].Remaining, infos[1].Remaining)
+	}
+	if infos[1].Room != "kitchen" || infos[1].Timestamp != clock.Unix() {
+		t.Errorf("Expected the room and issue time of the second token, got %+v", infos[1])
+	}
+
+	if !tm.Revoke(first) {
+		t.Fatal("Expected revoking an active token to succeed")
+	}
+	if tm.Revoke(first) {
+		t.Error("Expected revoking the same token twice to report false")
+	}
+	if err := tm.ValidateToken(first); err != ErrTokenNotFound {
+		t.Errorf("Expected a revoked token to fail validation, got %v", err)
+	}
+	if err := tm.ValidateRoomToken(second, "kitchen"); err != nil {
+		t.Errorf("Expected the other token to stay valid, got %v", err)
+	}
+
+	// Expired tokens aren't listed even before cleanup removes them
+	clock = clock.Add(tm.Timeout() + time.Second)
+	if infos := tm.ListTokens(); len(infos) != 0 {
+		t.Errorf("Expected no active tokens after expiry, got %+v", infos)
+	}
+}
+
+func TestTokenTTL(t *testing.T) {
+	tm := NewTokenManager(10)
+	clock := time.Unix(1700000000, 0)
+	tm.SetClock(func() time.Time { return clock })
+
+	short, _ := tm.GenerateRoomTokenTTL("", 30*time.Second)
+	regular, _ := tm.GenerateToken()
+	if ttl := tm.TTL(short); ttl != 30*time.Second {
+		t.Errorf("Expected the short token to keep its 30s lifetime, got %v", ttl)
+	}
+	if ttl := tm.TTL(regular); ttl != tm.Timeout() {
+		t.Errorf("Expected the regular token to use the timeout, got %v", ttl)
+	}
+
+	// The short token expires long before the global timeout
+	clock = clock.Add(31 * time.Second)
+	if err := tm.ValidateToken(short); err != ErrTokenExpired {
+		t.Errorf("Expected the short token to expire after 30s, got %v", err)
+	}
+	if err := tm.ValidateToken(regular); err != nil {
+		t.Errorf("Expected the regular token to stay valid, got %v", err)
+	}
+	if infos := tm.ListTokens(); len(infos) != 1 || infos[0].ID != regular {
+		t.Errorf("Expected only the regular token listed, got %+v", infos)
+	}
+	tm.cleanupExpired()
+	if tm.TokenCount() != 1 {
+		t.Errorf("Expected cleanup to honor the short lifetime, got %d tokens", tm.TokenCount())
+	}
+
+	// Without a configured max, a token can't outlive the timeout
+	long, _ := tm.GenerateRoomTokenTTL("", 24*time.Hour)
+	if ttl := tm.TTL(long); ttl != tm.Timeout() {
+		t.Errorf("Expected the lifetime clamped to the timeout, got %v", ttl)
+	}
+	tm.SetMaxTTL(time.Hour)
+	long, _ = tm.GenerateRoomTokenTTL("", 24*time.Hour)
+	if ttl := tm.TTL(long); ttl != time.Hour {
+		t.Errorf("Expected the lifetime clamped to the 1h max, got %v", ttl)
+	}
+	clock = clock.Add(30 * time.Minute)
+	if err := tm.ValidateToken(long); err != nil {
+		t.Errorf("Expected the long-lived token to outlast the timeout, got %v", err)
+	}
+}
@@ -1,4 +1,4 @@
-/* global t, formatTime, encryptMessage, getWebSocketURL */
+/* global t, formatTime, encryptMessage, getWebSocketURL, getRoomQuery */
 // Client-specific functionality
 (function() {
     'use strict';
@@ -7,6 +7,7 @@
     let sessionExpired = false;
     let connectionFailed = false;
     let timerInterval;
+    let reconnectToken = null; // From the last welcome; lets us rejoin as the same client after a drop
     const appDiv = document.querySelector('.container');
     const sessionTimeout = appDiv ? parseInt(appDiv.getAttribute('data-session-timeout') || '600', 10) : 600;
 
@@ -56,6 +57,9 @@ function clearInput() {
 }
 
 function closeTab() {
+    if (ws && ws.readyState === WebSocket.OPEN) {
+        ws.send(JSON.stringify({ type: 'bye', content: 'closed' }));
+    }
     window.close();
 }
 
@@ -116,6 +120,14 @@ function showError(message) {
     }
 }
 
+function showAnnouncement(message) {
+    const el = document.getElementById('announcement');
+    if (el) {
+        el.textContent = '📢 ' + message;
+        el.style.display = 'block';
+    }
+}
+
 function disableAll() {
     const textarea = document.getElementById('input');
     const buttons = document.querySelectorAll('button');
@@ -217,7 +229,11 @@ function connect() {
     const urlParams = new URLSearchParams(window.location.search);
     const token = urlParams.get('token');
 
-    ws = new WebSocket(url + '?token=' + token);
+    const room = getRoomQuery();
+    // Reconnect tokens are single use; the QR token still gets us in if it has gone stale
+    const reconnect = reconnectToken ? '&reconnect=' + encodeURIComponent(reconnectToken) : '';
+    reconnectToken = null;
+    ws = new WebSocket(url + '?token=' + token + reconnect + (room ? '&' + room : ''));
 
     ws.onopen = function() {
         const status = document.getElementById('status');
@@ -233,6 +249,10 @@ function connect() {
             errorEl.style.display = 'none';
         }
 
+        // Greet the server so it doesn't drop us as a silent connection
+        ws.send(JSON.stringify({ type: 'hello' }));
+        startLatencyReports(ws);
+
         enableAll();
         console.log('WebSocket connected');
 
@@ -293,12 +313,40 @@ function connect() {
         }
         console.log('Received message:', message);
 
-        if (message.type === 'role') {
+        if (message.type === 'pong') {
+            handlePong(ws, message);
+        } else if (message.type === 'role') {
             handleRoleAssignment(message.role);
+        } else if (message.type === 'welcome') {
+            reconnectToken = message.reconnect_token || null;
+            showSessionTitle(message.title);
+        } else if (message.type === 'title') {
+            showSessionTitle(message.content);
+        } else if (message.type === 'join_denied') {
+            connectionFailed = true;
+            showError(t('errors.join_denied'));
+            disableAll();
+        } else if (message.type === 'shutdown') {
+            connectionFailed = true;
+            showError(t('errors.server_shutdown'));
+            disableAll();
+        } else if (message.type === 'announcement' && message.content) {
+            showAnnouncement(message.content);
+        } else if (message.type === 'maintenance') {
+            connectionFailed = true;
+            showError(t('errors.server_maintenance'));
+            disableAll();
         }
     };
 }
 
+    function showSessionTitle(title) {
+        const modeEl = document.querySelector('.mode-switch');
+        if (modeEl && title) {
+            modeEl.textContent = '📺 ' + title;
+        }
+    }
+
     function handleRoleAssignment(role) {
         if (role !== 'client') {
             console.warn('Expected client role but got:', role);
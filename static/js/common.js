@@ -1,5 +1,5 @@
 /* global t */
-/* exported encryptMessage, decryptMessage, getWebSocketURL, getPublicURL, formatTime */
+/* exported encryptMessage, decryptMessage, getWebSocketURL, getPublicURL, getRoomQuery, formatTime */
 // Common utilities and encryption
 
 let encryptionKey = null;
@@ -100,13 +100,47 @@ async function decryptMessage(base64) {
 function getWebSocketURL() {
     const protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
     const host = window.location.host;
-    return `${protocol}//${host}/ws`;
+    // The server injects its WebSocket path, which --ws-path can move away from /ws
+    const appDiv = document.querySelector('.container');
+    const path = (appDiv && appDiv.getAttribute('data-ws-path')) || '/ws';
+    return `${protocol}//${host}${path}`;
+}
+
+// Returns "room=<code>" for the current page's room, or '' for the default room
+function getRoomQuery() {
+    const room = new URLSearchParams(window.location.search).get('room');
+    return room ? 'room=' + encodeURIComponent(room) : '';
 }
 
 function getPublicURL() {
     return window.location.href;
 }
 
+// Latency reports: ping the server now and then and report the measured round trip for /api/clients
+const LATENCY_INTERVAL_MS = 30000;
+
+function startLatencyReports(socket) {
+    function ping() {
+        socket.send(JSON.stringify({ type: 'ping', meta: { t: String(Date.now()) } }));
+    }
+    ping();
+    const interval = setInterval(function() {
+        if (socket.readyState !== WebSocket.OPEN) {
+            clearInterval(interval);
+            return;
+        }
+        ping();
+    }, LATENCY_INTERVAL_MS);
+}
+
+// Answers a "pong" with the round trip since the ping it echoes
+function handlePong(socket, message) {
+    const sent = Number(message.meta && message.meta.t);
+    if (sent && socket.readyState === WebSocket.OPEN) {
+        socket.send(JSON.stringify({ type: 'rtt', content: String(Math.max(0, Date.now() - sent)) }));
+    }
+}
+
 function formatTime(seconds) {
     const mins = Math.floor(seconds / 60);
     const secs = seconds % 60;
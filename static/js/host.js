@@ -1,4 +1,4 @@
-/* global t, formatTime, getWebSocketURL, getPublicURL, decryptMessage */
+/* global t, formatTime, getWebSocketURL, getPublicURL, getRoomQuery, decryptMessage */
 // Host-specific functionality
 (function() {
     'use strict';
@@ -119,15 +119,41 @@ function generateQRCode() {
     const container = document.getElementById('qrcode');
     const urlText = document.getElementById('url-text');
 
-    // Use server-side generated QR code
-    const img = document.createElement('img');
-    img.src = '/qrcode.png?' + Date.now();
-    img.alt = 'QR Code';
-    img.style.width = '200px';
-    img.style.height = '200px';
+    // Use server-side generated QR codes, one per address when the server has several (e.g. LAN and public)
+    const appDiv = document.querySelector('.container');
+    const targetList = appDiv && appDiv.getAttribute('data-qr-targets');
+    const targets = targetList ? targetList.split(',') : [''];
+    const room = getRoomQuery();
+
+    // With --inline-qr the first codes came embedded in the page; later calls fetch fresh ones
+    if (container.hasAttribute('data-inline')) {
+        container.removeAttribute('data-inline');
+        container.querySelectorAll('img[data-qr-target]').forEach(function(img) {
+            const target = img.getAttribute('data-qr-target');
+            const caption = document.createElement('figcaption');
+            caption.textContent = t('host.qr_target_' + target, null, target);
+            img.parentNode.appendChild(caption);
+        });
+        urlText.textContent = url + ' (' + t('host.links_to_client') + ')';
+        return;
+    }
 
     container.innerHTML = '';
-    container.appendChild(img);
+    targets.forEach(function(target) {
+        const figure = document.createElement('figure');
+        const img = document.createElement('img');
+        img.src = '/qrcode.png?' + (room ? room + '&' : '') + (target ? 'target=' + encodeURIComponent(target) + '&' : '') + Date.now();
+        img.alt = 'QR Code';
+        img.style.width = '200px';
+        img.style.height = '200px';
+        figure.appendChild(img);
+        if (target) {
+            const caption = document.createElement('figcaption');
+            caption.textContent = t('host.qr_target_' + target, null, target);
+            figure.appendChild(caption);
+        }
+        container.appendChild(figure);
+    });
 
     urlText.textContent = url + ' (' + t('host.links_to_client') + ')';
 }
@@ -175,7 +201,8 @@ function connect() {
         ws.close();
     }
 
-    const url = getWebSocketURL();
+    const room = getRoomQuery();
+    const url = getWebSocketURL() + (room ? '?' + room : '');
     console.log('Attempting to connect to WebSocket URL:', url);
 
     ws = new WebSocket(url);
@@ -194,6 +221,10 @@ function connect() {
 
         console.log('WebSocket connected');
 
+        // Greet the server so it doesn't drop us as a silent connection
+        ws.send(JSON.stringify({ type: 'hello' }));
+        startLatencyReports(ws);
+
         startTimer();
     };
 
@@ -243,14 +274,35 @@ function connect() {
         }
         console.log('Received message:', message);
 
-        if (message.type === 'role') {
+        if (message.type === 'pong') {
+            handlePong(ws, message);
+        } else if (message.type === 'role') {
             handleRoleAssignment(message.role);
         } else if (message.type === 'text' && message.content) {
             showReceivedContent(message.content);
+        } else if (message.type === 'join_request' && message.content) {
+            handleJoinRequest(message.content);
+        } else if (message.type === 'announcement' && message.content) {
+            showAnnouncement(message.content);
         }
     };
 }
 
+function showAnnouncement(message) {
+    const el = document.getElementById('announcement');
+    if (el) {
+        el.textContent = '📢 ' + message;
+        el.style.display = 'block';
+    }
+}
+
+function handleJoinRequest(clientId) {
+    const approve = confirm(t('host.approve_join', { id: clientId }));
+    if (ws && ws.readyState === WebSocket.OPEN) {
+        ws.send(JSON.stringify({ type: approve ? 'approve' : 'deny', content: clientId }));
+    }
+}
+
 function handleRoleAssignment(role) {
     if (role !== 'host') {
         console.warn('Expected host role but got:', role);